@@ -46,6 +46,11 @@ type BackupOptions struct {
 	Filter       string   // Path prefix filter
 	User         string
 	Description  string
+	// Mode selects a logical backup (the default) or a full, incremental
+	// or differential backup directory; see BackupMode. Parent is the
+	// backup directory an incremental or differential backup builds on.
+	Mode   BackupMode
+	Parent string
 }
 
 // RestoreOptions configures restore behavior
@@ -55,6 +60,12 @@ type RestoreOptions struct {
 	Filter       string // Path prefix filter
 	User         string
 	IncludeTypes []string
+	// TargetDir is where a backup directory is restored to, as a new
+	// database. TargetTime and TargetSequence restore it as of that moment
+	// or WAL sequence number instead of as of the backup.
+	TargetDir      string
+	TargetTime     time.Time
+	TargetSequence uint64
 }
 
 // ExportOptions configures export behavior
@@ -84,6 +95,9 @@ func (db *DB) Backup(opts BackupOptions) error {
 	if opts.OutputPath == "" {
 		return fmt.Errorf("output path is required")
 	}
+	if opts.Mode != BackupLogical {
+		return db.backupChain(opts)
+	}
 
 	// Default to all types
 	if len(opts.IncludeTypes) == 0 {
@@ -247,6 +261,9 @@ func (db *DB) Restore(opts RestoreOptions) error {
 	if opts.BackupPath == "" {
 		return fmt.Errorf("backup path is required")
 	}
+	if isBackupDir(opts.BackupPath) {
+		return db.restoreChain(opts)
+	}
 
 	// Verify backup integrity first
 	fmt.Println("🔐 Verifying backup integrity...")
@@ -0,0 +1,658 @@
+package velocity
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupMode selects what Backup writes.
+type BackupMode string
+
+const (
+	// BackupLogical writes the secrets, folders and objects to one signed
+	// file that Restore applies to a running database. It is the default.
+	BackupLogical BackupMode = ""
+	// BackupFull copies the files of the database to a backup directory
+	// and starts a backup chain.
+	BackupFull BackupMode = "full"
+	// BackupIncremental copies the files that changed since its parent, the
+	// previous backup of the chain.
+	BackupIncremental BackupMode = "incremental"
+	// BackupDifferential copies the files that changed since the full
+	// backup the parent's chain starts with.
+	BackupDifferential BackupMode = "differential"
+)
+
+// backupManifestName is the signed manifest of a backup directory; the
+// database files are under backupDataDir and the archived WAL segments
+// under backupWALDir.
+const (
+	backupManifestName = "BACKUP"
+	backupDataDir      = "data"
+	backupWALDir       = "wal_archive"
+)
+
+// BackupManifest describes one backup of a chain.
+type BackupManifest struct {
+	ID         string     `json:"id"`
+	Mode       BackupMode `json:"mode"`
+	Parent     string     `json:"parent,omitempty"`      // ID of the backup this one builds on
+	ParentPath string     `json:"parent_path,omitempty"` // directory of the parent backup
+	// CreatedAt is when the backup's copy of the database was complete;
+	// every write it holds happened before.
+	CreatedAt time.Time `json:"created_at"`
+	// Sequence is the WAL sequence number of the last write the backup
+	// holds.
+	Sequence uint64 `json:"sequence"`
+	// Files lists every file of the database, each with the backup of the
+	// chain that stores it. WAL lists the archived WAL segments this
+	// backup stores, oldest first.
+	Files       []BackupFile    `json:"files"`
+	WAL         []BackupFile    `json:"wal,omitempty"`
+	CopiedBytes int64           `json:"copied_bytes"`
+	User        string          `json:"user"`
+	Description string          `json:"description,omitempty"`
+	ChainLinks  []string        `json:"chain_links,omitempty"`
+	Signature   BackupSignature `json:"signature"`
+	AuditID     string          `json:"audit_id"`
+}
+
+// BackupFile is a file of a backup.
+type BackupFile struct {
+	Path   string `json:"path"` // relative to the data or WAL directory
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`   // SHA-512 of the content
+	Backup string `json:"backup"` // ID of the backup that stores the file
+}
+
+// holds reports whether the backup's copy of f has the content of the file
+// at path, of the given size. A path can be written again with other
+// content of the same size, so the hash decides.
+func (f BackupFile) holds(path string, size int64) bool {
+	if f.Size != size {
+		return false
+	}
+	_, hash, err := hashFile(path)
+	return err == nil && hash == f.Hash
+}
+
+// backupLink is a verified backup of a chain and its directory.
+type backupLink struct {
+	manifest BackupManifest
+	dir      string
+}
+
+// signedContent is the part of the manifest the signature covers: all of
+// it but the signature and the audit ID, which is added after signing.
+func (m BackupManifest) signedContent() ([]byte, error) {
+	m.Signature = BackupSignature{}
+	m.AuditID = ""
+	return json.Marshal(m)
+}
+
+// isBackupDir reports whether path is a backup directory written by a full,
+// incremental or differential backup.
+func isBackupDir(path string) bool {
+	info, err := os.Stat(filepath.Join(path, backupManifestName))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// backupChain writes a full, incremental or differential backup to the
+// directory opts.OutputPath. The database is checkpointed into it, except
+// for SSTable, value log and object files the parent's chain already holds,
+// which the manifest points to instead. Archived WAL segments the chain does
+// not hold yet are copied too, so Restore can replay writes made between
+// backups; that needs Config.RetainWAL.
+func (db *DB) backupChain(opts BackupOptions) error {
+	var base *backupLink
+	heldWAL := make(map[string]BackupFile)
+	switch opts.Mode {
+	case BackupFull:
+		if opts.Parent != "" {
+			return fmt.Errorf("a full backup has no parent")
+		}
+	case BackupIncremental, BackupDifferential:
+		if opts.Parent == "" {
+			return fmt.Errorf("an %s backup needs a parent backup", opts.Mode)
+		}
+		chain, err := db.readBackupChain(opts.Parent)
+		if err != nil {
+			return fmt.Errorf("failed to read parent backup: %w", err)
+		}
+		if opts.Mode == BackupDifferential {
+			chain = chain[:1]
+		}
+		base = &chain[len(chain)-1]
+		for _, link := range chain {
+			for _, f := range link.manifest.WAL {
+				heldWAL[f.Path] = f
+			}
+		}
+	default:
+		return fmt.Errorf("unknown backup mode %q", opts.Mode)
+	}
+
+	out := filepath.Clean(opts.OutputPath)
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("backup directory %s already exists", out)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", out, time.Now().UnixNano())
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	manifest := BackupManifest{
+		ID:          fmt.Sprintf("backup-%d", time.Now().UnixNano()),
+		Mode:        opts.Mode,
+		User:        opts.User,
+		Description: opts.Description,
+		ChainLinks:  db.getBackupChainLinks(3),
+	}
+	held := make(map[string]BackupFile)
+	if base != nil {
+		manifest.Parent = base.manifest.ID
+		if abs, err := filepath.Abs(base.dir); err == nil {
+			manifest.ParentPath = abs
+		} else {
+			manifest.ParentPath = base.dir
+		}
+		for _, f := range base.manifest.Files {
+			held[f.Path] = f
+		}
+	}
+
+	var reused []BackupFile
+	cp, err := db.checkpoint(filepath.Join(tmp, backupDataDir), func(rel string, info fs.FileInfo) bool {
+		f, ok := held[filepath.ToSlash(rel)]
+		if ok && f.holds(filepath.Join(db.path, rel), info.Size()) {
+			reused = append(reused, f)
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	manifest.CreatedAt = time.Now().UTC()
+	manifest.Sequence = cp.Sequence
+
+	copied, err := hashBackupFiles(filepath.Join(tmp, backupDataDir), manifest.ID)
+	if err != nil {
+		return err
+	}
+	manifest.Files = append(copied, reused...)
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+	for _, f := range copied {
+		manifest.CopiedBytes += f.Size
+	}
+
+	if db.wal != nil {
+		floor := uint64(0)
+		if base != nil {
+			floor = base.manifest.Sequence
+		}
+		segments, err := db.copyWALSegments(filepath.Join(tmp, backupWALDir), floor, heldWAL, manifest.ID)
+		if err != nil {
+			return err
+		}
+		manifest.WAL = segments
+		for _, f := range segments {
+			manifest.CopiedBytes += f.Size
+		}
+	}
+
+	content, err := manifest.signedContent()
+	if err != nil {
+		return fmt.Errorf("failed to encode backup manifest: %w", err)
+	}
+	manifest.Signature, err = db.createSignature(content, opts.User)
+	if err != nil {
+		return fmt.Errorf("failed to create signature: %w", err)
+	}
+
+	auditRecord := AuditRecord{
+		Operation: "backup",
+		Type:      string(opts.Mode),
+		User:      opts.User,
+		FilePath:  out,
+		ItemCount: len(manifest.Files),
+		Success:   true,
+		Signature: manifest.Signature,
+		Metadata: map[string]interface{}{
+			"backup_id":    manifest.ID,
+			"parent":       manifest.Parent,
+			"sequence":     manifest.Sequence,
+			"copied_bytes": manifest.CopiedBytes,
+			"wal_segments": len(manifest.WAL),
+		},
+	}
+	if err := db.recordAudit(auditRecord); err != nil {
+		fmt.Printf("Warning: failed to record audit: %v\n", err)
+	} else {
+		// recordAudit assigns the ID and links the record into the chain.
+		manifest.AuditID = db.getLastAuditID()
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, backupManifestName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+	if err := syncFile(filepath.Join(tmp, backupManifestName)); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return fmt.Errorf("failed to commit backup directory: %w", err)
+	}
+	committed = true
+	if err := syncDir(filepath.Dir(out)); err != nil {
+		return fmt.Errorf("failed to sync backup directory: %w", err)
+	}
+
+	db.storeBackupReference(manifest.AuditID, out)
+	return nil
+}
+
+// syncFile fsyncs the file at path.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// hashBackupFiles lists the files under dir with their sizes and hashes.
+func hashBackupFiles(dir, backupID string) ([]BackupFile, error) {
+	var files []BackupFile
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		size, hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, BackupFile{Path: filepath.ToSlash(rel), Size: size, Hash: hash, Backup: backupID})
+		return nil
+	})
+	return files, err
+}
+
+// hashFile returns the size and SHA-512 of the file at path.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha512.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyWALSegments copies the archived WAL segments that may hold writes
+// after floor and are not in held to dir, oldest first.
+func (db *DB) copyWALSegments(dir string, floor uint64, held map[string]BackupFile, backupID string) ([]BackupFile, error) {
+	archive := db.wal.archiveDir
+	if archive == "" {
+		archive = filepath.Join(filepath.Dir(db.wal.file.Name()), "wal_archive")
+	}
+	entries, err := os.ReadDir(archive)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasPrefix(e.Name(), "wal_") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var segments []BackupFile
+	for i, name := range names {
+		path := filepath.Join(archive, name)
+		// A segment ends where the next one starts, so one followed by a
+		// segment starting at or before floor only holds older writes.
+		if i+1 < len(names) {
+			if next, ok := walSegmentFloor(filepath.Join(archive, names[i+1])); ok && next <= floor {
+				continue
+			}
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Retention removed it since it was listed.
+				continue
+			}
+			return nil, err
+		}
+		if f, ok := held[name]; ok && f.holds(path, info.Size()) {
+			continue
+		}
+		if err := linkOrCopyFile(path, filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+		size, hash, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, BackupFile{Path: name, Size: size, Hash: hash, Backup: backupID})
+	}
+	return segments, nil
+}
+
+// walSegmentFloor returns the sequence number a WAL segment starts after,
+// if it records one.
+func walSegmentFloor(path string) (uint64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	var hdr [12]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil || binary.LittleEndian.Uint32(hdr[:4]) != walSequenceFloor {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(hdr[4:]), true
+}
+
+// BackupChain returns the backups of the chain that ends with the backup
+// directory path, full backup first, after verifying the signature of each.
+func (db *DB) BackupChain(path string) ([]BackupManifest, error) {
+	chain, err := db.readBackupChain(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]BackupManifest, len(chain))
+	for i, link := range chain {
+		out[i] = link.manifest
+	}
+	return out, nil
+}
+
+// readBackupChain reads and verifies the backup in dir and its ancestors,
+// and returns them full backup first.
+func (db *DB) readBackupChain(dir string) ([]backupLink, error) {
+	var chain []backupLink
+	seen := make(map[string]bool)
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup %s: %w", dir, err)
+		}
+		var m BackupManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("failed to parse backup %s: %w", dir, err)
+		}
+		content, err := m.signedContent()
+		if err != nil {
+			return nil, err
+		}
+		if err := db.verifySignature(content, m.Signature); err != nil {
+			return nil, fmt.Errorf("backup %s: %w", dir, err)
+		}
+		if seen[m.ID] {
+			return nil, fmt.Errorf("backup chain of %s has a cycle at %s", dir, m.ID)
+		}
+		seen[m.ID] = true
+		if n := len(chain); n > 0 && chain[n-1].manifest.Parent != m.ID {
+			return nil, fmt.Errorf("backup %s is %s, not the parent %s", dir, m.ID, chain[n-1].manifest.Parent)
+		}
+		chain = append(chain, backupLink{manifest: m, dir: dir})
+		if m.Parent == "" {
+			break
+		}
+		if m.ParentPath == "" {
+			return nil, fmt.Errorf("backup %s does not record where its parent is", m.ID)
+		}
+		parent := m.ParentPath
+		if !filepath.IsAbs(parent) {
+			parent = filepath.Join(dir, parent)
+		}
+		dir = parent
+	}
+	if chain[len(chain)-1].manifest.Mode != BackupFull {
+		return nil, fmt.Errorf("backup chain does not start with a full backup")
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// restoreChain rebuilds the database of a backup chain in opts.TargetDir.
+// Without a target it restores the backup at opts.BackupPath. With
+// TargetTime or TargetSequence it restores the last backup of the chain
+// made before the target and replays the WAL the later backups hold up to
+// the target, through the WAL of the restored database.
+func (db *DB) restoreChain(opts RestoreOptions) error {
+	if opts.TargetDir == "" {
+		return fmt.Errorf("restoring backup directory %s needs a target directory", opts.BackupPath)
+	}
+	target := filepath.Clean(opts.TargetDir)
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("restore directory %s already exists", target)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	chain, err := db.readBackupChain(opts.BackupPath)
+	if err != nil {
+		db.recordAudit(AuditRecord{
+			Operation: "restore",
+			Type:      "point-in-time",
+			User:      opts.User,
+			FilePath:  opts.BackupPath,
+			ErrorMsg:  fmt.Sprintf("Integrity verification failed: %v", err),
+		})
+		return fmt.Errorf("backup integrity verification failed: %w", err)
+	}
+
+	pointInTime := !opts.TargetTime.IsZero() || opts.TargetSequence > 0
+	before := func(m BackupManifest) bool {
+		if opts.TargetSequence > 0 && m.Sequence > opts.TargetSequence {
+			return false
+		}
+		return opts.TargetTime.IsZero() || !m.CreatedAt.After(opts.TargetTime)
+	}
+	base := len(chain) - 1
+	if pointInTime {
+		for base >= 0 && !before(chain[base].manifest) {
+			base--
+		}
+		if base < 0 {
+			return fmt.Errorf("no backup in the chain was made before the restore target")
+		}
+	}
+	dirs := make(map[string]string, len(chain))
+	for _, link := range chain {
+		dirs[link.manifest.ID] = link.dir
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", target, time.Now().UnixNano())
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(tmp)
+		}
+	}()
+	for _, f := range chain[base].manifest.Files {
+		dir, ok := dirs[f.Backup]
+		if !ok {
+			return fmt.Errorf("file %s is in backup %s, which is not in the chain", f.Path, f.Backup)
+		}
+		src := filepath.Join(dir, backupDataDir, filepath.FromSlash(f.Path))
+		if err := copyBackupFile(src, filepath.Join(tmp, filepath.FromSlash(f.Path)), f); err != nil {
+			return err
+		}
+	}
+
+	last := chain[base].manifest.Sequence
+	if pointInTime && db.wal != nil {
+		if last, err = db.replayBackupWAL(chain[base+1:], tmp, last, opts); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return fmt.Errorf("failed to commit restore directory: %w", err)
+	}
+	committed = true
+
+	auditRecord := AuditRecord{
+		Operation: "restore",
+		Type:      "point-in-time",
+		User:      opts.User,
+		FilePath:  opts.BackupPath,
+		ItemCount: len(chain[base].manifest.Files),
+		Success:   true,
+		Signature: chain[base].manifest.Signature,
+		Metadata: map[string]interface{}{
+			"source_backup_id": chain[base].manifest.ID,
+			"target_dir":       target,
+			"target_time":      opts.TargetTime,
+			"target_sequence":  opts.TargetSequence,
+			"restored_through": last,
+		},
+	}
+	if err := db.recordAudit(auditRecord); err != nil {
+		fmt.Printf("Warning: failed to record audit: %v\n", err)
+	}
+	return nil
+}
+
+// copyBackupFile copies a backup file to dst and checks it against its
+// size and hash.
+func copyBackupFile(src, dst string, f BackupFile) error {
+	if err := copyFile(src, dst); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", f.Path, err)
+	}
+	size, hash, err := hashFile(dst)
+	if err != nil {
+		return err
+	}
+	if size != f.Size || hash != f.Hash {
+		return fmt.Errorf("backup file %s of %s failed its integrity check", f.Path, f.Backup)
+	}
+	return nil
+}
+
+// replayBackupWAL appends to the WAL in dir the writes after seq, up to the
+// restore target, that the WAL segments and WAL copies of later backups
+// hold, so the restored database replays them when it opens. It returns the
+// sequence number of the last write appended.
+func (db *DB) replayBackupWAL(later []backupLink, dir string, seq uint64, opts RestoreOptions) (uint64, error) {
+	walName := filepath.Base(db.wal.file.Name())
+	var sources []string
+	for _, link := range later {
+		for _, f := range link.manifest.WAL {
+			sources = append(sources, filepath.Join(link.dir, backupWALDir, f.Path))
+		}
+		sources = append(sources, filepath.Join(link.dir, backupDataDir, walName))
+	}
+
+	db.wal.mutex.Lock()
+	families := make(map[uint32]*CryptoProvider, len(db.wal.families))
+	for id, crypto := range db.wal.families {
+		families[id] = crypto
+	}
+	db.wal.mutex.Unlock()
+	reader := walReader{crypto: db.crypto, families: families}
+
+	var buf bytes.Buffer
+	scratch := make([]byte, 8)
+	reached := fmt.Errorf("restore target reached")
+	for _, path := range sources {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return seq, err
+		}
+		_, err = reader.readSegment(f, func(next uint64, e *Entry) error {
+			if next == 0 || next <= seq {
+				return nil
+			}
+			if next > seq+1 {
+				return fmt.Errorf("the backups do not hold WAL records %d to %d; enable RetainWAL for point-in-time restores", seq+1, next-1)
+			}
+			if opts.TargetSequence > 0 && next > opts.TargetSequence {
+				return reached
+			}
+			if e != nil && !opts.TargetTime.IsZero() && e.Timestamp > uint64(opts.TargetTime.UnixNano()) {
+				return reached
+			}
+			if e != nil {
+				crypto := db.crypto
+				if e.family != 0 {
+					crypto = families[e.family]
+				}
+				nonce, ciphertext, err := crypto.Encrypt(e.Value, buildEntryAAD(e.Key, e.Timestamp, e.ExpiresAt, recordFlag(e)))
+				if err != nil {
+					return err
+				}
+				encodeWALRecord(&buf, scratch, next, e.family, e, nonce, ciphertext)
+			}
+			seq = next
+			return nil
+		})
+		f.Close()
+		if err == reached {
+			break
+		}
+		if err != nil {
+			return seq, fmt.Errorf("failed to replay %s: %w", path, err)
+		}
+	}
+	if opts.TargetSequence > 0 && seq < opts.TargetSequence && opts.TargetTime.IsZero() {
+		return seq, fmt.Errorf("the backups hold WAL records up to %d, before the target %d", seq, opts.TargetSequence)
+	}
+
+	out, err := os.OpenFile(filepath.Join(dir, walName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return seq, err
+	}
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		out.Close()
+		return seq, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return seq, err
+	}
+	return seq, out.Close()
+}
@@ -0,0 +1,182 @@
+package velocity
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIncrementalBackupChainRestoresToPointInTime(t *testing.T) {
+	root := t.TempDir()
+	db, err := NewWithConfig(Config{Path: filepath.Join(root, "db"), RetainWAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("bk:%03d", i)), []byte("v1"))
+	}
+	full := filepath.Join(root, "full")
+	if err := db.Backup(BackupOptions{OutputPath: full, Mode: BackupFull, User: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Backup(BackupOptions{OutputPath: filepath.Join(root, "orphan"), Mode: BackupIncremental}); err == nil {
+		t.Fatal("expected an incremental backup without a parent to fail")
+	}
+
+	// Writes between the backups: the first batch is the restore target.
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("bk:%03d", i)), []byte("v2"))
+	}
+	target := db.LastSequence()
+	db.Put([]byte("bk:late"), []byte("v3"))
+	db.Delete([]byte("bk:100"))
+
+	incr := filepath.Join(root, "incr")
+	if err := db.Backup(BackupOptions{OutputPath: incr, Mode: BackupIncremental, Parent: full, User: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := db.BackupChain(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].Mode != BackupFull || chain[1].Parent != chain[0].ID {
+		t.Fatalf("unexpected chain: %+v", chain)
+	}
+	if chain[1].CopiedBytes >= chain[0].CopiedBytes {
+		t.Fatalf("expected the incremental backup to copy less than the full one, got %d and %d", chain[1].CopiedBytes, chain[0].CopiedBytes)
+	}
+	if len(chain[1].WAL) == 0 {
+		t.Fatal("expected the incremental backup to hold the archived WAL")
+	}
+	if chain[1].AuditID == "" || chain[1].Signature.HMAC == "" {
+		t.Fatal("expected the backup to be signed and audited")
+	}
+
+	get := func(db *DB, key string) string {
+		t.Helper()
+		v, err := db.Get([]byte(key))
+		if err != nil {
+			return ""
+		}
+		return string(v)
+	}
+
+	// Restoring the tip brings back every write made before it.
+	tip := filepath.Join(root, "restore-tip")
+	if err := db.Restore(RestoreOptions{BackupPath: incr, TargetDir: tip}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewWithConfig(Config{Path: tip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get(restored, "bk:late") != "v3" || get(restored, "bk:100") != "" || get(restored, "bk:005") != "v2" {
+		t.Fatal("restore of the tip lost writes")
+	}
+	restored.Close()
+
+	// A target sequence between the backups replays the archived WAL up to
+	// it and no further.
+	pit := filepath.Join(root, "restore-pit")
+	if err := db.Restore(RestoreOptions{BackupPath: incr, TargetDir: pit, TargetSequence: target}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err = NewWithConfig(Config{Path: pit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if get(restored, "bk:009") != "v2" || get(restored, "bk:010") != "v1" {
+		t.Fatal("point-in-time restore did not replay the writes before the target")
+	}
+	if get(restored, "bk:late") != "" || get(restored, "bk:100") != "v1" {
+		t.Fatal("point-in-time restore replayed writes after the target")
+	}
+
+	if err := db.Restore(RestoreOptions{BackupPath: incr, TargetDir: pit}); err == nil {
+		t.Fatal("expected a restore into an existing directory to fail")
+	}
+	if err := db.Restore(RestoreOptions{BackupPath: incr, TargetDir: filepath.Join(root, "far"), TargetSequence: db.LastSequence() + 100}); err == nil {
+		t.Fatal("expected a target past the backups to fail")
+	}
+}
+
+func TestBackupChainRejectsTamperedManifest(t *testing.T) {
+	root := t.TempDir()
+	db, err := NewWithConfig(Config{Path: filepath.Join(root, "db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put([]byte("bk:key"), []byte("value"))
+
+	full := filepath.Join(root, "full")
+	if err := db.Backup(BackupOptions{OutputPath: full, Mode: BackupFull}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(full, backupManifestName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Replace(data, []byte(`"mode": "full"`), []byte(`"mode": "incremental"`), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BackupChain(full); err == nil {
+		t.Fatal("expected a tampered manifest to fail verification")
+	}
+	if err := db.Restore(RestoreOptions{BackupPath: full, TargetDir: filepath.Join(root, "restore")}); err == nil {
+		t.Fatal("expected restoring a tampered backup to fail")
+	}
+	if err := db.Backup(BackupOptions{OutputPath: filepath.Join(root, "incr"), Mode: BackupIncremental, Parent: full}); err == nil {
+		t.Fatal("expected an incremental backup on a tampered parent to fail")
+	}
+}
+
+func TestIncrementalBackupCopiesFilesRewrittenAtTheSameSize(t *testing.T) {
+	root := t.TempDir()
+	db, err := NewWithConfig(Config{Path: filepath.Join(root, "db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	blob := filepath.Join(db.filesDir, "blob.bin")
+	if err := os.MkdirAll(db.filesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	full := filepath.Join(root, "full")
+	if err := db.Backup(BackupOptions{OutputPath: full, Mode: BackupFull}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, []byte("again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	incr := filepath.Join(root, "incr")
+	if err := db.Backup(BackupOptions{OutputPath: incr, Mode: BackupIncremental, Parent: full}); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := db.BackupChain(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range chain[1].Files {
+		if f.Path == "objects/blob.bin" && f.Backup != chain[1].ID {
+			t.Fatalf("expected the rewritten file to be copied, it points to %s", f.Backup)
+		}
+	}
+
+	target := filepath.Join(root, "restore")
+	if err := db.Restore(RestoreOptions{BackupPath: incr, TargetDir: target}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "objects", "blob.bin")); err != nil || string(data) != "again" {
+		t.Fatalf("expected the rewritten content, got %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,367 @@
+package velocity
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	ChangeDeleteRange = "delete_range"
+	ChangeMerge       = "merge"
+)
+
+// ErrChangesUnavailable is returned by ChangesSince when the WAL no longer
+// holds every change after the requested sequence number.
+var ErrChangesUnavailable = errors.New("velocity: changes since the requested sequence are no longer in the WAL")
+
+// Change is one write read from the WAL. Sequence numbers are persisted with
+// the records and increase across restarts, so a consumer can resume after
+// the last Sequence it processed. Type is WatchPut, WatchDelete,
+// ChangeMerge, or ChangeDeleteRange, which deletes the keys in [Key, End).
+type Change struct {
+	Sequence  uint64 `json:"sequence"`
+	Type      string `json:"type"`
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+	End       []byte `json:"end,omitempty"`
+	Timestamp uint64 `json:"timestamp"`
+	ExpiresAt uint64 `json:"expires_at,omitempty"`
+}
+
+func changeFromEntry(seq uint64, e *Entry) Change {
+	c := Change{
+		Sequence:  seq,
+		Type:      WatchPut,
+		Key:       append([]byte(nil), e.Key...),
+		Timestamp: e.Timestamp,
+		ExpiresAt: e.ExpiresAt,
+	}
+	switch {
+	case e.kind == entryKindRangeDelete:
+		c.Type = ChangeDeleteRange
+		c.End = append([]byte(nil), e.Value...)
+	case e.kind == entryKindMerge:
+		c.Type = ChangeMerge
+		c.Value = append([]byte(nil), e.Value...)
+	case e.Deleted:
+		c.Type = WatchDelete
+	default:
+		c.Value = append([]byte(nil), e.Value...)
+	}
+	return c
+}
+
+// LastSequence returns the sequence number of the last write logged to the
+// WAL, or 0 without a WAL.
+func (db *DB) LastSequence() uint64 {
+	if db.wal == nil {
+		return 0
+	}
+	db.wal.mutex.Lock()
+	defer db.wal.mutex.Unlock()
+	return db.wal.seq
+}
+
+// ChangesSince streams every write logged after sequence number seq, in
+// order: first from the archived and live WAL segments, then as new writes
+// are logged. Pass the Sequence of the last change processed to resume, or
+// LastSequence() to start from now. The channel is closed when ctx is
+// cancelled or the DB closes.
+//
+// The WAL is discarded at every flush unless Config.RetainWAL is set, which
+// archives it instead; archived segments are kept according to the WAL
+// rotation policy. ErrChangesUnavailable is returned when the changes after
+// seq are no longer there, and the channel is closed early if a flush
+// discards changes the feed has not read yet. A consumer that falls far
+// behind the writers has its changes read back from the log, so it is
+// subject to the same limit. Column family writes are not included.
+func (db *DB) ChangesSince(ctx context.Context, seq uint64, buffer int) (<-chan Change, error) {
+	if db.wal == nil {
+		return nil, fmt.Errorf("velocity: ChangesSince requires the WAL")
+	}
+	if buffer < 1 {
+		buffer = 1
+	}
+	tail, segments, start, reader, err := db.tailWAL(seq)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Change, buffer)
+	go func() {
+		defer close(out)
+
+		last := seq
+		send := func(c Change) error {
+			if c.Sequence <= last {
+				return nil
+			}
+			select {
+			case out <- c:
+				last = c.Sequence
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-db.shutdownCh:
+				return errChangeFeedClosed
+			}
+		}
+		for {
+			overflow := db.followWAL(ctx, tail, segments[start:], reader, last, send)
+			db.wal.untail(tail, segments)
+			if !overflow {
+				return
+			}
+			// The feed fell so far behind that its tail stopped collecting;
+			// what it missed is read back from the log.
+			tail, segments, start, reader, err = db.tailWAL(last)
+			if err != nil {
+				log.Printf("velocity: change feed stopped after sequence %d: %v", last, err)
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// tailWAL registers a tail for a feed resuming after seq and opens the log
+// segments. Those from start on hold the records logged after seq and
+// before the tail.
+func (db *DB) tailWAL(seq uint64) (*walTail, []walSegment, int, walReader, error) {
+	tail, segments, reader, logged, err := db.wal.tail()
+	if err != nil {
+		return nil, nil, 0, walReader{}, err
+	}
+	// Segments before the last one that starts at or before seq only hold
+	// older records.
+	start := -1
+	for i, s := range segments {
+		if s.floor <= seq {
+			start = i
+		}
+	}
+	if seq >= logged {
+		start = len(segments)
+	}
+	if start < 0 {
+		db.wal.untail(tail, segments)
+		return nil, nil, 0, walReader{}, ErrChangesUnavailable
+	}
+	return tail, segments, start, reader, nil
+}
+
+// followWAL sends the changes of segments after seen, then those the tail
+// collects, until the feed stops. It reports true if it stopped because the
+// tail overflowed.
+func (db *DB) followWAL(ctx context.Context, tail *walTail, segments []walSegment, reader walReader, seen uint64, send func(Change) error) bool {
+	for _, s := range segments {
+		if s.floor > seen {
+			// The log was truncated after these records were written.
+			log.Printf("velocity: change feed stopped: records %d to %d were discarded", seen+1, s.floor)
+			return false
+		}
+		_, err := reader.readSegment(io.LimitReader(s.file, s.size), func(seq uint64, e *Entry) error {
+			seen = max(seen, seq)
+			if e == nil || seq == 0 || e.family != 0 {
+				return nil
+			}
+			return send(changeFromEntry(seq, e))
+		})
+		if err == nil {
+			continue
+		}
+		if err != ctx.Err() && err != errChangeFeedClosed {
+			log.Printf("velocity: change feed stopped reading %s: %v", s.file.Name(), err)
+		}
+		return false
+	}
+	for {
+		select {
+		case <-tail.signal:
+		case <-ctx.Done():
+			return false
+		case <-db.shutdownCh:
+			return false
+		}
+		changes, overflow := tail.drain()
+		for _, c := range changes {
+			if send(c) != nil {
+				return false
+			}
+		}
+		if overflow {
+			return true
+		}
+	}
+}
+
+var errChangeFeedClosed = errors.New("velocity: database closed")
+
+// changeFeedPendingLimit is the most changes a tail holds for a feed that
+// has fallen behind. Past it the tail drops them, and the feed reads them
+// back from the log.
+var changeFeedPendingLimit = 1 << 16
+
+// walTail collects the changes of one family logged while a change feed
+// catches up with the log, without ever blocking writers.
+type walTail struct {
+	family   uint32
+	mu       sync.Mutex
+	pending  []Change
+	overflow bool
+	signal   chan struct{}
+}
+
+func (t *walTail) push(c Change) {
+	t.mu.Lock()
+	switch {
+	case t.overflow:
+	case len(t.pending) < changeFeedPendingLimit:
+		t.pending = append(t.pending, c)
+	default:
+		t.pending, t.overflow = nil, true
+	}
+	t.mu.Unlock()
+	select {
+	case t.signal <- struct{}{}:
+	default:
+	}
+}
+
+// drain returns the changes collected since the last call, and whether the
+// tail overflowed and stopped collecting.
+func (t *walTail) drain() ([]Change, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := t.pending
+	t.pending = nil
+	return out, t.overflow
+}
+
+// walSegment is a log file opened for a change feed, read up to size.
+type walSegment struct {
+	file  *os.File
+	size  int64
+	floor uint64
+}
+
+// publishUnlocked hands a logged entry to the tails of its family. Caller
+// holds the lock.
+func (w *WAL) publishUnlocked(seq uint64, family uint32, entry *Entry) {
+	if len(w.tails) == 0 {
+		return
+	}
+	w.pushUnlocked(family, changeFromEntry(seq, entry))
+}
+
+// pushUnlocked hands a change to the tails of family. Caller holds the lock.
+func (w *walLog) pushUnlocked(family uint32, c Change) {
+	for t := range w.tails {
+		if t.family == family {
+			t.push(c)
+		}
+	}
+}
+
+// tail registers a tail for the default family and opens the segments that
+// hold the records logged before it: the archived logs, oldest first, and
+// the live log up to its current end. It also returns the sequence number
+// of the last of those records.
+func (w *WAL) tail() (*walTail, []walSegment, walReader, uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.syncUnsafe(); err != nil {
+		return nil, nil, walReader{}, 0, err
+	}
+	archive := w.archiveDir
+	if archive == "" {
+		archive = filepath.Join(filepath.Dir(w.file.Name()), "wal_archive")
+	}
+	var paths []string
+	if files, err := os.ReadDir(archive); err == nil {
+		for _, f := range files {
+			if !f.IsDir() && strings.HasPrefix(f.Name(), "wal_") {
+				paths = append(paths, filepath.Join(archive, f.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	paths = append(paths, w.file.Name())
+
+	var segments []walSegment
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			// Retention may have removed an archive since it was listed.
+			if os.IsNotExist(err) {
+				continue
+			}
+			closeSegments(segments)
+			return nil, nil, walReader{}, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeSegments(segments)
+			return nil, nil, walReader{}, 0, err
+		}
+		floor, ok := segmentFloor(f)
+		if !ok {
+			f.Close()
+			continue
+		}
+		segments = append(segments, walSegment{file: f, size: info.Size(), floor: floor})
+	}
+
+	families := make(map[uint32]*CryptoProvider, len(w.families))
+	for id, crypto := range w.families {
+		families[id] = crypto
+	}
+	t := &walTail{signal: make(chan struct{}, 1)}
+	if w.tails == nil {
+		w.tails = make(map[*walTail]struct{})
+	}
+	w.tails[t] = struct{}{}
+	return t, segments, walReader{crypto: w.crypto, families: families}, w.seq, nil
+}
+
+// untail unregisters t and closes the segments opened for it.
+func (w *WAL) untail(t *walTail, segments []walSegment) {
+	w.mutex.Lock()
+	delete(w.tails, t)
+	w.mutex.Unlock()
+	closeSegments(segments)
+}
+
+func closeSegments(segments []walSegment) {
+	for _, s := range segments {
+		s.file.Close()
+	}
+}
+
+// segmentFloor returns the sequence number the records of a log segment
+// follow. ok is false for an empty segment.
+func segmentFloor(f *os.File) (floor uint64, ok bool) {
+	var rec [12]byte
+	if n, _ := f.ReadAt(rec[:], 0); n < 4 {
+		return 0, false
+	}
+	switch binary.LittleEndian.Uint32(rec[:4]) {
+	case walSequenceFloor:
+		return binary.LittleEndian.Uint64(rec[4:]), true
+	case walSequenceMarker:
+		return binary.LittleEndian.Uint64(rec[4:]) - 1, true
+	}
+	// Records of older versions have no numbers; they are skipped.
+	return 0, true
+}
@@ -0,0 +1,163 @@
+package velocity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveChanges reads the next n changes to keys under "cdc:".
+func receiveChanges(t *testing.T, ch <-chan Change, n int) []Change {
+	t.Helper()
+	var out []Change
+	for len(out) < n {
+		select {
+		case c, ok := <-ch:
+			if !ok {
+				t.Fatalf("feed closed after %d of %d changes", len(out), n)
+			}
+			if strings.HasPrefix(string(c.Key), "cdc:") {
+				out = append(out, c)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d of %d changes", len(out), n)
+		}
+	}
+	return out
+}
+
+func TestChangesSinceResumesAcrossFlushesAndRestarts(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *DB {
+		db, err := NewWithConfig(Config{Path: dir, RetainWAL: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	db := open()
+	start := db.LastSequence()
+	for i := 0; i < 5; i++ {
+		db.Put([]byte(fmt.Sprintf("cdc:%d", i)), []byte("v"))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.Delete([]byte("cdc:0"))
+	mid := db.LastSequence()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = open()
+	defer db.Close()
+	if db.LastSequence() < mid {
+		t.Fatalf("expected the sequence to survive a restart: %d < %d", db.LastSequence(), mid)
+	}
+	db.Put([]byte("cdc:5"), []byte("v"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	feed, err := db.ChangesSince(ctx, start, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Change
+	for _, c := range receiveChanges(t, feed, 7) {
+		if c.Sequence <= start {
+			t.Fatalf("change %d is not after %d", c.Sequence, start)
+		}
+		if len(got) > 0 && c.Sequence <= got[len(got)-1].Sequence {
+			t.Fatalf("sequence went backwards: %d after %d", c.Sequence, got[len(got)-1].Sequence)
+		}
+		got = append(got, c)
+	}
+	if got[5].Type != WatchDelete || string(got[5].Key) != "cdc:0" || got[5].Sequence != mid {
+		t.Fatalf("unexpected delete change: %+v", got[5])
+	}
+	if string(got[6].Key) != "cdc:5" {
+		t.Fatalf("expected the write after the restart, got %+v", got[6])
+	}
+
+	// Writes made while the feed is open follow the logged ones.
+	db.Put([]byte("cdc:6"), []byte("live"))
+	if c := receiveChanges(t, feed, 1)[0]; string(c.Key) != "cdc:6" || string(c.Value) != "live" {
+		t.Fatalf("unexpected live change: %+v", c)
+	}
+
+	resumed, err := db.ChangesSince(ctx, mid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := receiveChanges(t, resumed, 1)[0]; string(c.Key) != "cdc:5" {
+		t.Fatalf("expected to resume after the delete, got %+v", c)
+	}
+}
+
+func TestChangesSinceReportsDiscardedChanges(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	start := db.LastSequence()
+	db.Put([]byte("cdc:a"), []byte("v"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ChangesSince(context.Background(), start, 1); !errors.Is(err, ErrChangesUnavailable) {
+		t.Fatalf("expected ErrChangesUnavailable, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed, err := db.ChangesSince(ctx, db.LastSequence(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("cdc:b"), []byte("v"))
+	if c := receiveChanges(t, feed, 1)[0]; string(c.Key) != "cdc:b" {
+		t.Fatalf("unexpected change: %+v", c)
+	}
+	cancel()
+	select {
+	case _, ok := <-feed:
+		if ok {
+			t.Fatal("expected the feed to close after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("feed did not close after cancel")
+	}
+}
+
+func TestChangesSinceRereadsLogWhenTailOverflows(t *testing.T) {
+	defer func(limit int) { changeFeedPendingLimit = limit }(changeFeedPendingLimit)
+	changeFeedPendingLimit = 4
+
+	db, err := NewWithConfig(Config{Path: t.TempDir(), RetainWAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	feed, err := db.ChangesSince(ctx, db.LastSequence(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody reads while these are written, so the tail overflows.
+	for i := 0; i < 50; i++ {
+		db.Put([]byte(fmt.Sprintf("cdc:%02d", i)), []byte("v"))
+	}
+	for i, c := range receiveChanges(t, feed, 50) {
+		if want := fmt.Sprintf("cdc:%02d", i); string(c.Key) != want {
+			t.Fatalf("change %d: got %s, want %s", i, c.Key, want)
+		}
+	}
+	db.Put([]byte("cdc:live"), []byte("v"))
+	if c := receiveChanges(t, feed, 1)[0]; string(c.Key) != "cdc:live" {
+		t.Fatalf("expected the feed to follow new writes, got %+v", c)
+	}
+}
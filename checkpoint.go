@@ -0,0 +1,267 @@
+package velocity
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const checkpointManifestName = "CHECKPOINT"
+
+// checkpointManifest describes a checkpoint directory. It is informational;
+// opening the checkpoint does not need it.
+type checkpointManifest struct {
+	Source    string   `json:"source"`
+	CreatedAt int64    `json:"created_at"`
+	SSTables  []string `json:"sstables"`
+	WALBytes  int64    `json:"wal_bytes"`
+	// Sequence is the number of the last WAL record the checkpoint holds.
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+// Checkpoint writes a copy of the database to dir that New(dir) opens
+// directly. The memtables are flushed first; SSTables, value log files and
+// object files, which never change once written, are hard-linked rather
+// than copied when dir is on the same file system, and the WAL is copied as
+// of the moment the table set was captured. dir must not exist. Writers are
+// not blocked, except for the short time the WAL is copied.
+func (db *DB) Checkpoint(dir string) error {
+	_, err := db.checkpoint(dir, nil)
+	return err
+}
+
+// checkpoint writes a checkpoint to dir and returns its description. SSTable,
+// value log and object files for which shared reports true are left out;
+// backups use it to skip the files an earlier backup holds.
+func (db *DB) checkpoint(dir string, shared func(rel string, info fs.FileInfo) bool) (checkpointManifest, error) {
+	dir = filepath.Clean(dir)
+	if _, err := os.Stat(dir); err == nil {
+		return checkpointManifest{}, fmt.Errorf("checkpoint directory %s already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return checkpointManifest{}, err
+	}
+
+	sharers := db.walSharers()
+	sort.Slice(sharers[1:], func(i, j int) bool { return sharers[1+i].path < sharers[1+j].path })
+	for _, s := range sharers {
+		if err := s.flushMemTable(); err != nil {
+			return checkpointManifest{}, err
+		}
+	}
+
+	// With flushes held off, the captured tables and the WAL copy together
+	// hold every write: the WAL cannot be truncated under us. The tables
+	// stay pinned afterwards, so flushes resume before they are linked.
+	for _, s := range sharers {
+		s.flushMu.Lock()
+	}
+	tables := make(map[string]*SSTable)
+	manifests := make(map[*DB][]manifestTable, len(sharers))
+	for _, s := range sharers {
+		var live []manifestTable
+		s.mutex.RLock()
+		for level, ssts := range s.levels {
+			for _, sst := range ssts {
+				sst.ref()
+				tables[filepath.Clean(sst.path)] = sst
+				live = append(live, manifestTableFor(sst, level))
+			}
+		}
+		s.mutex.RUnlock()
+		manifests[s] = live
+	}
+	defer func() {
+		for _, sst := range tables {
+			sst.unref()
+		}
+	}()
+
+	tmp := fmt.Sprintf("%s.tmp-%d", dir, time.Now().UnixNano())
+	manifest := checkpointManifest{Source: db.path, CreatedAt: time.Now().UnixNano()}
+	err := db.copyCheckpointWAL(tmp, &manifest)
+	for _, s := range sharers {
+		s.flushMu.Unlock()
+	}
+	if err == nil {
+		err = db.writeCheckpoint(tmp, &manifest, tables, manifests, shared)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return checkpointManifest{}, fmt.Errorf("checkpoint failed: %w", err)
+	}
+	return manifest, nil
+}
+
+// copyCheckpointWAL creates dir and copies the WAL into it. Callers hold
+// flushMu of every WAL sharer.
+func (db *DB) copyCheckpointWAL(dir string, manifest *checkpointManifest) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if db.wal == nil {
+		return nil
+	}
+	n, seq, err := db.wal.copyTo(filepath.Join(dir, filepath.Base(db.wal.file.Name())))
+	if err != nil {
+		return err
+	}
+	manifest.WALBytes, manifest.Sequence = n, seq
+	return nil
+}
+
+// writeCheckpoint fills dir, which holds the WAL copy, with the captured
+// tables, a MANIFEST listing them for each database in manifests and every
+// other file of the database, except the immutable files shared reports.
+// Callers keep the captured tables pinned.
+func (db *DB) writeCheckpoint(dir string, manifest *checkpointManifest, tables map[string]*SSTable, manifests map[*DB][]manifestTable, shared func(rel string, info fs.FileInfo) bool) error {
+
+	root := filepath.Clean(db.path)
+	archive := ""
+	if db.wal != nil {
+		archive = db.wal.archiveDir
+		if archive == "" {
+			archive = filepath.Join(root, "wal_archive")
+		}
+	}
+	skipDirs := map[string]bool{filepath.Clean(archive): true, filepath.Clean(dir): true}
+	// The captured tables keep the value log files they point into alive.
+	valueLogs := make(map[string]bool)
+	for s, live := range manifests {
+		for _, t := range live {
+			for _, id := range t.ValueLogs {
+				valueLogs[filepath.Join(filepath.Clean(s.path), valueLogFileName(id))] = true
+			}
+		}
+	}
+	objects := filepath.Clean(db.filesDir)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && (skipDirs[path] || strings.HasPrefix(path, dir+".tmp-")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		target := filepath.Join(dir, rel)
+		isShared := func() bool {
+			if shared == nil {
+				return false
+			}
+			info, err := d.Info()
+			return err == nil && shared(rel, info)
+		}
+		switch {
+		case db.wal != nil && path == filepath.Clean(db.wal.file.Name()):
+			return nil
+		case name == manifestName || name == flushCheckpointName || strings.Contains(name, ".tmp"):
+			return nil
+		case strings.HasPrefix(name, "sst_") && filepath.Ext(name) == ".db":
+			// Tables outside the captured set are being written or were
+			// compacted away since.
+			if tables[path] == nil {
+				return nil
+			}
+			manifest.SSTables = append(manifest.SSTables, rel)
+			if isShared() {
+				return nil
+			}
+			return linkOrCopyFile(path, target)
+		case isValueLogName(name):
+			if !valueLogs[path] || isShared() {
+				return nil
+			}
+			return linkOrCopyFile(path, target)
+		case db.filesDir != "" && strings.HasPrefix(path, objects+string(filepath.Separator)):
+			if isShared() {
+				return nil
+			}
+			return linkOrCopyFile(path, target)
+		default:
+			return copyFile(path, target)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for s, live := range manifests {
+		rel, err := filepath.Rel(root, filepath.Clean(s.path))
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := writeManifestSnapshot(target, live, s.crypto); err != nil {
+			return err
+		}
+	}
+
+	sort.Strings(manifest.SSTables)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, checkpointManifestName), data, 0644)
+}
+
+// linkOrCopyFile hard-links src to dst, copying it if the link fails, for
+// example across file systems.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to dst with the same permissions and syncs it.
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
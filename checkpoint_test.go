@@ -0,0 +1,116 @@
+package velocity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointOpensAsIndependentDatabase(t *testing.T) {
+	root := t.TempDir()
+	db, err := NewWithConfig(Config{Path: filepath.Join(root, "db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	events, err := db.CreateColumnFamily("events", ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("ck:%03d", i)), []byte("flushed"))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("ck:memtable"), []byte("unflushed"))
+	db.Delete([]byte("ck:000"))
+	events.Put([]byte("e:1"), []byte("event"))
+
+	ckpt := filepath.Join(root, "ckpt")
+	if err := db.Checkpoint(ckpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(ckpt); err == nil {
+		t.Fatal("expected a checkpoint into an existing directory to fail")
+	}
+	if _, err := os.Stat(filepath.Join(ckpt, checkpointManifestName)); err != nil {
+		t.Fatalf("expected a checkpoint manifest: %v", err)
+	}
+
+	// Writes after the checkpoint must not show up in it.
+	db.Put([]byte("ck:after"), []byte("later"))
+	db.Put([]byte("ck:001"), []byte("changed"))
+	events.Put([]byte("e:2"), []byte("later"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.compactLevel(0)
+
+	restored, err := NewWithConfig(Config{Path: ckpt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if got := scanKeys(t, restored, "ck:"); len(got) != 100 {
+		t.Fatalf("expected 100 keys in the checkpoint, got %d", len(got))
+	}
+	for key, want := range map[string]string{"ck:001": "flushed", "ck:memtable": "unflushed"} {
+		if v, err := restored.Get([]byte(key)); err != nil || string(v) != want {
+			t.Fatalf("expected %s=%s, got %q (%v)", key, want, v, err)
+		}
+	}
+	for _, key := range []string{"ck:000", "ck:after"} {
+		if _, err := restored.Get([]byte(key)); err == nil {
+			t.Fatalf("expected %s to be absent from the checkpoint", key)
+		}
+	}
+	restoredEvents, err := restored.ColumnFamily("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := restoredEvents.Get([]byte("e:1")); err != nil || string(v) != "event" {
+		t.Fatalf("expected the column family in the checkpoint, got %q (%v)", v, err)
+	}
+	if _, err := restoredEvents.Get([]byte("e:2")); err == nil {
+		t.Fatal("expected e:2 to be absent from the checkpoint")
+	}
+
+	// The original keeps working on its own files.
+	if v, err := db.Get([]byte("ck:001")); err != nil || string(v) != "changed" {
+		t.Fatalf("expected the source to keep its writes, got %q (%v)", v, err)
+	}
+}
+
+func TestCheckpointLinksTablesWithFlushesResumed(t *testing.T) {
+	root := t.TempDir()
+	db, err := NewWithConfig(Config{Path: filepath.Join(root, "db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("ck:%03d", i)), []byte("v"))
+	}
+
+	// Only the WAL copy holds flushes off; the tables are linked after.
+	tables, flushable := 0, 0
+	_, err = db.checkpoint(filepath.Join(root, "ckpt"), func(rel string, info os.FileInfo) bool {
+		if filepath.Ext(rel) == ".db" {
+			tables++
+			if db.flushMu.TryLock() {
+				db.flushMu.Unlock()
+				flushable++
+			}
+		}
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables == 0 || flushable != tables {
+		t.Fatalf("expected flushes to run while %d tables were linked, %d could", tables, flushable)
+	}
+}
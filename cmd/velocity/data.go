@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/oarkflow/velocity"
 	"github.com/urfave/cli/v3"
@@ -47,6 +55,156 @@ func dataCmd(db *velocity.DB) *cli.Command {
 					return nil
 				},
 			},
+			{
+				Name:      "ingest",
+				Usage:     "Bulk load key-value files or SSTables without going through the WAL",
+				ArgsUsage: "<file>...",
+				Description: "Files ending in .sst or .db are SSTables built with SSTableWriter and are ingested as they are.\n" +
+					"Other files are read as JSON lines of {\"key\": ..., \"value\": ...} objects, or as key,value\n" +
+					"CSV rows if they end in .csv, and written to one SSTable first as they are read, so their keys\n" +
+					"must be in byte order, across the files in the order given.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "output", Usage: "Only build the SSTable at this path instead of ingesting it"},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					if cmd.Args().Len() < 1 {
+						return fmt.Errorf("usage: velocity data ingest [--output file.sst] <file>...")
+					}
+					var tables, inputs []string
+					for _, path := range cmd.Args().Slice() {
+						switch strings.ToLower(filepath.Ext(path)) {
+						case ".sst", ".db":
+							tables = append(tables, path)
+						default:
+							inputs = append(inputs, path)
+						}
+					}
+					output := cmd.String("output")
+					if output != "" && len(tables) > 0 {
+						return fmt.Errorf("--output builds an SSTable from key-value files only")
+					}
+					if len(inputs) > 0 {
+						path := output
+						if path == "" {
+							dir, err := os.MkdirTemp("", "velocity-ingest-")
+							if err != nil {
+								return err
+							}
+							defer os.RemoveAll(dir)
+							path = filepath.Join(dir, "ingest.sst")
+						}
+						n, err := buildIngestTable(db, path, inputs)
+						if err != nil {
+							return fmt.Errorf("failed to build sstable: %w", err)
+						}
+						if output != "" {
+							fmt.Printf("Wrote %d keys to %s\n", n, output)
+							return nil
+						}
+						fmt.Printf("Built sstable with %d keys\n", n)
+						tables = append(tables, path)
+					}
+					if err := db.IngestExternalFiles(tables); err != nil {
+						return fmt.Errorf("failed to ingest: %w", err)
+					}
+					fmt.Printf("Ingested %d file(s)\n", len(tables))
+					return nil
+				},
+			},
 		},
 	}
 }
+
+// buildIngestTable writes the key-value pairs of inputs to one SSTable at
+// path as they are read, so the pairs must be sorted by key, each file
+// picking up where the previous one ends. A key that appears more than once
+// in a row keeps its last value.
+func buildIngestTable(db *velocity.DB, path string, inputs []string) (int, error) {
+	w := db.NewSSTableWriter(path)
+	var (
+		key   string
+		value []byte
+		held  bool
+	)
+	for _, input := range inputs {
+		if err := readIngestPairs(input, func(k string, v []byte) error {
+			if held && k != key {
+				if k < key {
+					return fmt.Errorf("key %q is out of order after %q; sort the input by key first", k, key)
+				}
+				if err := w.Put([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			key, value, held = k, v, true
+			return nil
+		}); err != nil {
+			w.Abort()
+			return 0, fmt.Errorf("%s: %w", input, err)
+		}
+	}
+	if held {
+		if err := w.Put([]byte(key), value); err != nil {
+			w.Abort()
+			return 0, err
+		}
+	}
+	return w.Len(), w.Finish()
+}
+
+// readIngestPairs calls fn for every key-value pair of a JSON lines or CSV
+// file, in file order, and stops at the first error fn returns.
+func readIngestPairs(path string, fn func(key string, value []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = 2
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(row[0], []byte(row[1])); err != nil {
+				line, _ := r.FieldPos(0)
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var pair struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(text, &pair); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if pair.Key == "" {
+			return fmt.Errorf("line %d: missing key", line)
+		}
+		// String values are stored as is, anything else as its JSON.
+		value := append([]byte(nil), pair.Value...)
+		var s string
+		if err := json.Unmarshal(pair.Value, &s); err == nil {
+			value = []byte(s)
+		}
+		if err := fn(pair.Key, value); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,755 @@
+package velocity
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/oarkflow/velocity/pkg/storage"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// DefaultColumnFamily names the keyspace that the DB's own methods use.
+const DefaultColumnFamily = "default"
+
+const (
+	columnFamiliesFile = "column_families.json"
+	columnFamiliesDir  = "families"
+)
+
+var (
+	// ErrColumnFamilyNotFound is returned for a column family that was never
+	// created or has been dropped.
+	ErrColumnFamilyNotFound = errors.New("column family not found")
+	// ErrColumnFamilyExists is returned when creating a column family whose
+	// name is taken.
+	ErrColumnFamilyExists = errors.New("column family already exists")
+)
+
+// ColumnFamilyOptions configures a column family. Zero values fall back to
+// the database defaults.
+type ColumnFamilyOptions struct {
+	MemTableSize        int64           `json:"memtable_size,omitempty"`         // 0 means DefaultMemTableSize
+	CacheSize           int             `json:"cache_size,omitempty"`            // value cache in bytes; 0 disables it
+	Compression         CompressionType `json:"compression,omitempty"`           // codec for SSTable data blocks
+	BlockSize           int             `json:"block_size,omitempty"`            // 0 means DefaultBlockSize
+	TargetFileSize      int64           `json:"target_file_size,omitempty"`      // 0 means DefaultTargetFileSize
+	CompactionRateLimit int64           `json:"compaction_rate_limit,omitempty"` // 0 means DefaultCompactionRateLimit, negative disables throttling
+	TTL                 time.Duration   `json:"ttl,omitempty"`                   // expiry applied by Put; 0 means keys do not expire
+	ValueThreshold      int             `json:"value_threshold,omitempty"`       // values this large go to the value log; 0 keeps them inline
+	ValueLogGCRatio     float64         `json:"value_log_gc_ratio,omitempty"`    // 0 means DefaultValueLogGCRatio
+	BloomBitsPerKey     int             `json:"bloom_bits_per_key,omitempty"`    // 0 means DefaultBloomFilterBits
+
+	// EncryptionKey is the 32-byte key the family's data is encrypted with.
+	// If nil a random key is generated. The key is stored encrypted with the
+	// database key.
+	EncryptionKey []byte `json:"-"`
+}
+
+// ColumnFamily is a keyspace with its own memtable, SSTables, cache and
+// encryption key. Its writes go to the database WAL, so a ColumnFamilyBatch
+// can update several families atomically. A ColumnFamily is safe for
+// concurrent use and becomes unusable once dropped.
+type ColumnFamily struct {
+	name string
+	id   uint32
+	opts ColumnFamilyOptions
+	db   *DB // the family's own LSM tree
+}
+
+// columnFamilySet holds the column families of a database and the records
+// persisted to column_families.json.
+type columnFamilySet struct {
+	root    string
+	nextID  uint32
+	byName  map[string]*ColumnFamily
+	records []columnFamilyRecord
+}
+
+type columnFamilyRecord struct {
+	ID      uint32              `json:"id"`
+	Name    string              `json:"name"`
+	Options ColumnFamilyOptions `json:"options"`
+	Key     []byte              `json:"key,omitempty"` // nonce followed by the sealed family key
+}
+
+type columnFamilyManifest struct {
+	NextID   uint32               `json:"next_id"`
+	Families []columnFamilyRecord `json:"families"`
+}
+
+// openColumnFamilies opens the column families recorded under root and
+// registers them with wal so that replay can decrypt their records.
+func openColumnFamilies(root string, crypto *CryptoProvider, wal *WAL, cfg Config, caches *sstableCaches) (*columnFamilySet, error) {
+	set := &columnFamilySet{root: root, nextID: 1, byName: make(map[string]*ColumnFamily)}
+	data, err := os.ReadFile(filepath.Join(root, columnFamiliesFile))
+	if os.IsNotExist(err) {
+		return set, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest columnFamilyManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("velocity: corrupt column family manifest: %w", err)
+	}
+	set.nextID = max(manifest.NextID, 1)
+	set.records = manifest.Families
+	for _, rec := range manifest.Families {
+		familyCrypto, err := unsealColumnFamilyKey(crypto, rec)
+		if err != nil {
+			return nil, err
+		}
+		cf, err := openColumnFamily(root, rec.ID, rec.Name, rec.Options, familyCrypto, wal, cfg, caches)
+		if err != nil {
+			return nil, err
+		}
+		set.byName[rec.Name] = cf
+	}
+	return set, nil
+}
+
+// openColumnFamily opens the LSM tree of one column family. Its SSTables
+// share the read caches of the database.
+func openColumnFamily(root string, id uint32, name string, opts ColumnFamilyOptions, crypto *CryptoProvider, wal *WAL, cfg Config, caches *sstableCaches) (*ColumnFamily, error) {
+	path := filepath.Join(root, columnFamiliesDir, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	if err := recoverFlushCheckpoint(path); err != nil {
+		return nil, err
+	}
+	db := &DB{
+		path:                path,
+		memTable:            NewMemTable(),
+		levels:              make([][]*SSTable, MaxLevels),
+		memTableSize:        opts.MemTableSize,
+		crypto:              crypto,
+		shutdownCh:          make(chan struct{}),
+		disableWAL:          cfg.DisableWAL,
+		skipCloseFlush:      cfg.SkipCloseFlush,
+		sstOptions:          SSTableOptions{BlockSize: opts.BlockSize, Compression: opts.Compression, BloomBitsPerKey: opts.BloomBitsPerKey, PrefixExtractor: cfg.PrefixExtractor},
+		targetFileSize:      opts.TargetFileSize,
+		compactionRateLimit: opts.CompactionRateLimit,
+		values:              newValueLog(path, crypto, opts.ValueThreshold, opts.ValueLogGCRatio),
+		caches:              caches,
+	}
+	if wal != nil {
+		db.wal = wal.forFamily(id, crypto)
+	}
+	if db.memTableSize <= 0 {
+		db.memTableSize = DefaultMemTableSize
+	}
+	db.initWriteStalls(cfg.L0SlowdownWritesTrigger, cfg.L0StopWritesTrigger, cfg.MaxImmutableMemTables)
+	if db.targetFileSize <= 0 {
+		db.targetFileSize = DefaultTargetFileSize
+	}
+	if db.compactionRateLimit == 0 {
+		db.compactionRateLimit = DefaultCompactionRateLimit
+	}
+	if opts.CacheSize > 0 {
+		db.cache = storage.NewLRUCache(opts.CacheSize)
+	}
+	if err := db.loadSSTables(); err != nil {
+		return nil, err
+	}
+
+	db.startBackgroundLoops()
+
+	opts.EncryptionKey = nil
+	return &ColumnFamily{name: name, id: id, opts: opts, db: db}, nil
+}
+
+// attachColumnFamilies hands the column families opened before the WAL was
+// replayed to db, loads their replayed entries and returns the rest.
+func (db *DB) attachColumnFamilies(set *columnFamilySet, entries []*Entry) []*Entry {
+	db.families = set
+	byID := make(map[uint32]*ColumnFamily, len(set.byName))
+	for _, cf := range set.byName {
+		cf.db.walOwner = db
+		byID[cf.id] = cf
+	}
+	if len(byID) == 0 {
+		return entries
+	}
+	own := entries[:0]
+	replayed := make(map[*ColumnFamily][]*Entry)
+	for _, e := range entries {
+		if e.family == 0 {
+			own = append(own, e)
+			continue
+		}
+		if cf := byID[e.family]; cf != nil {
+			replayed[cf] = append(replayed[cf], e)
+		}
+	}
+	for cf, list := range replayed {
+		for _, e := range list {
+			observeEntryTimestamp(e.Timestamp)
+		}
+		cf.db.memTable.LoadEntries(list)
+		if len(cf.db.memTable.rangeTombstones()) > 0 {
+			cf.db.hasRangeDels.Store(true)
+		}
+	}
+	return own
+}
+
+// sealColumnFamilyKey encrypts a family key with the database key. Nothing
+// is stored when encryption is disabled.
+func sealColumnFamilyKey(crypto *CryptoProvider, id uint32, key []byte) ([]byte, error) {
+	if crypto.noop {
+		return nil, nil
+	}
+	nonce, sealed, err := crypto.Encrypt(key, columnFamilyKeyAAD(id))
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, sealed...), nil
+}
+
+// unsealColumnFamilyKey returns the crypto provider of a recorded family.
+func unsealColumnFamilyKey(crypto *CryptoProvider, rec columnFamilyRecord) (*CryptoProvider, error) {
+	if crypto.noop {
+		return newNoopCryptoProvider(), nil
+	}
+	if len(rec.Key) < chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("velocity: column family %q has no key", rec.Name)
+	}
+	key, err := crypto.Decrypt(rec.Key[:chacha20poly1305.NonceSizeX], rec.Key[chacha20poly1305.NonceSizeX:], columnFamilyKeyAAD(rec.ID))
+	if err != nil {
+		return nil, fmt.Errorf("velocity: cannot decrypt key of column family %q: %w", rec.Name, err)
+	}
+	return newCryptoProvider(key)
+}
+
+func columnFamilyKeyAAD(id uint32) []byte {
+	aad := []byte("velocity-column-family:")
+	return binary.LittleEndian.AppendUint32(aad, id)
+}
+
+// save replaces the persisted records of set with records and nextID.
+// Callers hold db.familyMu.
+func (set *columnFamilySet) save(records []columnFamilyRecord, nextID uint32) error {
+	data, err := json.MarshalIndent(columnFamilyManifest{NextID: nextID, Families: records}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(set.root, columnFamiliesFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	set.records, set.nextID = records, nextID
+	return nil
+}
+
+func validColumnFamilyName(name string) error {
+	if name == "" || name == DefaultColumnFamily || len(name) > 128 {
+		return fmt.Errorf("invalid column family name %q", name)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return fmt.Errorf("invalid column family name %q: use letters, digits, '_', '-' and '.'", name)
+		}
+	}
+	return nil
+}
+
+// CreateColumnFamily creates a column family. Its name and options are
+// persisted; it is opened again with the database.
+func (db *DB) CreateColumnFamily(name string, opts ColumnFamilyOptions) (*ColumnFamily, error) {
+	if err := validColumnFamilyName(name); err != nil {
+		return nil, err
+	}
+	key := opts.EncryptionKey
+	if key == nil {
+		key = make([]byte, chacha20poly1305.KeySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+	}
+	familyCrypto, err := newCryptoProvider(key)
+	if err != nil {
+		return nil, err
+	}
+	if db.crypto.noop {
+		familyCrypto = newNoopCryptoProvider()
+	}
+
+	db.familyMu.Lock()
+	defer db.familyMu.Unlock()
+	if db.closed.Load() || db.families == nil {
+		return nil, fmt.Errorf("database is closed")
+	}
+	if _, ok := db.families.byName[name]; ok {
+		return nil, fmt.Errorf("%w: %q", ErrColumnFamilyExists, name)
+	}
+	id := db.families.nextID
+	sealed, err := sealColumnFamilyKey(db.crypto, id, key)
+	if err != nil {
+		return nil, err
+	}
+	opts.EncryptionKey = nil
+	// Clear out a directory left behind by a drop that did not finish.
+	if err := os.RemoveAll(filepath.Join(db.families.root, columnFamiliesDir, name)); err != nil {
+		return nil, err
+	}
+	records := append(db.families.records[:len(db.families.records):len(db.families.records)],
+		columnFamilyRecord{ID: id, Name: name, Options: opts, Key: sealed})
+	if err := db.families.save(records, id+1); err != nil {
+		return nil, err
+	}
+	cf, err := openColumnFamily(db.families.root, id, name, opts, familyCrypto, db.wal, Config{
+		DisableWAL:     db.disableWAL,
+		SkipCloseFlush: db.skipCloseFlush,
+
+		L0SlowdownWritesTrigger: db.l0SlowdownTrigger,
+		L0StopWritesTrigger:     db.l0StopTrigger,
+		MaxImmutableMemTables:   db.maxImmutableMemTables,
+	}, db.caches)
+	if err != nil {
+		return nil, err
+	}
+	cf.db.walOwner = db
+	db.families.byName[name] = cf
+	return cf, nil
+}
+
+// ColumnFamily returns the column family called name.
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.familyMu.RLock()
+	defer db.familyMu.RUnlock()
+	if db.families == nil {
+		return nil, fmt.Errorf("%w: %q", ErrColumnFamilyNotFound, name)
+	}
+	if cf, ok := db.families.byName[name]; ok {
+		return cf, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrColumnFamilyNotFound, name)
+}
+
+// ColumnFamilies returns the names of the column families, sorted. The
+// default keyspace is not included.
+func (db *DB) ColumnFamilies() []string {
+	db.familyMu.RLock()
+	defer db.familyMu.RUnlock()
+	if db.families == nil {
+		return nil
+	}
+	names := make([]string, 0, len(db.families.byName))
+	for name := range db.families.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropColumnFamily deletes a column family and all of its data.
+func (db *DB) DropColumnFamily(name string) error {
+	db.familyMu.Lock()
+	var cf *ColumnFamily
+	if db.families != nil {
+		cf = db.families.byName[name]
+	}
+	if cf == nil {
+		db.familyMu.Unlock()
+		return fmt.Errorf("%w: %q", ErrColumnFamilyNotFound, name)
+	}
+	var records []columnFamilyRecord
+	for _, rec := range db.families.records {
+		if rec.ID != cf.id {
+			records = append(records, rec)
+		}
+	}
+	if err := db.families.save(records, db.families.nextID); err != nil {
+		db.familyMu.Unlock()
+		return err
+	}
+	delete(db.families.byName, name)
+	db.familyMu.Unlock()
+
+	cf.db.closeColumnFamily(false)
+	if db.wal != nil {
+		db.wal.dropFamily(cf.id)
+	}
+	return os.RemoveAll(cf.db.path)
+}
+
+// closeColumnFamilies closes every column family, flushing them as Close
+// flushes the database.
+func (db *DB) closeColumnFamilies() {
+	flush := db.disableWAL || (db.wal != nil && !db.skipCloseFlush)
+	for _, family := range db.walSharers()[1:] {
+		family.closeColumnFamily(flush)
+	}
+}
+
+// closeColumnFamily stops the background work of a column family's LSM tree
+// and closes its tables, flushing the memtable first if flush is set. The
+// shared WAL stays open.
+func (db *DB) closeColumnFamily(flush bool) {
+	if db.closed.Swap(true) {
+		return
+	}
+	close(db.shutdownCh)
+	db.compactionWG.Wait()
+	if flush {
+		if err := db.flushMemTable(); err != nil {
+			log.Printf("velocity: column family flush failed during close: %v", err)
+		}
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, level := range db.levels {
+		for _, sst := range level {
+			sst.Close()
+		}
+	}
+	db.levels = make([][]*SSTable, MaxLevels)
+	if db.manifest != nil {
+		db.manifest.close()
+	}
+	if db.values != nil {
+		db.values.close()
+	}
+}
+
+// walSharers returns the databases whose writes are in the WAL of db: db
+// itself and its column families.
+func (db *DB) walSharers() []*DB {
+	sharers := []*DB{db}
+	if db.families == nil {
+		return sharers
+	}
+	db.familyMu.RLock()
+	defer db.familyMu.RUnlock()
+	for _, cf := range db.families.byName {
+		sharers = append(sharers, cf.db)
+	}
+	return sharers
+}
+
+// releaseWAL truncates the WAL after db flushed its memtable. A WAL shared
+// with column families also holds their unflushed writes, so those are
+// flushed first. If one of them is already flushing, the WAL is left for
+// that flush to truncate.
+func (db *DB) releaseWAL() error {
+	if db.wal == nil {
+		return nil
+	}
+	owner := db
+	if db.walOwner != nil {
+		owner = db.walOwner
+	}
+	for _, other := range owner.walSharers() {
+		// Writes waiting for their sync are only in the log; the next
+		// flush truncates it once they are in a memtable.
+		if other.hasPendingWrites() {
+			return nil
+		}
+		if other == db {
+			continue
+		}
+		if other.closed.Load() {
+			if other.memTable.Size() > 0 {
+				return nil
+			}
+			continue
+		}
+		if !other.flushMu.TryLock() {
+			return nil
+		}
+		_, err := other.writeMemTableToL0()
+		other.flushMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return db.wal.Truncate()
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Options returns the options the column family was created with, without
+// its encryption key.
+func (cf *ColumnFamily) Options() ColumnFamilyOptions {
+	return cf.opts
+}
+
+func (cf *ColumnFamily) check() error {
+	if cf.db.closed.Load() {
+		return fmt.Errorf("column family %q is closed", cf.name)
+	}
+	return nil
+}
+
+// expiry returns the expiry time of a key written now under the family TTL.
+func (cf *ColumnFamily) expiry() uint64 {
+	if cf.opts.TTL <= 0 {
+		return 0
+	}
+	return uint64(time.Now().Add(cf.opts.TTL).UnixNano())
+}
+
+// Put stores a key, expiring it after the family TTL if one is set.
+func (cf *ColumnFamily) Put(key, value []byte) error {
+	return cf.PutWithTTL(key, value, cf.opts.TTL)
+}
+
+// PutWithTTL stores a key with a TTL. If ttl <= 0 the key will not expire.
+func (cf *ColumnFamily) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if err := cf.check(); err != nil {
+		return err
+	}
+	cf.db.mutex.Lock()
+	if err := cf.db.makeRoomForWriteLocked(); err != nil {
+		cf.db.mutex.Unlock()
+		return err
+	}
+	_, write, err := cf.db.putWithTTLLocked(key, value, ttl)
+	cf.db.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return cf.db.awaitWrite(write)
+}
+
+// Get returns the value of key.
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	if err := cf.check(); err != nil {
+		return nil, err
+	}
+	return cf.db.Get(key)
+}
+
+// Has reports whether key exists.
+func (cf *ColumnFamily) Has(key []byte) bool {
+	return cf.check() == nil && cf.db.Has(key)
+}
+
+// Delete deletes key.
+func (cf *ColumnFamily) Delete(key []byte) error {
+	if err := cf.check(); err != nil {
+		return err
+	}
+	cf.db.mutex.Lock()
+	if err := cf.db.makeRoomForWriteLocked(); err != nil {
+		cf.db.mutex.Unlock()
+		return err
+	}
+	write, err := cf.db.deleteBuffered(key)
+	cf.db.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return cf.db.awaitWrite(write)
+}
+
+// DeleteRange deletes every key in [start, end). See DB.DeleteRange.
+func (cf *ColumnFamily) DeleteRange(start, end []byte) error {
+	if err := cf.check(); err != nil {
+		return err
+	}
+	return cf.db.DeleteRange(start, end)
+}
+
+// DeletePrefix deletes every key that starts with prefix.
+func (cf *ColumnFamily) DeletePrefix(prefix []byte) error {
+	if err := cf.check(); err != nil {
+		return err
+	}
+	return cf.db.DeletePrefix(prefix)
+}
+
+// Scan calls fn for every live key with the given prefix in key order.
+func (cf *ColumnFamily) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	if err := cf.check(); err != nil {
+		return err
+	}
+	return cf.db.Scan(prefix, fn)
+}
+
+// NewIterator returns an iterator over the column family. See DB.NewIterator.
+func (cf *ColumnFamily) NewIterator(opts IterOptions) *Iterator {
+	return cf.db.NewIterator(opts)
+}
+
+// Stats returns the storage engine statistics of the column family. See
+// DB.Stats.
+func (cf *ColumnFamily) Stats() Stats {
+	return cf.db.Stats()
+}
+
+// SetCompactionFilter registers a compaction filter for the family's keys
+// starting with prefix. See DB.SetCompactionFilter.
+func (cf *ColumnFamily) SetCompactionFilter(prefix string, f CompactionFilter) {
+	cf.db.SetCompactionFilter(prefix, f)
+}
+
+// Flush writes the column family's memtable to an SSTable.
+func (cf *ColumnFamily) Flush() error {
+	if err := cf.check(); err != nil {
+		return err
+	}
+	return cf.db.flushMemTable()
+}
+
+// ColumnFamilyBatch collects writes to any number of column families and
+// applies them atomically: the WAL records the whole batch or none of it.
+// A nil *ColumnFamily refers to the default keyspace.
+type ColumnFamilyBatch struct {
+	db     *DB
+	groups map[*ColumnFamily][]*Entry
+	order  []*ColumnFamily
+}
+
+// NewColumnFamilyBatch starts an empty batch.
+func (db *DB) NewColumnFamilyBatch() *ColumnFamilyBatch {
+	return &ColumnFamilyBatch{db: db, groups: make(map[*ColumnFamily][]*Entry)}
+}
+
+// Put adds a write of key to cf, with the family TTL.
+func (b *ColumnFamilyBatch) Put(cf *ColumnFamily, key, value []byte) {
+	var expiresAt uint64
+	if cf != nil {
+		expiresAt = cf.expiry()
+	}
+	b.add(cf, &Entry{
+		Key:       append([]byte(nil), key...),
+		Value:     append([]byte(nil), value...),
+		ExpiresAt: expiresAt,
+	})
+}
+
+// Delete adds a delete of key from cf.
+func (b *ColumnFamilyBatch) Delete(cf *ColumnFamily, key []byte) {
+	b.add(cf, &Entry{Key: append([]byte(nil), key...), Deleted: true})
+}
+
+func (b *ColumnFamilyBatch) add(cf *ColumnFamily, e *Entry) {
+	if _, ok := b.groups[cf]; !ok {
+		b.order = append(b.order, cf)
+	}
+	b.groups[cf] = append(b.groups[cf], e)
+}
+
+// Len reports the number of writes in the batch.
+func (b *ColumnFamilyBatch) Len() int {
+	n := 0
+	for _, entries := range b.groups {
+		n += len(entries)
+	}
+	return n
+}
+
+// Commit applies the batch. All of its writes share one timestamp.
+func (b *ColumnFamilyBatch) Commit() error {
+	if b.Len() == 0 {
+		return nil
+	}
+	// Lock the default keyspace first, then families by id.
+	families := append([]*ColumnFamily(nil), b.order...)
+	sort.Slice(families, func(i, j int) bool {
+		if families[i] == nil || families[j] == nil {
+			return families[i] == nil
+		}
+		return families[i].id < families[j].id
+	})
+	lsm := func(cf *ColumnFamily) *DB {
+		if cf == nil {
+			return b.db
+		}
+		return cf.db
+	}
+	for _, cf := range families {
+		if cf != nil && cf.db.walOwner != b.db {
+			return fmt.Errorf("column family %q belongs to another database", cf.name)
+		}
+	}
+	// Stalls wait with a single lock held, before the batch takes them all.
+	for _, cf := range families {
+		if err := lsm(cf).makeRoomForWrite(); err != nil {
+			return err
+		}
+	}
+	for _, cf := range families {
+		lsm(cf).mutex.Lock()
+	}
+	unlock := func() {
+		for _, cf := range families {
+			lsm(cf).mutex.Unlock()
+		}
+	}
+	for _, cf := range families {
+		if cf != nil {
+			if err := cf.check(); err != nil {
+				unlock()
+				return err
+			}
+		}
+	}
+
+	commitTs := nextEntryTimestamp()
+	groups := make([]walBatchGroup, 0, len(families))
+	for _, cf := range families {
+		for _, e := range b.groups[cf] {
+			e.Timestamp = commitTs
+			if e.Deleted {
+				e.checksum = crc32.ChecksumIEEE(e.Key)
+			} else {
+				e.checksum = crc32.Update(crc32.ChecksumIEEE(e.Key), crc32.IEEETable, e.Value)
+			}
+		}
+		groups = append(groups, walBatchGroup{wal: lsm(cf).wal, entries: b.groups[cf]})
+	}
+	var commit *walGroup
+	if !b.db.disableWAL {
+		if b.db.wal == nil {
+			unlock()
+			return fmt.Errorf("WAL is not initialized")
+		}
+		var err error
+		if commit, err = b.db.wal.appendAtomic(groups); err != nil {
+			unlock()
+			return err
+		}
+	}
+
+	// As for transactions, the batch is synced once the families are
+	// unlocked and reaches each of them after that.
+	writes := make([]*pendingWrite, len(families))
+	for i, cf := range families {
+		writes[i] = lsm(cf).queueWriteLocked(commit, b.groups[cf], true)
+	}
+	unlock()
+
+	var firstErr error
+	for i, cf := range families {
+		err := lsm(cf).awaitWrite(writes[i])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if cf == nil && (err == nil || writes[i].applied) {
+			b.db.publishCommitted(b.groups[nil])
+		}
+	}
+	b.groups = make(map[*ColumnFamily][]*Entry)
+	b.order = nil
+	return firstErr
+}
@@ -0,0 +1,244 @@
+package velocity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestColumnFamiliesAreIndependentAndPersist(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewWithConfig(Config{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := db.CreateColumnFamily("events", ColumnFamilyOptions{MemTableSize: 4 * 1024, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := db.CreateColumnFamily("meta", ColumnFamilyOptions{CacheSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateColumnFamily("meta", ColumnFamilyOptions{}); !errors.Is(err, ErrColumnFamilyExists) {
+		t.Fatalf("expected ErrColumnFamilyExists, got %v", err)
+	}
+	if _, err := db.CreateColumnFamily(DefaultColumnFamily, ColumnFamilyOptions{}); err == nil {
+		t.Fatal("expected the default name to be rejected")
+	}
+
+	db.Put([]byte("k"), []byte("default"))
+	events.Put([]byte("k"), []byte("events"))
+	meta.Put([]byte("k"), []byte("meta"))
+	for i := 0; i < 200; i++ {
+		events.Put([]byte(fmt.Sprintf("e:%03d", i)), []byte("payload-payload-payload"))
+	}
+	if err := events.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for _, c := range []struct {
+			get  func([]byte) ([]byte, error)
+			want string
+		}{{db.Get, "default"}, {events.Get, "events"}, {meta.Get, "meta"}} {
+			if v, err := c.get([]byte("k")); err != nil || string(v) != c.want {
+				t.Fatalf("%s: expected %q, got %q (%v)", stage, c.want, v, err)
+			}
+		}
+		if got := scanKeys(t, db, "e:"); len(got) != 0 {
+			t.Fatalf("%s: family keys leaked into the default keyspace: %v", stage, got)
+		}
+		n := 0
+		events.Scan([]byte("e:"), func(_, _ []byte) bool { n++; return true })
+		if n != 200 {
+			t.Fatalf("%s: expected 200 event keys, got %d", stage, n)
+		}
+	}
+	check("open")
+
+	files, _ := filepath.Glob(filepath.Join(dir, columnFamiliesDir, "events", "sst_*.db"))
+	if len(files) == 0 {
+		t.Fatal("expected the events family to flush into its own directory")
+	}
+	events.db.mutex.RLock()
+	entry, _ := events.db.latestEntryLocked([]byte("k"))
+	events.db.mutex.RUnlock()
+	if entry == nil || entry.ExpiresAt == 0 {
+		t.Fatal("expected the family TTL to apply to Put")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewWithConfig(Config{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if names := db.ColumnFamilies(); len(names) != 2 || names[0] != "events" || names[1] != "meta" {
+		t.Fatalf("unexpected families after reopen: %v", names)
+	}
+	events, _ = db.ColumnFamily("events")
+	meta, _ = db.ColumnFamily("meta")
+	if events.Options().TTL != time.Hour {
+		t.Fatalf("expected options to persist, got %+v", events.Options())
+	}
+	check("reopened")
+
+	if err := db.DropColumnFamily("events"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := events.Get([]byte("k")); err == nil {
+		t.Fatal("expected a dropped family to be unusable")
+	}
+	if _, err := os.Stat(filepath.Join(dir, columnFamiliesDir, "events")); !os.IsNotExist(err) {
+		t.Fatalf("expected the dropped family's directory to be removed: %v", err)
+	}
+	events, err = db.CreateColumnFamily("events", ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := events.Get([]byte("k")); err == nil {
+		t.Fatal("expected a recreated family to start empty")
+	}
+}
+
+func TestColumnFamilyBatchReplaysAtomically(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewWithConfig(Config{Path: dir, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	users, err := db.CreateColumnFamily("users", ColumnFamilyOptions{EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := db.CreateColumnFamily("index", ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put([]byte("unflushed"), []byte("default"))
+	batch := db.NewColumnFamilyBatch()
+	batch.Put(users, []byte("user:1"), []byte("alice"))
+	batch.Put(index, []byte("name:alice"), []byte("user:1"))
+	batch.Put(nil, []byte("count"), []byte("1"))
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// Flushing one family must not drop the others' writes from the WAL.
+	index.Put([]byte("name:bob"), []byte("user:2"))
+	if err := users.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	users.Put([]byte("user:2"), []byte("bob"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewWithConfig(Config{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, _ = db.ColumnFamily("users")
+	index, _ = db.ColumnFamily("index")
+	for _, c := range []struct {
+		get       func([]byte) ([]byte, error)
+		key, want string
+	}{
+		{users.Get, "user:1", "alice"},
+		{users.Get, "user:2", "bob"},
+		{index.Get, "name:alice", "user:1"},
+		{index.Get, "name:bob", "user:2"},
+		{db.Get, "count", "1"},
+		{db.Get, "unflushed", "default"},
+	} {
+		if v, err := c.get([]byte(c.key)); err != nil || string(v) != c.want {
+			t.Fatalf("expected %s=%s after replay, got %q (%v)", c.key, c.want, v, err)
+		}
+	}
+}
+
+func TestColumnFamilyBatchSyncsWithoutHoldingTheFamilies(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, err := db.CreateColumnFamily("users", ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put([]byte("user:0"), []byte("root")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the shared log as if a sync were in flight.
+	w := db.wal
+	w.mutex.Lock()
+	w.syncing = true
+	w.mutex.Unlock()
+	release := func() {
+		w.mutex.Lock()
+		w.syncing = false
+		w.synced.Broadcast()
+		w.mutex.Unlock()
+	}
+
+	committed := make(chan error, 1)
+	go func() {
+		batch := db.NewColumnFamilyBatch()
+		batch.Put(users, []byte("user:1"), []byte("alice"))
+		batch.Put(nil, []byte("count"), []byte("1"))
+		committed <- batch.Commit()
+	}()
+	for {
+		w.mutex.Lock()
+		waiting := w.pending != nil
+		w.mutex.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := users.Get([]byte("user:0"))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		release()
+		t.Fatal("expected reads to go on while a batch waits for its sync")
+	}
+	if _, err := users.Get([]byte("user:1")); err == nil {
+		t.Fatal("expected the batch to be unreadable before its sync")
+	}
+
+	release()
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+	if v, err := users.Get([]byte("user:1")); err != nil || string(v) != "alice" {
+		t.Fatalf("expected user:1=alice, got %q (%v)", v, err)
+	}
+	if v, err := db.Get([]byte("count")); err != nil || string(v) != "1" {
+		t.Fatalf("expected count=1, got %q (%v)", v, err)
+	}
+}
@@ -0,0 +1,607 @@
+package velocity
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Compaction settings
+const (
+	// L0CompactionTrigger is the number of level 0 tables that makes level 0
+	// due for compaction.
+	L0CompactionTrigger = 4
+
+	// DefaultTargetFileSize is the approximate size of the tables compaction
+	// writes; the merged output is split at key boundaries once it is reached.
+	DefaultTargetFileSize = 4 * 1024 * 1024 // 4MB
+
+	// DefaultLevelBaseSize is the target size of level 1. Each further level
+	// may grow CompactionRatio times larger than the one above it.
+	DefaultLevelBaseSize = 64 * 1024 * 1024 // 64MB
+
+	// DefaultCompactionRateLimit caps compaction I/O in bytes per second so
+	// foreground reads and writes keep a steady share of the disk.
+	DefaultCompactionRateLimit = 32 * 1024 * 1024 // 32MB/s
+)
+
+// compactionLoop runs in the background and performs compaction when levels
+// exceed size thresholds. Flushes and stalled writers signal it; the ticker
+// catches up on work nobody signals, like value log GC.
+func (db *DB) compactionLoop() {
+	ticker := time.NewTicker(10 * time.Second) // Check every 10 seconds
+	defer ticker.Stop()
+	shutdownCh := db.shutdownCh
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.compactCh:
+		case <-shutdownCh:
+			return
+		}
+		// Keep going while levels are over their targets.
+		for db.performCompaction() {
+			select {
+			case <-shutdownCh:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// performCompaction compacts the level that is furthest over its target, if
+// any. Level 0 is scored by table count, since its tables overlap and every
+// one of them costs a lookup; deeper levels are scored by size. It reports
+// whether an over-target level was compacted, so more may be due.
+func (db *DB) performCompaction() bool {
+	if db.compacting.Load() {
+		return false // Already compacting
+	}
+	db.compacting.Store(true)
+	defer db.compacting.Store(false)
+
+	db.mutex.RLock()
+	bestLevel, bestScore := -1, 1.0
+	for level := 0; level < MaxLevels-1 && level < len(db.levels); level++ {
+		if score := db.levelScoreLocked(level); score >= bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	due := bestLevel >= 0
+	var input *SSTable
+	if bestLevel > 0 {
+		input = db.pickCompactionInputLocked(bestLevel)
+	} else if bestLevel < 0 {
+		bestLevel, input = db.pickValueLogGCInputLocked()
+	}
+	db.mutex.RUnlock()
+
+	switch {
+	case bestLevel == 0:
+		return db.compactLevel(0) && due
+	case input != nil:
+		return db.compactTables(bestLevel, []*SSTable{input}) && due
+	}
+	return false
+}
+
+// levelScoreLocked returns how far a level is over its target; at 1 or more
+// it is due for compaction. Callers hold db.mutex.
+func (db *DB) levelScoreLocked(level int) float64 {
+	if level == 0 {
+		return float64(len(db.levels[0])) / float64(db.l0CompactionTrigger())
+	}
+	return float64(levelSize(db.levels[level])) / float64(levelMaxBytes(level))
+}
+
+// levelMaxBytes returns the target size of a level below level 0.
+func levelMaxBytes(level int) int64 {
+	size := int64(DefaultLevelBaseSize)
+	for i := 1; i < level; i++ {
+		size *= CompactionRatio
+	}
+	return size
+}
+
+// levelSize returns the total file size of the given tables.
+func levelSize(sstables []*SSTable) int64 {
+	var total int64
+	for _, sst := range sstables {
+		total += sst.size
+	}
+	return total
+}
+
+// pickCompactionInputLocked chooses the next table of a level to push down.
+// Tables are taken in key order, resuming after the last compacted key, so
+// every part of the key space is compacted in turn. Callers hold db.mutex.
+func (db *DB) pickCompactionInputLocked(level int) *SSTable {
+	pointer := db.compactPointers[level]
+	var first, next *SSTable
+	for _, sst := range db.levels[level] {
+		if first == nil || compareKeys(sst.minKey, first.minKey) < 0 {
+			first = sst
+		}
+		if pointer != nil && compareKeys(sst.minKey, pointer) > 0 &&
+			(next == nil || compareKeys(sst.minKey, next.minKey) < 0) {
+			next = sst
+		}
+	}
+	if next != nil {
+		return next
+	}
+	return first
+}
+
+// pickValueLogGCInputLocked chooses a table that points into the value log
+// file with the most garbage, so that compacting it moves the file's live
+// values out. It returns level 0 without a table when the table is in level
+// 0, which is only compacted as a whole. Tables of the last level are never
+// rewritten, so a file only they point into stays until their keys change.
+// Callers hold db.mutex.
+func (db *DB) pickValueLogGCInputLocked() (int, *SSTable) {
+	for _, id := range db.values.mostGarbage() {
+		for level := 0; level < MaxLevels-1 && level < len(db.levels); level++ {
+			for _, sst := range db.levels[level] {
+				i := sort.Search(len(sst.valueLogs), func(i int) bool { return sst.valueLogs[i] >= id })
+				if i == len(sst.valueLogs) || sst.valueLogs[i] != id {
+					continue
+				}
+				if level == 0 {
+					return 0, nil
+				}
+				return level, sst
+			}
+		}
+	}
+	return -1, nil
+}
+
+// compactLevel merges every table of level into level+1. It reports whether
+// the level was compacted.
+func (db *DB) compactLevel(level int) bool {
+	if level >= MaxLevels-1 {
+		return false
+	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.mutex.RLock()
+	inputs := append([]*SSTable(nil), db.levels[level]...)
+	db.mutex.RUnlock()
+	return db.compactTablesLocked(level, inputs)
+}
+
+// compactTables merges inputs, which belong to level, into level+1.
+func (db *DB) compactTables(level int, inputs []*SSTable) bool {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	return db.compactTablesLocked(level, inputs)
+}
+
+// compactTablesLocked merges inputs, which belong to level, with the tables
+// of level+1 whose key ranges overlap them, and replaces all of them with new
+// tables in level+1. The merge streams through a MergedIterator and writes
+// tables of about the target file size, so memory use does not grow with the
+// size of the level. Callers hold db.compactMu.
+func (db *DB) compactTablesLocked(level int, inputs []*SSTable) bool {
+	if level >= MaxLevels-1 || len(inputs) == 0 {
+		return false
+	}
+
+	// Pick the overlapping tables of the next level, and the tables of the
+	// levels below it, which decide whether tombstones are still needed.
+	db.mutex.RLock()
+	if len(removeTables(inputs, db.levels[level])) > 0 {
+		// An input was compacted away since it was picked.
+		db.mutex.RUnlock()
+		return false
+	}
+	smallest, largest := keyRange(inputs)
+	var overlapping []*SSTable
+	for _, sst := range db.levels[level+1] {
+		if compareKeys(sst.maxKey, smallest) >= 0 && compareKeys(sst.minKey, largest) <= 0 {
+			overlapping = append(overlapping, sst)
+		}
+	}
+	var lower []*SSTable
+	for l := level + 2; l < len(db.levels); l++ {
+		lower = append(lower, db.levels[l]...)
+	}
+	sources := append(append([]*SSTable(nil), inputs...), overlapping...)
+	// Range tombstones may still hide keys in any table at or below the
+	// input level that is not being rewritten.
+	var others []*SSTable
+	for l := level; l < len(db.levels); l++ {
+		others = append(others, removeTables(db.levels[l], sources)...)
+	}
+	for _, sst := range sources {
+		sst.ref()
+	}
+	db.mutex.RUnlock()
+	defer func() {
+		for _, sst := range sources {
+			sst.unref()
+		}
+	}()
+
+	iterators := make([]*SSTableIterator, 0, len(sources))
+	for _, sst := range sources {
+		iter, err := NewSSTableIterator(sst)
+		if err != nil {
+			log.Printf("velocity: compaction of level %d aborted: %v", level, err)
+			return false
+		}
+		iterators = append(iterators, iter)
+	}
+	merged := NewMergedIterator(iterators...)
+	out := &compactionOutput{
+		db:       db,
+		level:    level + 1,
+		throttle: newCompactionThrottle(db.compactionRateLimit),
+		pointed:  make(map[uint64]int64),
+	}
+	// Bytes of each value log file the inputs point to; what the output no
+	// longer points to becomes garbage.
+	pointed := make(map[uint64]int64)
+
+	// The versions of a key arrive next to each other. Snapshots are read
+	// after the input tables were chosen; any snapshot pinned later only
+	// needs the newest versions, which are always kept.
+	snapshots := db.liveSnapshots()
+	var rangeDels []rangeTombstone
+	for _, sst := range sources {
+		rangeDels = append(rangeDels, sst.rangeDels...)
+	}
+	// Tombstones are dropped once no snapshot can read below them and no
+	// other table holds keys they might still hide.
+	for _, t := range rangeDels {
+		if len(snapshots) > 0 || overlapsTombstone(others, t) {
+			out.rangeDels = append(out.rangeDels, t)
+		}
+	}
+	now := uint64(time.Now().UnixNano())
+	var group []*Entry
+	emit := func() error {
+		if len(rangeDels) > 0 {
+			group = dropRangeDeleted(group, rangeDels, snapshots)
+		}
+		if len(group) == 0 {
+			return nil
+		}
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Timestamp > group[j].Timestamp })
+		if group[0].kind == entryKindMerge {
+			// The value the operands fold into may be in the value log.
+			for i := range group {
+				if group[i].kind == entryKindValuePointer {
+					resolved, err := db.values.resolve(group[i])
+					if err != nil {
+						return err
+					}
+					group[i] = resolved
+				}
+				if group[i].kind != entryKindMerge {
+					break
+				}
+			}
+			group = db.foldMergeVersions(group, snapshots, !mayContainKey(lower, group[0].Key))
+		}
+		kept := retainVersions(group, snapshots)
+		if len(kept) == 1 {
+			// Entries with ExpiresAt=0 never expire. An expired version that
+			// shadows older ones kept for snapshots must stay, or those would
+			// reappear.
+			if kept[0].ExpiresAt > 0 && kept[0].ExpiresAt < now {
+				return nil
+			}
+			// A tombstone only has to outlive the values it shadows, which
+			// can only be in deeper levels.
+			if kept[0].Deleted && !mayContainKey(lower, kept[0].Key) {
+				return nil
+			}
+			filtered, err := db.applyCompactionFilters(kept[0], level+1, snapshots, lower)
+			if err != nil || filtered == nil {
+				return err
+			}
+			kept[0] = filtered
+		}
+		return out.add(kept)
+	}
+	var err error
+	for err == nil && merged.Next() {
+		entry := merged.Entry()
+		if entry.kind == entryKindValuePointer {
+			if ptr, perr := decodeValuePointer(entry.Value); perr == nil {
+				pointed[ptr.file] += int64(ptr.size)
+			}
+		}
+		if len(group) > 0 && !bytes.Equal(group[0].Key, entry.Key) {
+			err = emit()
+			group = group[:0]
+		}
+		group = append(group, entry)
+	}
+	if err == nil {
+		err = merged.Err()
+	}
+	if err == nil {
+		err = emit()
+	}
+	if err == nil {
+		err = out.finish(true)
+	}
+	if err == nil && out.values != nil {
+		err = out.values.finish()
+	}
+	if err == nil {
+		// The manifest decides which tables survive a crash from here on.
+		edit := manifestEdit{}
+		for _, sst := range sources {
+			edit.Removed = append(edit.Removed, filepath.Base(sst.path))
+		}
+		for _, sst := range out.tables {
+			edit.Added = append(edit.Added, manifestTableFor(sst, level+1))
+		}
+		err = db.logEdit(edit)
+	}
+	if err != nil {
+		out.abort()
+		log.Printf("velocity: compaction of level %d aborted: %v", level, err)
+		return false
+	}
+
+	for _, sst := range out.tables {
+		db.attachTable(sst)
+	}
+	db.counters.compactions.Add(1)
+	db.counters.compactionBytesRead.Add(uint64(levelSize(sources)))
+	db.counters.compactionBytesWritten.Add(uint64(levelSize(out.tables)))
+	garbage := make(map[uint64]int64, len(pointed))
+	for id, n := range pointed {
+		if n > out.pointed[id] {
+			garbage[id] = n - out.pointed[id]
+		}
+	}
+	db.values.addGarbage(garbage)
+
+	// Swap the tables atomically. Tables flushed into level 0 meanwhile are
+	// not among the inputs and stay in place.
+	db.mutex.Lock()
+	db.levels[level] = removeTables(db.levels[level], inputs)
+	next := append(removeTables(db.levels[level+1], overlapping), out.tables...)
+	sort.Slice(next, func(i, j int) bool { return compareKeys(next[i].minKey, next[j].minKey) < 0 })
+	db.levels[level+1] = next
+	if level > 0 {
+		db.compactPointers[level] = append([]byte(nil), largest...)
+	}
+	db.updateRangeDelsLocked()
+	db.wakeWritersLocked()
+	db.mutex.Unlock()
+
+	// Iterators pin the tables they read, so retired tables outlive them.
+	for _, sst := range sources {
+		sst.retire()
+	}
+	return true
+}
+
+// keyRange returns the smallest and largest key of the given tables.
+func keyRange(sstables []*SSTable) (smallest, largest []byte) {
+	for i, sst := range sstables {
+		if i == 0 || compareKeys(sst.minKey, smallest) < 0 {
+			smallest = sst.minKey
+		}
+		if i == 0 || compareKeys(sst.maxKey, largest) > 0 {
+			largest = sst.maxKey
+		}
+	}
+	return smallest, largest
+}
+
+// mayContainKey reports whether any of the tables may hold key.
+func mayContainKey(sstables []*SSTable, key []byte) bool {
+	for _, sst := range sstables {
+		if compareKeys(key, sst.minKey) >= 0 && compareKeys(key, sst.maxKey) <= 0 && sst.bloomFilter.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropRangeDeleted removes the versions that a range tombstone deletes for
+// every reader: those older than the tombstone that no snapshot taken before
+// the tombstone reads.
+func dropRangeDeleted(versions []*Entry, rangeDels []rangeTombstone, snapshots []uint64) []*Entry {
+	kept := versions[:0]
+	for _, e := range versions {
+		deleted := false
+		for _, t := range rangeDels {
+			if t.Timestamp > e.Timestamp && t.contains(e.Key) && !snapshotBetween(snapshots, e.Timestamp, t.Timestamp) {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// snapshotBetween reports whether a snapshot in the ascending list reads at
+// a timestamp in [from, to).
+func snapshotBetween(snapshots []uint64, from, to uint64) bool {
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i] >= from })
+	return i < len(snapshots) && snapshots[i] < to
+}
+
+// overlapsTombstone reports whether any of the tables may hold keys in the
+// tombstone's range.
+func overlapsTombstone(sstables []*SSTable, t rangeTombstone) bool {
+	for _, sst := range sstables {
+		if compareKeys(sst.maxKey, t.Start) >= 0 && compareKeys(sst.minKey, t.End) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// removeTables returns level without the given tables.
+func removeTables(level, remove []*SSTable) []*SSTable {
+	kept := make([]*SSTable, 0, len(level))
+	for _, sst := range level {
+		drop := false
+		for _, r := range remove {
+			if sst == r {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			kept = append(kept, sst)
+		}
+	}
+	return kept
+}
+
+// compactionOutput collects merged entries into tables of about the target
+// file size. The versions of a key never span two tables, since reads stop
+// at the first table that has the key.
+type compactionOutput struct {
+	db       *DB
+	level    int
+	throttle *compactionThrottle
+	pending  []*Entry
+	size     int64
+	tables   []*SSTable
+
+	// rangeDels are the tombstones the output keeps. Each table holds the
+	// part of them from lower, just past the previous table's last key, up
+	// to its own last key, so the tables of the level stay disjoint.
+	rangeDels []rangeTombstone
+	lower     []byte
+
+	// values receives the values the output moves to the value log, and
+	// pointed counts the bytes of each file the output still points to.
+	values  *valueLogWriter
+	pointed map[uint64]int64
+}
+
+func (o *compactionOutput) add(versions []*Entry) error {
+	for _, e := range versions {
+		e, err := o.separate(e)
+		if err != nil {
+			return err
+		}
+		o.pending = append(o.pending, e)
+		o.size += int64(len(e.Key) + len(e.Value) + blockRecordOverhead)
+	}
+	if o.size >= o.db.targetFileSize {
+		return o.finish(false)
+	}
+	return nil
+}
+
+// separate returns the record to write for e. Values large enough for the
+// value log are moved there, and so are the values of value log files that
+// are mostly garbage; other pointers are kept as they are.
+func (o *compactionOutput) separate(e *Entry) (*Entry, error) {
+	values := o.db.values
+	if e.kind == entryKindValuePointer {
+		ptr, err := decodeValuePointer(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		if !values.collectable(ptr.file) {
+			o.pointed[ptr.file] += int64(ptr.size)
+			return e, nil
+		}
+		if e, err = values.resolve(e); err != nil {
+			return nil, err
+		}
+	}
+	if !values.separates(e) {
+		return e, nil
+	}
+	if o.values == nil {
+		w, err := values.newWriter()
+		if err != nil {
+			return nil, err
+		}
+		o.values = w
+	}
+	return o.values.add(e)
+}
+
+// finish writes the pending entries out as a table, with their share of the
+// range tombstones. The last table takes what is left of the tombstones.
+func (o *compactionOutput) finish(last bool) error {
+	var upper []byte
+	if !last && len(o.pending) > 0 {
+		upper = keySuccessor(o.pending[len(o.pending)-1].Key)
+	}
+	rangeDels := clipTombstones(o.rangeDels, o.lower, upper)
+	if len(o.pending) == 0 && len(rangeDels) == 0 {
+		return nil
+	}
+	sstPath := filepath.Join(o.db.path, fmt.Sprintf("sst_L%d_%d.db", o.level, time.Now().UnixNano()))
+	sst, err := newSSTable(sstPath, o.pending, rangeDels, o.db.crypto, o.db.sstOptions)
+	if err != nil {
+		return err
+	}
+	o.tables = append(o.tables, sst)
+	o.throttle.wait(sst.size)
+	o.pending = o.pending[:0]
+	o.size = 0
+	o.lower = upper
+	return nil
+}
+
+// abort removes the tables and the value log file written so far.
+func (o *compactionOutput) abort() {
+	for _, sst := range o.tables {
+		path := sst.path
+		sst.Close()
+		os.Remove(path)
+	}
+	o.tables = nil
+	if o.values != nil {
+		o.values.abort()
+		o.values = nil
+	}
+}
+
+// compactionThrottle paces compaction writes to a byte rate.
+type compactionThrottle struct {
+	mu      sync.Mutex
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+// newCompactionThrottle returns a throttle for rate bytes per second. A
+// non-positive rate disables throttling.
+func newCompactionThrottle(rate int64) *compactionThrottle {
+	return &compactionThrottle{rate: rate, start: time.Now()}
+}
+
+// wait accounts for n written bytes and sleeps until the average rate is
+// back under the limit.
+func (t *compactionThrottle) wait(n int64) {
+	if t.rate <= 0 {
+		return
+	}
+	t.mu.Lock()
+	t.written += n
+	due := t.start.Add(time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second)))
+	t.mu.Unlock()
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
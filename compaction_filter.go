@@ -0,0 +1,134 @@
+package velocity
+
+import (
+	"bytes"
+	"hash/crc32"
+	"math"
+	"sort"
+)
+
+// CompactionDecision is what a CompactionFilter does with an entry.
+type CompactionDecision int
+
+const (
+	// CompactionKeep writes the entry out unchanged.
+	CompactionKeep CompactionDecision = iota
+	// CompactionRemove deletes the key, as if Delete had been called when
+	// the entry was written.
+	CompactionRemove
+	// CompactionChangeValue writes the entry out with the returned value.
+	CompactionChangeValue
+)
+
+// CompactionEntry is the live value of a key that compaction is about to
+// rewrite.
+type CompactionEntry struct {
+	Level     int    // level the entry is written to
+	Key       []byte // must not be modified
+	Value     []byte // must not be modified
+	Timestamp uint64 // when the value was written, in Unix nanoseconds
+	ExpiresAt uint64 // TTL expiry in Unix nanoseconds; 0 means never
+}
+
+// CompactionFilter decides, for every live value compaction rewrites,
+// whether to keep, drop or rewrite it. Filters make data that is no longer
+// wanted leave the disk as compaction reaches it, without a scan. They are
+// not called for values still in the memtable or in level 0, for tombstones
+// and merge operands, or for versions a snapshot may read.
+type CompactionFilter interface {
+	// Name identifies the filter in logs and errors.
+	Name() string
+	// Filter returns the decision for e, and the new value for
+	// CompactionChangeValue. It runs on the compaction goroutine and must
+	// not call back into the database.
+	Filter(e CompactionEntry) (CompactionDecision, []byte)
+}
+
+// SetCompactionFilter registers f for every key starting with prefix; an
+// empty prefix matches every key. When several prefixes match, the filters
+// run longest prefix first, each seeing the value the one before returned,
+// until one removes the key. A nil f removes the registration.
+func (db *DB) SetCompactionFilter(prefix string, f CompactionFilter) {
+	db.compactionFilterMu.Lock()
+	defer db.compactionFilterMu.Unlock()
+	if f == nil {
+		delete(db.compactionFilters, prefix)
+		return
+	}
+	if db.compactionFilters == nil {
+		db.compactionFilters = make(map[string]CompactionFilter)
+	}
+	db.compactionFilters[prefix] = f
+}
+
+// compactionFiltersFor returns the filters registered for key, longest
+// prefix first.
+func (db *DB) compactionFiltersFor(key []byte) []CompactionFilter {
+	db.compactionFilterMu.RLock()
+	defer db.compactionFilterMu.RUnlock()
+	if len(db.compactionFilters) == 0 {
+		return nil
+	}
+	var prefixes []string
+	for prefix := range db.compactionFilters {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	filters := make([]CompactionFilter, len(prefixes))
+	for i, prefix := range prefixes {
+		filters[i] = db.compactionFilters[prefix]
+	}
+	return filters
+}
+
+// applyCompactionFilters runs the filters registered for the newest version
+// of a key that compaction writes to level. It returns the entry to write,
+// or nil to drop the key. A removed key that deeper levels may still hold
+// becomes a tombstone, so the older value does not come back. Versions a
+// snapshot may read are left alone.
+func (db *DB) applyCompactionFilters(e *Entry, level int, snapshots []uint64, lower []*SSTable) (*Entry, error) {
+	if e.Deleted || e.kind == entryKindMerge || snapshotBetween(snapshots, e.Timestamp, math.MaxUint64) {
+		return e, nil
+	}
+	filters := db.compactionFiltersFor(e.Key)
+	if len(filters) == 0 {
+		return e, nil
+	}
+	current := e
+	if e.kind == entryKindValuePointer {
+		resolved, err := db.values.resolve(e)
+		if err != nil {
+			return nil, err
+		}
+		current = resolved
+	}
+	value, changed := current.Value, false
+	for _, f := range filters {
+		decision, next := f.Filter(CompactionEntry{
+			Level:     level,
+			Key:       e.Key,
+			Value:     value,
+			Timestamp: e.Timestamp,
+			ExpiresAt: e.ExpiresAt,
+		})
+		switch decision {
+		case CompactionRemove:
+			if !mayContainKey(lower, e.Key) {
+				return nil, nil
+			}
+			tombstone := &Entry{Key: e.Key, Timestamp: e.Timestamp, Deleted: true}
+			tombstone.checksum = crc32.ChecksumIEEE(tombstone.Key)
+			return tombstone, nil
+		case CompactionChangeValue:
+			value, changed = append([]byte(nil), next...), true
+		}
+	}
+	if !changed {
+		return e, nil
+	}
+	rewritten := &Entry{Key: e.Key, Value: value, Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt}
+	rewritten.checksum = crc32.Update(crc32.ChecksumIEEE(rewritten.Key), crc32.IEEETable, rewritten.Value)
+	return rewritten, nil
+}
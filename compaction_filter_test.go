@@ -0,0 +1,87 @@
+package velocity
+
+import (
+	"bytes"
+	"testing"
+)
+
+// scrubFilter drops the keys of one data subject and redacts card numbers.
+type scrubFilter struct {
+	subject []byte
+	seen    int
+}
+
+func (f *scrubFilter) Name() string { return "scrub" }
+
+func (f *scrubFilter) Filter(e CompactionEntry) (CompactionDecision, []byte) {
+	f.seen++
+	switch {
+	case bytes.Contains(e.Key, f.subject):
+		return CompactionRemove, nil
+	case bytes.HasPrefix(e.Value, []byte("card:")):
+		return CompactionChangeValue, []byte("card:redacted")
+	}
+	return CompactionKeep, nil
+}
+
+func TestCompactionFilterRemovesAndRewritesValues(t *testing.T) {
+	db := newCompactionTestDB(t)
+	filter := &scrubFilter{subject: []byte(":alice:")}
+	db.SetCompactionFilter("user:", filter)
+
+	db.Put([]byte("user:alice:email"), []byte("alice@example.com"))
+	db.Put([]byte("user:bob:email"), []byte("bob@example.com"))
+	db.Put([]byte("user:bob:card"), []byte("card:4111"))
+	db.Put([]byte("other:alice:note"), []byte("card:1234"))
+	db.flushMemTable()
+	db.compactLevel(0)
+
+	if filter.seen != 3 {
+		t.Fatalf("expected the filter to see the 3 user keys, saw %d", filter.seen)
+	}
+	if _, err := db.Get([]byte("user:alice:email")); err == nil {
+		t.Fatal("expected the data subject's key to be removed")
+	}
+	for key, want := range map[string]string{
+		"user:bob:email":   "bob@example.com",
+		"user:bob:card":    "card:redacted",
+		"other:alice:note": "card:1234",
+	} {
+		if got, err := db.Get([]byte(key)); err != nil || string(got) != want {
+			t.Fatalf("%s: got %q (%v), want %q", key, got, err, want)
+		}
+	}
+}
+
+func TestCompactionFilterRemovalHidesDeeperVersions(t *testing.T) {
+	db := newCompactionTestDB(t)
+
+	db.Put([]byte("user:alice:name"), []byte("old"))
+	db.flushMemTable()
+	db.compactLevel(0)
+	db.compactLevel(1) // the old value now lives in level 2
+
+	db.Put([]byte("user:alice:name"), []byte("new"))
+	db.flushMemTable()
+	db.SetCompactionFilter("user:", &scrubFilter{subject: []byte(":alice:")})
+	db.compactLevel(0)
+
+	if _, err := db.Get([]byte("user:alice:name")); err == nil {
+		t.Fatal("expected the removed key to stay deleted, the level 2 value came back")
+	}
+}
+
+func TestCompactionFilterSkipsSnapshotVersions(t *testing.T) {
+	db := newCompactionTestDB(t)
+	db.SetCompactionFilter("", &scrubFilter{subject: []byte(":alice:")})
+
+	db.Put([]byte("user:alice:name"), []byte("alice"))
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	db.flushMemTable()
+	db.compactLevel(0)
+
+	if got, err := snap.Get([]byte("user:alice:name")); err != nil || string(got) != "alice" {
+		t.Fatalf("snapshot lost a version it reads: %q (%v)", got, err)
+	}
+}
@@ -0,0 +1,101 @@
+package velocity
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newCompactionTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := NewWithConfig(Config{Path: t.TempDir(), TargetFileSize: 8 * 1024, CompactionRateLimit: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestCompactionSplitsOutputAndRewritesOnlyOverlaps(t *testing.T) {
+	db := newCompactionTestDB(t)
+
+	for i := 0; i < 400; i++ {
+		db.Put([]byte(fmt.Sprintf("a:%04d", i)), []byte(fmt.Sprintf("value-%04d-padding-padding", i)))
+	}
+	db.Put([]byte("z:0001"), []byte("far away"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.compactLevel(0)
+	if len(db.levels[1]) < 2 {
+		t.Fatalf("expected compaction output split into several tables, got %d", len(db.levels[1]))
+	}
+	untouched := db.levels[1][len(db.levels[1])-1]
+
+	db.Put([]byte("a:0005"), []byte("updated"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.compactLevel(0)
+
+	found := false
+	for _, sst := range db.levels[1] {
+		if sst == untouched {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected a table outside the compacted key range to be left alone")
+	}
+	for i := 1; i < len(db.levels[1]); i++ {
+		if compareKeys(db.levels[1][i-1].maxKey, db.levels[1][i].minKey) >= 0 {
+			t.Fatalf("level 1 tables overlap: %s >= %s", db.levels[1][i-1].maxKey, db.levels[1][i].minKey)
+		}
+	}
+	if v, err := db.Get([]byte("a:0005")); err != nil || string(v) != "updated" {
+		t.Fatalf("expected updated value, got %q (%v)", v, err)
+	}
+	if v, err := db.Get([]byte("a:0399")); err != nil || string(v) != "value-0399-padding-padding" {
+		t.Fatalf("expected original value, got %q (%v)", v, err)
+	}
+}
+
+func TestCompactionDropsTombstonesAtBottom(t *testing.T) {
+	db := newCompactionTestDB(t)
+
+	countTombstones := func(level int, key string) int {
+		n := 0
+		for _, sst := range db.levels[level] {
+			sst.forEachVersion([]byte(key), func(IndexEntry) bool {
+				n++
+				return true
+			})
+		}
+		return n
+	}
+
+	db.Put([]byte("deep"), []byte("v"))
+	db.flushMemTable()
+	db.compactLevel(0)
+	db.compactLevel(1) // "deep" now lives in level 2
+
+	db.Delete([]byte("deep"))
+	db.Put([]byte("shallow"), []byte("v"))
+	db.flushMemTable()
+	db.compactLevel(0)
+	db.Delete([]byte("shallow"))
+	db.flushMemTable()
+	db.compactLevel(0)
+
+	if n := countTombstones(1, "deep"); n != 1 {
+		t.Fatalf("expected the tombstone shadowing level 2 to be kept, found %d", n)
+	}
+	if n := countTombstones(1, "shallow"); n != 0 {
+		t.Fatalf("expected the tombstone with nothing below it to be dropped, found %d", n)
+	}
+	if _, err := db.Get([]byte("deep")); err == nil {
+		t.Fatal("expected deleted key to stay deleted")
+	}
+	if _, err := db.Get([]byte("shallow")); err == nil {
+		t.Fatal("expected deleted key to stay deleted")
+	}
+}
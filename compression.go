@@ -0,0 +1,201 @@
+package velocity
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// CompressionType selects the codec applied to SSTable data blocks before
+// they are encrypted.
+type CompressionType uint8
+
+const (
+	// CompressionDefault uses the built-in LZ4 codec.
+	CompressionDefault CompressionType = iota
+	// CompressionNone stores blocks uncompressed.
+	CompressionNone
+	// CompressionLZ4 uses a pure-Go implementation of the LZ4 block format.
+	CompressionLZ4
+)
+
+func (c CompressionType) String() string {
+	switch c {
+	case CompressionDefault:
+		return "default"
+	case CompressionNone:
+		return "none"
+	case CompressionLZ4:
+		return "lz4"
+	default:
+		return fmt.Sprintf("compression(%d)", uint8(c))
+	}
+}
+
+// resolve maps CompressionDefault to the concrete codec written to disk.
+func (c CompressionType) resolve() CompressionType {
+	if c == CompressionDefault {
+		return CompressionLZ4
+	}
+	return c
+}
+
+// compressBlock compresses src with codec, appending to dst. It returns the
+// codec actually used: blocks that do not shrink are stored uncompressed.
+func compressBlock(dst, src []byte, codec CompressionType) ([]byte, CompressionType) {
+	if codec.resolve() == CompressionLZ4 {
+		out := lz4CompressBlock(dst, src)
+		if len(out)-len(dst) < len(src) {
+			return out, CompressionLZ4
+		}
+		dst = out[:len(dst)]
+	}
+	return append(dst, src...), CompressionNone
+}
+
+// decompressBlock reverses compressBlock for a block of rawLen bytes.
+func decompressBlock(src []byte, codec CompressionType, rawLen int) ([]byte, error) {
+	switch codec {
+	case CompressionNone:
+		if len(src) != rawLen {
+			return nil, fmt.Errorf("compression: stored block is %d bytes, expected %d", len(src), rawLen)
+		}
+		return src, nil
+	case CompressionLZ4:
+		return lz4DecompressBlock(make([]byte, 0, rawLen), src, rawLen)
+	default:
+		return nil, fmt.Errorf("compression: unknown codec %d", codec)
+	}
+}
+
+// LZ4 block format constants. A match needs at least lz4MinMatch bytes, the
+// last lz4LastLiterals bytes of a block are always literals, and no match may
+// start within the last lz4MFLimit bytes.
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5
+	lz4MFLimit      = 12
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 14
+)
+
+// lz4CompressBlock appends the LZ4 block encoding of src to dst using a
+// single-probe hash table, which favours speed over ratio.
+func lz4CompressBlock(dst, src []byte) []byte {
+	if len(src) < lz4MFLimit+1 {
+		return lz4AppendSequence(dst, src, 0, 0)
+	}
+	var table [1 << lz4HashLog]int32
+	anchor := 0
+	limit := len(src) - lz4MFLimit
+	for i := 0; i < limit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		matchLen := lz4MinMatch
+		for i+matchLen < len(src)-lz4LastLiterals && src[ref+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, matchLen)
+		i += matchLen
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence writes literals followed by a match of matchLen bytes at
+// offset. A zero matchLen writes the final, literals-only sequence.
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	litLen := len(literals)
+	token := byte(min(litLen, 15)) << 4
+	if matchLen > 0 {
+		token |= byte(min(matchLen-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	if litLen >= 15 {
+		dst = lz4AppendLength(dst, litLen-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, matchLen-lz4MinMatch-15)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+// lz4DecompressBlock appends the decoded form of an LZ4 block to dst and
+// checks that it decodes to exactly rawLen bytes.
+func lz4DecompressBlock(dst, src []byte, rawLen int) ([]byte, error) {
+	start := len(dst)
+	readLength := func(i int, n int) (int, int, error) {
+		for {
+			if i >= len(src) {
+				return 0, 0, fmt.Errorf("compression: truncated lz4 length")
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if b != 255 {
+				return i, n, nil
+			}
+		}
+	}
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		litLen := int(token >> 4)
+		var err error
+		if litLen == 15 {
+			if i, litLen, err = readLength(i, litLen); err != nil {
+				return nil, err
+			}
+		}
+		if litLen > len(src)-i || len(dst)-start+litLen > rawLen {
+			return nil, fmt.Errorf("compression: lz4 literals out of range")
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		if i == len(src) {
+			break // last sequence carries literals only
+		}
+		if i+2 > len(src) {
+			return nil, fmt.Errorf("compression: truncated lz4 offset")
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			if i, matchLen, err = readLength(i, matchLen); err != nil {
+				return nil, err
+			}
+		}
+		matchLen += lz4MinMatch
+		if offset == 0 || offset > len(dst)-start || len(dst)-start+matchLen > rawLen {
+			return nil, fmt.Errorf("compression: lz4 match out of range")
+		}
+		// Byte by byte: a match may overlap the bytes it produces.
+		pos := len(dst) - offset
+		for k := 0; k < matchLen; k++ {
+			dst = append(dst, dst[pos+k])
+		}
+	}
+	if len(dst)-start != rawLen {
+		return nil, fmt.Errorf("compression: lz4 block decoded to %d bytes, expected %d", len(dst)-start, rawLen)
+	}
+	return dst, nil
+}
@@ -81,12 +81,11 @@ func (cp *CryptoProvider) Decrypt(nonce, ciphertext, aad []byte) ([]byte, error)
 	return cp.aead.Open(nil, nonce, ciphertext, aad)
 }
 
-func buildEntryAAD(key []byte, timestamp uint64, expiresAt uint64, deleted bool) []byte {
+func buildEntryAAD(key []byte, timestamp uint64, expiresAt uint64, flag byte) []byte {
 	var (
-		aad        = make([]byte, 0, len(key)+21)
-		tmp32      [4]byte
-		tmp64      [8]byte
-		deleteByte byte
+		aad   = make([]byte, 0, len(key)+21)
+		tmp32 [4]byte
+		tmp64 [8]byte
 	)
 	binary.LittleEndian.PutUint32(tmp32[:], uint32(len(key)))
 	aad = append(aad, tmp32[:]...)
@@ -95,10 +94,7 @@ func buildEntryAAD(key []byte, timestamp uint64, expiresAt uint64, deleted bool)
 	aad = append(aad, tmp64[:]...)
 	binary.LittleEndian.PutUint64(tmp64[:], expiresAt)
 	aad = append(aad, tmp64[:]...)
-	if deleted {
-		deleteByte = 1
-	}
-	aad = append(aad, deleteByte)
+	aad = append(aad, flag)
 	return aad
 }
 
@@ -482,3 +478,22 @@ func equalBytes(a, b []byte) bool {
 	}
 	return result == 0
 }
+
+// buildBlockAAD binds an SSTable data block to its position in the file and
+// its encoding, so blocks cannot be swapped or relabelled undetected.
+func buildBlockAAD(offset uint64, codec CompressionType, rawLen uint32) []byte {
+	aad := make([]byte, 13)
+	binary.LittleEndian.PutUint64(aad[0:8], offset)
+	aad[8] = byte(codec)
+	binary.LittleEndian.PutUint32(aad[9:13], rawLen)
+	return aad
+}
+
+// buildValueLogAAD binds a value log record to the key and version it was
+// written for, so a pointer cannot be made to resolve to another value.
+func buildValueLogAAD(key []byte, timestamp uint64) []byte {
+	aad := make([]byte, 0, len(key)+12)
+	aad = binary.LittleEndian.AppendUint32(aad, uint32(len(key)))
+	aad = append(aad, key...)
+	return binary.LittleEndian.AppendUint64(aad, timestamp)
+}
@@ -2,6 +2,7 @@ package velocity
 
 import (
 	"encoding/binary"
+	"fmt"
 	"unsafe"
 )
 
@@ -23,10 +24,23 @@ func NewBloomFilter(expectedItems int, bitsPerItem int) *BloomFilter {
 	return &BloomFilter{
 		bits: make([]uint64, (size+63)/64),
 		size: size,
-		hash: 2, // Number of hash functions
+		hash: bloomHashCount(bitsPerItem),
 	}
 }
 
+// bloomHashCount returns the number of hash functions that gives the lowest
+// false positive rate at bitsPerItem bits per key: bitsPerItem * ln 2.
+func bloomHashCount(bitsPerItem int) uint64 {
+	k := uint64(float64(bitsPerItem)*0.69 + 0.5)
+	if k < 1 {
+		return 1
+	}
+	if k > 30 {
+		return 30
+	}
+	return k
+}
+
 func (bf *BloomFilter) Add(key []byte) {
 	h1, h2 := bf.hash1(key), bf.hash2(key)
 	for i := uint64(0); i < bf.hash; i++ {
@@ -66,6 +80,34 @@ func (bf *BloomFilter) Marshal() []byte {
 	return buf
 }
 
+// unmarshalBloomFilter decodes a filter written by Marshal. It returns the
+// filter and ignores any bytes after it.
+func unmarshalBloomFilter(data []byte) (*BloomFilter, error) {
+	bf, _, err := decodeBloomFilter(data)
+	return bf, err
+}
+
+// decodeBloomFilter decodes a filter written by Marshal at the start of data
+// and returns the bytes after it.
+func decodeBloomFilter(data []byte) (*BloomFilter, []byte, error) {
+	if len(data) < 16 {
+		return nil, nil, fmt.Errorf("bloom filter truncated")
+	}
+	bf := &BloomFilter{
+		size: binary.LittleEndian.Uint64(data[0:8]),
+		hash: binary.LittleEndian.Uint64(data[8:16]),
+	}
+	words := (bf.size + 63) / 64
+	if bf.size == 0 || words > uint64(len(data)-16)/8 {
+		return nil, nil, fmt.Errorf("bloom filter truncated")
+	}
+	bf.bits = make([]uint64, words)
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(data[16+i*8:])
+	}
+	return bf, data[16+words*8:], nil
+}
+
 // Vectorized hash function for better distribution
 func fastHash(data []byte) uint64 {
 	const (
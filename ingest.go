@@ -0,0 +1,291 @@
+package velocity
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SSTableWriter builds an SSTable outside the write path, for loading with
+// IngestExternalFiles. Keys must be added in increasing order. Each entry is
+// written to the table's current data block as it is added and full blocks
+// go to disk, so only the keys are held in memory until Finish completes the
+// table.
+type SSTableWriter struct {
+	path      string
+	crypto    *CryptoProvider
+	opts      SSTableOptions
+	timestamp uint64
+	builder   *sstableBuilder
+	last      []byte
+	count     int
+	finished  bool
+}
+
+// NewSSTableWriter returns a writer for an SSTable at path, encrypted with
+// the master key of the database it will be ingested into.
+func NewSSTableWriter(path string, key []byte, opts SSTableOptions) (*SSTableWriter, error) {
+	crypto, err := newCryptoProvider(key)
+	if err != nil {
+		return nil, err
+	}
+	return newSSTableWriter(path, crypto, opts), nil
+}
+
+// NewSSTableWriter returns a writer for an SSTable at path that db can
+// ingest, using its encryption key and SSTable options.
+func (db *DB) NewSSTableWriter(path string) *SSTableWriter {
+	return newSSTableWriter(path, db.crypto, db.sstOptions)
+}
+
+func newSSTableWriter(path string, crypto *CryptoProvider, opts SSTableOptions) *SSTableWriter {
+	return &SSTableWriter{path: path, crypto: crypto, opts: opts, timestamp: nextEntryTimestamp()}
+}
+
+// Put adds key with value.
+func (w *SSTableWriter) Put(key, value []byte) error {
+	e := &Entry{Key: key, Value: value}
+	e.checksum = crc32.Update(crc32.ChecksumIEEE(e.Key), crc32.IEEETable, e.Value)
+	return w.add(e)
+}
+
+// Delete adds a tombstone for key, which hides the key in older data once
+// the table is ingested.
+func (w *SSTableWriter) Delete(key []byte) error {
+	e := &Entry{Key: key, Deleted: true}
+	e.checksum = crc32.ChecksumIEEE(e.Key)
+	return w.add(e)
+}
+
+// add writes e to the table, which is created with the first key. A failed
+// write aborts the writer.
+func (w *SSTableWriter) add(e *Entry) error {
+	if w.finished {
+		return fmt.Errorf("velocity: sstable writer for %s is finished", w.path)
+	}
+	if len(e.Key) == 0 {
+		return fmt.Errorf("velocity: empty key")
+	}
+	if w.count > 0 && compareKeys(e.Key, w.last) <= 0 {
+		return fmt.Errorf("velocity: key %q is not after %q", e.Key, w.last)
+	}
+	if w.builder == nil {
+		b, err := newSSTableBuilder(w.path, w.crypto, w.opts)
+		if err != nil {
+			return err
+		}
+		w.builder = b
+	}
+	e.Timestamp = w.timestamp
+	if err := w.builder.add(e); err != nil {
+		w.Abort()
+		return err
+	}
+	w.last = append(w.last[:0], e.Key...)
+	w.count++
+	return nil
+}
+
+// Len returns the number of keys added.
+func (w *SSTableWriter) Len() int {
+	return w.count
+}
+
+// Finish writes the rest of the table and syncs it to disk.
+func (w *SSTableWriter) Finish() error {
+	if w.finished {
+		return fmt.Errorf("velocity: sstable writer for %s is finished", w.path)
+	}
+	if w.count == 0 {
+		return fmt.Errorf("velocity: no keys were added to %s", w.path)
+	}
+	w.finished = true
+	sst, err := w.builder.finish(nil)
+	w.builder = nil
+	if err != nil {
+		return err
+	}
+	return sst.Close()
+}
+
+// Abort stops the writer and removes the partly written table. It does
+// nothing once Finish has been called.
+func (w *SSTableWriter) Abort() {
+	w.finished = true
+	if w.builder != nil {
+		w.builder.abort()
+		w.builder = nil
+	}
+}
+
+// IngestExternalFiles adds SSTables built by SSTableWriter to the database
+// without passing their entries through the WAL and memtable. Each file is
+// checked, linked or copied into the database directory, and placed in the
+// deepest level that holds no overlapping keys; the files are added in one
+// manifest edit, so either all of them become visible or none does.
+//
+// Ingested entries are newer than everything written before the call. The
+// memtable is flushed first if it overlaps a file; files that overlap each
+// other are rejected. The source files are left in place.
+func (db *DB) IngestExternalFiles(paths []string) error {
+	if db.closed.Load() {
+		return fmt.Errorf("database is closed")
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	// Bring the files into the directory before taking any lock.
+	tables := make([]*SSTable, 0, len(paths))
+	staged := make([]string, 0, len(paths))
+	cleanup := func() {
+		for _, sst := range tables {
+			sst.Close()
+		}
+		for _, path := range staged {
+			os.Remove(path)
+		}
+	}
+	for i, path := range paths {
+		tmp := filepath.Join(db.path, fmt.Sprintf("sst_ingest_%d.db.tmp.%d", time.Now().UnixNano(), i))
+		if err := linkOrCopyFile(path, tmp); err != nil {
+			cleanup()
+			return fmt.Errorf("velocity: ingest %s: %w", path, err)
+		}
+		staged = append(staged, tmp)
+		sst, err := loadVerifiedSSTable(tmp, db.crypto)
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("velocity: ingest %s: %w", path, err)
+		}
+		tables = append(tables, sst)
+		if sst.entryCount == 0 || len(sst.rangeDels) > 0 || sst.minKey == nil {
+			cleanup()
+			return fmt.Errorf("velocity: ingest %s: not a table written by SSTableWriter", path)
+		}
+	}
+	order := append([]*SSTable(nil), tables...)
+	sort.Slice(order, func(i, j int) bool { return compareKeys(order[i].minKey, order[j].minKey) < 0 })
+	for i := 1; i < len(order); i++ {
+		if compareKeys(order[i].minKey, order[i-1].maxKey) <= 0 {
+			cleanup()
+			return fmt.Errorf("velocity: ingested files overlap at key %q", order[i].minKey)
+		}
+	}
+
+	// Compaction must not move tables while levels are picked.
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.mutex.Lock()
+	for attempt := 0; db.memTablesOverlapLocked(tables); attempt++ {
+		db.mutex.Unlock()
+		if attempt == 3 {
+			cleanup()
+			return fmt.Errorf("velocity: ingest: keys in the ingested range keep being written")
+		}
+		if err := db.flushMemTable(); err != nil {
+			cleanup()
+			return err
+		}
+		db.mutex.Lock()
+	}
+	defer db.mutex.Unlock()
+
+	timestamp := nextEntryTimestamp()
+	levels := make([]int, len(tables))
+	var edit manifestEdit
+	for i, sst := range tables {
+		levels[i] = db.ingestLevelLocked(sst)
+		name := fmt.Sprintf("sst_L%d_%d.db", levels[i], time.Now().UnixNano())
+		path := filepath.Join(db.path, name)
+		if err := os.Rename(staged[i], path); err != nil {
+			cleanup()
+			return err
+		}
+		staged[i], sst.path = path, path
+		sst.globalTimestamp = timestamp
+		edit.Added = append(edit.Added, manifestTableFor(sst, levels[i]))
+	}
+	if err := syncDir(db.path); err != nil {
+		cleanup()
+		return err
+	}
+	if err := db.logEdit(edit); err != nil {
+		cleanup()
+		return err
+	}
+
+	for i, sst := range tables {
+		db.attachTable(sst)
+		db.counters.ingestedBytes.Add(uint64(sst.size))
+		level := levels[i]
+		db.levels[level] = append(db.levels[level], sst)
+		if level > 0 {
+			next := db.levels[level]
+			sort.Slice(next, func(i, j int) bool { return compareKeys(next[i].minKey, next[j].minKey) < 0 })
+		}
+	}
+	if db.cache != nil {
+		db.cache.Clear()
+	}
+	db.scheduleCompaction()
+	return nil
+}
+
+// ingestLevelLocked returns the deepest level sst can be placed in: every
+// level above it and the level itself hold no keys in its range, so the
+// table is found before any older version of its keys. Callers hold
+// db.mutex.
+func (db *DB) ingestLevelLocked(sst *SSTable) int {
+	target := 0
+	for level := 0; level < len(db.levels); level++ {
+		for _, other := range db.levels[level] {
+			if compareKeys(other.maxKey, sst.minKey) >= 0 && compareKeys(other.minKey, sst.maxKey) <= 0 {
+				return target
+			}
+		}
+		target = level
+	}
+	return target
+}
+
+// memTablesOverlapLocked reports whether the active or queued memtables hold
+// keys or range tombstones in the key range of any of tables. Callers hold
+// db.mutex.
+func (db *DB) memTablesOverlapLocked(tables []*SSTable) bool {
+	within := func(start, end []byte) bool {
+		for _, sst := range tables {
+			if compareKeys(end, sst.minKey) >= 0 && compareKeys(start, sst.maxKey) <= 0 {
+				return true
+			}
+		}
+		return false
+	}
+	overlaps := func(mt *MemTable) bool {
+		found := false
+		mt.entries.Range(func(key, value any) bool {
+			k := []byte(key.(string))
+			found = within(k, k)
+			return !found
+		})
+		for _, t := range mt.rangeTombstones() {
+			if found {
+				break
+			}
+			found = within(t.Start, t.End)
+		}
+		return found
+	}
+	if overlaps(db.memTable) {
+		return true
+	}
+	for _, mt := range db.flushingMemTables {
+		if overlaps(mt) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package velocity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeIngestTable(t *testing.T, db *DB, path string, keys []string, value string) {
+	t.Helper()
+	w := db.NewSSTableWriter(path)
+	for _, key := range keys {
+		if err := w.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestExternalFilesOverridesOlderData(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewWithConfig(Config{Path: dir, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("ing:%02d", i)), []byte("old"))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("ing:05"), []byte("memtable"))
+
+	external := filepath.Join(t.TempDir(), "bulk.sst")
+	writeIngestTable(t, db, external, []string{"ing:03", "ing:05", "ing:20"}, "new")
+	if err := db.IngestExternalFiles([]string{external}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB) {
+		t.Helper()
+		for key, want := range map[string]string{"ing:00": "old", "ing:03": "new", "ing:05": "new", "ing:20": "new"} {
+			if got, err := db.Get([]byte(key)); err != nil || string(got) != want {
+				t.Fatalf("%s: got %q (%v), want %q", key, got, err, want)
+			}
+		}
+	}
+	check(db)
+
+	// Writes after the ingest win over it.
+	db.Put([]byte("ing:03"), []byte("later"))
+	if got, _ := db.Get([]byte("ing:03")); string(got) != "later" {
+		t.Fatalf("expected a later write to win, got %q", got)
+	}
+	db.Delete([]byte("ing:03"))
+	db.Close()
+
+	db, err = NewWithConfig(Config{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get([]byte("ing:03")); err == nil {
+		t.Fatal("expected ing:03 to stay deleted after reopen")
+	}
+	db.Put([]byte("ing:03"), []byte("new"))
+	check(db)
+}
+
+func TestIngestExternalFilesPlacesDisjointTablesDeep(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir(), SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put([]byte("a:1"), []byte("v"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	external := filepath.Join(t.TempDir(), "bulk.sst")
+	writeIngestTable(t, db, external, []string{"z:1", "z:2"}, "v")
+	if err := db.IngestExternalFiles([]string{external}); err != nil {
+		t.Fatal(err)
+	}
+	db.mutex.RLock()
+	deepest := len(db.levels) - 1
+	found := false
+	for _, sst := range db.levels[deepest] {
+		found = found || string(sst.minKey) == "z:1"
+	}
+	db.mutex.RUnlock()
+	if !found {
+		t.Fatalf("expected the table in level %d", deepest)
+	}
+	if got, err := db.Get([]byte("z:2")); err != nil || string(got) != "v" {
+		t.Fatalf("z:2: got %q (%v)", got, err)
+	}
+}
+
+func TestIngestExternalFilesRejectsBadInput(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir(), SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := db.NewSSTableWriter(filepath.Join(t.TempDir(), "unsorted.sst"))
+	w.Put([]byte("b"), []byte("v"))
+	if err := w.Put([]byte("a"), []byte("v")); err == nil {
+		t.Fatal("expected out of order keys to be rejected")
+	}
+
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "1.sst"), filepath.Join(dir, "2.sst")
+	writeIngestTable(t, db, first, []string{"ov:1", "ov:5"}, "v")
+	writeIngestTable(t, db, second, []string{"ov:3", "ov:9"}, "v")
+	if err := db.IngestExternalFiles([]string{first, second}); err == nil || !strings.Contains(err.Error(), "overlap") {
+		t.Fatalf("expected overlapping files to be rejected, got %v", err)
+	}
+	if _, err := db.Get([]byte("ov:1")); err == nil {
+		t.Fatal("a rejected ingest left keys behind")
+	}
+
+	other, err := NewWithConfig(Config{Path: t.TempDir(), MasterKey: make([]byte, 32), SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	foreign := filepath.Join(dir, "foreign.sst")
+	writeIngestTable(t, other, foreign, []string{"fk:1"}, "v")
+	if err := db.IngestExternalFiles([]string{foreign}); err == nil {
+		t.Fatal("expected a table written with another key to be rejected")
+	}
+}
+
+func TestSSTableWriterWritesBlocksAsKeysAreAdded(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewSSTableWriter(filepath.Join(dir, "bulk.sst"), make([]byte, 32), SSTableOptions{BlockSize: 512, Compression: CompressionNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := func() int64 {
+		t.Helper()
+		files, _ := filepath.Glob(filepath.Join(dir, "bulk.sst.tmp.*"))
+		if len(files) != 1 {
+			t.Fatalf("expected one table being written, got %v", files)
+		}
+		info, err := os.Stat(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 1000; i++ {
+		if err := w.Put([]byte(fmt.Sprintf("k:%04d", i)), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The buffered writer may hold the last few blocks back.
+	if size := written(); size < 50*1024 {
+		t.Fatalf("expected the blocks to be on disk before Finish, got %d bytes", size)
+	}
+
+	w.Abort()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected Abort to remove the table, found %d files", len(files))
+	}
+	if err := w.Put([]byte("k:9999"), []byte(value)); err == nil {
+		t.Fatal("expected an aborted writer to reject keys")
+	}
+}
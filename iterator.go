@@ -0,0 +1,413 @@
+package velocity
+
+import (
+	"bytes"
+	"math"
+	"sort"
+)
+
+// IterOptions configures an Iterator. Bounds are in bytewise key order;
+// LowerBound is inclusive and UpperBound exclusive. Prefix restricts the
+// iterator to keys starting with it and combines with the bounds.
+type IterOptions struct {
+	LowerBound []byte
+	UpperBound []byte
+	Reverse    bool
+	Prefix     []byte
+}
+
+// Iterator walks live keys in order, merging the memtables and every SSTable
+// level on the fly. Only the current position of each source is held, so a
+// scan over any number of keys runs in memory bounded by the memtable size.
+//
+// A fresh iterator is unpositioned: the first Next moves to the first key in
+// the iteration direction (the last key when Reverse is set). Seek jumps to a
+// key, which makes resuming a paginated scan cheap. Key and Value are valid
+// until the iterator moves and must not be modified. Callers must Close the
+// iterator to release the SSTables it pins.
+type Iterator struct {
+	db      *DB
+	readTs  uint64
+	lower   []byte
+	upper   []byte
+	reverse bool
+
+	sources   []keyCursor // newest first, so the first source holding a key wins
+	merge     *MergedIterator
+	tables    []*SSTable
+	rangeDels []rangeTombstone
+
+	positioned bool
+	forward    bool // direction of the last step
+	valid      bool
+	key        []byte
+	value      []byte
+	err        error
+	closed     bool
+}
+
+// NewIterator returns an iterator over the current contents of the database.
+// Writes made after it is created are not visible to it.
+func (db *DB) NewIterator(opts IterOptions) *Iterator {
+	return db.newIterator(opts, math.MaxUint64)
+}
+
+// NewIterator returns an iterator over the database as of the snapshot.
+func (s *Snapshot) NewIterator(opts IterOptions) *Iterator {
+	return s.db.newIterator(opts, s.ts)
+}
+
+func (db *DB) newIterator(opts IterOptions, readTs uint64) *Iterator {
+	it := &Iterator{
+		db:      db,
+		readTs:  readTs,
+		lower:   opts.LowerBound,
+		upper:   opts.UpperBound,
+		reverse: opts.Reverse,
+	}
+	if len(opts.Prefix) > 0 {
+		if it.lower == nil || compareKeys(opts.Prefix, it.lower) > 0 {
+			it.lower = opts.Prefix
+		}
+		if end := prefixUpperBound(opts.Prefix); end != nil && (it.upper == nil || compareKeys(end, it.upper) < 0) {
+			it.upper = end
+		}
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	it.rangeDels = db.rangeTombstonesLocked(readTs, it.lower, it.upper)
+	it.sources = append(it.sources, newMemCursor(db.memTable, it.lower, it.upper))
+	for i := len(db.flushingMemTables) - 1; i >= 0; i-- {
+		it.sources = append(it.sources, newMemCursor(db.flushingMemTables[i], it.lower, it.upper))
+	}
+	for level := 0; level < len(db.levels); level++ {
+		sstables := db.levels[level]
+		for i := len(sstables) - 1; i >= 0; i-- {
+			sst := sstables[i]
+			// Range tombstones were collected above, so a table that
+			// cannot hold a key in range is not needed.
+			if !sst.mayHoldRange(it.lower, it.upper) ||
+				(len(opts.Prefix) > 0 && !sst.mayHoldPrefix(opts.Prefix, db.sstOptions.PrefixExtractor)) {
+				db.counters.scanTablesSkipped.Add(1)
+				continue
+			}
+			iter, err := NewSSTableIterator(sst)
+			if err != nil {
+				it.err = err
+				continue
+			}
+			sst.ref()
+			it.tables = append(it.tables, sst)
+			it.sources = append(it.sources, iter)
+		}
+	}
+	it.merge = newMergedIterator(it.sources)
+	return it
+}
+
+// prefixUpperBound returns the smallest key greater than every key with the
+// given prefix, or nil if there is none.
+func prefixUpperBound(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Next moves to the next key in the iteration direction.
+func (it *Iterator) Next() bool {
+	return it.step(!it.reverse)
+}
+
+// Prev moves to the previous key in the iteration direction.
+func (it *Iterator) Prev() bool {
+	return it.step(it.reverse)
+}
+
+// Seek moves to the first key at or after key in the iteration direction:
+// the smallest key >= key, or with Reverse the largest key <= key.
+func (it *Iterator) Seek(key []byte) bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	it.positioned = true
+	if !it.reverse {
+		target := key
+		if it.lower != nil && compareKeys(target, it.lower) < 0 {
+			target = it.lower
+		}
+		for _, src := range it.sources {
+			src.seekGE(target)
+		}
+		it.merge.reset(true)
+		return it.settle(true)
+	}
+	target := append(append([]byte(nil), key...), 0)
+	if it.upper != nil && compareKeys(target, it.upper) > 0 {
+		target = it.upper
+	}
+	for _, src := range it.sources {
+		src.seekLT(target)
+	}
+	it.merge.reset(false)
+	return it.settle(false)
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.key
+}
+
+// Value returns the current value.
+func (it *Iterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.value
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. It is safe to call more than once.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.valid = false
+	for _, sst := range it.tables {
+		sst.unref()
+	}
+	it.tables = nil
+	it.sources = nil
+	it.merge = nil
+	return nil
+}
+
+// step moves one key forward or backward in bytewise order.
+func (it *Iterator) step(forward bool) bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	switch {
+	case !it.positioned || (!it.valid && it.forward != forward):
+		// Start from the end of the range we are moving away from.
+		for _, src := range it.sources {
+			switch {
+			case forward && it.lower != nil:
+				src.seekGE(it.lower)
+			case forward:
+				src.first()
+			case it.upper != nil:
+				src.seekLT(it.upper)
+			default:
+				src.last()
+			}
+		}
+		it.merge.reset(forward)
+	case !it.valid:
+		return false
+	case it.forward != forward:
+		// Changing direction: bring every source back to the current key
+		// and step past it.
+		for _, src := range it.sources {
+			if forward {
+				src.seekGE(it.key)
+			} else {
+				src.seekLT(append(append([]byte(nil), it.key...), 0))
+			}
+			if src.valid() && bytes.Equal(src.key(), it.key) {
+				if forward {
+					src.next()
+				} else {
+					src.prev()
+				}
+			}
+		}
+		it.merge.reset(forward)
+	default:
+		it.merge.advance()
+	}
+	it.positioned = true
+	return it.settle(forward)
+}
+
+// settle positions the iterator on the nearest key, in the given direction,
+// whose newest visible version is live, skipping tombstones, expired keys and
+// keys deleted by a range tombstone.
+func (it *Iterator) settle(forward bool) bool {
+	it.forward = forward
+	it.valid = false
+	for {
+		cur, found := it.merge.gather()
+		if !found {
+			it.err = it.merge.Err()
+			return false
+		}
+		if forward && it.upper != nil && compareKeys(cur, it.upper) >= 0 {
+			return false
+		}
+		if !forward && it.lower != nil && compareKeys(cur, it.lower) < 0 {
+			return false
+		}
+
+		var entry *Entry
+		for _, i := range it.merge.at {
+			src := it.sources[i]
+			e, err := src.entryAt(it.readTs)
+			if err == nil && e != nil {
+				e, err = src.resolve(e)
+			}
+			if err != nil {
+				it.err = err
+				return false
+			}
+			if e != nil {
+				entry = e
+				break
+			}
+		}
+		rangeTs := coveringTombstoneTs(it.rangeDels, cur, it.readTs)
+		if entry != nil && entry.kind == entryKindMerge && rangeTs < entry.Timestamp {
+			if entry = it.resolveMerge(cur, rangeTs); it.err != nil {
+				return false
+			}
+		}
+		if entryVisible(entry) && rangeTs < entry.Timestamp {
+			it.key = append([]byte(nil), cur...)
+			it.value = entry.Value
+			it.valid = true
+			return true
+		}
+		it.merge.advance()
+	}
+}
+
+// resolveMerge folds the merge operands of cur across the sources positioned
+// on it, newest first.
+func (it *Iterator) resolveMerge(cur []byte, rangeTs uint64) *Entry {
+	c := &mergeCollector{readTs: it.readTs, rangeTs: rangeTs}
+	for _, i := range it.merge.at {
+		if c.done {
+			break
+		}
+		src := it.sources[i]
+		var resolveErr error
+		err := src.versionsAt(it.readTs, func(e *Entry) bool {
+			if e, resolveErr = src.resolve(e); resolveErr != nil {
+				return false
+			}
+			return c.add(e)
+		})
+		if err == nil {
+			err = resolveErr
+		}
+		if err != nil {
+			it.err = err
+			return nil
+		}
+	}
+	entry, err := c.result(it.db.mergeOperatorFor(cur), append([]byte(nil), cur...))
+	if err != nil {
+		it.err = err
+		return nil
+	}
+	return entry
+}
+
+// keyCursor walks the distinct keys of one source in bytewise order. The
+// memtables have a memCursor and SSTables an SSTableIterator; a
+// MergedIterator combines them.
+type keyCursor interface {
+	seekGE(key []byte) // first key >= key
+	seekLT(key []byte) // last key < key
+	first()
+	last()
+	next()
+	prev()
+	valid() bool
+	key() []byte
+	// entryAt returns the newest version of the current key at or before
+	// ts, or nil if the source has none.
+	entryAt(ts uint64) (*Entry, error)
+	// versionsAt calls fn with the versions of the current key at or before
+	// ts, newest first, until fn returns false.
+	versionsAt(ts uint64, fn func(*Entry) bool) error
+	// resolve reads back the value of an entry of the source that was
+	// moved to the value log.
+	resolve(e *Entry) (*Entry, error)
+	error() error
+}
+
+// memCursor iterates a memtable. sync.Map has no order, so the entries in
+// range are captured and sorted up front; a memtable is bounded by
+// memTableSize, which bounds the cursor as well.
+type memCursor struct {
+	entries []*Entry
+	pos     int
+}
+
+func newMemCursor(mt *MemTable, lower, upper []byte) *memCursor {
+	c := &memCursor{pos: -1}
+	mt.entries.Range(func(_, v any) bool {
+		e := storedEntryPtr(v)
+		if e == nil {
+			return true
+		}
+		if (lower == nil || compareKeys(e.Key, lower) >= 0) && (upper == nil || compareKeys(e.Key, upper) < 0) {
+			c.entries = append(c.entries, e)
+		}
+		return true
+	})
+	sort.Slice(c.entries, func(i, j int) bool { return compareKeys(c.entries[i].Key, c.entries[j].Key) < 0 })
+	return c
+}
+
+func (c *memCursor) search(key []byte) int {
+	return sort.Search(len(c.entries), func(i int) bool { return compareKeys(c.entries[i].Key, key) >= 0 })
+}
+
+func (c *memCursor) seekGE(key []byte) { c.pos = c.search(key) }
+func (c *memCursor) seekLT(key []byte) { c.pos = c.search(key) - 1 }
+func (c *memCursor) first()            { c.pos = 0 }
+func (c *memCursor) last()             { c.pos = len(c.entries) - 1 }
+func (c *memCursor) next()             { c.pos++ }
+func (c *memCursor) prev()             { c.pos-- }
+func (c *memCursor) valid() bool       { return c.pos >= 0 && c.pos < len(c.entries) }
+func (c *memCursor) key() []byte       { return c.entries[c.pos].Key }
+func (c *memCursor) error() error      { return nil }
+
+func (c *memCursor) entryAt(ts uint64) (*Entry, error) {
+	e := c.entries[c.pos]
+	for e != nil && e.Timestamp > ts {
+		e = e.prev
+	}
+	return e, nil
+}
+
+func (c *memCursor) resolve(e *Entry) (*Entry, error) { return e, nil }
+
+func (c *memCursor) versionsAt(ts uint64, fn func(*Entry) bool) error {
+	for e := c.entries[c.pos]; e != nil; e = e.prev {
+		if e.Timestamp <= ts && !fn(e) {
+			return nil
+		}
+	}
+	return nil
+}
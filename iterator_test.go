@@ -0,0 +1,241 @@
+package velocity
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func collectIter(it *Iterator, step func() bool) []string {
+	var out []string
+	for step() {
+		out = append(out, string(it.Key())+"="+string(it.Value()))
+	}
+	return out
+}
+
+func TestIteratorMergesMemtableAndSSTables(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"user:b", "user:d", "user:aa", "order:1"} {
+		db.Put([]byte(k), []byte("old"))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("user:c"), []byte("new"))
+	db.Put([]byte("user:d"), []byte("new"))
+	db.Delete([]byte("user:b"))
+	db.Put([]byte("user:z"), []byte("new"))
+
+	it := db.NewIterator(IterOptions{Prefix: []byte("user:")})
+	got := collectIter(it, it.Next)
+	it.Close()
+	want := "[user:aa=old user:c=new user:d=new user:z=new]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("forward: got %v, want %s", got, want)
+	}
+
+	it = db.NewIterator(IterOptions{Prefix: []byte("user:"), Reverse: true})
+	got = collectIter(it, it.Next)
+	it.Close()
+	if fmt.Sprint(got) != "[user:z=new user:d=new user:c=new user:aa=old]" {
+		t.Fatalf("reverse: got %v", got)
+	}
+
+	it = db.NewIterator(IterOptions{LowerBound: []byte("user:b"), UpperBound: []byte("user:z")})
+	got = collectIter(it, it.Next)
+	it.Close()
+	if fmt.Sprint(got) != "[user:c=new user:d=new]" {
+		t.Fatalf("bounds: got %v", got)
+	}
+}
+
+func TestIteratorSeekAndDirectionChange(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i)))
+		if i == 25 {
+			if err := db.flushMemTable(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	it := db.NewIterator(IterOptions{})
+	defer it.Close()
+	if !it.Seek([]byte("k10a")) || string(it.Key()) != "k11" {
+		t.Fatalf("seek: expected k11, got %s", it.Key())
+	}
+	if !it.Next() || string(it.Key()) != "k12" {
+		t.Fatalf("next: expected k12, got %s", it.Key())
+	}
+	if !it.Prev() || string(it.Key()) != "k11" {
+		t.Fatalf("prev: expected k11, got %s", it.Key())
+	}
+	if !it.Prev() || string(it.Key()) != "k10" {
+		t.Fatalf("prev: expected k10, got %s", it.Key())
+	}
+
+	rev := db.NewIterator(IterOptions{Reverse: true})
+	defer rev.Close()
+	if !rev.Seek([]byte("k30a")) || string(rev.Key()) != "k30" {
+		t.Fatalf("reverse seek: expected k30, got %s", rev.Key())
+	}
+	if !rev.Next() || string(rev.Key()) != "k29" {
+		t.Fatalf("reverse next: expected k29, got %s", rev.Key())
+	}
+}
+
+func TestIteratorRandomWalkMatchesModel(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Overlapping writes and deletes spread over several tables and the
+	// memtable, so every key is merged from more than one source.
+	rng := rand.New(rand.NewSource(7))
+	model := make(map[string]string)
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 60; i++ {
+			key := fmt.Sprintf("k%03d", rng.Intn(80))
+			if rng.Intn(4) == 0 {
+				db.Delete([]byte(key))
+				delete(model, key)
+				continue
+			}
+			value := fmt.Sprintf("%d.%d", round, i)
+			db.Put([]byte(key), []byte(value))
+			model[key] = value
+		}
+		if round < 3 {
+			if err := db.flushMemTable(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	keys := make([]string, 0, len(model))
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	it := db.NewIterator(IterOptions{Prefix: []byte("k")})
+	defer it.Close()
+	pos := -1 // index into keys; -1 or len(keys) when off either end
+	for step := 0; step < 2000; step++ {
+		var ok bool
+		switch op := rng.Intn(10); {
+		case op < 4:
+			ok = it.Next()
+			if pos < len(keys) {
+				pos++
+			}
+		case op < 8:
+			ok = it.Prev()
+			if pos >= 0 {
+				pos--
+			}
+		default:
+			target := fmt.Sprintf("k%03d", rng.Intn(85))
+			ok = it.Seek([]byte(target))
+			pos = sort.SearchStrings(keys, target)
+		}
+		if pos < 0 || pos >= len(keys) {
+			if ok {
+				t.Fatalf("step %d: expected the end, got %s", step, it.Key())
+			}
+			// Walking off an end leaves the iterator there; restart.
+			it.Seek([]byte(keys[0]))
+			pos = 0
+			continue
+		}
+		if !ok || string(it.Key()) != keys[pos] || string(it.Value()) != model[keys[pos]] {
+			t.Fatalf("step %d: got %s=%s (%v), want %s=%s", step, it.Key(), it.Value(), ok, keys[pos], model[keys[pos]])
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIteratorOutlivesCompaction(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		db.Put([]byte(fmt.Sprintf("row:%02d", i)), []byte("v"))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := db.NewIterator(IterOptions{Prefix: []byte("row:")})
+	defer it.Close()
+	if !it.Next() {
+		t.Fatal("expected a first key")
+	}
+	db.compactLevel(0)
+	count := 1
+	for it.Next() {
+		count++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 20 {
+		t.Fatalf("expected 20 keys across compaction, got %d", count)
+	}
+}
+
+func TestIteratorReadsLengthOrderedTable(t *testing.T) {
+	crypto, _ := newCryptoProvider(make([]byte, 32))
+	keys := []string{"b", "ab", "abc", "a", "c", "bb"}
+	var entries []*Entry
+	for _, k := range keys {
+		entries = append(entries, &Entry{Key: []byte(k), Value: []byte("v" + k), Timestamp: 1, checksum: crc32Of(k, "v"+k)})
+	}
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	writeRecordSSTable(t, path, entries, crypto, sstableVersionLengthOrdered)
+
+	legacy, err := LoadSSTable(path, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	for _, k := range keys {
+		if e, err := legacy.Get([]byte(k)); err != nil || e == nil || string(e.Value) != "v"+k {
+			t.Fatalf("get %s from legacy table: %+v (%v)", k, e, err)
+		}
+	}
+
+	iter, err := NewSSTableIterator(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for iter.Next() {
+		got = append(got, string(iter.Entry().Key))
+	}
+	sort.Strings(keys)
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expected bytewise order %v, got %v", keys, got)
+	}
+}
@@ -409,28 +409,11 @@ func (db *DB) getRawValue(key []byte) ([]byte, error) {
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
 
-	// Check memtable first
-	if entry := db.memTable.Get(key); entry != nil {
-		if entry.Deleted {
-			return nil, errors.New("key not found")
-		}
-		return entry.Value, nil
-	}
-
-	// Check SSTables
-	for level := 0; level < len(db.levels); level++ {
-		for _, sst := range db.levels[level] {
-			entry, err := sst.Get(key)
-			if err == nil && entry != nil {
-				if entry.Deleted {
-					return nil, errors.New("key not found")
-				}
-				return entry.Value, nil
-			}
-		}
+	entry, err := db.latestEntryLocked(key)
+	if err != nil || entry == nil || entry.Deleted {
+		return nil, errors.New("key not found")
 	}
-
-	return nil, errors.New("key not found")
+	return entry.Value, nil
 }
 
 // putRawValue stores raw encrypted value (helper method)
@@ -390,6 +390,18 @@ func (db *DB) KGAutoDeleteSQLRow(table string, key []byte) {
 	}
 }
 
+// KGAutoDeleteSQLTable removes the documents of every row of table. It reads
+// only the row keys, and must run before the rows are deleted.
+func (db *DB) KGAutoDeleteSQLTable(table string) error {
+	if db.kgAutoIndex == nil || !db.kgAutoIndex.enabled(kg.ResourceSQLRow) {
+		return nil
+	}
+	return db.Scan([]byte(table+":"), func(key, _ []byte) bool {
+		db.kgAutoDeleteSource("sql:" + table + ":" + string(key))
+		return true
+	})
+}
+
 func (db *DB) kgAutoIndexEnvelope(env *Envelope) {
 	if env == nil {
 		return
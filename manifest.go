@@ -0,0 +1,428 @@
+package velocity
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// manifestName is the append-only log of the SSTables that make up the LSM
+// tree of a database directory.
+const manifestName = "MANIFEST"
+
+// manifestRewriteEdits is how many edits the log collects before it is
+// rewritten as a single snapshot.
+const manifestRewriteEdits = 1000
+
+var manifestAAD = []byte("velocity-manifest")
+
+// manifestTable describes one SSTable of the tree and the value log files
+// it points into. Timestamp is the timestamp of every entry of an ingested
+// table.
+type manifestTable struct {
+	Name      string   `json:"name"`
+	Level     int      `json:"level"`
+	MinKey    []byte   `json:"min_key,omitempty"`
+	MaxKey    []byte   `json:"max_key,omitempty"`
+	Size      int64    `json:"size"`
+	ValueLogs []uint64 `json:"value_logs,omitempty"`
+	Timestamp uint64   `json:"timestamp,omitempty"`
+
+	Tombstones int `json:"tombstones,omitempty"`
+}
+
+// manifestEdit is one record of the log. Flushes add a table, compactions
+// remove their inputs and add their outputs in one edit, and a snapshot
+// edit lists the whole tree, replacing everything before it. Sequence is
+// the entry clock when the edit was made; every version stored in the
+// tables it adds is at or below it.
+type manifestEdit struct {
+	Snapshot bool            `json:"snapshot,omitempty"`
+	Added    []manifestTable `json:"added,omitempty"`
+	Removed  []string        `json:"removed,omitempty"`
+	Sequence uint64          `json:"sequence"`
+}
+
+// manifest appends edits to the MANIFEST of a directory and tracks the
+// tables they leave live, in the order they were added.
+type manifest struct {
+	mu     sync.Mutex
+	dir    string
+	file   *os.File
+	crypto *CryptoProvider
+	live   []manifestTable
+	edits  int
+}
+
+// manifestTableFor describes sst, a table of level stored in the directory
+// of the manifest.
+func manifestTableFor(sst *SSTable, level int) manifestTable {
+	return manifestTable{
+		Name:      filepath.Base(sst.path),
+		Level:     level,
+		MinKey:    sst.minKey,
+		MaxKey:    sst.maxKey,
+		Size:      sst.size,
+		ValueLogs: sst.valueLogs,
+		Timestamp: sst.globalTimestamp,
+
+		Tombstones: sst.tombstones,
+	}
+}
+
+// readManifest replays the MANIFEST in dir and returns the live tables. ok
+// is false if there is no MANIFEST. A record torn by a crash ends the log;
+// any other damage is an error.
+func readManifest(dir string, crypto *CryptoProvider) (live []manifestTable, ok bool, err error) {
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, true, err
+		}
+		size := binary.LittleEndian.Uint32(header[:4])
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[4:]) {
+			if _, err := r.Peek(1); err == io.EOF {
+				break
+			}
+			return nil, true, fmt.Errorf("velocity: corrupt manifest record")
+		}
+		edit, err := decodeManifestEdit(body, crypto)
+		if err != nil {
+			return nil, true, err
+		}
+		observeEntryTimestamp(edit.Sequence)
+		live = applyManifestEdit(live, edit)
+	}
+	return live, true, nil
+}
+
+// applyManifestEdit returns live with edit applied.
+func applyManifestEdit(live []manifestTable, edit manifestEdit) []manifestTable {
+	if edit.Snapshot {
+		live = live[:0]
+	}
+	if len(edit.Removed) > 0 {
+		removed := make(map[string]bool, len(edit.Removed))
+		for _, name := range edit.Removed {
+			removed[name] = true
+		}
+		kept := live[:0]
+		for _, t := range live {
+			if !removed[t.Name] {
+				kept = append(kept, t)
+			}
+		}
+		live = kept
+	}
+	return append(live, edit.Added...)
+}
+
+func encodeManifestEdit(edit manifestEdit, crypto *CryptoProvider) ([]byte, error) {
+	data, err := json.Marshal(edit)
+	if err != nil {
+		return nil, err
+	}
+	nonce, sealed, err := crypto.Encrypt(data, manifestAAD)
+	if err != nil {
+		return nil, err
+	}
+	body := binary.LittleEndian.AppendUint16(nil, uint16(len(nonce)))
+	body = append(append(body, nonce...), sealed...)
+	record := binary.LittleEndian.AppendUint32(nil, uint32(len(body)))
+	record = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(body))
+	return append(record, body...), nil
+}
+
+func decodeManifestEdit(body []byte, crypto *CryptoProvider) (manifestEdit, error) {
+	var edit manifestEdit
+	if len(body) < 2 || int(binary.LittleEndian.Uint16(body))+2 > len(body) {
+		return edit, fmt.Errorf("velocity: corrupt manifest record")
+	}
+	n := int(binary.LittleEndian.Uint16(body)) + 2
+	data, err := crypto.Decrypt(body[2:n], body[n:], manifestAAD)
+	if err != nil {
+		return edit, fmt.Errorf("velocity: cannot decrypt manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &edit); err != nil {
+		return edit, fmt.Errorf("velocity: corrupt manifest record: %w", err)
+	}
+	return edit, nil
+}
+
+// writeManifestSnapshot replaces the MANIFEST in dir with a single snapshot
+// of live.
+func writeManifestSnapshot(dir string, live []manifestTable, crypto *CryptoProvider) error {
+	record, err := encodeManifestEdit(manifestEdit{
+		Snapshot: true,
+		Added:    live,
+		Sequence: lastEntryTimestamp.Load(),
+	}, crypto)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, manifestName)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(record); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// openManifest writes a snapshot of live and opens the MANIFEST in dir for
+// appending.
+func openManifest(dir string, live []manifestTable, crypto *CryptoProvider) (*manifest, error) {
+	if err := writeManifestSnapshot(dir, live, crypto); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, manifestName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{dir: dir, file: f, crypto: crypto, live: live}, nil
+}
+
+// apply logs edit durably. Once the log has grown long enough it is
+// rewritten as a snapshot of the live tables.
+func (m *manifest) apply(edit manifestEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return fmt.Errorf("manifest is closed")
+	}
+	edit.Sequence = lastEntryTimestamp.Load()
+	record, err := encodeManifestEdit(edit, m.crypto)
+	if err != nil {
+		return err
+	}
+	info, err := m.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = m.file.Write(record); err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		// Drop what was written, so later edits do not follow a torn one.
+		m.file.Truncate(info.Size())
+		return err
+	}
+	m.live = applyManifestEdit(m.live, edit)
+	m.edits++
+	if m.edits < manifestRewriteEdits {
+		return nil
+	}
+	// The edit is already durable; a failed rewrite leaves the old log.
+	if err := writeManifestSnapshot(m.dir, m.live, m.crypto); err != nil {
+		log.Printf("velocity: WARN: manifest rewrite failed: %v", err)
+		return nil
+	}
+	m.file.Close()
+	m.file, err = os.OpenFile(filepath.Join(m.dir, manifestName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		// Later edits fail rather than go to the replaced file.
+		log.Printf("velocity: WARN: cannot reopen manifest: %v", err)
+		m.file = nil
+	}
+	m.edits = 0
+	return nil
+}
+
+func (m *manifest) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
+
+// logEdit records edit in the manifest of db, if it has one.
+func (db *DB) logEdit(edit manifestEdit) error {
+	if db.manifest == nil {
+		return nil
+	}
+	return db.manifest.apply(edit)
+}
+
+// loadSSTables opens the tables the MANIFEST lists and removes the SSTable
+// files it does not, which flushes and compactions left behind when they
+// were interrupted. A directory without a MANIFEST, or with a damaged one,
+// is loaded from the SSTable files it holds, as older versions did, and
+// nothing is removed.
+func (db *DB) loadSSTables() error {
+	live, ok, err := readManifest(db.path, db.crypto)
+	if err != nil {
+		log.Printf("velocity: WARN: %v; rebuilding the manifest from the sstable files", err)
+		ok = false
+	}
+	if !ok {
+		live = scanSSTableFiles(db.path)
+	}
+	scanValueLogs := !ok && hasValueLogFiles(db.path)
+
+	listed := make(map[string]bool, len(live))
+	valueLogs := make(map[uint64]bool)
+	for i, t := range live {
+		listed[t.Name] = true
+		for _, id := range t.ValueLogs {
+			valueLogs[id] = true
+		}
+		sst, err := loadVerifiedSSTable(filepath.Join(db.path, t.Name), db.crypto)
+		if err != nil {
+			// The table stays listed so it is not mistaken for an orphan;
+			// RebuildManifest drops it once it has been dealt with.
+			log.Printf("velocity: WARN: sstable %s will be skipped: %v", t.Name, err)
+			log.Printf("velocity: consider running repair or restoring from backup")
+			continue
+		}
+		sst.valueLogs = t.ValueLogs
+		sst.globalTimestamp = t.Timestamp
+		sst.tombstones = t.Tombstones
+		if scanValueLogs {
+			if err := sst.scanValueLogRefs(); err != nil {
+				log.Printf("velocity: WARN: cannot list the value log files of sstable %s: %v", t.Name, err)
+			}
+		}
+		if !ok {
+			live[i] = manifestTableFor(sst, t.Level)
+		}
+		db.attachTable(sst)
+		level := min(max(t.Level, 0), MaxLevels-1)
+		if level >= len(db.levels) {
+			db.levels = append(db.levels, make([][]*SSTable, level-len(db.levels)+1)...)
+		}
+		db.levels[level] = append(db.levels[level], sst)
+		if len(sst.rangeDels) > 0 {
+			db.hasRangeDels.Store(true)
+		}
+	}
+	for level := 1; level < len(db.levels); level++ {
+		tables := db.levels[level]
+		sort.Slice(tables, func(i, j int) bool { return compareKeys(tables[i].minKey, tables[j].minKey) < 0 })
+	}
+	if ok {
+		removeOrphanTables(db.path, listed)
+		removeOrphanValueLogs(db.path, valueLogs)
+	}
+	db.values.loadStats()
+
+	db.manifest, err = openManifest(db.path, live, db.crypto)
+	return err
+}
+
+// loadVerifiedSSTable opens the table at path and checks its integrity.
+func loadVerifiedSSTable(path string, crypto *CryptoProvider) (*SSTable, error) {
+	sst, err := LoadSSTable(path, crypto)
+	if err != nil {
+		return nil, err
+	}
+	if err := sst.VerifyIntegrity(); err != nil {
+		sst.Close()
+		return nil, fmt.Errorf("integrity check failed: %w", err)
+	}
+	return sst, nil
+}
+
+// scanSSTableFiles lists the SSTable files in dir, oldest first, with the
+// level their name carries, e.g. sst_L1_<nanos>.db for level 1.
+func scanSSTableFiles(dir string) []manifestTable {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var tables []manifestTable
+	for _, f := range files {
+		name := f.Name()
+		if !isSSTableName(name) {
+			continue
+		}
+		tables = append(tables, manifestTable{Name: name, Level: sstableNameLevel(name)})
+	}
+	return tables
+}
+
+func isSSTableName(name string) bool {
+	return strings.HasPrefix(name, "sst_") && filepath.Ext(name) == ".db"
+}
+
+// sstableNameLevel parses the level from a table name, e.g. sst_L0_001.db ->
+// level 0. Names without one are level 0.
+func sstableNameLevel(name string) int {
+	if !strings.HasPrefix(name, "sst_L") {
+		return 0
+	}
+	end := 5
+	for end < len(name) && name[end] >= '0' && name[end] <= '9' {
+		end++
+	}
+	if l, err := strconv.Atoi(name[5:end]); err == nil && l < MaxLevels {
+		return l
+	}
+	return 0
+}
+
+// removeOrphanTables deletes the SSTable files in dir that are not listed,
+// together with the temporary files of interrupted table writes. Unlisted
+// tables are either inputs of a compaction that committed, or outputs of a
+// flush or compaction that did not, whose data the WAL or the input tables
+// still hold.
+func removeOrphanTables(dir string, listed map[string]bool) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		name := f.Name()
+		orphan := isSSTableName(name) && !listed[name]
+		if !orphan && !(strings.HasPrefix(name, "sst_") && strings.Contains(name, ".db.tmp.")) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("velocity: WARN: cannot remove orphaned %s: %v", name, err)
+		}
+	}
+}
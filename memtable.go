@@ -1,6 +1,7 @@
 package velocity
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"hash/crc32"
@@ -18,6 +19,50 @@ type Entry struct {
 	ExpiresAt uint64 // unix nano timestamp; 0 means no expiry
 	Deleted   bool
 	checksum  uint32
+
+	// kind marks records that are not plain values or tombstones, such as
+	// merge operands; see recordFlag. Pooled entries always have a zero kind.
+	kind entryKind
+
+	// family is the column family of an entry replayed from the WAL.
+	family uint32
+
+	// prev links to the version this entry replaced in a memtable that
+	// retains versions for live snapshots, and below merge operands.
+	prev *Entry
+}
+
+// lastEntryTimestamp is the highest timestamp handed out to an entry in this
+// process. Entry timestamps double as version numbers, so they must never go
+// backwards even when the wall clock does or two writes land in the same
+// nanosecond.
+var lastEntryTimestamp atomic.Uint64
+
+// nextEntryTimestamp returns a strictly increasing entry timestamp.
+func nextEntryTimestamp() uint64 {
+	now := uint64(time.Now().UnixNano())
+	for {
+		last := lastEntryTimestamp.Load()
+		next := now
+		if next <= last {
+			next = last + 1
+		}
+		if lastEntryTimestamp.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// observeEntryTimestamp advances the entry clock past ts. It is used when
+// entries written by an earlier process are loaded back, so new writes always
+// sort after recovered ones.
+func observeEntryTimestamp(ts uint64) {
+	for {
+		last := lastEntryTimestamp.Load()
+		if ts <= last || lastEntryTimestamp.CompareAndSwap(last, ts) {
+			return
+		}
+	}
 }
 
 // EntryPool for reducing GC pressure
@@ -36,6 +81,16 @@ var entryPool = sync.Pool{
 type MemTable struct {
 	entries sync.Map
 	size    int64
+
+	// keepVersions makes writes chain the replaced version instead of
+	// dropping it, so snapshots can still read it. It is switched on while no
+	// writer is active and stays on until the memtable is flushed.
+	keepVersions atomic.Bool
+	versionMu    sync.Mutex
+
+	// rangeDels holds the range tombstones written to this memtable.
+	rangeMu   sync.RWMutex
+	rangeDels []rangeTombstone
 }
 
 func NewMemTable() *MemTable {
@@ -49,18 +104,13 @@ func (mt *MemTable) Put(key, value []byte) {
 	entry.Key = append(entry.Key[:0], key...)
 	entry.KeyString = ""
 	entry.Value = append(entry.Value[:0], value...)
-	entry.Timestamp = uint64(time.Now().UnixNano())
+	entry.Timestamp = nextEntryTimestamp()
 	entry.ExpiresAt = 0
 	entry.Deleted = false
 	// Compute checksum without allocating a temporary concatenation
 	entry.checksum = crc32.Update(crc32.ChecksumIEEE(key), crc32.IEEETable, value)
 
-	keyStr := string(key)
-	old, loaded := mt.entries.Swap(keyStr, entry)
-	oldSize := int64(0)
-	if loaded {
-		oldSize = storedEntrySize(old)
-	}
+	oldSize := mt.swap(string(key), entry)
 	atomic.AddInt64(&mt.size, int64(len(entry.Key)+len(entry.Value))-oldSize)
 }
 
@@ -77,11 +127,7 @@ func (mt *MemTable) PutEntry(entry *Entry) {
 	e.Deleted = entry.Deleted
 	e.checksum = entry.checksum
 
-	old, loaded := mt.entries.Swap(string(e.Key), e)
-	oldSize := int64(0)
-	if loaded {
-		oldSize = storedEntrySize(old)
-	}
+	oldSize := mt.swap(string(e.Key), e)
 	atomic.AddInt64(&mt.size, int64(len(e.Key)+len(e.Value))-oldSize)
 }
 
@@ -97,11 +143,7 @@ func (mt *MemTable) PutEntryOwned(entry *Entry) {
 	e.Deleted = entry.Deleted
 	e.checksum = entry.checksum
 
-	old, loaded := mt.entries.Swap(string(e.Key), e)
-	oldSize := int64(0)
-	if loaded {
-		oldSize = storedEntrySize(old)
-	}
+	oldSize := mt.swap(string(e.Key), e)
 	atomic.AddInt64(&mt.size, int64(len(e.Key)+len(e.Value))-oldSize)
 }
 
@@ -129,10 +171,14 @@ func (mt *MemTable) PutEntriesOwned(entries []Entry) {
 			Deleted:   false,
 			checksum:  entry.checksum,
 		}
-		old, loaded := mt.entries.Swap(keyStr, stored)
-		oldSize := int64(0)
-		if loaded {
-			oldSize = storedEntrySize(old)
+		var oldSize int64
+		if mt.keepVersions.Load() {
+			oldSize = mt.swap(keyStr, &stored)
+		} else {
+			old, loaded := mt.entries.Swap(keyStr, stored)
+			if loaded {
+				oldSize = storedEntrySize(old)
+			}
 		}
 		delta += int64(len(stored.Key)+len(stored.Value)) - oldSize
 	}
@@ -152,6 +198,39 @@ func (mt *MemTable) GetString(key string) *Entry {
 	return nil
 }
 
+// GetAt returns the newest version of key with a timestamp at or before ts.
+// Versions older than the current one are only available while the memtable
+// retains them.
+func (mt *MemTable) GetAt(key []byte, ts uint64) *Entry {
+	e := mt.Get(key)
+	for e != nil && e.Timestamp > ts {
+		e = e.prev
+	}
+	return e
+}
+
+// swap installs e as the current version of key and returns the size to
+// release for the version it replaced. A replaced version that is retained
+// for snapshots stays accounted until the memtable is flushed.
+func (mt *MemTable) swap(key string, e *Entry) int64 {
+	if !mt.keepVersions.Load() {
+		e.prev = nil
+		old, loaded := mt.entries.Swap(key, e)
+		if loaded {
+			return storedEntrySize(old)
+		}
+		return 0
+	}
+	mt.versionMu.Lock()
+	defer mt.versionMu.Unlock()
+	e.prev = nil
+	if old, ok := mt.entries.Load(key); ok {
+		e.prev = storedEntryPtr(old)
+	}
+	mt.entries.Store(key, e)
+	return 0
+}
+
 func storedEntryPtr(v any) *Entry {
 	switch e := v.(type) {
 	case *Entry:
@@ -163,11 +242,19 @@ func storedEntryPtr(v any) *Entry {
 	}
 }
 
+// storedEntrySize returns the size accounted for a stored entry and the
+// versions chained below it, which go when it is replaced.
 func storedEntrySize(v any) int64 {
-	if e := storedEntryPtr(v); e != nil {
-		return int64(len(e.Key) + len(e.Value))
+	return entryChainSize(storedEntryPtr(v))
+}
+
+// entryChainSize returns the size of e and the versions chained below it.
+func entryChainSize(e *Entry) int64 {
+	var size int64
+	for ; e != nil; e = e.prev {
+		size += int64(len(e.Key) + len(e.Value))
 	}
-	return 0
+	return size
 }
 
 func (mt *MemTable) Delete(key []byte) {
@@ -175,11 +262,13 @@ func (mt *MemTable) Delete(key []byte) {
 	entry.Key = append(entry.Key[:0], key...)
 	entry.KeyString = ""
 	entry.Value = entry.Value[:0]
-	entry.Timestamp = uint64(time.Now().UnixNano())
+	entry.Timestamp = nextEntryTimestamp()
+	entry.ExpiresAt = 0
 	entry.Deleted = true
 	entry.checksum = crc32.ChecksumIEEE(key)
 
-	mt.entries.Store(string(key), entry)
+	oldSize := mt.swap(string(key), entry)
+	atomic.AddInt64(&mt.size, int64(len(entry.Key))-oldSize)
 }
 
 // LoadEntries restores a set of entries into the memtable (used during WAL replay).
@@ -187,6 +276,14 @@ func (mt *MemTable) Delete(key []byte) {
 // already exist.
 func (mt *MemTable) LoadEntries(entries []*Entry) {
 	for _, e := range entries {
+		switch e.kind {
+		case entryKindRangeDelete:
+			mt.addRangeTombstone(rangeTombstoneFromEntry(e))
+			continue
+		case entryKindMerge:
+			mt.addMerge(e, nil)
+			continue
+		}
 		oldSize := int64(0)
 		if old, ok := mt.entries.Load(string(e.Key)); ok {
 			oldSize = storedEntrySize(old)
@@ -249,8 +346,10 @@ func (sl *SkipList) randomLevel() int {
 	return level
 }
 
+// compareKeys is the key order of memtables, SSTables and iterators: plain
+// bytewise comparison, so prefixes and ranges are contiguous.
 func compareKeys(a, b []byte) int {
-	return compareKeysFast(a, b)
+	return bytes.Compare(a, b)
 }
 
 func (sl *SkipList) Put(key []byte, entry *Entry) {
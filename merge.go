@@ -0,0 +1,424 @@
+package velocity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// MergeOperator folds merge operands into a value. Merge stores operands
+// without reading the key; they are combined with the value below them when
+// the key is read, when compaction rewrites it, and in the memtable when no
+// snapshot needs them apart.
+type MergeOperator interface {
+	// Name identifies the operator in logs and errors.
+	Name() string
+	// FullMerge applies operands, oldest first, to existing. existing is nil
+	// when the key has no live value.
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// PartialMerger is implemented by operators that can combine operands
+// without the value they apply to. Compaction uses it to collapse operand
+// runs whose base value lives in a deeper level.
+type PartialMerger interface {
+	// PartialMerge combines operands, oldest first, into a single operand.
+	// It reports false if they cannot be combined.
+	PartialMerge(key []byte, operands [][]byte) ([]byte, bool)
+}
+
+// SetMergeOperator registers op for every key starting with prefix. The
+// longest matching prefix wins; an empty prefix matches every key. A nil op
+// removes the registration.
+func (db *DB) SetMergeOperator(prefix string, op MergeOperator) {
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	if op == nil {
+		delete(db.mergeOperators, prefix)
+		return
+	}
+	if db.mergeOperators == nil {
+		db.mergeOperators = make(map[string]MergeOperator)
+	}
+	db.mergeOperators[prefix] = op
+}
+
+// mergeOperatorFor returns the operator registered for key, or nil.
+func (db *DB) mergeOperatorFor(key []byte) MergeOperator {
+	db.mergeMu.RLock()
+	defer db.mergeMu.RUnlock()
+	var best MergeOperator
+	bestLen := -1
+	for prefix, op := range db.mergeOperators {
+		if len(prefix) > bestLen && bytes.HasPrefix(key, []byte(prefix)) {
+			best, bestLen = op, len(prefix)
+		}
+	}
+	return best
+}
+
+// Merge records operand for key without reading the current value. The
+// operator registered for the key's prefix folds it in lazily. Merged keys
+// are not search indexed and do not notify watchers.
+func (db *DB) Merge(key, operand []byte) error {
+	op := db.mergeOperatorFor(key)
+	if op == nil {
+		return fmt.Errorf("velocity: no merge operator registered for key %q", key)
+	}
+	e := &Entry{
+		Key:   append([]byte(nil), key...),
+		Value: append([]byte(nil), operand...),
+		kind:  entryKindMerge,
+	}
+	e.checksum = crc32.Update(crc32.ChecksumIEEE(e.Key), crc32.IEEETable, e.Value)
+
+	db.mutex.Lock()
+	if err := db.makeRoomForWriteLocked(); err != nil {
+		db.mutex.Unlock()
+		return err
+	}
+	e.Timestamp = nextEntryTimestamp()
+	if !db.disableWAL {
+		if db.wal == nil {
+			db.mutex.Unlock()
+			return fmt.Errorf("WAL is not initialized")
+		}
+		if err := db.wal.Write(e); err != nil {
+			db.mutex.Unlock()
+			return err
+		}
+	}
+	db.applyPendingLocked()
+	db.memTable.addMerge(e, op)
+	if db.cache != nil {
+		db.cache.Remove(string(key))
+	}
+	db.mutex.Unlock()
+
+	if db.memTable.Size() > db.memTableSize {
+		db.scheduleFlush()
+	}
+	return nil
+}
+
+// addMerge stacks a merge operand on the current version of its key. The
+// version below is kept, since the operand means nothing without it, unless
+// op can fold the two right away; then the memtable holds and counts only
+// the folded result. op is nil during WAL replay.
+func (mt *MemTable) addMerge(e *Entry, op MergeOperator) {
+	key := string(e.Key)
+	mt.versionMu.Lock()
+	e.prev = nil
+	var released int64
+	if old, ok := mt.entries.Load(key); ok {
+		e.prev = storedEntryPtr(old)
+		if folded := mt.foldMerge(e, op); folded != nil {
+			released = entryChainSize(e.prev)
+			e = folded
+		}
+	}
+	mt.entries.Store(key, e)
+	mt.versionMu.Unlock()
+	atomic.AddInt64(&mt.size, int64(len(e.Key)+len(e.Value))-released)
+}
+
+// foldMerge returns the operand e folded with the versions below it: into a
+// value if the one it applies to is in the memtable, otherwise into a single
+// operand if op is a PartialMerger. It returns nil if the versions must stay
+// as they are: a snapshot may read them, or a range tombstone or expiry
+// decides at read time which value the operands apply to.
+func (mt *MemTable) foldMerge(e *Entry, op MergeOperator) *Entry {
+	if op == nil || mt.keepVersions.Load() {
+		return nil
+	}
+	c := &mergeCollector{readTs: ^uint64(0)}
+	oldest := e
+	for v := e; v != nil; v = v.prev {
+		oldest = v
+		if !c.add(v) {
+			break
+		}
+	}
+	if (c.base != nil && c.base.ExpiresAt > 0) ||
+		coveringTombstoneTs(mt.rangeTombstones(), e.Key, ^uint64(0)) > oldest.Timestamp {
+		return nil
+	}
+	folded := &Entry{Key: e.Key, Timestamp: e.Timestamp}
+	if c.base != nil {
+		value, err := op.FullMerge(e.Key, baseValue(c.base), oldestFirst(c.operands))
+		if err != nil {
+			// The read reports the error.
+			return nil
+		}
+		folded.Value = value
+	} else {
+		partial, ok := op.(PartialMerger)
+		if !ok {
+			return nil
+		}
+		value, ok := partial.PartialMerge(e.Key, oldestFirst(c.operands))
+		if !ok {
+			return nil
+		}
+		folded.Value, folded.kind = value, entryKindMerge
+	}
+	folded.checksum = crc32.Update(crc32.ChecksumIEEE(folded.Key), crc32.IEEETable, folded.Value)
+	return folded
+}
+
+// mergeCollector gathers the versions of a key, newest first, until it
+// reaches the value the merge operands on top apply to.
+type mergeCollector struct {
+	readTs   uint64
+	rangeTs  uint64 // versions older than a covering range tombstone are gone
+	newestTs uint64
+	operands [][]byte // newest first
+	base     *Entry
+	done     bool
+}
+
+// add takes the next older version and reports whether more are needed.
+func (c *mergeCollector) add(e *Entry) bool {
+	if c.done || e.Timestamp > c.readTs {
+		return !c.done
+	}
+	if e.Timestamp < c.rangeTs {
+		c.done = true
+		return false
+	}
+	if c.newestTs == 0 {
+		c.newestTs = e.Timestamp
+	}
+	if e.kind != entryKindMerge {
+		c.base = e
+		c.done = true
+		return false
+	}
+	c.operands = append(c.operands, e.Value)
+	return true
+}
+
+// result folds the collected operands into a value entry.
+func (c *mergeCollector) result(op MergeOperator, key []byte) (*Entry, error) {
+	if op == nil {
+		return nil, fmt.Errorf("velocity: no merge operator registered for key %q", key)
+	}
+	value, err := op.FullMerge(key, baseValue(c.base), oldestFirst(c.operands))
+	if err != nil {
+		return nil, fmt.Errorf("velocity: merge operator %s failed for key %q: %w", op.Name(), key, err)
+	}
+	return &Entry{Key: key, Value: value, Timestamp: c.newestTs}, nil
+}
+
+// oldestFirst returns operands collected newest first in application order.
+func oldestFirst(operands [][]byte) [][]byte {
+	out := make([][]byte, len(operands))
+	for i, operand := range operands {
+		out[len(operands)-1-i] = operand
+	}
+	return out
+}
+
+// resolveMergeLocked folds the merge operands of key visible at readTs with
+// the value below them. Callers hold db.mutex.
+func (db *DB) resolveMergeLocked(key []byte, readTs uint64) (*Entry, error) {
+	c := &mergeCollector{readTs: readTs, rangeTs: db.rangeDeleteTsLocked(key, readTs)}
+	for e := db.memTable.Get(key); e != nil && c.add(e); e = e.prev {
+	}
+	for i := len(db.flushingMemTables) - 1; i >= 0 && !c.done; i-- {
+		for e := db.flushingMemTables[i].Get(key); e != nil && c.add(e); e = e.prev {
+		}
+	}
+	for level := 0; level < len(db.levels) && !c.done; level++ {
+		sstables := db.levels[level]
+		for i := len(sstables) - 1; i >= 0 && !c.done; i-- {
+			if err := sstables[i].versionsAt(key, readTs, c.add); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c.result(db.mergeOperatorFor(key), key)
+}
+
+// resolvedEntryLocked returns entry with any merge operands folded in, or
+// nil if they cannot be. Scans that walk stored entries use it. Callers hold
+// db.mutex.
+func (db *DB) resolvedEntryLocked(entry *Entry) *Entry {
+	if entry == nil || entry.kind != entryKindMerge {
+		return entry
+	}
+	resolved, err := db.resolveMergeLocked(entry.Key, ^uint64(0))
+	if err != nil {
+		return nil
+	}
+	return resolved
+}
+
+// foldMergeVersions collapses the merge operands on top of versions, sorted
+// newest first, during compaction. With the base value at hand, or nothing
+// below the output level, they are folded into a plain value; otherwise they
+// are combined into one operand if the operator allows it. Runs that a
+// snapshot reads part way through are left alone.
+func (db *DB) foldMergeVersions(versions []*Entry, snapshots []uint64, bottom bool) []*Entry {
+	key := versions[0].Key
+	op := db.mergeOperatorFor(key)
+	if op == nil {
+		return versions
+	}
+	c := &mergeCollector{readTs: ^uint64(0)}
+	n := 0
+	for _, e := range versions {
+		n++
+		if !c.add(e) {
+			break
+		}
+	}
+	oldest := versions[n-1].Timestamp
+	if snapshotBetween(snapshots, oldest, c.newestTs) {
+		return versions
+	}
+	folded := &Entry{Key: key, Timestamp: c.newestTs}
+	switch {
+	case c.base != nil || bottom:
+		value, err := op.FullMerge(key, baseValue(c.base), oldestFirst(c.operands))
+		if err != nil {
+			log.Printf("velocity: compaction kept merge operands of %q: %s: %v", key, op.Name(), err)
+			return versions
+		}
+		folded.Value = value
+	case len(c.operands) > 1:
+		partial, ok := op.(PartialMerger)
+		if !ok {
+			return versions
+		}
+		value, ok := partial.PartialMerge(key, oldestFirst(c.operands))
+		if !ok {
+			return versions
+		}
+		folded.Value, folded.kind = value, entryKindMerge
+	default:
+		return versions
+	}
+	return append([]*Entry{folded}, versions[n:]...)
+}
+
+// baseValue returns the live value of the version merge operands apply to.
+func baseValue(base *Entry) []byte {
+	if entryVisible(base) {
+		return base.Value
+	}
+	return nil
+}
+
+// CounterMergeOperator adds numeric operands to a numeric value, stored as
+// decimal text in the same format Incr uses. A missing value counts as 0.
+type CounterMergeOperator struct{}
+
+func (CounterMergeOperator) Name() string { return "counter" }
+
+func (CounterMergeOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	if existing == nil {
+		existing = []byte("0")
+	}
+	return sumNumbers(append([][]byte{existing}, operands...))
+}
+
+func (CounterMergeOperator) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+	sum, err := sumNumbers(operands)
+	return sum, err == nil
+}
+
+// sumNumbers adds decimal numbers, exactly while they are all integers.
+func sumNumbers(values [][]byte) ([]byte, error) {
+	var (
+		isum    int64
+		fsum    float64
+		integer = true
+	)
+	for _, v := range values {
+		s := strings.TrimSpace(string(v))
+		if integer {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				isum += n
+				continue
+			}
+			integer = false
+			fsum = float64(isum)
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		fsum += f
+	}
+	if integer {
+		return strconv.AppendInt(nil, isum, 10), nil
+	}
+	return strconv.AppendFloat(nil, fsum, 'f', -1, 64), nil
+}
+
+// AppendMergeOperator appends operands to the value, separated by Separator.
+type AppendMergeOperator struct {
+	Separator []byte
+}
+
+func (AppendMergeOperator) Name() string { return "append" }
+
+func (o AppendMergeOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	if len(existing) == 0 {
+		return bytes.Join(operands, o.Separator), nil
+	}
+	return bytes.Join(append([][]byte{existing}, operands...), o.Separator), nil
+}
+
+func (o AppendMergeOperator) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+	return bytes.Join(operands, o.Separator), true
+}
+
+// JSONMergePatchOperator applies operands as JSON merge patches (RFC 7386)
+// to a JSON document. A missing value starts out as null.
+type JSONMergePatchOperator struct{}
+
+func (JSONMergePatchOperator) Name() string { return "json-merge-patch" }
+
+func (JSONMergePatchOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var doc any
+	if len(existing) > 0 {
+		if err := json.Unmarshal(existing, &doc); err != nil {
+			return nil, fmt.Errorf("existing value is not JSON: %w", err)
+		}
+	}
+	for _, operand := range operands {
+		var patch any
+		if err := json.Unmarshal(operand, &patch); err != nil {
+			return nil, fmt.Errorf("patch is not JSON: %w", err)
+		}
+		doc = applyMergePatch(doc, patch)
+	}
+	return json.Marshal(doc)
+}
+
+// applyMergePatch implements the MergePatch function of RFC 7386.
+func applyMergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = make(map[string]any, len(patchObj))
+	}
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+			continue
+		}
+		targetObj[name] = applyMergePatch(targetObj[name], value)
+	}
+	return targetObj
+}
@@ -0,0 +1,190 @@
+package velocity
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCounterMergeAcrossFlushCompactionAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *DB {
+		db, err := NewWithConfig(Config{
+			Path:           dir,
+			SkipCloseFlush: true,
+			MergeOperators: map[string]MergeOperator{"count:": CounterMergeOperator{}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	db := open()
+
+	check := func(stage, key, want string) {
+		t.Helper()
+		if v, err := db.Get([]byte(key)); err != nil || string(v) != want {
+			t.Fatalf("%s: expected %s=%s, got %q (%v)", stage, key, want, v, err)
+		}
+	}
+
+	db.Put([]byte("count:a"), []byte("10"))
+	for i := 0; i < 5; i++ {
+		if err := db.Merge([]byte("count:a"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Merge([]byte("count:b"), []byte("3"))
+	check("memtable", "count:a", "15")
+	check("memtable", "count:b", "3")
+
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.Merge([]byte("count:a"), []byte("-2"))
+	check("flushed", "count:a", "13")
+
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.compactLevel(0)
+	check("compacted", "count:a", "13")
+	check("compacted", "count:b", "3")
+	for _, level := range db.levels {
+		for _, sst := range level {
+			versions := 0
+			sst.forEachVersion([]byte("count:a"), func(IndexEntry) bool {
+				versions++
+				return true
+			})
+			if versions > 1 {
+				t.Fatalf("expected compaction to fold count:a into one version, found %d", versions)
+			}
+		}
+	}
+
+	db.Merge([]byte("count:a"), []byte("7"))
+	if got := scanKeys(t, db, "count:"); len(got) != 2 {
+		t.Fatalf("expected 2 counters from Scan, got %v", got)
+	}
+	iter := db.NewIterator(IterOptions{Prefix: []byte("count:a")})
+	if !iter.Next() || string(iter.Value()) != "20" {
+		t.Fatalf("iterator should fold merge operands, got %q (%v)", iter.Value(), iter.Err())
+	}
+	iter.Close()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	defer db.Close()
+	check("replayed", "count:a", "20")
+}
+
+func TestMergeOperatorsAndOverwrites(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMergeOperator("log:", AppendMergeOperator{Separator: []byte(",")})
+	db.SetMergeOperator("doc:", JSONMergePatchOperator{})
+
+	for i := 0; i < 3; i++ {
+		db.Merge([]byte("log:1"), []byte(fmt.Sprint(i)))
+	}
+	if v, err := db.Get([]byte("log:1")); err != nil || string(v) != "0,1,2" {
+		t.Fatalf("expected appended log, got %q (%v)", v, err)
+	}
+
+	db.Put([]byte("doc:1"), []byte(`{"name":"a","tags":{"x":1}}`))
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	db.Merge([]byte("doc:1"), []byte(`{"tags":{"x":null,"y":2}}`))
+	db.Merge([]byte("doc:1"), []byte(`{"age":3}`))
+	if v, err := db.Get([]byte("doc:1")); err != nil || string(v) != `{"age":3,"name":"a","tags":{"y":2}}` {
+		t.Fatalf("expected patched document, got %s (%v)", v, err)
+	}
+	if v, err := snap.Get([]byte("doc:1")); err != nil || string(v) != `{"name":"a","tags":{"x":1}}` {
+		t.Fatalf("snapshot should read the document before the patches, got %s (%v)", v, err)
+	}
+
+	db.Put([]byte("log:1"), []byte("reset"))
+	db.Merge([]byte("log:1"), []byte("3"))
+	if v, err := db.Get([]byte("log:1")); err != nil || string(v) != "reset,3" {
+		t.Fatalf("expected Put to replace earlier operands, got %q (%v)", v, err)
+	}
+
+	if err := db.Merge([]byte("other"), []byte("1")); err == nil {
+		t.Fatal("expected Merge without a registered operator to fail")
+	}
+}
+
+func TestMergeMemTableSizeFollowsFoldedValue(t *testing.T) {
+	db, err := NewWithConfig(Config{
+		Path: t.TempDir(),
+		MergeOperators: map[string]MergeOperator{
+			"count:": CounterMergeOperator{},
+			"doc:":   JSONMergePatchOperator{},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check := func(key, want string) {
+		t.Helper()
+		if v, err := db.Get([]byte(key)); err != nil || string(v) != want {
+			t.Fatalf("expected %s=%s, got %q (%v)", key, want, v, err)
+		}
+	}
+
+	db.Put([]byte("count:deep"), []byte("100"))
+	db.Put([]byte("doc:1"), []byte(`{}`))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	base := db.memTable.Size()
+	db.Put([]byte("count:a"), []byte("10"))
+	for i := 0; i < 1000; i++ {
+		db.Merge([]byte("count:a"), []byte("1"))
+		db.Merge([]byte("count:deep"), []byte("1"))
+	}
+	check("count:a", "1010")
+	check("count:deep", "1100")
+	// One folded value and one combined operand, not 2000 operands.
+	if size := db.memTable.Size() - base; size > 64 {
+		t.Fatalf("expected the memtable to count the folded values only, got %d bytes", size)
+	}
+
+	// Patches cannot be combined without the document, so they stack up
+	// until a Put replaces them.
+	held := db.memTable.Size()
+	for i := 0; i < 100; i++ {
+		db.Merge([]byte("doc:1"), []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	check("doc:1", `{"n":99}`)
+	db.Put([]byte("doc:1"), []byte(`{}`))
+	if size := db.memTable.Size() - held; size != int64(len("doc:1{}")) {
+		t.Fatalf("expected the Put to release the patches, %d bytes left", size)
+	}
+
+	// A range tombstone below the operands is applied when they are read.
+	db.Put([]byte("count:r"), []byte("5"))
+	if err := db.DeletePrefix([]byte("count:r")); err != nil {
+		t.Fatal(err)
+	}
+	db.Merge([]byte("count:r"), []byte("1"))
+	db.Merge([]byte("count:r"), []byte("1"))
+	check("count:r", "2")
+
+	// Operands a snapshot reads are kept.
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	for i := 0; i < 10; i++ {
+		db.Merge([]byte("count:a"), []byte("1"))
+	}
+	check("count:a", "1020")
+	if v, err := snap.Get([]byte("count:a")); err != nil || string(v) != "1010" {
+		t.Fatalf("snapshot should read 1010, got %q (%v)", v, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -32,7 +33,8 @@ type counterValue struct {
 // ---------------------------------------------------------------------------
 
 type gaugeEntry struct {
-	value  atomic.Int64
+	value  atomic.Int64 // float64 bits when float is set
+	float  atomic.Bool
 	labels map[string]string
 }
 
@@ -145,34 +147,106 @@ func NewMetricsCollector() *MetricsCollector {
 			[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0},
 		),
 		metricHelp: map[string]string{
-			"velocity_requests_total":                "Total number of requests processed",
-			"velocity_request_duration_seconds":      "Histogram of request durations in seconds",
-			"velocity_objects_total":                 "Current number of stored objects",
-			"velocity_bytes_stored_total":            "Current total bytes stored",
-			"velocity_replication_pending":           "Number of pending replication tasks",
-			"velocity_replication_replicated":        "Number of successfully replicated objects",
-			"velocity_replication_failed":            "Number of failed replication attempts",
-			"velocity_replication_bytes_transferred": "Bytes transferred via replication",
-			"velocity_cluster_nodes_total":           "Number of active cluster nodes",
-			"velocity_bitrot_scans_total":            "Total number of bit-rot scan operations",
-			"velocity_healing_operations_total":      "Total number of healing operations",
-			"velocity_transport_messages_sent":       "Total transport messages sent",
-			"velocity_transport_messages_received":   "Total transport messages received",
+			"velocity_requests_total":                 "Total number of requests processed",
+			"velocity_request_duration_seconds":       "Histogram of request durations in seconds",
+			"velocity_objects_total":                  "Current number of stored objects",
+			"velocity_bytes_stored_total":             "Current total bytes stored",
+			"velocity_replication_pending":            "Number of pending replication tasks",
+			"velocity_replication_replicated":         "Number of successfully replicated objects",
+			"velocity_replication_failed":             "Number of failed replication attempts",
+			"velocity_replication_bytes_transferred":  "Bytes transferred via replication",
+			"velocity_cluster_nodes_total":            "Number of active cluster nodes",
+			"velocity_bitrot_scans_total":             "Total number of bit-rot scan operations",
+			"velocity_healing_operations_total":       "Total number of healing operations",
+			"velocity_transport_messages_sent":        "Total transport messages sent",
+			"velocity_transport_messages_received":    "Total transport messages received",
+			"velocity_lsm_level_files":                "Number of SSTables in each level",
+			"velocity_lsm_level_bytes":                "Bytes of SSTables in each level",
+			"velocity_lsm_level_overlaps":             "SSTables whose key range overlaps another table of the same level",
+			"velocity_lsm_level_tombstones":           "Point tombstones stored in each level",
+			"velocity_lsm_level_compaction_score":     "Compaction score of each level; 1 or more means due",
+			"velocity_tombstones":                     "Point tombstones stored in SSTables",
+			"velocity_range_tombstones":               "Range tombstones stored in SSTables",
+			"velocity_memtable_bytes":                 "Size of the active memtable",
+			"velocity_immutable_memtables":            "Full memtables waiting to be flushed",
+			"velocity_immutable_memtable_bytes":       "Size of the memtables waiting to be flushed",
+			"velocity_flushes_total":                  "Total number of memtable flushes",
+			"velocity_flush_bytes_total":              "Total bytes written by memtable flushes",
+			"velocity_compactions_total":              "Total number of compactions",
+			"velocity_compaction_read_bytes_total":    "Total bytes of SSTables read by compaction",
+			"velocity_compaction_written_bytes_total": "Total bytes of SSTables written by compaction",
+			"velocity_ingested_bytes_total":           "Total bytes of SSTables ingested",
+			"velocity_write_amplification":            "SSTable bytes written per byte flushed or ingested",
+			"velocity_compaction_backlog":             "Number of levels due for compaction",
+			"velocity_compaction_pending_bytes":       "Estimated bytes compaction has to rewrite to catch up",
+			"velocity_bloom_checks_total":             "Total bloom filter probes by point reads",
+			"velocity_bloom_useful_total":             "Total bloom filter probes that ruled a table out",
+			"velocity_bloom_false_positives_total":    "Total bloom filter probes that passed for a missing key",
+			"velocity_bloom_false_positive_rate":      "Share of missing keys the bloom filters let through",
+			"velocity_scan_tables_skipped_total":      "Total SSTables scans skipped by key range or prefix bloom filter",
+			"velocity_block_cache_hits_total":         "Total block cache hits",
+			"velocity_block_cache_misses_total":       "Total block cache misses",
+			"velocity_block_cache_bytes":              "Bytes of decoded blocks in the block cache",
+			"velocity_block_cache_hit_ratio":          "Share of block reads served by the block cache",
+			"velocity_open_sstables":                  "Number of SSTables open in the table cache",
+			"velocity_write_stalls_delayed_total":     "Total writes delayed by the level 0 slowdown trigger",
+			"velocity_write_stalls_stopped_total":     "Total writes blocked by write stalls",
+			"velocity_write_stall_seconds_total":      "Total time writes spent stalled",
+			"velocity_wal_syncs_total":                "Total fsyncs of the write-ahead log",
+			"velocity_wal_bytes_total":                "Total bytes appended to the write-ahead log",
+			"velocity_wal_group_commits_total":        "Total WAL syncs writers waited for",
+			"velocity_wal_grouped_writes_total":       "Total writes acknowledged by WAL group commits",
 		},
 		metricType: map[string]string{
-			"velocity_requests_total":                "counter",
-			"velocity_request_duration_seconds":      "histogram",
-			"velocity_objects_total":                 "gauge",
-			"velocity_bytes_stored_total":            "gauge",
-			"velocity_replication_pending":           "gauge",
-			"velocity_replication_replicated":        "gauge",
-			"velocity_replication_failed":            "gauge",
-			"velocity_replication_bytes_transferred": "gauge",
-			"velocity_cluster_nodes_total":           "gauge",
-			"velocity_bitrot_scans_total":            "counter",
-			"velocity_healing_operations_total":      "counter",
-			"velocity_transport_messages_sent":       "counter",
-			"velocity_transport_messages_received":   "counter",
+			"velocity_requests_total":                 "counter",
+			"velocity_request_duration_seconds":       "histogram",
+			"velocity_objects_total":                  "gauge",
+			"velocity_bytes_stored_total":             "gauge",
+			"velocity_replication_pending":            "gauge",
+			"velocity_replication_replicated":         "gauge",
+			"velocity_replication_failed":             "gauge",
+			"velocity_replication_bytes_transferred":  "gauge",
+			"velocity_cluster_nodes_total":            "gauge",
+			"velocity_bitrot_scans_total":             "counter",
+			"velocity_healing_operations_total":       "counter",
+			"velocity_transport_messages_sent":        "counter",
+			"velocity_transport_messages_received":    "counter",
+			"velocity_lsm_level_files":                "gauge",
+			"velocity_lsm_level_bytes":                "gauge",
+			"velocity_lsm_level_overlaps":             "gauge",
+			"velocity_lsm_level_tombstones":           "gauge",
+			"velocity_lsm_level_compaction_score":     "gauge",
+			"velocity_tombstones":                     "gauge",
+			"velocity_range_tombstones":               "gauge",
+			"velocity_memtable_bytes":                 "gauge",
+			"velocity_immutable_memtables":            "gauge",
+			"velocity_immutable_memtable_bytes":       "gauge",
+			"velocity_flushes_total":                  "counter",
+			"velocity_flush_bytes_total":              "counter",
+			"velocity_compactions_total":              "counter",
+			"velocity_compaction_read_bytes_total":    "counter",
+			"velocity_compaction_written_bytes_total": "counter",
+			"velocity_ingested_bytes_total":           "counter",
+			"velocity_write_amplification":            "gauge",
+			"velocity_compaction_backlog":             "gauge",
+			"velocity_compaction_pending_bytes":       "gauge",
+			"velocity_bloom_checks_total":             "counter",
+			"velocity_bloom_useful_total":             "counter",
+			"velocity_bloom_false_positives_total":    "counter",
+			"velocity_bloom_false_positive_rate":      "gauge",
+			"velocity_scan_tables_skipped_total":      "counter",
+			"velocity_block_cache_hits_total":         "counter",
+			"velocity_block_cache_misses_total":       "counter",
+			"velocity_block_cache_bytes":              "gauge",
+			"velocity_block_cache_hit_ratio":          "gauge",
+			"velocity_open_sstables":                  "gauge",
+			"velocity_write_stalls_delayed_total":     "counter",
+			"velocity_write_stalls_stopped_total":     "counter",
+			"velocity_write_stall_seconds_total":      "counter",
+			"velocity_wal_syncs_total":                "counter",
+			"velocity_wal_bytes_total":                "counter",
+			"velocity_wal_group_commits_total":        "counter",
+			"velocity_wal_grouped_writes_total":       "counter",
 		},
 	}
 	return mc
@@ -257,7 +331,17 @@ func (mc *MetricsCollector) getOrCreateGauge(name string, labels map[string]stri
 
 // SetGauge atomically sets a gauge to the given value.
 func (mc *MetricsCollector) SetGauge(name string, labels map[string]string, value int64) {
-	mc.getOrCreateGauge(name, labels).value.Store(value)
+	g := mc.getOrCreateGauge(name, labels)
+	g.value.Store(value)
+	g.float.Store(false)
+}
+
+// SetGaugeFloat atomically sets a gauge to a fractional value, such as a
+// ratio.
+func (mc *MetricsCollector) SetGaugeFloat(name string, labels map[string]string, value float64) {
+	g := mc.getOrCreateGauge(name, labels)
+	g.value.Store(int64(math.Float64bits(value)))
+	g.float.Store(true)
 }
 
 // ---------------------------------------------------------------------------
@@ -300,6 +384,8 @@ func (mc *MetricsCollector) UpdateGauges(db *DB, cluster *ClusterManager, repl *
 
 		mc.SetGauge("velocity_objects_total", nil, objectCount)
 		mc.SetGauge("velocity_bytes_stored_total", nil, bytesStored)
+
+		mc.updateEngineGauges(db.Stats())
 	}
 
 	// Cluster node count.
@@ -326,6 +412,49 @@ func (mc *MetricsCollector) UpdateGauges(db *DB, cluster *ClusterManager, repl *
 	}
 }
 
+// updateEngineGauges exports the storage engine statistics of DB.Stats.
+func (mc *MetricsCollector) updateEngineGauges(stats Stats) {
+	for _, ls := range stats.Levels {
+		labels := map[string]string{"level": strconv.Itoa(ls.Level)}
+		mc.SetGauge("velocity_lsm_level_files", labels, int64(ls.Files))
+		mc.SetGauge("velocity_lsm_level_bytes", labels, ls.Bytes)
+		mc.SetGauge("velocity_lsm_level_overlaps", labels, int64(ls.Overlaps))
+		mc.SetGauge("velocity_lsm_level_tombstones", labels, int64(ls.Tombstones))
+		mc.SetGaugeFloat("velocity_lsm_level_compaction_score", labels, ls.Score)
+	}
+	mc.SetGauge("velocity_tombstones", nil, int64(stats.Tombstones))
+	mc.SetGauge("velocity_range_tombstones", nil, int64(stats.RangeTombstones))
+	mc.SetGauge("velocity_memtable_bytes", nil, stats.MemTableBytes)
+	mc.SetGauge("velocity_immutable_memtables", nil, int64(stats.ImmutableMemTables))
+	mc.SetGauge("velocity_immutable_memtable_bytes", nil, stats.ImmutableMemTableBytes)
+	mc.SetGauge("velocity_flushes_total", nil, int64(stats.Flushes))
+	mc.SetGauge("velocity_flush_bytes_total", nil, int64(stats.FlushBytes))
+	mc.SetGauge("velocity_compactions_total", nil, int64(stats.Compactions))
+	mc.SetGauge("velocity_compaction_read_bytes_total", nil, int64(stats.CompactionBytesRead))
+	mc.SetGauge("velocity_compaction_written_bytes_total", nil, int64(stats.CompactionBytesWritten))
+	mc.SetGauge("velocity_ingested_bytes_total", nil, int64(stats.IngestedBytes))
+	mc.SetGaugeFloat("velocity_write_amplification", nil, stats.WriteAmplification)
+	mc.SetGauge("velocity_compaction_backlog", nil, int64(stats.CompactionBacklog))
+	mc.SetGauge("velocity_compaction_pending_bytes", nil, stats.PendingCompactionBytes)
+	mc.SetGauge("velocity_bloom_checks_total", nil, int64(stats.BloomChecks))
+	mc.SetGauge("velocity_bloom_useful_total", nil, int64(stats.BloomUseful))
+	mc.SetGauge("velocity_bloom_false_positives_total", nil, int64(stats.BloomFalsePositives))
+	mc.SetGaugeFloat("velocity_bloom_false_positive_rate", nil, stats.BloomFalsePositiveRate)
+	mc.SetGauge("velocity_scan_tables_skipped_total", nil, int64(stats.ScanTablesSkipped))
+	mc.SetGauge("velocity_block_cache_hits_total", nil, int64(stats.BlockCache.Hits))
+	mc.SetGauge("velocity_block_cache_misses_total", nil, int64(stats.BlockCache.Misses))
+	mc.SetGauge("velocity_block_cache_bytes", nil, stats.BlockCache.Bytes)
+	mc.SetGaugeFloat("velocity_block_cache_hit_ratio", nil, stats.BlockCacheHitRate)
+	mc.SetGauge("velocity_open_sstables", nil, int64(stats.TableCache.Open))
+	mc.SetGauge("velocity_write_stalls_delayed_total", nil, int64(stats.WriteStalls.Delayed))
+	mc.SetGauge("velocity_write_stalls_stopped_total", nil, int64(stats.WriteStalls.Stopped))
+	mc.SetGaugeFloat("velocity_write_stall_seconds_total", nil, stats.WriteStalls.StallTime.Seconds())
+	mc.SetGauge("velocity_wal_syncs_total", nil, int64(stats.WAL.Syncs))
+	mc.SetGauge("velocity_wal_bytes_total", nil, int64(stats.WAL.BytesWritten))
+	mc.SetGauge("velocity_wal_group_commits_total", nil, int64(stats.WAL.GroupCommits))
+	mc.SetGauge("velocity_wal_grouped_writes_total", nil, int64(stats.WAL.GroupedWrites))
+}
+
 // UpdateTransportMetrics refreshes transport counters from a NodeTransport.
 func (mc *MetricsCollector) UpdateTransportMetrics(transport *NodeTransport) {
 	if transport == nil {
@@ -397,7 +526,7 @@ func (mc *MetricsCollector) RenderMetrics() string {
 	type gaugeRenderEntry struct {
 		name   string
 		labels map[string]string
-		value  int64
+		value  string
 	}
 	gaugeGrouped := make(map[string][]gaugeRenderEntry)
 
@@ -409,10 +538,14 @@ func (mc *MetricsCollector) RenderMetrics() string {
 		if idx := strings.Index(key, "{"); idx >= 0 {
 			name = key[:idx]
 		}
+		value := strconv.FormatInt(g.value.Load(), 10)
+		if g.float.Load() {
+			value = formatFloat(math.Float64frombits(uint64(g.value.Load())))
+		}
 		gaugeGrouped[name] = append(gaugeGrouped[name], gaugeRenderEntry{
 			name:   name,
 			labels: g.labels,
-			value:  g.value.Load(),
+			value:  value,
 		})
 		return true
 	})
@@ -435,7 +568,7 @@ func (mc *MetricsCollector) RenderMetrics() string {
 			return encodeLabels(entries[i].labels) < encodeLabels(entries[j].labels)
 		})
 		for _, e := range entries {
-			fmt.Fprintf(&sb, "%s%s %d\n", name, formatLabels(e.labels), e.value)
+			fmt.Fprintf(&sb, "%s%s %s\n", name, formatLabels(e.labels), e.value)
 		}
 		sb.WriteString("\n")
 	}
@@ -806,23 +806,11 @@ func (db *DB) DeleteFolderRecursive(path, user string) error {
 		}
 	}
 
-	// Get all subfolders (in reverse order to delete children first)
-	subFolders, err := db.ListFolders(path, true)
-	if err != nil {
+	// Delete all subfolder markers with one range tombstone
+	if err := db.DeletePrefix([]byte(ObjectFolderPrefix + path + FolderSeparator)); err != nil {
 		return err
 	}
 
-	// Sort in reverse order (deepest first)
-	sort.Slice(subFolders, func(i, j int) bool {
-		return subFolders[i].Path > subFolders[j].Path
-	})
-
-	// Delete all subfolders
-	for _, folder := range subFolders {
-		folderKey := []byte(ObjectFolderPrefix + folder.Path)
-		_ = db.Delete(folderKey)
-	}
-
 	// Delete the main folder
 	folderKey := []byte(ObjectFolderPrefix + path)
 	return db.Delete(folderKey)
@@ -0,0 +1,139 @@
+package velocity
+
+// pendingWrite holds entries logged to a group commit that has not synced
+// yet. They reach the memtable and cache only once it has, in log order, so
+// no reader, snapshot or transaction acts on a write that a failed sync
+// loses.
+type pendingWrite struct {
+	commit  *walGroup
+	entries []*Entry
+	index   bool // update search indexes too, as transaction commits do
+	done    bool
+	applied bool
+	err     error // the sync error that dropped the entries, or an indexing error
+}
+
+// queueWriteLocked queues entries, appended to the WAL as part of commit,
+// to be applied once commit syncs. With no sync to wait for and nothing
+// queued ahead of them they are applied right away. Callers hold db.mutex.
+func (db *DB) queueWriteLocked(commit *walGroup, entries []*Entry, index bool) *pendingWrite {
+	p := &pendingWrite{commit: commit, entries: entries, index: index}
+	if commit == nil && len(db.pending) == 0 {
+		db.applyWriteLocked(p)
+		return p
+	}
+	db.pending = append(db.pending, p)
+	if db.pendingKeys == nil {
+		db.pendingKeys = make(map[string]uint64)
+	}
+	for _, e := range entries {
+		db.pendingKeys[string(e.Key)] = e.Timestamp
+	}
+	return p
+}
+
+// awaitWrite waits for the group commit of p to sync and for p to be
+// applied. Callers do not hold db.mutex, so writers share the sync.
+func (db *DB) awaitWrite(p *pendingWrite) error {
+	if p == nil {
+		return nil
+	}
+	syncErr := p.commit.wait()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.settleWriteLocked(p, syncErr)
+}
+
+// awaitWriteLocked is awaitWrite for callers that hold db.mutex.
+func (db *DB) awaitWriteLocked(p *pendingWrite) error {
+	if p == nil {
+		return nil
+	}
+	return db.settleWriteLocked(p, p.commit.wait())
+}
+
+func (db *DB) settleWriteLocked(p *pendingWrite, syncErr error) error {
+	if !p.done && db.applyingPending {
+		// A write made while applying another one, such as a transaction's
+		// index update, goes in right away; its sync completed every group
+		// ahead of it.
+		for i, q := range db.pending {
+			if q == p {
+				db.pending = append(db.pending[:i], db.pending[i+1:]...)
+				break
+			}
+		}
+		db.forgetPendingKeysLocked(p)
+		if syncErr == nil {
+			db.applyWriteLocked(p)
+		}
+		p.done = true
+	}
+	db.applyPendingLocked()
+	if syncErr != nil {
+		return syncErr
+	}
+	return p.err
+}
+
+// applyPendingLocked applies the queued writes whose group commits have
+// synced, oldest first, and drops those whose sync failed. Callers hold
+// db.mutex.
+func (db *DB) applyPendingLocked() {
+	if db.applyingPending {
+		return
+	}
+	db.applyingPending = true
+	defer func() { db.applyingPending = false }()
+	for len(db.pending) > 0 {
+		p := db.pending[0]
+		done, err := p.commit.result()
+		if !done {
+			return
+		}
+		db.pending[0] = nil
+		db.pending = db.pending[1:]
+		db.forgetPendingKeysLocked(p)
+		if err != nil {
+			p.err = err
+		} else {
+			db.applyWriteLocked(p)
+		}
+		p.done = true
+	}
+}
+
+func (db *DB) applyWriteLocked(p *pendingWrite) {
+	if err := db.applyCommittedLocked(p.entries, p.index); err != nil {
+		p.err = err
+	}
+	p.done, p.applied = true, true
+}
+
+func (db *DB) forgetPendingKeysLocked(p *pendingWrite) {
+	for _, e := range p.entries {
+		key := string(e.Key)
+		if db.pendingKeys[key] == e.Timestamp {
+			delete(db.pendingKeys, key)
+		}
+	}
+}
+
+// oldestPendingLocked returns the timestamp of the oldest queued write, or
+// 0 if there is none. Callers hold db.mutex.
+func (db *DB) oldestPendingLocked() uint64 {
+	for _, p := range db.pending {
+		if len(p.entries) > 0 {
+			return p.entries[0].Timestamp
+		}
+	}
+	return 0
+}
+
+// hasPendingWrites reports whether writes are waiting for their group
+// commit to sync.
+func (db *DB) hasPendingWrites() bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return len(db.pending) > 0
+}
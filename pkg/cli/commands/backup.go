@@ -62,6 +62,17 @@ func BackupCreateCommand(db *velocity.DB) velocitycli.CommandBuilder {
 				Aliases: []string{"d"},
 				Usage:   "Backup description",
 			},
+			&cli.StringFlag{
+				Name:    "mode",
+				Aliases: []string{"m"},
+				Usage:   "Backup mode: logical (single file), full, incremental or differential (backup directory)",
+				Value:   "logical",
+			},
+			&cli.StringFlag{
+				Name:    "parent",
+				Aliases: []string{"p"},
+				Usage:   "Parent backup directory of an incremental or differential backup",
+			},
 		).
 		SetAction(func(ctx context.Context, c *cli.Command) error {
 			output := c.String("output")
@@ -70,13 +81,24 @@ func BackupCreateCommand(db *velocity.DB) velocitycli.CommandBuilder {
 			includes := c.StringSlice("include")
 			filter := c.String("filter")
 			description := c.String("description")
+			mode := c.String("mode")
+			parent := c.String("parent")
 			user := c.Root().String("user")
+			if mode == "logical" {
+				mode = ""
+			}
 
 			if len(includes) == 0 {
 				includes = []string{"secrets", "folders", "objects"}
 			}
 
 			fmt.Printf("Creating backup: %s\n", output)
+			if mode != "" {
+				fmt.Printf("  Mode: %s\n", mode)
+				if parent != "" {
+					fmt.Printf("  Parent: %s\n", parent)
+				}
+			}
 			fmt.Printf("  Compress: %v\n", compress)
 			fmt.Printf("  Encrypt: %v\n", encrypt)
 			fmt.Printf("  Include: %v\n", includes)
@@ -94,6 +116,8 @@ func BackupCreateCommand(db *velocity.DB) velocitycli.CommandBuilder {
 				Filter:       filter,
 				User:         user,
 				Description:  description,
+				Mode:         velocity.BackupMode(mode),
+				Parent:       parent,
 			}
 
 			if err := db.Backup(opts); err != nil {
@@ -135,15 +159,42 @@ func BackupRestoreCommand(db *velocity.DB) velocitycli.CommandBuilder {
 				Aliases: []string{"f"},
 				Usage:   "Path prefix filter (only restore items matching prefix)",
 			},
+			&cli.StringFlag{
+				Name:    "target-dir",
+				Aliases: []string{"d"},
+				Usage:   "Directory to restore a backup directory to, as a new database",
+			},
+			&cli.StringFlag{
+				Name:  "target-time",
+				Usage: "Restore a backup directory as of this time (RFC3339)",
+			},
+			&cli.Uint64Flag{
+				Name:  "target-seq",
+				Usage: "Restore a backup directory as of this WAL sequence number",
+			},
 		).
 		SetAction(func(ctx context.Context, c *cli.Command) error {
 			input := c.String("input")
 			overwrite := c.Bool("overwrite")
 			includes := c.StringSlice("include")
 			filter := c.String("filter")
+			targetDir := c.String("target-dir")
+			targetSeq := c.Uint64("target-seq")
 			user := c.Root().String("user")
 
+			var targetTime time.Time
+			if s := c.String("target-time"); s != "" {
+				t, err := time.Parse(time.RFC3339, s)
+				if err != nil {
+					return fmt.Errorf("invalid target time: %w", err)
+				}
+				targetTime = t
+			}
+
 			fmt.Printf("Restoring from backup: %s\n", input)
+			if targetDir != "" {
+				fmt.Printf("  Target directory: %s\n", targetDir)
+			}
 			fmt.Printf("  Overwrite: %v\n", overwrite)
 			if len(includes) > 0 {
 				fmt.Printf("  Include: %v\n", includes)
@@ -155,11 +206,14 @@ func BackupRestoreCommand(db *velocity.DB) velocitycli.CommandBuilder {
 			startTime := time.Now()
 
 			opts := velocity.RestoreOptions{
-				BackupPath:   input,
-				Overwrite:    overwrite,
-				Filter:       filter,
-				User:         user,
-				IncludeTypes: includes,
+				BackupPath:     input,
+				Overwrite:      overwrite,
+				Filter:         filter,
+				User:           user,
+				IncludeTypes:   includes,
+				TargetDir:      targetDir,
+				TargetTime:     targetTime,
+				TargetSequence: targetSeq,
 			}
 
 			if err := db.Restore(opts); err != nil {
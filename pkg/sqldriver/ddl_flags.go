@@ -8,7 +8,9 @@ import (
 type velocityColumnFlags struct {
 	index    bool
 	fulltext bool
+	fuzzy    bool
 	value    bool
+	geo      bool
 }
 
 type createTableRewrite struct {
@@ -41,7 +43,7 @@ func rewriteVelocityCreateTable(sql string) createTableRewrite {
 		if !ok {
 			continue
 		}
-		if colFlags.index || colFlags.fulltext || colFlags.value {
+		if colFlags.index || colFlags.fulltext || colFlags.value || colFlags.geo {
 			flags[col] = mergeVelocityColumnFlags(flags[col], colFlags)
 			parts[i] = cleaned
 			changed = true
@@ -95,14 +97,21 @@ func stripVelocityColumnFlags(def string) (string, string, velocityColumnFlags,
 			case "fulltext":
 				flags.fulltext = true
 				continue
+			case "fuzzy":
+				flags.fulltext = true
+				flags.fuzzy = true
+				continue
 			case "value":
 				flags.value = true
 				continue
+			case "geo":
+				flags.geo = true
+				continue
 			}
 		}
 		out = append(out, token)
 	}
-	if !(flags.index || flags.fulltext || flags.value) {
+	if !(flags.index || flags.fulltext || flags.value || flags.geo) {
 		return def, col, flags, true
 	}
 	return leadingWhitespace(def) + strings.Join(out, " ") + trailingWhitespace(def), col, flags, true
@@ -181,8 +190,12 @@ func normalizeDDLFlagToken(token string) string {
 		return "index"
 	case "fulltext", "full_text":
 		return "fulltext"
+	case "fuzzy", "fuzzytext", "fuzzy_text":
+		return "fuzzy"
 	case "valueindex", "value_index", "rangeindex", "range_index":
 		return "value"
+	case "spatial", "geo", "geoindex", "geo_index":
+		return "geo"
 	default:
 		return ""
 	}
@@ -192,7 +205,9 @@ func mergeVelocityColumnFlags(a, b velocityColumnFlags) velocityColumnFlags {
 	return velocityColumnFlags{
 		index:    a.index || b.index,
 		fulltext: a.fulltext || b.fulltext,
+		fuzzy:    a.fuzzy || b.fuzzy,
 		value:    a.value || b.value,
+		geo:      a.geo || b.geo,
 	}
 }
 
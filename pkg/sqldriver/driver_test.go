@@ -130,3 +130,62 @@ func TestSQLDriver_OpContext(t *testing.T) {
 		t.Fatalf("ExecContext failed: %v", err)
 	}
 }
+
+func TestSQLDriver_TruncateTable(t *testing.T) {
+	path := t.TempDir()
+	DSNConfigs[path] = velocity.Config{Path: path, DisableEncryption: true}
+	t.Cleanup(func() { delete(DSNConfigs, path) })
+	db, err := sql.Open("velocity", path)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE items (id int PRIMARY KEY, kind string INDEX)`); err != nil {
+		t.Fatalf("create table failed: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := db.Exec(`INSERT INTO items (id, kind) VALUES (?, 'a')`, i); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+	count := func(query string, args ...any) int {
+		t.Helper()
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		defer rows.Close()
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		return n
+	}
+	if n := count(`SELECT id FROM items WHERE id = 2`); n != 1 {
+		t.Fatalf("expected the row before truncate, got %d", n)
+	}
+
+	if _, err := db.Exec(`TRUNCATE TABLE items`); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	if n := count(`SELECT id FROM items`); n != 0 {
+		t.Fatalf("expected an empty table, got %d rows", n)
+	}
+	if n := count(`SELECT id FROM items WHERE id = 2`); n != 0 {
+		t.Fatalf("expected the cached point lookup to be invalidated, got %d rows", n)
+	}
+	if n := count(`SELECT id FROM items WHERE kind = 'a'`); n != 0 {
+		t.Fatalf("expected no indexed rows, got %d", n)
+	}
+
+	if _, err := db.Exec(`INSERT INTO items (id, kind) VALUES (2, 'b')`); err != nil {
+		t.Fatalf("insert after truncate failed: %v", err)
+	}
+	if n := count(`SELECT id FROM items WHERE kind = 'b'`); n != 1 {
+		t.Fatalf("expected the new row to be indexed, got %d", n)
+	}
+	if n := count(`SELECT id FROM items WHERE kind = 'a'`); n != 0 {
+		t.Fatalf("expected no stale postings, got %d", n)
+	}
+}
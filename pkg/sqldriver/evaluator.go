@@ -10,6 +10,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/oarkflow/sqlparser/ast"
 	"github.com/oarkflow/sqlparser/lexer"
+	"github.com/oarkflow/velocity"
 )
 
 // Evaluator provides a recursive execution environment for SQL Expressions
@@ -403,6 +404,12 @@ func (e *Evaluator) evalFuncCall(v *ast.FuncCall, row Row) (interface{}, error)
 		}
 		return strings.ToLower(fmt.Sprintf("%v", val)), nil
 	}
+	if strings.EqualFold(funcName, "fuzzy_match") && (len(v.Args) == 2 || len(v.Args) == 3) {
+		return e.evalFuzzyMatch(v, row)
+	}
+	if isSpatialFunc(funcName, len(v.Args)) {
+		return e.evalSpatialFunc(funcName, v, row)
+	}
 	if strings.EqualFold(funcName, "length") || strings.EqualFold(funcName, "len") {
 		if len(v.Args) == 1 {
 			val, err := e.Eval(v.Args[0], row)
@@ -416,6 +423,35 @@ func (e *Evaluator) evalFuncCall(v *ast.FuncCall, row Row) (interface{}, error)
 	return nil, fmt.Errorf("velocity engine: unsupported function %s", funcName)
 }
 
+// evalFuzzyMatch evaluates FUZZY_MATCH(column, text[, max_edits]): whether
+// every word of text is in the column within the edits of a fuzzy search.
+func (e *Evaluator) evalFuzzyMatch(v *ast.FuncCall, row Row) (interface{}, error) {
+	val, err := e.Eval(v.Args[0], row)
+	if err != nil {
+		return nil, err
+	}
+	query, err := e.Eval(v.Args[1], row)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil || query == nil {
+		return nil, nil
+	}
+	edits := 0
+	if len(v.Args) == 3 {
+		raw, err := e.Eval(v.Args[2], row)
+		if err != nil {
+			return nil, err
+		}
+		n, ok := asFloat(raw)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("velocity engine: FUZZY_MATCH max edits must be a non-negative number, got %v", raw)
+		}
+		edits = int(n)
+	}
+	return velocity.FuzzyMatch(fmt.Sprintf("%v", val), fmt.Sprintf("%v", query), edits), nil
+}
+
 func (e *Evaluator) evalBetween(v *ast.BetweenExpr, row Row) (interface{}, error) {
 	val, err := e.Eval(v.Expr, row)
 	if err != nil {
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	sqlparser "github.com/oarkflow/sqlparser"
 	"github.com/oarkflow/sqlparser/ast"
@@ -76,8 +77,10 @@ type projectedRow struct {
 }
 
 type searchPlan struct {
-	filters  []velocity.SearchFilter
-	fullText string
+	filters       []velocity.SearchFilter
+	fullText      string
+	fuzzy         bool
+	fuzzyMaxEdits int
 }
 
 type tableSearchPlans map[string]searchPlan
@@ -942,21 +945,36 @@ func (e *ExecutorV2) executeDropTable(n *ast.DropTableStmt) (driver.Result, erro
 }
 
 func (e *ExecutorV2) executeTruncateTable(tableName string) (driver.Result, error) {
-	rows, err := e.conn.db.Search(velocity.SearchQuery{Prefix: tableName, Limit: maxSearchLimit})
-	if err != nil {
-		return nil, err
+	if e.conn.tx != nil {
+		rows, err := e.conn.db.Search(velocity.SearchQuery{Prefix: tableName, Limit: maxSearchLimit})
+		if err != nil {
+			return nil, err
+		}
+		keys := make([][]byte, 0, len(rows))
+		for _, row := range rows {
+			keys = append(keys, append([]byte(nil), row.Key...))
+		}
+		if err := e.applyDeleteOperations(keys); err != nil {
+			return nil, err
+		}
+		return Result{rowsAffected: int64(len(keys))}, nil
 	}
-	keys := make([][]byte, 0, len(rows))
-	for _, row := range rows {
-		keys = append(keys, append([]byte(nil), row.Key...))
+	// Outside a transaction the table is not read: the rows go with a single
+	// range tombstone, and their postings and doc-id bindings with the
+	// table's index. As in MySQL and PostgreSQL, no rows are reported.
+	if err := e.conn.db.KGAutoDeleteSQLTable(tableName); err != nil {
+		return nil, err
 	}
-	if err := e.applyDeleteOperations(keys); err != nil {
+	if err := e.conn.db.DeletePrefix([]byte(tableName + ":")); err != nil {
 		return nil, err
 	}
-	if e.conn.tx == nil {
-		e.conn.applyKnowledgeGraphMutations(entriesFromKeys(keys, true))
+	if err := e.conn.db.DropIndexForPrefix(tableName); err != nil {
+		return nil, err
 	}
-	return Result{rowsAffected: int64(len(keys))}, nil
+	// Cached point lookups depend on their row alone, so the whole cache
+	// goes, as for any large delete.
+	e.conn.queryCache.Clear()
+	return Result{}, nil
 }
 
 func (e *ExecutorV2) executeSelectStatement(ctx context.Context, stmt *ast.SelectStmt, args []driver.NamedValue) (*Rows, error) {
@@ -1619,10 +1637,12 @@ func (e *ExecutorV2) buildTableRefIterator(ctx context.Context, ref ast.TableRef
 			return nil, err
 		}
 		return NewConnTableScanIterator(e.conn, alias, velocity.SearchQuery{
-			Prefix:   tableName,
-			FullText: tablePlan.fullText,
-			Filters:  tablePlan.filters,
-			Limit:    queryLimit,
+			Prefix:        tableName,
+			FullText:      tablePlan.fullText,
+			Filters:       tablePlan.filters,
+			Limit:         queryLimit,
+			Fuzzy:         tablePlan.fuzzy,
+			FuzzyMaxEdits: tablePlan.fuzzyMaxEdits,
 		})
 
 	case *ast.SubqueryTable:
@@ -1666,7 +1686,7 @@ func (e *ExecutorV2) coerceSearchPlan(tableName string, plan searchPlan) (search
 	for i := range plan.filters {
 		filter := &plan.filters[i]
 		typ, ok := meta.ColumnTypes[filter.Field]
-		if !ok || filter.Value == nil {
+		if !ok || filter.Value == nil || isSpatialFilterOp(filter.Op) {
 			continue
 		}
 		coerced, err := coerceColumnValue(typ, filter.Value)
@@ -1752,15 +1772,25 @@ func (e *ExecutorV2) extractFilters(expr ast.Expr, args []driver.NamedValue) []v
 				HashOnly: v.Op == lexer.EQ,
 			}}
 		}
+	case *ast.FuncCall:
+		if filter, ok := spatialFilter(v, eval); ok {
+			return []velocity.SearchFilter{filter}
+		}
 	}
 	return nil
 }
 
 func (e *ExecutorV2) extractSearchPlan(expr ast.Expr, args []driver.NamedValue) searchPlan {
-	return searchPlan{
+	plan := searchPlan{
 		filters:  e.extractFilters(expr, args),
 		fullText: e.extractFullText(expr, args),
 	}
+	if text, edits, ok := e.extractFuzzyMatch(expr, args); ok {
+		plan.fullText = strings.TrimSpace(plan.fullText + " " + text)
+		plan.fuzzy = true
+		plan.fuzzyMaxEdits = edits
+	}
+	return plan
 }
 
 func mergeSearchPlans(a, b searchPlan) searchPlan {
@@ -1769,6 +1799,8 @@ func mergeSearchPlans(a, b searchPlan) searchPlan {
 	}
 	if a.fullText == "" {
 		a.fullText = b.fullText
+		a.fuzzy = b.fuzzy
+		a.fuzzyMaxEdits = b.fuzzyMaxEdits
 	}
 	return a
 }
@@ -1883,6 +1915,56 @@ func (e *ExecutorV2) extractFullText(expr ast.Expr, args []driver.NamedValue) st
 	return strings.Join(dedupeStrings(terms), " ")
 }
 
+// extractFuzzyMatch returns the words of the FUZZY_MATCH(column, text[,
+// max_edits]) calls ANDed in expr and the largest edit cap among them, for
+// a fuzzy full-text search whose candidates the calls then filter.
+func (e *ExecutorV2) extractFuzzyMatch(expr ast.Expr, args []driver.NamedValue) (string, int, bool) {
+	eval := &Evaluator{Args: args, ParamOrder: e.paramOrder}
+	var texts []string
+	edits := 0
+	var walk func(ast.Expr)
+	walk = func(node ast.Expr) {
+		switch v := node.(type) {
+		case *ast.BinaryExpr:
+			if v.Op == lexer.AND {
+				walk(v.Left)
+				walk(v.Right)
+			}
+		case *ast.FuncCall:
+			if !strings.EqualFold(qualifiedIdentToString(v.Name), "fuzzy_match") || len(v.Args) < 2 || len(v.Args) > 3 || exprColumnName(v.Args[0]) == "" {
+				return
+			}
+			raw, err := eval.Eval(v.Args[1], nil)
+			if err != nil {
+				return
+			}
+			text, ok := raw.(string)
+			if !ok {
+				return
+			}
+			// Only the words are searched: quotes, dashes and operator words
+			// would make the search stricter than the call.
+			for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+			}) {
+				switch strings.ToUpper(word) {
+				case "AND", "OR", "NOT":
+				default:
+					texts = append(texts, word)
+				}
+			}
+			if len(v.Args) == 3 {
+				edits = max(edits, exprToPositiveInt(v.Args[2], args, e.paramOrder, 0))
+			}
+		}
+	}
+	walk(expr)
+	if len(texts) == 0 {
+		return "", 0, false
+	}
+	return strings.Join(texts, " "), edits, true
+}
+
 func likePatternToFullText(pattern string) (string, bool) {
 	pattern = strings.TrimSpace(pattern)
 	if pattern == "" || strings.Contains(pattern, "_") {
@@ -1967,10 +2049,12 @@ func (e *ExecutorV2) tryFastCountSelect(sel *ast.SelectStmt, args []driver.Named
 	}
 	limit := e.extractCount(sel.Limit, args)
 	count, err := e.conn.db.SearchCount(velocity.SearchQuery{
-		Prefix:   tableName,
-		FullText: plan.fullText,
-		Filters:  plan.filters,
-		Limit:    limit,
+		Prefix:        tableName,
+		FullText:      plan.fullText,
+		Filters:       plan.filters,
+		Limit:         limit,
+		Fuzzy:         plan.fuzzy,
+		FuzzyMaxEdits: plan.fuzzyMaxEdits,
 	})
 	if err != nil {
 		return nil, true, err
@@ -2532,8 +2616,10 @@ func (e *ExecutorV2) schemaMetaFromCreateStmt(ctx context.Context, stmt *ast.Cre
 func searchSchemaFieldFromColumnDef(name string, flags velocityColumnFlags) velocity.SearchSchemaField {
 	field := velocity.SearchSchemaField{Name: name}
 	field.Searchable = flags.fulltext
+	field.Fuzzy = flags.fuzzy
 	field.HashSearch = flags.index
 	field.ValueIndex = flags.value
+	field.GeoPoint = flags.geo
 	return field
 }
 
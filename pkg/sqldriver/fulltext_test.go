@@ -68,3 +68,74 @@ func TestSQLDriver_FullTextLike(t *testing.T) {
 		t.Fatalf("expected indexed count=1, got %d", count)
 	}
 }
+
+func TestSQLDriver_FuzzyMatch(t *testing.T) {
+	os.RemoveAll("./testdb_fuzzy")
+	defer os.RemoveAll("./testdb_fuzzy")
+
+	db, err := sql.Open("velocity", "./testdb_fuzzy")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE products (
+		id int PRIMARY KEY,
+		name string FUZZY,
+		notes string
+	)`); err != nil {
+		t.Fatalf("create table failed: %v", err)
+	}
+	for _, stmt := range []string{
+		`INSERT INTO products (id, name, notes) VALUES (1, 'Wireless Headphones', 'over ear')`,
+		`INSERT INTO products (id, name, notes) VALUES (2, 'Headphone Stand', 'wireless charging')`,
+		`INSERT INTO products (id, name, notes) VALUES (3, 'Bluetooth Speaker', 'waterproof')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+
+	ids := func(query string, args ...any) []int {
+		t.Helper()
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		defer rows.Close()
+		var out []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				t.Fatalf("scan failed: %v", err)
+			}
+			out = append(out, id)
+		}
+		return out
+	}
+
+	if got := ids(`SELECT id FROM products WHERE FUZZY_MATCH(name, 'wireles headphnes') ORDER BY id`); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("unexpected fuzzy matches: %v", got)
+	}
+	if got := ids(`SELECT id FROM products WHERE FUZZY_MATCH(name, ?) ORDER BY id`, "headphone"); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("unexpected fuzzy matches: %v", got)
+	}
+	// The match is limited to the column, and the edits to the cap.
+	if got := ids(`SELECT id FROM products WHERE FUZZY_MATCH(name, 'wireles') ORDER BY id`); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("unexpected column-scoped matches: %v", got)
+	}
+	if got := ids(`SELECT id FROM products WHERE FUZZY_MATCH(name, 'blutoth speker', 2)`); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("unexpected matches with two edits: %v", got)
+	}
+	if got := ids(`SELECT id FROM products WHERE FUZZY_MATCH(name, 'blutoth speker')`); len(got) != 0 {
+		t.Fatalf("expected no matches with one edit, got %v", got)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM products WHERE FUZZY_MATCH(notes, 'wireles')`).Scan(&count); err != nil {
+		t.Fatalf("count query failed: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected count=1, got %d", count)
+	}
+}
@@ -115,3 +115,27 @@ func TestSQLKnowledgeGraphAutoIndex_RollbackDoesNotIndex(t *testing.T) {
 		t.Fatalf("rolled back SQL row indexed: %d hits", resp.TotalHits)
 	}
 }
+
+func TestSQLKnowledgeGraphAutoIndex_Truncate(t *testing.T) {
+	sdb, path := openAutoKGSQLDB(t, "truncate")
+	if _, err := sdb.Exec(`CREATE TABLE visits (id BIGINT PRIMARY KEY, note TEXT)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	vdb := engineDBForPath(t, path)
+	for i := 1; i <= 2; i++ {
+		if _, err := sdb.Exec(`INSERT INTO visits (id, note) VALUES (?, ?)`, i, "truncated kg row"); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	waitSQLKGHits(t, vdb, "truncated kg", 2)
+	if _, err := sdb.Exec(`TRUNCATE TABLE visits`); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	resp, err := vdb.KnowledgeGraph().Search(context.Background(), &kg.KGSearchRequest{Query: "truncated kg", Limit: 10})
+	if err != nil {
+		t.Fatalf("search after truncate: %v", err)
+	}
+	if resp.TotalHits != 0 {
+		t.Fatalf("truncated SQL rows still indexed: %d hits", resp.TotalHits)
+	}
+}
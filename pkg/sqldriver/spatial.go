@@ -0,0 +1,216 @@
+package sqldriver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/oarkflow/sqlparser/ast"
+	"github.com/oarkflow/velocity"
+)
+
+// Spatial functions follow PostGIS on a sphere: points are made from
+// longitude then latitude and distances are in meters.
+var spatialFuncs = map[string]int{
+	"st_point":        2,
+	"st_makepoint":    2,
+	"st_x":            1,
+	"st_y":            1,
+	"st_distance":     2,
+	"st_dwithin":      3,
+	"st_makeenvelope": 4,
+	"st_geomfromtext": 1,
+	"st_within":       2,
+	"st_contains":     2,
+}
+
+func isSpatialFunc(name string, args int) bool {
+	n, ok := spatialFuncs[strings.ToLower(name)]
+	// ST_MakeEnvelope may be given an SRID, which is ignored.
+	return ok && (args == n || strings.EqualFold(name, "st_makeenvelope") && args == 5)
+}
+
+func (e *Evaluator) evalSpatialFunc(name string, v *ast.FuncCall, row Row) (interface{}, error) {
+	vals := make([]interface{}, len(v.Args))
+	for i, arg := range v.Args {
+		val, err := e.Eval(arg, row)
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			return nil, nil
+		}
+		vals[i] = val
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "st_point", "st_makepoint":
+		lon, okLon := asFloat(vals[0])
+		lat, okLat := asFloat(vals[1])
+		p, ok := velocity.ParseGeoPoint(velocity.GeoPoint{Lat: lat, Lon: lon})
+		if !okLon || !okLat || !ok {
+			return nil, fmt.Errorf("velocity engine: %s expects a longitude and a latitude, got %v, %v", strings.ToUpper(name), vals[0], vals[1])
+		}
+		return p, nil
+	case "st_x", "st_y":
+		p, err := spatialPoint(name, vals[0])
+		if err != nil {
+			return nil, err
+		}
+		if name == "st_x" {
+			return p.Lon, nil
+		}
+		return p.Lat, nil
+	case "st_distance", "st_dwithin":
+		a, err := spatialPoint(name, vals[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := spatialPoint(name, vals[1])
+		if err != nil {
+			return nil, err
+		}
+		d := a.DistanceMeters(b)
+		if name == "st_distance" {
+			return d, nil
+		}
+		limit, ok := asFloat(vals[2])
+		if !ok {
+			return nil, fmt.Errorf("velocity engine: ST_DWITHIN distance must be a number, got %v", vals[2])
+		}
+		return d <= limit, nil
+	case "st_makeenvelope":
+		var coords [4]float64
+		for i := range coords {
+			f, ok := asFloat(vals[i])
+			if !ok {
+				return nil, fmt.Errorf("velocity engine: ST_MAKEENVELOPE expects numbers, got %v", vals[i])
+			}
+			coords[i] = f
+		}
+		return velocity.GeoBBox{MinLon: coords[0], MinLat: coords[1], MaxLon: coords[2], MaxLat: coords[3]}, nil
+	case "st_geomfromtext":
+		geom, ok := parseSpatialText(fmt.Sprintf("%v", vals[0]))
+		if !ok {
+			return nil, fmt.Errorf("velocity engine: ST_GEOMFROMTEXT expects a POINT or POLYGON, got %v", vals[0])
+		}
+		return geom, nil
+	case "st_within", "st_contains":
+		point, region := vals[0], vals[1]
+		if name == "st_contains" {
+			point, region = region, point
+		}
+		p, err := spatialPoint(name, point)
+		if err != nil {
+			return nil, err
+		}
+		switch r := region.(type) {
+		case velocity.GeoBBox:
+			return r.Contains(p), nil
+		case velocity.GeoPolygon:
+			return r.Contains(p), nil
+		}
+		return nil, fmt.Errorf("velocity engine: %s expects an envelope or polygon, got %v", strings.ToUpper(name), region)
+	}
+	return nil, fmt.Errorf("velocity engine: unsupported function %s", name)
+}
+
+func spatialPoint(name string, v interface{}) (velocity.GeoPoint, error) {
+	p, ok := velocity.ParseGeoPoint(v)
+	if !ok {
+		return p, fmt.Errorf("velocity engine: %s expects a point, got %v", strings.ToUpper(name), v)
+	}
+	return p, nil
+}
+
+// parseSpatialText reads a WKT POINT as a GeoPoint or the outer ring of a
+// WKT POLYGON as a GeoPolygon.
+func parseSpatialText(text string) (interface{}, bool) {
+	text = strings.TrimSpace(text)
+	upper := strings.ToUpper(text)
+	if !strings.HasPrefix(upper, "POLYGON") {
+		p, ok := velocity.ParseGeoPoint(text)
+		return p, ok
+	}
+	inner := strings.TrimSpace(text[len("POLYGON"):])
+	if !strings.HasPrefix(inner, "((") {
+		return nil, false
+	}
+	ring, _, found := strings.Cut(inner[2:], ")")
+	if !found {
+		return nil, false
+	}
+	var polygon velocity.GeoPolygon
+	for _, pair := range strings.Split(ring, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) != 2 {
+			return nil, false
+		}
+		lon, err1 := strconv.ParseFloat(parts[0], 64)
+		lat, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil {
+			return nil, false
+		}
+		polygon = append(polygon, velocity.GeoPoint{Lat: lat, Lon: lon})
+	}
+	return polygon, len(polygon) >= 3
+}
+
+// spatialFilter turns ST_DWithin(column, point, meters), ST_Within(column,
+// region) and ST_Contains(region, column) into the geo search filter that
+// finds the same rows through the column's cell postings.
+func spatialFilter(v *ast.FuncCall, eval *Evaluator) (velocity.SearchFilter, bool) {
+	name := strings.ToLower(qualifiedIdentToString(v.Name))
+	if !isSpatialFunc(name, len(v.Args)) {
+		return velocity.SearchFilter{}, false
+	}
+	column, other := 0, 1
+	switch name {
+	case "st_dwithin", "st_within":
+		if exprColumnName(v.Args[0]) == "" {
+			column, other = 1, 0
+		}
+	case "st_contains":
+		column, other = 1, 0
+	default:
+		return velocity.SearchFilter{}, false
+	}
+	field := exprColumnName(v.Args[column])
+	if field == "" {
+		return velocity.SearchFilter{}, false
+	}
+	value, err := eval.Eval(v.Args[other], nil)
+	if err != nil || value == nil {
+		return velocity.SearchFilter{}, false
+	}
+	if name == "st_dwithin" {
+		center, ok := velocity.ParseGeoPoint(value)
+		if !ok {
+			return velocity.SearchFilter{}, false
+		}
+		raw, err := eval.Eval(v.Args[2], nil)
+		if err != nil {
+			return velocity.SearchFilter{}, false
+		}
+		meters, ok := asFloat(raw)
+		if !ok {
+			return velocity.SearchFilter{}, false
+		}
+		return velocity.SearchFilter{Field: field, Op: velocity.GeoWithinRadius, Value: velocity.GeoRadius{Center: center, Meters: meters}}, true
+	}
+	if column == 1 && name == "st_within" {
+		// A constant point within a column's region is not a geo filter.
+		return velocity.SearchFilter{}, false
+	}
+	switch region := value.(type) {
+	case velocity.GeoBBox:
+		return velocity.SearchFilter{Field: field, Op: velocity.GeoWithinBBox, Value: region}, true
+	case velocity.GeoPolygon:
+		return velocity.SearchFilter{Field: field, Op: velocity.GeoWithinPolygon, Value: region}, true
+	}
+	return velocity.SearchFilter{}, false
+}
+
+func isSpatialFilterOp(op string) bool {
+	return op == velocity.GeoWithinRadius || op == velocity.GeoWithinBBox || op == velocity.GeoWithinPolygon
+}
@@ -0,0 +1,122 @@
+package sqldriver
+
+import (
+	"database/sql"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/oarkflow/sqlparser"
+	"github.com/oarkflow/sqlparser/ast"
+	"github.com/oarkflow/velocity"
+)
+
+func TestSQLDriver_SpatialFunctions(t *testing.T) {
+	os.RemoveAll("./testdb_spatial")
+	defer os.RemoveAll("./testdb_spatial")
+
+	db, err := sql.Open("velocity", "./testdb_spatial")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE places (
+		id int PRIMARY KEY,
+		name string,
+		loc point SPATIAL
+	)`); err != nil {
+		t.Fatalf("create table failed: %v", err)
+	}
+	for _, stmt := range []string{
+		`INSERT INTO places (id, name, loc) VALUES (1, 'Paris', ST_Point(2.3522, 48.8566))`,
+		`INSERT INTO places (id, name, loc) VALUES (2, 'Versailles', 'POINT(2.1204 48.8049)')`,
+		`INSERT INTO places (id, name, loc) VALUES (3, 'London', '51.5074,-0.1278')`,
+		`INSERT INTO places (id, name, loc) VALUES (4, 'Berlin', ST_GeomFromText('POINT(13.405 52.52)'))`,
+		`INSERT INTO places (id, name) VALUES (5, 'Nowhere')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO places (id, name, loc) VALUES (6, 'Mars', 'POINT(200 100)')`); err == nil {
+		t.Fatal("expected an invalid point to be rejected")
+	}
+
+	ids := func(query string, args ...any) []int {
+		t.Helper()
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		defer rows.Close()
+		var out []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				t.Fatalf("scan failed: %v", err)
+			}
+			out = append(out, id)
+		}
+		return out
+	}
+	expect := func(got []int, want ...int) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		}
+	}
+
+	expect(ids(`SELECT id FROM places WHERE ST_DWithin(loc, ST_Point(2.3522, 48.8566), 25000) ORDER BY id`), 1, 2)
+	expect(ids(`SELECT id FROM places WHERE ST_DWithin(loc, ST_MakePoint(?, ?), ?) ORDER BY id`, 2.3522, 48.8566, 400000), 1, 2, 3)
+	expect(ids(`SELECT id FROM places WHERE ST_Within(loc, ST_MakeEnvelope(-5, 45, 5, 55)) AND name != 'Paris' ORDER BY id`), 2, 3)
+	expect(ids(`SELECT id FROM places WHERE ST_Contains(ST_GeomFromText('POLYGON((-3 51, -3 53, 16 53, 16 51.8, -3 51))'), loc) ORDER BY id`), 3, 4)
+	// Distance ordering leaves rows without a point out of the comparison.
+	expect(ids(`SELECT id FROM places WHERE loc IS NOT NULL ORDER BY ST_Distance(loc, ST_Point(13.405, 52.52))`), 4, 1, 2, 3)
+
+	var dist, lon, lat float64
+	if err := db.QueryRow(`SELECT ST_Distance(loc, ST_Point(-0.1278, 51.5074)), ST_X(loc), ST_Y(loc) FROM places ORDER BY id LIMIT 1`).Scan(&dist, &lon, &lat); err != nil {
+		t.Fatalf("distance query failed: %v", err)
+	}
+	if math.Abs(dist-343_500) > 1_000 || lon != 2.3522 || lat != 48.8566 {
+		t.Fatalf("unexpected distance %.0f or coordinates %v, %v", dist, lon, lat)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM places WHERE ST_DWithin(loc, 'POINT(2.3522 48.8566)', 400000)`).Scan(&count); err != nil {
+		t.Fatalf("count query failed: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected count=3, got %d", count)
+	}
+}
+
+func TestSpatialFilterPushdown(t *testing.T) {
+	e := &ExecutorV2{}
+	for query, want := range map[string]string{
+		`SELECT * FROM t WHERE ST_DWithin(loc, ST_Point(2, 48), 1000) AND kind = 'a'`:         velocity.GeoWithinRadius,
+		`SELECT * FROM t WHERE ST_Within(loc, ST_MakeEnvelope(1, 2, 3, 4))`:                   velocity.GeoWithinBBox,
+		`SELECT * FROM t WHERE ST_Contains(ST_GeomFromText('POLYGON((0 0, 1 0, 1 1))'), loc)`: velocity.GeoWithinPolygon,
+		`SELECT * FROM t WHERE ST_Within(ST_Point(2, 48), ST_MakeEnvelope(1, 2, 3, 4))`:       "",
+		`SELECT * FROM t WHERE ST_Distance(loc, ST_Point(2, 48)) < 1000`:                      "",
+	} {
+		stmt, err := sqlparser.NewString(query).Next()
+		if err != nil {
+			t.Fatalf("parse %q: %v", query, err)
+		}
+		got := ""
+		for _, f := range e.extractFilters(stmt.(*ast.SelectStmt).Where, nil) {
+			if isSpatialFilterOp(f.Op) {
+				got = f.Op
+			}
+		}
+		if got != want {
+			t.Errorf("%s: pushed down %q, want %q", query, got, want)
+		}
+	}
+}
@@ -39,6 +39,7 @@ const (
 	columnTypeTime       columnTypeKind = "time"
 	columnTypeUUID       columnTypeKind = "uuid"
 	columnTypeMoney      columnTypeKind = "money"
+	columnTypeGeoPoint   columnTypeKind = "geopoint"
 )
 
 type sqlColumnType struct {
@@ -100,6 +101,8 @@ func columnTypeFromAST(dt *ast.DataType) (sqlColumnType, error) {
 		meta.Kind = columnTypeUUID
 	case "money":
 		meta.Kind = columnTypeMoney
+	case "point", "geopoint", "geo_point", "geography":
+		meta.Kind = columnTypeGeoPoint
 	default:
 		return sqlColumnType{}, fmt.Errorf("velocity driver: unsupported SQL column type %q", name)
 	}
@@ -217,6 +220,8 @@ func coerceColumnValue(typ sqlColumnType, value any) (any, error) {
 		return coerceTimeOnly(value)
 	case columnTypeMoney:
 		return coerceMoney(value)
+	case columnTypeGeoPoint:
+		return coerceGeoPoint(value)
 	default:
 		return value, nil
 	}
@@ -523,6 +528,21 @@ func parseFlexibleTime(s string, requireZone bool) (time.Time, error) {
 	return time.Time{}, last
 }
 
+func coerceGeoPoint(value any) (any, error) {
+	if v, ok := value.(driver.Valuer); ok {
+		raw, err := v.Value()
+		if err != nil {
+			return nil, err
+		}
+		value = raw
+	}
+	p, ok := velocity.ParseGeoPoint(value)
+	if !ok {
+		return nil, fmt.Errorf("expected geo point, got %v", value)
+	}
+	return map[string]any{"lat": p.Lat, "lon": p.Lon}, nil
+}
+
 func coerceMoney(value any) (any, error) {
 	switch v := value.(type) {
 	case money.Money:
@@ -253,6 +253,15 @@ func (c *LRUCache) Remove(key string) {
 	}
 }
 
+// Clear removes every entry from the cache.
+func (c *LRUCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.items = make(map[string]*cacheItem)
+	c.evictList = newList()
+	c.totalBytes = 0
+}
+
 func (c *LRUCache) CapacityBytes() int64 {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
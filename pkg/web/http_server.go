@@ -506,7 +506,27 @@ func (s *HTTPServer) handleSearch(c fiber.Ctx) error {
 			Value    interface{} `json:"value"`
 			HashOnly bool        `json:"hashOnly"`
 		} `json:"filters"`
-		Limit int `json:"limit"`
+		Sort []struct {
+			Field string `json:"field"`
+			Desc  bool   `json:"desc"`
+		} `json:"sort"`
+		Limit        int      `json:"limit"`
+		Offset       int      `json:"offset"`
+		After        string   `json:"after"`
+		Fields       []string `json:"fields"`
+		Aggregations []struct {
+			Name     string  `json:"name"`
+			Type     string  `json:"type"`
+			Field    string  `json:"field"`
+			Size     int     `json:"size"`
+			Interval float64 `json:"interval"`
+			Ranges   []struct {
+				Key  string   `json:"key"`
+				From *float64 `json:"from"`
+				To   *float64 `json:"to"`
+			} `json:"ranges"`
+			DateInterval string `json:"dateInterval"`
+		} `json:"aggregations"`
 	}
 
 	if err := c.Bind().Body(&req); err != nil {
@@ -522,6 +542,9 @@ func (s *HTTPServer) handleSearch(c fiber.Ctx) error {
 	if req.Limit > 1000 {
 		return fiber.NewError(fiber.StatusBadRequest, "limit exceeds maximum of 1000")
 	}
+	if req.Offset < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "offset must be >= 0")
+	}
 
 	allowedOps := map[string]struct{}{
 		"=":        {},
@@ -535,7 +558,34 @@ func (s *HTTPServer) handleSearch(c fiber.Ctx) error {
 		"prefix":   {},
 	}
 
-	query := velocity.SearchQuery{Prefix: req.Prefix, FullText: req.FullText, Limit: req.Limit}
+	query := velocity.SearchQuery{
+		Prefix:   req.Prefix,
+		FullText: req.FullText,
+		Limit:    req.Limit,
+		Offset:   req.Offset,
+		After:    req.After,
+		Fields:   req.Fields,
+	}
+	for _, o := range req.Sort {
+		if strings.TrimSpace(o.Field) == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "sort field is required")
+		}
+		query.Sort = append(query.Sort, velocity.SearchSort{Field: o.Field, Desc: o.Desc})
+	}
+	for _, a := range req.Aggregations {
+		agg := velocity.SearchAggregation{
+			Name:         a.Name,
+			Type:         a.Type,
+			Field:        a.Field,
+			Size:         a.Size,
+			Interval:     a.Interval,
+			DateInterval: a.DateInterval,
+		}
+		for _, r := range a.Ranges {
+			agg.Ranges = append(agg.Ranges, velocity.AggregationRange{Key: r.Key, From: r.From, To: r.To})
+		}
+		query.Aggregations = append(query.Aggregations, agg)
+	}
 	for _, f := range req.Filters {
 		if strings.TrimSpace(f.Field) == "" {
 			return fiber.NewError(fiber.StatusBadRequest, "filter field is required")
@@ -552,23 +602,48 @@ func (s *HTTPServer) handleSearch(c fiber.Ctx) error {
 		})
 	}
 
-	results, err := s.db.Search(query)
+	var results []velocity.SearchResult
+	var searched *velocity.SearchResponse
+	var err error
+	if len(query.Aggregations) > 0 {
+		searched, err = s.db.SearchWithAggregations(query)
+		if searched != nil {
+			results = searched.Results
+		}
+	} else {
+		results, err = s.db.Search(query)
+	}
+	if errors.Is(err, velocity.ErrInvalidSearchCursor) || errors.Is(err, velocity.ErrInvalidAggregation) {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 	}
 
 	resp := make([]fiber.Map, 0, len(results))
 	for _, r := range results {
-		resp = append(resp, fiber.Map{
+		item := fiber.Map{
 			"key":   string(r.Key),
 			"value": string(r.Value),
-		})
+		}
+		if r.Cursor != "" {
+			item["cursor"] = r.Cursor
+		}
+		resp = append(resp, item)
 	}
 
-	return c.JSON(fiber.Map{
+	out := fiber.Map{
 		"count":   len(resp),
 		"results": resp,
-	})
+	}
+	if len(results) == req.Limit && results[len(results)-1].Cursor != "" {
+		out["next"] = results[len(results)-1].Cursor
+	}
+	if searched != nil {
+		out["total"] = searched.Total
+		out["aggregations"] = searched.Aggregations
+	}
+	return c.JSON(out)
 }
 
 const MaxUploadSize = 100 * 1024 * 1024 // 100 MB
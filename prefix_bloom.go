@@ -0,0 +1,185 @@
+package velocity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// PrefixExtractor maps keys to the prefix SSTables build a prefix bloom
+// filter over, so scans for a prefix can skip tables that hold no key with
+// it. An extractor must be consistent with key order: if Prefix(p) is ok,
+// every key that starts with p has the same prefix as p.
+type PrefixExtractor interface {
+	// Name identifies the extractor. Tables record it, and their prefix
+	// blooms are only used while the same extractor is configured.
+	Name() string
+	// Prefix returns the prefix of key, and false if key has none.
+	Prefix(key []byte) ([]byte, bool)
+}
+
+// DelimiterPrefixExtractor returns an extractor whose prefix runs up to and
+// including the n-th occurrence of delim, for example "users:" of
+// "users:42:name" for ':' and 1. Keys with fewer delimiters have no prefix.
+func DelimiterPrefixExtractor(delim byte, n int) PrefixExtractor {
+	if n < 1 {
+		n = 1
+	}
+	return delimiterPrefixExtractor{delim: delim, n: n}
+}
+
+type delimiterPrefixExtractor struct {
+	delim byte
+	n     int
+}
+
+func (e delimiterPrefixExtractor) Name() string {
+	return fmt.Sprintf("delimiter:%q:%d", e.delim, e.n)
+}
+
+func (e delimiterPrefixExtractor) Prefix(key []byte) ([]byte, bool) {
+	end := 0
+	for i := 0; i < e.n; i++ {
+		j := bytes.IndexByte(key[end:], e.delim)
+		if j < 0 {
+			return nil, false
+		}
+		end += j + 1
+	}
+	return key[:end], true
+}
+
+// FixedPrefixExtractor returns an extractor whose prefix is the first n
+// bytes of a key. Shorter keys have no prefix.
+func FixedPrefixExtractor(n int) PrefixExtractor {
+	return fixedPrefixExtractor(n)
+}
+
+type fixedPrefixExtractor int
+
+func (e fixedPrefixExtractor) Name() string {
+	return fmt.Sprintf("fixed:%d", int(e))
+}
+
+func (e fixedPrefixExtractor) Prefix(key []byte) ([]byte, bool) {
+	if int(e) <= 0 || len(key) < int(e) {
+		return nil, false
+	}
+	return key[:e], true
+}
+
+// prefixBloomMagic starts the prefix bloom section, which follows the key
+// bloom filter inside the bloom region of a table. Readers that predate it
+// only decode the key bloom and skip the rest of the region.
+const prefixBloomMagic = 0x50424c4d // "PBLM"
+
+// newPrefixBloom returns the prefix bloom filter of the keys of index, or
+// nil if none of them has a prefix.
+func newPrefixBloom(index []IndexEntry, extractor PrefixExtractor, bitsPerKey int) *BloomFilter {
+	var prefixes [][]byte
+	for _, e := range index {
+		p, ok := extractor.Prefix(e.Key)
+		if !ok {
+			continue
+		}
+		if n := len(prefixes); n > 0 && bytes.Equal(prefixes[n-1], p) {
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	bf := NewBloomFilter(len(prefixes), bitsPerKey)
+	for _, p := range prefixes {
+		bf.Add(p)
+	}
+	return bf
+}
+
+// appendPrefixBloom appends the prefix bloom section: the magic, the
+// extractor name, the filter and a CRC32 of all of it.
+func appendPrefixBloom(dst []byte, name string, bf *BloomFilter) []byte {
+	start := len(dst)
+	dst = binary.LittleEndian.AppendUint32(dst, prefixBloomMagic)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(name)))
+	dst = append(dst, name...)
+	data := bf.Marshal()
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(data)))
+	dst = append(dst, data...)
+	return binary.LittleEndian.AppendUint32(dst, crc32.ChecksumIEEE(dst[start:]))
+}
+
+// readPrefixBloom decodes the bloom region after the key bloom filter. An
+// empty region means the table has no prefix bloom.
+func readPrefixBloom(data []byte) (string, *BloomFilter, error) {
+	if len(data) == 0 {
+		return "", nil, nil
+	}
+	if len(data) < 16 || binary.LittleEndian.Uint32(data) != prefixBloomMagic {
+		return "", nil, fmt.Errorf("sstable: unknown data after bloom filter")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return "", nil, fmt.Errorf("sstable: prefix bloom checksum mismatch")
+	}
+	pos := 4
+	nameLen := int(binary.LittleEndian.Uint32(body[pos:]))
+	pos += 4
+	if pos+nameLen+4 > len(body) {
+		return "", nil, fmt.Errorf("sstable: prefix bloom truncated")
+	}
+	name := string(body[pos : pos+nameLen])
+	pos += nameLen
+	size := int(binary.LittleEndian.Uint32(body[pos:]))
+	pos += 4
+	if pos+size != len(body) {
+		return "", nil, fmt.Errorf("sstable: prefix bloom truncated")
+	}
+	bf, err := unmarshalBloomFilter(body[pos:])
+	if err != nil {
+		return "", nil, err
+	}
+	return name, bf, nil
+}
+
+// mayHoldPrefix reports whether the table may hold a key starting with
+// prefix: the prefix must fall in the table's key range, and if the table
+// has a prefix bloom built by extractor, the bloom must admit it.
+func (sst *SSTable) mayHoldPrefix(prefix []byte, extractor PrefixExtractor) bool {
+	if sst.minKey == nil || compareKeys(sst.maxKey, prefix) < 0 {
+		return false
+	}
+	if end := prefixUpperBound(prefix); end != nil && compareKeys(sst.minKey, end) >= 0 {
+		return false
+	}
+	if sst.prefixBloom == nil || extractor == nil || sst.prefixExtractor != extractor.Name() {
+		return true
+	}
+	p, ok := extractor.Prefix(prefix)
+	return !ok || sst.prefixBloom.Contains(p)
+}
+
+// mayHoldRange reports whether the table's key range meets [lower, upper);
+// nil bounds are open.
+func (sst *SSTable) mayHoldRange(lower, upper []byte) bool {
+	if sst.minKey == nil {
+		return false
+	}
+	if lower != nil && compareKeys(sst.maxKey, lower) < 0 {
+		return false
+	}
+	return upper == nil || compareKeys(sst.minKey, upper) < 0
+}
+
+// mayHoldSearchPrefix reports whether the table may hold a key a search with
+// the given prefix matches: the prefix itself, or the prefix followed by ':'
+// or '/'; see prefixMatch.
+func (sst *SSTable) mayHoldSearchPrefix(prefix string, extractor PrefixExtractor) bool {
+	exact := []byte(prefix)
+	if compareKeys(exact, sst.minKey) >= 0 && compareKeys(exact, sst.maxKey) <= 0 && sst.bloomFilter.Contains(exact) {
+		return true
+	}
+	return sst.mayHoldPrefix([]byte(prefix+":"), extractor) || sst.mayHoldPrefix([]byte(prefix+"/"), extractor)
+}
@@ -0,0 +1,141 @@
+package velocity
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPrefixBloomSkipsTablesInScans(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{Path: dir, PrefixExtractor: DelimiterPrefixExtractor(':', 1), SkipCloseFlush: true}
+	db, err := NewWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both tables span "a:" to "d:", so only the prefix bloom tells which of
+	// them holds the "c:" keys.
+	for i, prefixes := range [][]string{{"a", "c"}, {"b", "d"}} {
+		for _, p := range prefixes {
+			for j := 0; j < 5; j++ {
+				db.Put([]byte(fmt.Sprintf("%s:%d", p, j)), []byte(fmt.Sprint(i)))
+			}
+		}
+		if err := db.flushMemTable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// The prefix blooms are read back from disk.
+	db, err = NewWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count := func(prefix string) int {
+		n := 0
+		if err := db.Scan([]byte(prefix), func(key, value []byte) bool {
+			n++
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count("c:"); n != 5 {
+		t.Fatalf("expected 5 c: keys, got %d", n)
+	}
+	if skipped := db.Stats().ScanTablesSkipped; skipped == 0 {
+		t.Fatal("expected the scan to skip the table without c: keys")
+	}
+	if n := count("c"); n != 5 {
+		t.Fatalf("expected 5 keys for a prefix shorter than the extractor's, got %d", n)
+	}
+	if n := count("z:"); n != 0 {
+		t.Fatalf("expected no z: keys, got %d", n)
+	}
+}
+
+func TestPrefixBloomSkipsTablesInSearchScans(t *testing.T) {
+	// Searches match the prefix followed by ':' or '/', so only an
+	// extractor that cuts before either can rule a table out.
+	db, err := NewWithConfig(Config{Path: t.TempDir(), PrefixExtractor: FixedPrefixExtractor(2), SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, prefixes := range [][]string{{"aa", "cc"}, {"bb", "dd"}} {
+		for _, p := range prefixes {
+			for j := 0; j < 5; j++ {
+				db.Put([]byte(fmt.Sprintf("%s:%d", p, j)), []byte(`{"n":1}`))
+			}
+		}
+		if err := db.flushMemTable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := db.Search(SearchQuery{Prefix: "cc", Limit: 100})
+	if err != nil || len(results) != 5 {
+		t.Fatalf("expected 5 cc keys from search, got %d (%v)", len(results), err)
+	}
+	if db.Stats().ScanTablesSkipped == 0 {
+		t.Fatal("expected the search scan to skip the table without cc keys")
+	}
+}
+
+func TestPrefixBloomIgnoredForOtherExtractor(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewWithConfig(Config{Path: dir, PrefixExtractor: FixedPrefixExtractor(2), SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("ab:1"), []byte("v"))
+	db.Put([]byte("ab:2"), []byte("v"))
+	db.Put([]byte("ad:1"), []byte("v"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// "ac:" is inside the table's key range; the stored blooms were built
+	// with another extractor, so they must not be trusted.
+	db, err = NewWithConfig(Config{Path: dir, PrefixExtractor: DelimiterPrefixExtractor(':', 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put([]byte("ac:1"), []byte("v"))
+	n := 0
+	db.Scan([]byte("a"), func(key, value []byte) bool {
+		n++
+		return true
+	})
+	if n != 4 {
+		t.Fatalf("expected 4 keys, got %d", n)
+	}
+}
+
+func TestBloomBitsPerKeySizesFilters(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir(), BloomBitsPerKey: 20, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("bb:%03d", i)), []byte("v"))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.mutex.RLock()
+	sst := db.levels[0][0]
+	db.mutex.RUnlock()
+	if want := uint64(sst.entryCount * 20); sst.bloomFilter.size != want || sst.bloomFilter.hash != 14 {
+		t.Fatalf("expected %d bits and 14 hashes, got %d and %d", want, sst.bloomFilter.size, sst.bloomFilter.hash)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("bb:%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
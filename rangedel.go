@@ -0,0 +1,294 @@
+package velocity
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// entryKind tells special WAL records apart from ordinary values and
+// tombstones.
+type entryKind uint8
+
+const (
+	entryKindValue entryKind = iota
+	entryKindRangeDelete
+	entryKindMerge
+	// entryKindValuePointer is an SSTable record whose value was moved to
+	// the value log; its Value holds the location.
+	entryKindValuePointer
+)
+
+// Values of the flag byte that WAL and SSTable records carry. Older files
+// only ever wrote the first two.
+const (
+	recordFlagValue       byte = 0
+	recordFlagTombstone   byte = 1
+	recordFlagRangeDelete byte = 2
+	recordFlagMerge       byte = 3
+	recordFlagValuePtr    byte = 4
+)
+
+// recordFlag returns the flag byte stored with an entry.
+func recordFlag(e *Entry) byte {
+	switch {
+	case e.kind == entryKindRangeDelete:
+		return recordFlagRangeDelete
+	case e.kind == entryKindMerge:
+		return recordFlagMerge
+	case e.kind == entryKindValuePointer:
+		return recordFlagValuePtr
+	case e.Deleted:
+		return recordFlagTombstone
+	default:
+		return recordFlagValue
+	}
+}
+
+// applyRecordFlag sets the fields of e that flag encodes.
+func applyRecordFlag(e *Entry, flag byte) {
+	e.Deleted = flag == recordFlagTombstone
+	switch flag {
+	case recordFlagRangeDelete:
+		e.kind = entryKindRangeDelete
+	case recordFlagMerge:
+		e.kind = entryKindMerge
+	case recordFlagValuePtr:
+		e.kind = entryKindValuePointer
+	}
+}
+
+// rangeTombstone deletes every version of the keys in [Start, End) that is
+// older than Timestamp. Writes made after the tombstone stay visible.
+type rangeTombstone struct {
+	Start     []byte
+	End       []byte
+	Timestamp uint64
+}
+
+// rangeTombstoneFromEntry decodes a range tombstone from its WAL record,
+// which stores the start key as the key and the end key as the value.
+func rangeTombstoneFromEntry(e *Entry) rangeTombstone {
+	return rangeTombstone{
+		Start:     append([]byte(nil), e.Key...),
+		End:       append([]byte(nil), e.Value...),
+		Timestamp: e.Timestamp,
+	}
+}
+
+// entry encodes the tombstone as a WAL record.
+func (t rangeTombstone) entry() *Entry {
+	return &Entry{
+		Key:       t.Start,
+		Value:     t.End,
+		Timestamp: t.Timestamp,
+		kind:      entryKindRangeDelete,
+		checksum:  crc32.ChecksumIEEE(append(append([]byte(nil), t.Start...), t.End...)),
+	}
+}
+
+// contains reports whether key falls inside the tombstone's range.
+func (t rangeTombstone) contains(key []byte) bool {
+	return compareKeys(key, t.Start) >= 0 && compareKeys(key, t.End) < 0
+}
+
+// overlaps reports whether the range intersects the keys between lower and
+// upper, both inclusive. A nil bound is open.
+func (t rangeTombstone) overlaps(lower, upper []byte) bool {
+	if lower != nil && compareKeys(t.End, lower) <= 0 {
+		return false
+	}
+	return upper == nil || compareKeys(t.Start, upper) <= 0
+}
+
+// clipTombstones returns the parts of the tombstones that fall in [lower,
+// upper). A nil bound is open.
+func clipTombstones(tombstones []rangeTombstone, lower, upper []byte) []rangeTombstone {
+	var out []rangeTombstone
+	for _, t := range tombstones {
+		if lower != nil && compareKeys(t.Start, lower) < 0 {
+			t.Start = lower
+		}
+		if upper != nil && compareKeys(t.End, upper) > 0 {
+			t.End = upper
+		}
+		if compareKeys(t.Start, t.End) < 0 {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// keySuccessor returns the smallest key that sorts after key.
+func keySuccessor(key []byte) []byte {
+	return append(append(make([]byte, 0, len(key)+1), key...), 0)
+}
+
+// coveringTombstoneTs returns the timestamp of the newest tombstone in
+// tombstones that covers key and is visible at readTs, or 0.
+func coveringTombstoneTs(tombstones []rangeTombstone, key []byte, readTs uint64) uint64 {
+	var newest uint64
+	for _, t := range tombstones {
+		if t.Timestamp > newest && t.Timestamp <= readTs && t.contains(key) {
+			newest = t.Timestamp
+		}
+	}
+	return newest
+}
+
+// addRangeTombstone records a range tombstone in the memtable.
+func (mt *MemTable) addRangeTombstone(t rangeTombstone) {
+	mt.rangeMu.Lock()
+	mt.rangeDels = append(mt.rangeDels, t)
+	mt.rangeMu.Unlock()
+	atomic.AddInt64(&mt.size, int64(len(t.Start)+len(t.End)))
+}
+
+// rangeTombstones returns the range tombstones written to the memtable.
+func (mt *MemTable) rangeTombstones() []rangeTombstone {
+	mt.rangeMu.RLock()
+	defer mt.rangeMu.RUnlock()
+	return mt.rangeDels[:len(mt.rangeDels):len(mt.rangeDels)]
+}
+
+// DeleteRange deletes every key in [start, end) with a single range
+// tombstone, however many keys the range holds. The space is reclaimed as
+// compaction rewrites the affected tables. Search indexes and watchers are
+// not updated for the individual keys.
+func (db *DB) DeleteRange(start, end []byte) error {
+	if len(end) == 0 || compareKeys(start, end) >= 0 {
+		return fmt.Errorf("invalid range: start must sort before end")
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.makeRoomForWriteLocked(); err != nil {
+		return err
+	}
+	return db.deleteRangeLocked(start, end, true)
+}
+
+// DeletePrefix deletes every key that starts with prefix. See DeleteRange.
+func (db *DB) DeletePrefix(prefix []byte) error {
+	end := prefixUpperBound(prefix)
+	if len(prefix) == 0 || end == nil {
+		return fmt.Errorf("invalid prefix: prefix %q has no upper bound", prefix)
+	}
+	return db.DeleteRange(prefix, end)
+}
+
+// deleteRangeLocked writes a range tombstone, logging it to the WAL unless
+// useWAL is false. Callers hold db.mutex, which keeps snapshots and memtable
+// swaps out while the tombstone is added.
+func (db *DB) deleteRangeLocked(start, end []byte, useWAL bool) error {
+	t := rangeTombstone{
+		Start:     append([]byte(nil), start...),
+		End:       append([]byte(nil), end...),
+		Timestamp: nextEntryTimestamp(),
+	}
+	if useWAL && !db.disableWAL {
+		if db.wal == nil {
+			return fmt.Errorf("WAL is not initialized")
+		}
+		if err := db.wal.Write(t.entry()); err != nil {
+			return err
+		}
+	}
+	db.applyPendingLocked()
+	db.memTable.addRangeTombstone(t)
+	db.hasRangeDels.Store(true)
+	if db.cache != nil {
+		db.cache.Clear()
+	}
+	return nil
+}
+
+// updateRangeDelsLocked sets hasRangeDels from the memtables and tables
+// that hold range tombstones, once a flush or compaction changed them, so
+// reads stop looking for tombstones after compaction dropped the last one.
+// Callers hold db.mutex.
+func (db *DB) updateRangeDelsLocked() {
+	has := len(db.memTable.rangeTombstones()) > 0
+	for _, mt := range db.flushingMemTables {
+		has = has || len(mt.rangeTombstones()) > 0
+	}
+	for _, level := range db.levels {
+		for _, sst := range level {
+			has = has || len(sst.rangeDels) > 0
+		}
+	}
+	db.hasRangeDels.Store(has)
+}
+
+// rangeDeleteTsLocked returns the timestamp of the newest range tombstone
+// that covers key and is visible at readTs, or 0 if there is none. Callers
+// hold db.mutex.
+func (db *DB) rangeDeleteTsLocked(key []byte, readTs uint64) uint64 {
+	if !db.hasRangeDels.Load() {
+		return 0
+	}
+	newest := coveringTombstoneTs(db.memTable.rangeTombstones(), key, readTs)
+	for _, mt := range db.flushingMemTables {
+		newest = max(newest, coveringTombstoneTs(mt.rangeTombstones(), key, readTs))
+	}
+	for _, level := range db.levels {
+		for _, sst := range level {
+			newest = max(newest, coveringTombstoneTs(sst.rangeDels, key, readTs))
+		}
+	}
+	return newest
+}
+
+// rangeTombstonesLocked returns the range tombstones visible at readTs that
+// overlap the keys between lower and upper, both inclusive. Callers hold
+// db.mutex.
+func (db *DB) rangeTombstonesLocked(readTs uint64, lower, upper []byte) []rangeTombstone {
+	if !db.hasRangeDels.Load() {
+		return nil
+	}
+	var out []rangeTombstone
+	collect := func(tombstones []rangeTombstone) {
+		for _, t := range tombstones {
+			if t.Timestamp <= readTs && t.overlaps(lower, upper) {
+				out = append(out, t)
+			}
+		}
+	}
+	collect(db.memTable.rangeTombstones())
+	for _, mt := range db.flushingMemTables {
+		collect(mt.rangeTombstones())
+	}
+	for _, level := range db.levels {
+		for _, sst := range level {
+			collect(sst.rangeDels)
+		}
+	}
+	return out
+}
+
+// applyRangeDeletesLocked returns entry, the newest stored version of key at
+// readTs, or a tombstone if a newer range tombstone deletes it. Callers hold
+// db.mutex.
+func (db *DB) applyRangeDeletesLocked(key []byte, entry *Entry, readTs uint64) *Entry {
+	ts := db.rangeDeleteTsLocked(key, readTs)
+	if ts == 0 || (entry != nil && entry.Timestamp > ts) {
+		return entry
+	}
+	return &Entry{Key: key, Timestamp: ts, Deleted: true}
+}
+
+// rangeDeletedLocked reports whether a range tombstone newer than entry
+// deletes it. Callers hold db.mutex.
+func (db *DB) rangeDeletedLocked(entry *Entry) bool {
+	return db.rangeDeleteTsLocked(entry.Key, ^uint64(0)) > entry.Timestamp
+}
+
+// keyRangeDeletedLocked reports whether a range tombstone deletes the newest
+// stored version of key. Callers hold db.mutex.
+func (db *DB) keyRangeDeletedLocked(key []byte) bool {
+	ts := db.rangeDeleteTsLocked(key, ^uint64(0))
+	if ts == 0 {
+		return false
+	}
+	entry, err := db.latestStoredEntryLocked(key)
+	return err == nil && (entry == nil || entry.Timestamp < ts)
+}
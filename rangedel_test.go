@@ -0,0 +1,297 @@
+package velocity
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func scanKeys(t *testing.T, db *DB, prefix string) []string {
+	t.Helper()
+	var keys []string
+	if err := db.Scan([]byte(prefix), func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestDeleteRangeAcrossMemtableAndSSTables(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewWithConfig(Config{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		db.Put([]byte(fmt.Sprintf("a:%02d", i)), []byte("old"))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 20; i < 30; i++ {
+		db.Put([]byte(fmt.Sprintf("a:%02d", i)), []byte("old"))
+	}
+	snap := db.NewSnapshot()
+	defer snap.Release()
+
+	if err := db.DeleteRange([]byte("a:05"), []byte("a:25")); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("a:10"), []byte("new"))
+
+	check := func(stage string) {
+		t.Helper()
+		if _, err := db.Get([]byte("a:07")); err == nil {
+			t.Fatalf("%s: a:07 should be deleted", stage)
+		}
+		if _, err := db.Get([]byte("a:22")); err == nil {
+			t.Fatalf("%s: a:22 should be deleted", stage)
+		}
+		if db.Has([]byte("a:22")) {
+			t.Fatalf("%s: Has reports deleted key a:22", stage)
+		}
+		if v, err := db.Get([]byte("a:10")); err != nil || string(v) != "new" {
+			t.Fatalf("%s: expected rewritten a:10, got %q (%v)", stage, v, err)
+		}
+		if v, err := db.Get([]byte("a:25")); err != nil || string(v) != "old" {
+			t.Fatalf("%s: end key must survive, got %q (%v)", stage, v, err)
+		}
+		if got := scanKeys(t, db, "a:"); len(got) != 11 {
+			t.Fatalf("%s: expected 11 keys after the range delete, got %v", stage, got)
+		}
+		keys, err := db.Keys("a:*")
+		if err != nil || len(keys) != 11 {
+			t.Fatalf("%s: expected 11 keys from Keys, got %v (%v)", stage, keys, err)
+		}
+	}
+	check("memtable")
+	if v, err := snap.Get([]byte("a:07")); err != nil || string(v) != "old" {
+		t.Fatalf("snapshot should still read a:07, got %q (%v)", v, err)
+	}
+
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	check("flushed")
+	snap.Release()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewWithConfig(Config{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("reopened")
+}
+
+func TestDeletePrefixReplaysFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewWithConfig(Config{Path: dir, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("tmp:%d", i)), []byte("v"))
+	}
+	db.Put([]byte("keep"), []byte("v"))
+	if err := db.DeletePrefix([]byte("tmp:")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeletePrefix(nil); err == nil {
+		t.Fatal("expected an empty prefix to be rejected")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := scanKeys(t, db, "tmp:"); len(got) != 0 {
+		t.Fatalf("expected prefix to stay deleted after replay, got %v", got)
+	}
+	if _, err := db.Get([]byte("keep")); err != nil {
+		t.Fatalf("expected key outside the prefix to survive: %v", err)
+	}
+}
+
+func TestCompactionDropsRangeDeletedKeys(t *testing.T) {
+	db := newCompactionTestDB(t)
+
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("a:%04d", i)), []byte("value"))
+	}
+	db.Put([]byte("b:0001"), []byte("value"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	snap := db.NewSnapshot()
+	if err := db.DeletePrefix([]byte("a:")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot from before the delete keeps the covered keys alive.
+	db.compactLevel(0)
+	if v, err := snap.Get([]byte("a:0100")); err != nil || string(v) != "value" {
+		t.Fatalf("snapshot lost a:0100 across compaction: %q (%v)", v, err)
+	}
+	if _, err := db.Get([]byte("a:0100")); err == nil {
+		t.Fatal("a:0100 should be deleted")
+	}
+	snap.Release()
+
+	// Rewrite level 1 into level 2 with nothing below it and no snapshot left.
+	db.compactLevel(1)
+	covered, tombstones := 0, 0
+	for _, level := range db.levels {
+		for _, sst := range level {
+			tombstones += len(sst.rangeDels)
+			iter, err := NewSSTableIterator(sst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for iter.Next() {
+				if strings.HasPrefix(string(iter.Entry().Key), "a:") {
+					covered++
+				}
+			}
+		}
+	}
+	if covered != 0 || tombstones != 0 {
+		t.Fatalf("expected the deleted keys and their tombstone to be gone, got %d keys and %d range tombstones", covered, tombstones)
+	}
+	// With the last tombstone gone, reads stop looking for them.
+	if db.hasRangeDels.Load() {
+		t.Fatal("expected reads to skip range tombstones once none are left")
+	}
+	if _, err := db.Get([]byte("b:0001")); err != nil {
+		t.Fatalf("expected b:0001 to survive: %v", err)
+	}
+}
+
+func TestCompactionKeepsLevelsDisjointWithRangeTombstones(t *testing.T) {
+	db := newCompactionTestDB(t)
+
+	value := []byte(strings.Repeat("v", 40))
+	for i := 0; i < 400; i++ {
+		db.Put([]byte(fmt.Sprintf("a:%04d", i)), value)
+	}
+	db.Put([]byte("z:0001"), value)
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.compactLevel(0)
+
+	// The snapshot keeps the tombstones through every compaction.
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	if err := db.DeleteRange([]byte("a:0050"), []byte("a:0350")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteRange([]byte("a:0390"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 300; i += 10 {
+		db.Put([]byte(fmt.Sprintf("a:%04d", i)), []byte("new"))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.compactLevel(0)
+	db.compactLevel(1)
+
+	for _, ls := range db.Stats().Levels {
+		if ls.Level > 0 && ls.Overlaps != 0 {
+			t.Fatalf("level %d has %d overlapping tables", ls.Level, ls.Overlaps)
+		}
+	}
+	tombstones := 0
+	for _, level := range db.levels[1:] {
+		for i, sst := range level {
+			tombstones += len(sst.rangeDels)
+			if i > 0 && compareKeys(level[i-1].maxKey, sst.minKey) >= 0 {
+				t.Fatalf("tables overlap: %s >= %s", level[i-1].maxKey, sst.minKey)
+			}
+		}
+	}
+	if tombstones < 3 {
+		t.Fatalf("expected the tombstones split across tables, got %d pieces", tombstones)
+	}
+
+	if got := scanKeys(t, db, "a:"); len(got) != 50+20+40 {
+		t.Fatalf("expected 110 keys after the range deletes, got %d", len(got))
+	}
+	for key, want := range map[string]bool{"a:0049": true, "a:0050": false, "a:0200": true, "a:0201": false, "a:0350": true, "a:0395": false, "z:0001": true} {
+		if _, err := db.Get([]byte(key)); (err == nil) != want {
+			t.Fatalf("Get(%s): %v, want present=%v", key, err, want)
+		}
+	}
+	if v, err := snap.Get([]byte("a:0201")); err != nil || string(v) != string(value) {
+		t.Fatalf("snapshot lost a:0201: %q (%v)", v, err)
+	}
+}
+
+func TestDropIndexForPrefixForgetsDocIDs(t *testing.T) {
+	db, err := NewWithConfig(Config{
+		Path:              t.TempDir(),
+		DisableEncryption: true,
+		SearchSchemas: map[string]*SearchSchema{
+			"items": {Fields: []SearchSchemaField{{Name: "kind", HashSearch: true}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		db.Put([]byte(fmt.Sprintf("items:%d", i)), []byte(`{"kind":"a"}`))
+	}
+	db.mutex.RLock()
+	oldID, _, _ := db.getDocIDLocked([]byte("items:1"))
+	db.mutex.RUnlock()
+
+	if err := db.DeletePrefix([]byte("items:")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropIndexForPrefix("items"); err != nil {
+		t.Fatal(err)
+	}
+	// The persisted bindings must be gone too, not just the cached ones.
+	db.mutex.Lock()
+	db.docIDByKey = map[string]uint64{}
+	db.mutex.Unlock()
+	for i := 0; i < 3; i++ {
+		db.mutex.RLock()
+		_, bound, _ := db.getDocIDLocked([]byte(fmt.Sprintf("items:%d", i)))
+		db.mutex.RUnlock()
+		if bound {
+			t.Fatalf("items:%d is still bound to a doc id", i)
+		}
+	}
+
+	q := SearchQuery{Prefix: "items", Filters: []SearchFilter{{Field: "kind", Op: "=", Value: "a", HashOnly: true}}}
+	if results, err := db.Search(q); err != nil || len(results) != 0 {
+		t.Fatalf("expected no results after the drop, got %v (%v)", resultKeys(results), err)
+	}
+	db.Put([]byte("items:1"), []byte(`{"kind":"a"}`))
+	results, err := db.Search(q)
+	if err != nil || fmt.Sprint(resultKeys(results)) != "[items:1]" {
+		t.Fatalf("expected the new row, got %v (%v)", resultKeys(results), err)
+	}
+	db.mutex.RLock()
+	newID, _, _ := db.getDocIDLocked([]byte("items:1"))
+	db.mutex.RUnlock()
+	if newID <= oldID {
+		t.Fatalf("expected a fresh doc id, got %d after %d", newID, oldID)
+	}
+}
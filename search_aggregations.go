@@ -0,0 +1,507 @@
+package velocity
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchAggregation summarizes the values of Field over every document a
+// query matches. Type is one of:
+//
+//   - "terms": the Size most frequent values with their counts.
+//   - "histogram": counts per bucket of Interval width.
+//   - "range": counts per range of Ranges.
+//   - "stats", "min", "max", "avg", "sum": numeric statistics.
+//   - "date_histogram": counts per DateInterval of RFC 3339 dates or Unix
+//     seconds or milliseconds.
+type SearchAggregation struct {
+	Name         string // key of the result; Field when empty
+	Type         string
+	Field        string
+	Size         int     // terms: buckets returned, 10 by default
+	Interval     float64 // histogram: bucket width
+	Ranges       []AggregationRange
+	DateInterval string // "minute", "hour", "day", "week", "month", "quarter", "year" or a duration such as "15m"
+}
+
+// AggregationRange is a bucket of a range aggregation holding values from
+// From, inclusive, up to To, exclusive. A nil bound is open.
+type AggregationRange struct {
+	Key  string
+	From *float64
+	To   *float64
+}
+
+// AggregationResult is the result of one SearchAggregation. Buckets are
+// set for terms, histogram, range and date_histogram aggregations, and
+// Count, Min, Max, Sum and Avg for the numeric statistics. Missing counts
+// the matching documents without a usable value, and Other the documents
+// of terms beyond the Size returned.
+type AggregationResult struct {
+	Type    string
+	Buckets []AggregationBucket
+	Count   int
+	Min     float64
+	Max     float64
+	Sum     float64
+	Avg     float64
+	Missing int
+	Other   int
+}
+
+// AggregationBucket is a bucket of an aggregation. From and To bound
+// histogram and range buckets, and Time starts a date_histogram bucket.
+type AggregationBucket struct {
+	Key   string
+	Count int
+	From  *float64
+	To    *float64
+	Time  time.Time
+}
+
+// ErrInvalidAggregation is returned by SearchWithAggregations for an
+// aggregation it cannot compute, and by Search and SearchCount for any
+// aggregation.
+var ErrInvalidAggregation = errors.New("velocity: invalid aggregation")
+
+// checkNoAggregations rejects aggregations given to a search entry point
+// that does not compute them, rather than drop them.
+func (q SearchQuery) checkNoAggregations(method string) error {
+	if len(q.Aggregations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s does not compute aggregations; use SearchWithAggregations", ErrInvalidAggregation, method)
+}
+
+// SearchResponse holds the results of SearchWithAggregations.
+type SearchResponse struct {
+	Results      []SearchResult
+	Total        int // number of matching documents
+	Aggregations map[string]AggregationResult
+}
+
+// SearchWithAggregations runs q like Search and, in the same pass over the
+// matching documents, counts them and computes q.Aggregations. Aggregations
+// over ValueIndex fields are counted from the in-memory value postings
+// when the query is answered from the indexes, so those documents are not
+// read for them.
+func (db *DB) SearchWithAggregations(q SearchQuery) (*SearchResponse, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	q = db.withTextAnalysisLocked(q)
+
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	states := make([]*aggregationState, len(q.Aggregations))
+	names := make(map[string]bool, len(q.Aggregations))
+	for i, spec := range q.Aggregations {
+		state, err := newAggregationState(spec)
+		if err != nil {
+			return nil, err
+		}
+		if names[state.name] {
+			return nil, fmt.Errorf("%w: duplicate name %q", ErrInvalidAggregation, state.name)
+		}
+		names[state.name] = true
+		states[i] = state
+	}
+	order := q.searchOrder()
+	after, err := q.afterCursor(order)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := parseFullTextQuery(q)
+	matches, byID, err := db.searchMatchesLocked(q, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	// Aggregations over value-indexed fields count the postings of the
+	// matches; the others read the field from each match, all in one pass.
+	var ids map[uint64]struct{}
+	var fromDocs []*aggregationState
+	for _, state := range states {
+		var postings map[string][]uint64
+		if byID {
+			postings = db.valueIndexPostings[valueIndexValuesKey(q.Prefix, state.spec.Field)]
+		}
+		if len(postings) == 0 {
+			fromDocs = append(fromDocs, state)
+			continue
+		}
+		if ids == nil {
+			ids = make(map[uint64]struct{}, len(matches))
+			for _, m := range matches {
+				ids[m.id] = struct{}{}
+			}
+		}
+		counted := 0
+		for value, posting := range postings {
+			n := 0
+			for _, id := range posting {
+				if _, ok := ids[id]; ok {
+					n++
+				}
+			}
+			if n > 0 && state.add(value, n) {
+				counted += n
+			}
+		}
+		state.missing = len(matches) - counted
+	}
+	if len(fromDocs) > 0 {
+		for i := range matches {
+			value, ok := db.loadSearchMatchLocked(&matches[i])
+			for _, state := range fromDocs {
+				var v any
+				if ok {
+					v, _ = fastJSONScalarField(value, state.spec.Field)
+				}
+				if v == nil || !state.add(v, 1) {
+					state.missing++
+				}
+			}
+		}
+	}
+
+	resp := &SearchResponse{Total: len(matches), Aggregations: make(map[string]AggregationResult, len(states))}
+	for _, state := range states {
+		resp.Aggregations[state.name] = state.result()
+	}
+
+	rankTextResults := plan.active() || conditionHasFullText(q.Condition)
+	if q.paged() || rankTextResults {
+		all := make([]SearchResult, 0, len(matches))
+		for i := range matches {
+			if r, ok := db.searchMatchResultLocked(&matches[i], q, plan); ok {
+				all = append(all, r)
+			}
+		}
+		if q.paged() {
+			resp.Results = pageResults(orderResults(all, order, after), max(q.Offset, 0), q.Limit, order)
+		} else {
+			sort.SliceStable(all, func(i, j int) bool {
+				if all[i].Score == all[j].Score {
+					return string(all[i].Key) < string(all[j].Key)
+				}
+				return all[i].Score > all[j].Score
+			})
+			resp.Results = all[:min(q.Limit, len(all))]
+		}
+	} else {
+		for i := 0; i < len(matches) && len(resp.Results) < q.Limit; i++ {
+			if r, ok := db.searchMatchResultLocked(&matches[i], q, plan); ok {
+				resp.Results = append(resp.Results, r)
+			}
+		}
+	}
+	projectSearchResults(resp.Results, q.Fields)
+	return resp, nil
+}
+
+// searchMatch is a document matching a query. id is 0 for documents found
+// by scanning, and value is nil until loaded.
+type searchMatch struct {
+	id    uint64
+	key   []byte
+	value []byte
+}
+
+// searchMatchesLocked returns every match of q. byID reports whether the
+// matches came from the indexes and all carry their document id. Documents
+// whose index metadata decides the query are not read.
+func (db *DB) searchMatchesLocked(q SearchQuery, plan fullTextPlan) ([]searchMatch, bool, error) {
+	if id, ok := exactIDFilterValue(q.Filters); ok && q.Prefix != "" {
+		var matches []searchMatch
+		for _, r := range db.exactIDSearchLocked(q, id) {
+			matches = append(matches, searchMatch{key: r.Key, value: r.Value})
+		}
+		return matches, false, nil
+	}
+	candidates, used, err := db.searchCandidatesLocked(q, plan)
+	if err != nil {
+		return nil, false, err
+	}
+	if !used {
+		q.Limit = int(^uint(0) >> 1)
+		results, err := db.scanSearchLocked(q)
+		if err != nil {
+			return nil, false, err
+		}
+		matches := make([]searchMatch, len(results))
+		for i, r := range results {
+			matches[i] = searchMatch{key: r.Key, value: r.Value}
+		}
+		return matches, false, nil
+	}
+
+	matches := make([]searchMatch, 0, len(candidates))
+	for _, id := range candidates {
+		decided := false
+		if meta, found, err := db.getIndexMetaLocked(id); err == nil && found {
+			ok, exact := matchesQueryMeta(meta, q)
+			if exact && !ok {
+				continue
+			}
+			// The metadata does not cover nested conditions.
+			decided = exact && q.Condition == nil
+		}
+		key, err := db.getDocKeyLocked(id)
+		if err != nil || len(key) == 0 {
+			continue
+		}
+		if q.Prefix != "" && !prefixMatch(string(key), q.Prefix) {
+			continue
+		}
+		if decided {
+			matches = append(matches, searchMatch{id: id, key: key})
+			continue
+		}
+		value, err := db.get(key)
+		if err != nil || !matchesQuery(value, q) {
+			continue
+		}
+		matches = append(matches, searchMatch{id: id, key: key, value: value})
+	}
+	return matches, true, nil
+}
+
+func (db *DB) loadSearchMatchLocked(m *searchMatch) ([]byte, bool) {
+	if m.value == nil {
+		value, err := db.get(m.key)
+		if err != nil {
+			return nil, false
+		}
+		m.value = value
+	}
+	return m.value, true
+}
+
+func (db *DB) searchMatchResultLocked(m *searchMatch, q SearchQuery, plan fullTextPlan) (SearchResult, bool) {
+	value, ok := db.loadSearchMatchLocked(m)
+	if !ok {
+		return SearchResult{}, false
+	}
+	return SearchResult{
+		Key:        append([]byte{}, m.key...),
+		Value:      append([]byte{}, value...),
+		Score:      searchQueryScore(value, q, plan),
+		Highlights: searchQueryHighlights(value, q, plan),
+	}, true
+}
+
+// aggregationState accumulates one aggregation.
+type aggregationState struct {
+	name    string
+	spec    SearchAggregation
+	terms   map[string]int
+	buckets map[float64]int
+	times   map[int64]int
+	ranges  []int
+	every   time.Duration // fixed date_histogram interval
+	count   int
+	min     float64
+	max     float64
+	sum     float64
+	missing int
+}
+
+func newAggregationState(spec SearchAggregation) (*aggregationState, error) {
+	s := &aggregationState{name: spec.Name, spec: spec}
+	if s.name == "" {
+		s.name = spec.Field
+	}
+	if spec.Field == "" || spec.Field == "$value" {
+		return nil, fmt.Errorf("%w: %q needs a field", ErrInvalidAggregation, s.name)
+	}
+	switch spec.Type {
+	case "terms":
+		s.terms = make(map[string]int)
+		if s.spec.Size <= 0 {
+			s.spec.Size = 10
+		}
+	case "histogram":
+		if spec.Interval <= 0 {
+			return nil, fmt.Errorf("%w: histogram %q needs a positive interval", ErrInvalidAggregation, s.name)
+		}
+		s.buckets = make(map[float64]int)
+	case "range":
+		if len(spec.Ranges) == 0 {
+			return nil, fmt.Errorf("%w: range %q needs ranges", ErrInvalidAggregation, s.name)
+		}
+		s.ranges = make([]int, len(spec.Ranges))
+	case "date_histogram":
+		switch spec.DateInterval {
+		case "minute", "hour", "day", "week", "month", "quarter", "year":
+		default:
+			d, err := time.ParseDuration(spec.DateInterval)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%w: date_histogram %q has interval %q", ErrInvalidAggregation, s.name, spec.DateInterval)
+			}
+			s.every = d
+		}
+		s.times = make(map[int64]int)
+	case "stats", "min", "max", "avg", "sum":
+	default:
+		return nil, fmt.Errorf("%w: %q has unknown type %q", ErrInvalidAggregation, s.name, spec.Type)
+	}
+	return s, nil
+}
+
+// add counts n documents with value v and reports whether v was usable.
+func (s *aggregationState) add(v any, n int) bool {
+	switch s.spec.Type {
+	case "terms":
+		s.terms[normalizeValue(v)] += n
+		return true
+	case "date_histogram":
+		t, ok := aggregationTime(v)
+		if !ok {
+			return false
+		}
+		s.times[s.dateBucket(t).UnixNano()] += n
+		return true
+	}
+	f, ok := toFloat(v)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return false
+	}
+	switch s.spec.Type {
+	case "histogram":
+		s.buckets[math.Floor(f/s.spec.Interval)*s.spec.Interval] += n
+	case "range":
+		for i, r := range s.spec.Ranges {
+			if (r.From == nil || f >= *r.From) && (r.To == nil || f < *r.To) {
+				s.ranges[i] += n
+			}
+		}
+	default:
+		if s.count == 0 || f < s.min {
+			s.min = f
+		}
+		if s.count == 0 || f > s.max {
+			s.max = f
+		}
+		s.count += n
+		s.sum += f * float64(n)
+	}
+	return true
+}
+
+func (s *aggregationState) result() AggregationResult {
+	out := AggregationResult{Type: s.spec.Type, Missing: s.missing}
+	switch s.spec.Type {
+	case "terms":
+		for key, count := range s.terms {
+			out.Buckets = append(out.Buckets, AggregationBucket{Key: key, Count: count})
+		}
+		sort.Slice(out.Buckets, func(i, j int) bool {
+			if out.Buckets[i].Count != out.Buckets[j].Count {
+				return out.Buckets[i].Count > out.Buckets[j].Count
+			}
+			return out.Buckets[i].Key < out.Buckets[j].Key
+		})
+		if len(out.Buckets) > s.spec.Size {
+			for _, b := range out.Buckets[s.spec.Size:] {
+				out.Other += b.Count
+			}
+			out.Buckets = out.Buckets[:s.spec.Size]
+		}
+	case "histogram":
+		for from, count := range s.buckets {
+			to := from + s.spec.Interval
+			out.Buckets = append(out.Buckets, AggregationBucket{Key: normalizeValue(from), Count: count, From: &from, To: &to})
+		}
+		sort.Slice(out.Buckets, func(i, j int) bool { return *out.Buckets[i].From < *out.Buckets[j].From })
+	case "range":
+		for i, r := range s.spec.Ranges {
+			key := r.Key
+			if key == "" {
+				key = rangeKey(r)
+			}
+			out.Buckets = append(out.Buckets, AggregationBucket{Key: key, Count: s.ranges[i], From: r.From, To: r.To})
+		}
+	case "date_histogram":
+		for start, count := range s.times {
+			t := time.Unix(0, start).UTC()
+			out.Buckets = append(out.Buckets, AggregationBucket{Key: t.Format(time.RFC3339), Count: count, Time: t})
+		}
+		sort.Slice(out.Buckets, func(i, j int) bool { return out.Buckets[i].Time.Before(out.Buckets[j].Time) })
+	default:
+		out.Count, out.Min, out.Max, out.Sum = s.count, s.min, s.max, s.sum
+		if s.count > 0 {
+			out.Avg = s.sum / float64(s.count)
+		}
+	}
+	return out
+}
+
+func rangeKey(r AggregationRange) string {
+	from, to := "*", "*"
+	if r.From != nil {
+		from = normalizeValue(*r.From)
+	}
+	if r.To != nil {
+		to = normalizeValue(*r.To)
+	}
+	return from + "-" + to
+}
+
+// dateBucket returns the start of the date_histogram bucket holding t, in
+// UTC.
+func (s *aggregationState) dateBucket(t time.Time) time.Time {
+	t = t.UTC()
+	if s.every > 0 {
+		return t.Truncate(s.every)
+	}
+	y, m, d := t.Date()
+	switch s.spec.DateInterval {
+	case "minute":
+		return t.Truncate(time.Minute)
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	case "week":
+		day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case "quarter":
+		return time.Date(y, m-(m-1)%3, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// aggregationTime reads a date: an RFC 3339 or YYYY-MM-DD string, or Unix
+// seconds, or milliseconds for numbers past the year 5000 in seconds.
+func aggregationTime(v any) (time.Time, bool) {
+	if s, ok := v.(string); ok {
+		s = strings.TrimSpace(s)
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, true
+			}
+		}
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return time.Time{}, false
+		}
+	}
+	f, ok := toFloat(v)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	if math.Abs(f) >= 1e11 {
+		return time.UnixMilli(int64(f)), true
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
@@ -0,0 +1,164 @@
+package velocity
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var aggregationSearchSchemas = map[string]*SearchSchema{
+	"orders": {
+		Fields: []SearchSchemaField{
+			{Name: "note", Searchable: true},
+			{Name: "status", HashSearch: true},
+			{Name: "amount", ValueIndex: true},
+		},
+	},
+}
+
+func putAggregationOrders(t *testing.T, db *DB) {
+	t.Helper()
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	statuses := []string{"open", "paid", "paid", "shipped"}
+	for i := 0; i < 40; i++ {
+		record := fmt.Sprintf(`{"note":"order %d","status":%q,"amount":%d,"created":%q,"qty":%d}`,
+			i, statuses[i%4], 10*(i%5), day.AddDate(0, 0, i/10).Format(time.RFC3339), i%3)
+		if err := db.Put([]byte(fmt.Sprintf("orders:%02d", i)), []byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("orders:draft"), []byte(`{"note":"order draft","status":"open"}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchAggregationsOverAllMatches(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), aggregationSearchSchemas)
+	defer db.Close()
+	putAggregationOrders(t, db)
+	from, to := 15.0, 35.0
+	resp, err := db.SearchWithAggregations(SearchQuery{
+		Prefix: "orders",
+		Limit:  5,
+		Aggregations: []SearchAggregation{
+			{Type: "terms", Field: "status", Size: 2},
+			{Name: "amounts", Type: "terms", Field: "amount"},
+			{Name: "amount_hist", Type: "histogram", Field: "amount", Interval: 20},
+			{Name: "amount_ranges", Type: "range", Field: "amount", Ranges: []AggregationRange{{Key: "low", To: &from}, {From: &from, To: &to}}},
+			{Name: "amount_stats", Type: "stats", Field: "amount"},
+			{Name: "per_day", Type: "date_histogram", Field: "created", DateInterval: "day"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Total != 41 || len(resp.Results) != 5 {
+		t.Fatalf("expected 41 matches and 5 hits, got %d and %d", resp.Total, len(resp.Results))
+	}
+
+	status := resp.Aggregations["status"]
+	if len(status.Buckets) != 2 || status.Buckets[0].Key != "paid" || status.Buckets[0].Count != 20 || status.Buckets[1].Key != "open" || status.Buckets[1].Count != 11 || status.Other != 10 {
+		t.Fatalf("unexpected status facets: %+v", status)
+	}
+	amounts := resp.Aggregations["amounts"]
+	if len(amounts.Buckets) != 5 || amounts.Missing != 1 {
+		t.Fatalf("unexpected amount facets: %+v", amounts)
+	}
+	for _, b := range amounts.Buckets {
+		if b.Count != 8 {
+			t.Fatalf("expected 8 orders per amount, got %+v", b)
+		}
+	}
+	hist := resp.Aggregations["amount_hist"]
+	if len(hist.Buckets) != 3 || hist.Buckets[0].Key != "0" || hist.Buckets[0].Count != 16 || hist.Buckets[2].Count != 8 {
+		t.Fatalf("unexpected histogram: %+v", hist.Buckets)
+	}
+	ranges := resp.Aggregations["amount_ranges"]
+	if ranges.Buckets[0].Key != "low" || ranges.Buckets[0].Count != 16 || ranges.Buckets[1].Key != "15-35" || ranges.Buckets[1].Count != 16 {
+		t.Fatalf("unexpected ranges: %+v", ranges.Buckets)
+	}
+	stats := resp.Aggregations["amount_stats"]
+	if stats.Count != 40 || stats.Min != 0 || stats.Max != 40 || stats.Sum != 800 || stats.Avg != 20 || stats.Missing != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	days := resp.Aggregations["per_day"]
+	if len(days.Buckets) != 4 || days.Buckets[0].Key != "2026-03-01T00:00:00Z" || days.Buckets[0].Count != 10 || days.Missing != 1 {
+		t.Fatalf("unexpected date histogram: %+v", days)
+	}
+}
+
+func TestSearchAggregationsFollowTheQuery(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), aggregationSearchSchemas)
+	defer db.Close()
+	putAggregationOrders(t, db)
+	aggs := []SearchAggregation{
+		{Name: "amounts", Type: "terms", Field: "amount"},
+		{Name: "qty", Type: "sum", Field: "qty"},
+	}
+
+	// Index-backed: the amount facets come from the postings.
+	indexed, err := db.SearchWithAggregations(SearchQuery{
+		Prefix:       "orders",
+		Filters:      []SearchFilter{{Field: "status", Op: "=", Value: "paid", HashOnly: true}},
+		Aggregations: aggs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scan-backed: the same matches selected by an unindexed condition.
+	scanned, err := db.SearchWithAggregations(SearchQuery{
+		Prefix:       "orders",
+		Condition:    &SearchCondition{Field: "status", Op: "=", Value: "paid"},
+		Aggregations: aggs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resp := range []*SearchResponse{indexed, scanned} {
+		if resp.Total != 20 || len(resp.Results) != 20 {
+			t.Fatalf("expected 20 paid orders, got %d (%d hits)", resp.Total, len(resp.Results))
+		}
+		if fmt.Sprint(resp.Aggregations) != fmt.Sprint(indexed.Aggregations) {
+			t.Fatalf("index and scan aggregations differ:\n%+v\n%+v", indexed.Aggregations, resp.Aggregations)
+		}
+	}
+	if got := indexed.Aggregations["amounts"].Buckets; len(got) != 5 || got[0].Count != 4 {
+		t.Fatalf("unexpected paid amount facets: %+v", got)
+	}
+
+	// Hits follow Sort and Fields as in Search.
+	sorted, err := db.SearchWithAggregations(SearchQuery{
+		Prefix: "orders",
+		Sort:   []SearchSort{{Field: "amount", Desc: true}},
+		Fields: []string{"amount"},
+		Limit:  2,
+		Aggregations: []SearchAggregation{
+			{Name: "amount", Type: "max", Field: "amount"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sorted.Results) != 2 || string(sorted.Results[0].Value) != `{"amount":40}` || sorted.Results[0].Cursor == "" {
+		t.Fatalf("unexpected sorted hits: %+v", sorted.Results)
+	}
+	if sorted.Aggregations["amount"].Max != 40 {
+		t.Fatalf("unexpected max: %+v", sorted.Aggregations["amount"])
+	}
+
+	if _, err := db.SearchWithAggregations(SearchQuery{Prefix: "orders", Aggregations: []SearchAggregation{{Type: "histogram", Field: "amount"}}}); err == nil {
+		t.Fatal("expected a histogram without an interval to fail")
+	}
+	if _, err := db.SearchWithAggregations(SearchQuery{Prefix: "orders", Aggregations: []SearchAggregation{{Type: "median", Field: "amount"}}}); err == nil {
+		t.Fatal("expected an unknown aggregation type to fail")
+	}
+	// Entry points that do not compute aggregations reject them.
+	withAggs := SearchQuery{Prefix: "orders", Aggregations: []SearchAggregation{{Type: "sum", Field: "qty"}}}
+	if _, err := db.Search(withAggs); !errors.Is(err, ErrInvalidAggregation) {
+		t.Fatalf("expected Search to reject aggregations, got %v", err)
+	}
+	if _, err := db.SearchCount(withAggs); !errors.Is(err, ErrInvalidAggregation) {
+		t.Fatalf("expected SearchCount to reject aggregations, got %v", err)
+	}
+}
@@ -0,0 +1,465 @@
+package velocity
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Analyzer turns field text into the terms it is indexed and searched by.
+// Terms are compared exactly, so an analyzer lowercases what it should
+// match case-insensitively.
+type Analyzer interface {
+	Analyze(text string) []string
+}
+
+// QueryAnalyzer is implemented by analyzers that search with other terms
+// than they index, such as edge n-grams, which index every prefix of a
+// word but look up the query words whole.
+type QueryAnalyzer interface {
+	Analyzer
+	AnalyzeQuery(text string) []string
+}
+
+// AnalyzerFunc adapts a function to Analyzer.
+type AnalyzerFunc func(text string) []string
+
+// Analyze calls f(text).
+func (f AnalyzerFunc) Analyze(text string) []string {
+	return f(text)
+}
+
+// Built-in analyzer names for SearchSchemaField.Analyzer.
+const (
+	AnalyzerStandard  = "standard"   // lowercased letter and digit runs
+	AnalyzerEnglish   = "english"    // standard without stop words, Porter stemmed
+	AnalyzerKeyword   = "keyword"    // the whole lowercased value as one term
+	AnalyzerNGram     = "ngram"      // 2 to 3 rune n-grams of each word, for infix matches
+	AnalyzerEdgeNGram = "edge_ngram" // 1 to 20 rune prefixes of each word, for autocomplete
+	AnalyzerCJK       = "cjk"        // overlapping bigrams of Chinese, Japanese and Korean text
+)
+
+var (
+	analyzersMu sync.RWMutex
+	analyzers   = map[string]Analyzer{
+		AnalyzerStandard:  AnalyzerFunc(standardAnalyze),
+		AnalyzerEnglish:   AnalyzerFunc(englishAnalyze),
+		AnalyzerKeyword:   AnalyzerFunc(keywordAnalyze),
+		AnalyzerNGram:     NewNGramAnalyzer(2, 3),
+		AnalyzerEdgeNGram: NewEdgeNGramAnalyzer(1, 20),
+		AnalyzerCJK:       AnalyzerFunc(cjkAnalyze),
+	}
+)
+
+// RegisterAnalyzer makes an analyzer available to schemas under name,
+// replacing any analyzer registered as name before. Documents indexed with
+// the previous analyzer keep their terms until the index is rebuilt.
+func RegisterAnalyzer(name string, a Analyzer) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || a == nil {
+		return
+	}
+	analyzersMu.Lock()
+	analyzers[name] = a
+	analyzersMu.Unlock()
+}
+
+// lookupAnalyzer returns the analyzer registered as name; empty and
+// unknown names fall back to the standard analyzer.
+func lookupAnalyzer(name string) Analyzer {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = AnalyzerStandard
+	}
+	analyzersMu.RLock()
+	a, ok := analyzers[name]
+	if !ok {
+		a = analyzers[AnalyzerStandard]
+	}
+	analyzersMu.RUnlock()
+	return a
+}
+
+// isStandardAnalyzer reports whether name selects the built-in standard
+// analyzer, whose terms are the tokens of the raw value.
+func isStandardAnalyzer(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == AnalyzerStandard {
+		return true
+	}
+	analyzersMu.RLock()
+	_, ok := analyzers[name]
+	analyzersMu.RUnlock()
+	return !ok
+}
+
+// analyzeQuery returns the terms a looks text up by.
+func analyzeQuery(a Analyzer, text string) []string {
+	if qa, ok := a.(QueryAnalyzer); ok {
+		return qa.AnalyzeQuery(text)
+	}
+	return a.Analyze(text)
+}
+
+func standardAnalyze(text string) []string {
+	return tokenize(strings.ToLower(text))
+}
+
+// englishStopWords are the function words the english analyzer drops.
+var englishStopWords = map[string]struct{}{
+	"a": {}, "an": {}, "and": {}, "are": {}, "as": {}, "at": {}, "be": {}, "but": {},
+	"by": {}, "for": {}, "if": {}, "in": {}, "into": {}, "is": {}, "it": {}, "no": {},
+	"not": {}, "of": {}, "on": {}, "or": {}, "such": {}, "that": {}, "the": {},
+	"their": {}, "then": {}, "there": {}, "these": {}, "they": {}, "this": {}, "to": {},
+	"was": {}, "will": {}, "with": {},
+}
+
+func englishAnalyze(text string) []string {
+	tokens := standardAnalyze(text)
+	out := tokens[:0]
+	for _, token := range tokens {
+		if _, stop := englishStopWords[token]; stop {
+			continue
+		}
+		out = append(out, porterStem(token))
+	}
+	return out
+}
+
+func keywordAnalyze(text string) []string {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "" {
+		return nil
+	}
+	return []string{text}
+}
+
+type ngramAnalyzer struct {
+	min, max int
+	edge     bool
+}
+
+// NewNGramAnalyzer returns an analyzer indexing every run of min to max
+// runes inside each standard token, so that a query matches any part of a
+// word. Tokens shorter than min are kept whole.
+func NewNGramAnalyzer(min, max int) Analyzer {
+	min, max = ngramBounds(min, max)
+	return ngramAnalyzer{min: min, max: max}
+}
+
+// NewEdgeNGramAnalyzer returns an analyzer indexing the first min to max
+// runes of each standard token. Queries are looked up by their tokens, cut
+// to max runes, so a partly typed word finds the words it begins.
+func NewEdgeNGramAnalyzer(min, max int) QueryAnalyzer {
+	min, max = ngramBounds(min, max)
+	return ngramAnalyzer{min: min, max: max, edge: true}
+}
+
+func ngramBounds(min, max int) (int, int) {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+func (a ngramAnalyzer) Analyze(text string) []string {
+	var out []string
+	for _, token := range standardAnalyze(text) {
+		runes := []rune(token)
+		if len(runes) < a.min {
+			out = append(out, token)
+			continue
+		}
+		starts := len(runes)
+		if a.edge {
+			starts = 1
+		}
+		for start := 0; start < starts; start++ {
+			for n := a.min; n <= a.max && start+n <= len(runes); n++ {
+				out = append(out, string(runes[start:start+n]))
+			}
+		}
+	}
+	return out
+}
+
+func (a ngramAnalyzer) AnalyzeQuery(text string) []string {
+	if !a.edge {
+		return a.Analyze(text)
+	}
+	tokens := standardAnalyze(text)
+	for i, token := range tokens {
+		if utf8.RuneCountInString(token) > a.max {
+			tokens[i] = string([]rune(token)[:a.max])
+		}
+	}
+	return tokens
+}
+
+// isCJK reports whether r is written without spaces between words. The
+// katakana prolonged sound mark belongs to no script of its own.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || r == 'ー' || r == 'ｰ'
+}
+
+// cjkAnalyze splits standard tokens into their CJK and other runs. CJK runs
+// have no spaces between words, so they become overlapping bigrams; a
+// single CJK rune stays a term of its own.
+func cjkAnalyze(text string) []string {
+	var out []string
+	for _, token := range standardAnalyze(text) {
+		runes := []rune(token)
+		for i := 0; i < len(runes); {
+			j := i + 1
+			cjk := isCJK(runes[i])
+			for j < len(runes) && isCJK(runes[j]) == cjk {
+				j++
+			}
+			switch {
+			case !cjk:
+				out = append(out, string(runes[i:j]))
+			case j-i == 1:
+				out = append(out, string(runes[i]))
+			default:
+				for k := i; k+1 < j; k++ {
+					out = append(out, string(runes[k:k+2]))
+				}
+			}
+			i = j
+		}
+	}
+	return out
+}
+
+// porterStem reduces an English word to its stem with the Porter (1980)
+// algorithm. Words with runes outside a-z are returned unchanged.
+func porterStem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+	s := &porterStemmer{b: []byte(word), k: len(word) - 1}
+	s.step1ab()
+	if s.k > 0 {
+		s.step1c()
+		s.step2()
+		s.step3()
+		s.step4()
+		s.step5()
+	}
+	return string(s.b[:s.k+1])
+}
+
+// porterStemmer holds the word being stemmed in b[0..k]; j marks the end
+// of the stem before the suffix last matched by ends.
+type porterStemmer struct {
+	b    []byte
+	k, j int
+}
+
+func (s *porterStemmer) cons(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !s.cons(i-1)
+	}
+	return true
+}
+
+// m counts the vowel-consonant sequences in b[0..j].
+func (s *porterStemmer) m() int {
+	n, i := 0, 0
+	for ; i <= s.j && s.cons(i); i++ {
+	}
+	for i <= s.j {
+		for ; i <= s.j && !s.cons(i); i++ {
+		}
+		if i > s.j {
+			break
+		}
+		n++
+		for ; i <= s.j && s.cons(i); i++ {
+		}
+	}
+	return n
+}
+
+func (s *porterStemmer) vowelInStem() bool {
+	for i := 0; i <= s.j; i++ {
+		if !s.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *porterStemmer) doubleC(i int) bool {
+	return i >= 1 && s.b[i] == s.b[i-1] && s.cons(i)
+}
+
+// cvc reports whether b[i-2..i] is consonant-vowel-consonant and the last
+// consonant is not w, x or y.
+func (s *porterStemmer) cvc(i int) bool {
+	if i < 2 || !s.cons(i) || s.cons(i-1) || !s.cons(i-2) {
+		return false
+	}
+	switch s.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+func (s *porterStemmer) ends(suffix string) bool {
+	n := len(suffix)
+	if n > s.k+1 || string(s.b[s.k-n+1:s.k+1]) != suffix {
+		return false
+	}
+	s.j = s.k - n
+	return true
+}
+
+func (s *porterStemmer) setTo(suffix string) {
+	s.b = append(s.b[:s.j+1], suffix...)
+	s.k = s.j + len(suffix)
+}
+
+func (s *porterStemmer) replace(suffix string) {
+	if s.m() > 0 {
+		s.setTo(suffix)
+	}
+}
+
+// step1ab removes plurals and -ed or -ing.
+func (s *porterStemmer) step1ab() {
+	if s.b[s.k] == 's' {
+		switch {
+		case s.ends("sses"):
+			s.k -= 2
+		case s.ends("ies"):
+			s.setTo("i")
+		case s.b[s.k-1] != 's':
+			s.k--
+		}
+	}
+	if s.ends("eed") {
+		if s.m() > 0 {
+			s.k--
+		}
+		return
+	}
+	if !(s.ends("ed") || s.ends("ing")) || !s.vowelInStem() {
+		return
+	}
+	s.k = s.j
+	switch {
+	case s.ends("at"):
+		s.setTo("ate")
+	case s.ends("bl"):
+		s.setTo("ble")
+	case s.ends("iz"):
+		s.setTo("ize")
+	case s.doubleC(s.k):
+		switch s.b[s.k-1] {
+		case 'l', 's', 'z':
+		default:
+			s.k--
+		}
+	default:
+		s.j = s.k
+		if s.m() == 1 && s.cvc(s.k) {
+			s.setTo("e")
+		}
+	}
+}
+
+// step1c turns a final y into i when there is another vowel in the stem.
+func (s *porterStemmer) step1c() {
+	if s.ends("y") && s.vowelInStem() {
+		s.b[s.k] = 'i'
+	}
+}
+
+// porterRule replaces suffix by replacement.
+type porterRule struct {
+	suffix, replacement string
+}
+
+var porterStep2 = []porterRule{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+var porterStep3 = []porterRule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var porterStep4 = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+// applyRules replaces the first suffix of rules the word ends with when
+// the stem before it has a vowel-consonant sequence.
+func (s *porterStemmer) applyRules(rules []porterRule) {
+	for _, rule := range rules {
+		if s.ends(rule.suffix) {
+			s.replace(rule.replacement)
+			return
+		}
+	}
+}
+
+// step2 maps double suffixes to single ones.
+func (s *porterStemmer) step2() {
+	s.applyRules(porterStep2)
+}
+
+// step3 handles -ic-, -full, -ness and the like.
+func (s *porterStemmer) step3() {
+	s.applyRules(porterStep3)
+}
+
+// step4 removes a final suffix from stems with two vowel-consonant
+// sequences; -ion only after s or t.
+func (s *porterStemmer) step4() {
+	for _, suffix := range porterStep4 {
+		if !s.ends(suffix) {
+			continue
+		}
+		if suffix == "ion" && (s.j < 0 || (s.b[s.j] != 's' && s.b[s.j] != 't')) {
+			return
+		}
+		if s.m() > 1 {
+			s.k = s.j
+		}
+		return
+	}
+}
+
+// step5 removes a final -e and reduces a final -ll.
+func (s *porterStemmer) step5() {
+	s.j = s.k
+	if s.b[s.k] == 'e' {
+		if a := s.m(); a > 1 || (a == 1 && !s.cvc(s.k-1)) {
+			s.k--
+		}
+	}
+	if s.b[s.k] == 'l' && s.doubleC(s.k) && s.m() > 1 {
+		s.k--
+	}
+}
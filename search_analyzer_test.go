@@ -0,0 +1,254 @@
+package velocity
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPorterStem(t *testing.T) {
+	for word, want := range map[string]string{
+		"caresses":        "caress",
+		"ponies":          "poni",
+		"cats":            "cat",
+		"feed":            "feed",
+		"agreed":          "agre",
+		"plastered":       "plaster",
+		"motoring":        "motor",
+		"sing":            "sing",
+		"sized":           "size",
+		"hopping":         "hop",
+		"falling":         "fall",
+		"filing":          "file",
+		"happy":           "happi",
+		"relational":      "relat",
+		"generalizations": "gener",
+		"connection":      "connect",
+		"running":         "run",
+		"go2":             "go2",
+	} {
+		if got := porterStem(word); got != want {
+			t.Errorf("porterStem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestAnalyzers(t *testing.T) {
+	for _, tc := range []struct {
+		analyzer string
+		text     string
+		want     []string
+	}{
+		{AnalyzerStandard, "The Quick-Brown fox", []string{"the", "quick", "brown", "fox"}},
+		{AnalyzerEnglish, "The runners were running to the races", []string{"runner", "were", "run", "race"}},
+		{AnalyzerKeyword, "  SKU-42 Blue ", []string{"sku-42 blue"}},
+		{AnalyzerNGram, "Abcd", []string{"ab", "abc", "bc", "bcd", "cd"}},
+		{AnalyzerEdgeNGram, "Lap top", []string{"l", "la", "lap", "t", "to", "top"}},
+		{AnalyzerCJK, "東京タワー tokyo 日", []string{"東京", "京タ", "タワ", "ワー", "tokyo", "日"}},
+	} {
+		if got := lookupAnalyzer(tc.analyzer).Analyze(tc.text); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s(%q) = %v, want %v", tc.analyzer, tc.text, got, tc.want)
+		}
+	}
+	if got := analyzeQuery(lookupAnalyzer(AnalyzerEdgeNGram), "Lapt"); fmt.Sprint(got) != "[lapt]" {
+		t.Errorf("edge n-gram queries should look up whole words, got %v", got)
+	}
+	if lookupAnalyzer("no such analyzer") == nil || !isStandardAnalyzer("no such analyzer") {
+		t.Error("expected unknown analyzers to fall back to standard")
+	}
+}
+
+func TestSearchFieldAnalyzers(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), map[string]*SearchSchema{
+		"posts": {Fields: []SearchSchemaField{
+			{Name: "title", Searchable: true, Analyzer: AnalyzerEnglish, Boost: 3},
+			{Name: "body", Searchable: true, Analyzer: AnalyzerEnglish},
+		}},
+		"skus":  {Fields: []SearchSchemaField{{Name: "code", Searchable: true, Analyzer: AnalyzerKeyword}}},
+		"names": {Fields: []SearchSchemaField{{Name: "name", Searchable: true, Analyzer: AnalyzerEdgeNGram}}},
+		"parts": {Fields: []SearchSchemaField{{Name: "part", Searchable: true, Analyzer: AnalyzerNGram}}},
+		"notes": {Fields: []SearchSchemaField{{Name: "text", Searchable: true, Analyzer: AnalyzerCJK}}},
+	})
+	defer db.Close()
+	for key, value := range map[string]string{
+		"posts:1": `{"title":"Running shoes","body":"A review of trail shoes"}`,
+		"posts:2": `{"title":"Kitchen knives","body":"We ran out of shoes, so the team runs to buy knives"}`,
+		"posts:3": `{"title":"Garden","body":"Nothing about sport"}`,
+		"skus:1":  `{"code":"SKU-42 Blue"}`,
+		"skus:2":  `{"code":"SKU-42 Blue Large"}`,
+		"names:1": `{"name":"Laptop stand"}`,
+		"names:2": `{"name":"Lamp"}`,
+		"parts:1": `{"part":"flywheel"}`,
+		"parts:2": `{"part":"wheelbase"}`,
+		"notes:1": `{"text":"東京タワーに行きました"}`,
+		"notes:2": `{"text":"京都の寺"}`,
+	} {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(prefix, text string, want ...string) {
+		t.Helper()
+		for _, indexed := range []bool{true, false} {
+			db.EnableSearchIndex(indexed)
+			q := SearchQuery{Prefix: prefix, FullText: text, Limit: 10}
+			results, err := db.Search(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultKeys(results); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("%s %q (index %v): got %v, want %v", prefix, text, indexed, got, want)
+			}
+			count, err := db.SearchCount(q)
+			if err != nil || count != len(want) {
+				t.Fatalf("%s %q (index %v): count %d, want %d (%v)", prefix, text, indexed, count, len(want), err)
+			}
+		}
+		db.EnableSearchIndex(true)
+	}
+
+	// Stemming matches other forms of a word, and the boosted title ranks
+	// first; stop words do not have to be present.
+	search("posts", "runs", "posts:1", "posts:2")
+	search("posts", "the shoe", "posts:1", "posts:2")
+	search("posts", "shoes -knives", "posts:1")
+	search("posts", `"trail shoes"`, "posts:1")
+	// A keyword field matches its whole value only.
+	search("skus", `"sku-42 blue"`, "skus:1")
+	search("skus", "sku", []string{}...)
+	// Edge n-grams complete a partly typed word; n-grams match inside one.
+	search("names", "lap", "names:1")
+	search("names", "la", "names:2", "names:1")
+	search("parts", "wheel", "parts:1", "parts:2")
+	search("parts", "ywhe", "parts:1")
+	// CJK text is searched by bigrams.
+	search("notes", "東京", "notes:1")
+	search("notes", "京", []string{}...)
+	search("notes", "京都", "notes:2")
+}
+
+func TestSearchBM25UsesStoredFieldNorms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := NewWithConfig(Config{
+		Path:              path,
+		DisableEncryption: true,
+		DisableFsync:      true,
+		SearchSchemas: map[string]*SearchSchema{
+			"docs": {Fields: []SearchSchemaField{
+				{Name: "title", Searchable: true, Boost: 4},
+				{Name: "body", Searchable: true},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filler := strings.Repeat("filler words ", 20)
+	for key, value := range map[string]string{
+		"docs:short": `{"title":"notes","body":"raft consensus"}`,
+		"docs:long":  `{"title":"notes","body":"raft consensus ` + filler + `"}`,
+		"docs:title": `{"title":"raft","body":"` + filler + `"}`,
+		"docs:other": `{"title":"notes","body":"paxos"}`,
+	} {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleted and overwritten documents leave the norms.
+	db.Put([]byte("docs:gone"), []byte(`{"title":"gone","body":"`+filler+filler+`"}`))
+	db.Delete([]byte("docs:gone"))
+	db.Put([]byte("docs:other"), []byte(`{"title":"notes","body":"paxos made simple"}`))
+
+	norms := db.fieldNormsLocked("docs")
+	if norms.Docs != 4 || norms.Fields["body"] != 4 || norms.Lengths["body"] != 2+42+40+3 || norms.Lengths["title"] != 4 {
+		t.Fatalf("unexpected field norms: %+v", norms)
+	}
+
+	rank := func(db *DB) []SearchResult {
+		t.Helper()
+		results, err := db.Search(SearchQuery{Prefix: "docs", FullText: "raft", Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	results := rank(db)
+	// The boosted title wins, and the short body beats the long one with
+	// the same term frequency.
+	if got := resultKeys(results); fmt.Sprint(got) != "[docs:title docs:short docs:long]" {
+		t.Fatalf("unexpected BM25 order: %v", got)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The statistics are persisted with the index.
+	db, err = NewWithConfig(Config{
+		Path:              path,
+		DisableEncryption: true,
+		DisableFsync:      true,
+		SearchSchemas: map[string]*SearchSchema{
+			"docs": {Fields: []SearchSchemaField{
+				{Name: "title", Searchable: true, Boost: 4},
+				{Name: "body", Searchable: true},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := db.fieldNormsLocked("docs"); fmt.Sprint(got) != fmt.Sprint(norms) {
+		t.Fatalf("field norms after reopen: %+v, want %+v", got, norms)
+	}
+	reopened := rank(db)
+	for i := range results {
+		if reopened[i].Score != results[i].Score {
+			t.Fatalf("scores changed after reopen: %v vs %v", reopened[i].Score, results[i].Score)
+		}
+	}
+
+	// Rebuilding recounts the norms from the documents.
+	if err := db.RebuildIndex("docs", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.fieldNormsLocked("docs"); fmt.Sprint(got) != fmt.Sprint(norms) {
+		t.Fatalf("field norms after rebuild: %+v, want %+v", got, norms)
+	}
+}
+
+func TestRegisterAnalyzer(t *testing.T) {
+	RegisterAnalyzer("test_reversed", AnalyzerFunc(func(text string) []string {
+		var out []string
+		for _, token := range standardAnalyze(text) {
+			runes := []rune(token)
+			for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+				runes[i], runes[j] = runes[j], runes[i]
+			}
+			out = append(out, string(runes))
+		}
+		return out
+	}))
+	db, err := NewWithConfig(Config{
+		Path:              t.TempDir(),
+		DisableEncryption: true,
+		DisableFsync:      true,
+		SearchSchemas: map[string]*SearchSchema{
+			"words": {Fields: []SearchSchemaField{{Name: "word", Searchable: true, Analyzer: "test_reversed"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put([]byte("words:1"), []byte(`{"word":"stressed"}`))
+	results, err := db.Search(SearchQuery{Prefix: "words", FullText: "stressed"})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("expected the custom analyzer to match, got %v (%v)", resultKeys(results), err)
+	}
+	if ids, _ := db.getPostingListLocked(indexTermKey("words", hashValue("desserts"))); len(ids) != 1 {
+		t.Fatal("expected the reversed term in the index")
+	}
+}
@@ -94,7 +94,9 @@ func TestSearchFullTextAdvancedQueryModes(t *testing.T) {
 	}
 
 	assertKeys("and terms", SearchQuery{FullText: "full retrieval"}, "docs:1", "docs:3")
-	assertKeys("or terms", SearchQuery{FullText: "compliance OR ranking", MatchMode: "boolean"}, "docs:1", "docs:2")
+	// BM25: compliance in a short title and body outranks ranking repeated
+	// in a long body.
+	assertKeys("or terms", SearchQuery{FullText: "compliance OR ranking", MatchMode: "boolean"}, "docs:2", "docs:1")
 	assertKeys("negative term", SearchQuery{FullText: "full -shuffled"}, "docs:1")
 	assertKeys("phrase", SearchQuery{FullText: `"full text retrieval"`}, "docs:1")
 	assertKeys("prefix", SearchQuery{FullText: "documents retriev*"}, "docs:4")
@@ -0,0 +1,236 @@
+package velocity
+
+import (
+	"sort"
+	"strings"
+)
+
+// Fuzzy queries allow one edit per term unless FuzzyMaxEdits says otherwise,
+// and never more than two.
+const (
+	defaultFuzzyEdits = 1
+	maxFuzzyEdits     = 2
+)
+
+// fuzzyGramMarker starts the index terms that post trigrams, keeping them
+// apart from analyzed terms in the term postings of a prefix.
+const fuzzyGramMarker = "\x00tri:"
+
+// fuzzyQueryEdits returns the edit cap of q, 0 when q is not fuzzy.
+func fuzzyQueryEdits(q SearchQuery) int {
+	if !q.Fuzzy {
+		return 0
+	}
+	if q.FuzzyMaxEdits <= 0 {
+		return defaultFuzzyEdits
+	}
+	return min(q.FuzzyMaxEdits, maxFuzzyEdits)
+}
+
+// fuzzyEdits returns the edits term may differ by under a cap of limit.
+// Short terms would match too much: up to two characters they must match
+// exactly and up to five they allow a single edit.
+func fuzzyEdits(term string, limit int) int {
+	n := len([]rune(term))
+	switch {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return min(limit, 1)
+	default:
+		return limit
+	}
+}
+
+// fuzzyGrams returns the distinct trigrams of term, padded with two spaces
+// in front and one behind so that short terms and word starts have grams
+// of their own.
+func fuzzyGrams(term string) []string {
+	runes := []rune("  " + term + " ")
+	grams := make([]string, 0, len(runes)-2)
+	seen := make(map[string]struct{}, len(runes)-2)
+	for i := 0; i+3 <= len(runes); i++ {
+		gram := string(runes[i : i+3])
+		if _, ok := seen[gram]; ok {
+			continue
+		}
+		seen[gram] = struct{}{}
+		grams = append(grams, gram)
+	}
+	return grams
+}
+
+// fuzzyGramTerm is the index term documents with gram are posted under.
+func fuzzyGramTerm(gram string) string {
+	return fuzzyGramMarker + gram
+}
+
+// addFuzzyGramTerms adds to termSet the hashed trigram terms of tokens.
+func addFuzzyGramTerms(termSet map[string]struct{}, tokens []string) {
+	for _, token := range tokens {
+		for _, gram := range fuzzyGrams(token) {
+			termSet[hashValue(fuzzyGramTerm(gram))] = struct{}{}
+		}
+	}
+}
+
+// editDistance returns the optimal string alignment distance of a and b:
+// insertions, deletions, substitutions and swaps of adjacent runes each
+// count one. It gives up with limit+1 once the distance exceeds limit.
+func editDistance(a, b []rune, limit int) int {
+	if d := len(a) - len(b); d > limit || -d > limit {
+		return limit + 1
+	}
+	swapped := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		rowMin := i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := min(min(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d = min(d, swapped[j-2]+1)
+			}
+			curr[j] = d
+			rowMin = min(rowMin, d)
+		}
+		// No later row can come back under the smallest of this one.
+		if rowMin > limit {
+			return limit + 1
+		}
+		swapped, prev, curr = prev, curr, swapped
+	}
+	return min(prev[len(b)], limit+1)
+}
+
+// similarity scales an edit distance to 1 for equal terms and toward 0 as
+// the edits approach the length of the longer one.
+func similarity(a, b []rune, distance int) float64 {
+	return 1 - float64(distance)/float64(max(len(a), len(b)))
+}
+
+// match returns how often term occurs in f and with what weight: its own
+// count at weight 1 or, for fuzzy queries, the count of the closest term
+// within its edits weighted by their similarity.
+func (f *fieldText) match(term string) (int, float64) {
+	if n := f.counts[term]; n > 0 || f.edits == 0 {
+		return n, 1
+	}
+	edits := fuzzyEdits(term, f.edits)
+	if edits == 0 {
+		return 0, 0
+	}
+	query := []rune(term)
+	best, bestSim := 0, 0.0
+	for candidate, n := range f.counts {
+		runes := []rune(candidate)
+		d := editDistance(query, runes, edits)
+		if d > edits {
+			continue
+		}
+		if sim := similarity(query, runes, d); sim > bestSim || sim == bestSim && n > best {
+			best, bestSim = n, sim
+		}
+	}
+	return best, bestSim
+}
+
+// fuzzyClauseCandidatesLocked is clauseCandidatesLocked for fuzzy queries:
+// per field, the documents with a term near each term of c. It reports
+// false when a field the clause has terms in keeps no trigrams, as only a
+// scan can find typos there.
+func (db *DB) fuzzyClauseCandidatesLocked(prefix string, a *textAnalysis, c textClause) ([]uint64, bool, error) {
+	var out []uint64
+	seen := make(map[string]struct{}, len(c.terms))
+	for i, terms := range c.terms {
+		if len(terms) == 0 {
+			continue
+		}
+		if !a.fields[i].fuzzy {
+			return nil, false, nil
+		}
+		sig := strings.Join(terms, "\x00")
+		if _, ok := seen[sig]; ok {
+			continue
+		}
+		seen[sig] = struct{}{}
+		var ids []uint64
+		for j, term := range terms {
+			var posting []uint64
+			var err error
+			if edits := fuzzyEdits(term, a.edits); edits > 0 {
+				posting, err = db.fuzzyTermCandidatesLocked(prefix, term, edits)
+			} else {
+				posting, err = db.getPostingListLocked(indexTermKey(prefix, hashValue(term)))
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			if j == 0 {
+				ids = posting
+			} else {
+				ids = intersectSorted(ids, posting)
+			}
+			if len(ids) == 0 {
+				break
+			}
+		}
+		out = mergeSortedUnique(out, ids)
+	}
+	return out, true, nil
+}
+
+// fuzzyTermCandidatesLocked returns the documents that may hold a term
+// within edits of term: those posted under enough of its trigrams. An edit
+// changes at most four trigrams (a swap does), so such a term keeps all
+// but 4*edits of them; at least one has to be shared regardless.
+func (db *DB) fuzzyTermCandidatesLocked(prefix, term string, edits int) ([]uint64, error) {
+	grams := fuzzyGrams(term)
+	need := max(len(grams)-4*edits, 1)
+	hits := make(map[uint64]int)
+	for _, gram := range grams {
+		ids, err := db.getPostingListLocked(indexTermKey(prefix, hashValue(fuzzyGramTerm(gram))))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			hits[id]++
+		}
+	}
+	out := make([]uint64, 0, len(hits))
+	for id, n := range hits {
+		if n >= need {
+			out = append(out, id)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+// FuzzyMatch reports whether every word of query occurs in text, allowing
+// the edits of a fuzzy search with FuzzyMaxEdits maxEdits. Words are
+// compared as the standard analyzer splits them.
+func FuzzyMatch(text, query string, maxEdits int) bool {
+	terms := standardAnalyze(query)
+	if len(terms) == 0 {
+		return false
+	}
+	f := &fieldText{counts: make(map[string]int), edits: fuzzyQueryEdits(SearchQuery{Fuzzy: true, FuzzyMaxEdits: maxEdits})}
+	for _, word := range standardAnalyze(text) {
+		f.counts[word]++
+	}
+	for _, term := range terms {
+		if n, _ := f.match(term); n == 0 {
+			return false
+		}
+	}
+	return true
+}
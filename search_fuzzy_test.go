@@ -0,0 +1,154 @@
+package velocity
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  string
+		limit int
+		want  int
+	}{
+		{"shoes", "shoes", 2, 0},
+		{"shoes", "shoos", 2, 1},
+		{"shoes", "sheos", 2, 1},
+		{"shoes", "shoe", 2, 1},
+		{"headphones", "hedphnes", 2, 2},
+		{"headphones", "hedphnes", 1, 2},
+		{"kitten", "sitting", 5, 3},
+		{"", "abc", 5, 3},
+		{"abc", "xyzabc", 2, 3},
+		{"日本語", "日本", 1, 1},
+	} {
+		if got := editDistance([]rune(tc.a), []rune(tc.b), tc.limit); got != tc.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", tc.a, tc.b, tc.limit, got, tc.want)
+		}
+	}
+	if got := fuzzyGrams("cat"); fmt.Sprint(got) != "[  c  ca cat at ]" {
+		t.Errorf("unexpected trigrams %q", got)
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	for _, tc := range []struct {
+		text, query string
+		edits       int
+		want        bool
+	}{
+		{"Wireless Headphones", "wireles", 0, true},
+		{"Wireless Headphones", "wireles hedphnes", 0, false},
+		{"Wireless Headphones", "wireles hedphnes", 2, true},
+		{"USB cable", "usb cabel", 1, true},
+		{"USB cable", "usv", 1, true},
+		{"TV stand", "tb", 2, false},
+		{"TV stand", "", 1, false},
+	} {
+		if got := FuzzyMatch(tc.text, tc.query, tc.edits); got != tc.want {
+			t.Errorf("FuzzyMatch(%q, %q, %d) = %v, want %v", tc.text, tc.query, tc.edits, got, tc.want)
+		}
+	}
+}
+
+func TestSearchFuzzy(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), map[string]*SearchSchema{
+		"products": {Fields: []SearchSchemaField{
+			{Name: "name", Searchable: true, Fuzzy: true, Boost: 2},
+			{Name: "brand", Searchable: true, Fuzzy: true},
+		}},
+		"reviews": {Fields: []SearchSchemaField{
+			{Name: "text", Searchable: true},
+		}},
+	})
+	defer db.Close()
+	for key, value := range map[string]string{
+		"products:1": `{"name":"Wireless Headphones","brand":"Sony"}`,
+		"products:2": `{"name":"Wired Headphone","brand":"Sony"}`,
+		"products:3": `{"name":"Headphone Stand","brand":"Acme"}`,
+		"products:4": `{"name":"Bluetooth Speaker","brand":"Bose"}`,
+		"products:5": `{"name":"Wireless Mouse","brand":"Logitech"}`,
+		"reviews:1":  `{"text":"great battery life"}`,
+		"reviews:2":  `{"text":"the battery died"}`,
+		"reviews:3":  `{"text":"nice sound"}`,
+		"notes:1":    `plain text about headphones`,
+	} {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(q SearchQuery, want ...string) {
+		t.Helper()
+		q.Limit = 10
+		for _, indexed := range []bool{true, false} {
+			db.EnableSearchIndex(indexed)
+			results, err := db.Search(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultKeys(results); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("%q (index %v): got %v, want %v", q.FullText, indexed, got, want)
+			}
+			count, err := db.SearchCount(q)
+			if err != nil || count != len(want) {
+				t.Fatalf("%q (index %v): count %d, want %d (%v)", q.FullText, indexed, count, len(want), err)
+			}
+		}
+		db.EnableSearchIndex(true)
+	}
+
+	search(SearchQuery{Prefix: "products", FullText: "headphnes"})
+	// Exact matches rank above the typo-tolerant ones.
+	search(SearchQuery{Prefix: "products", FullText: "headphone", Fuzzy: true}, "products:2", "products:3", "products:1")
+	search(SearchQuery{Prefix: "products", FullText: "wireles headphnes", Fuzzy: true}, "products:1")
+	search(SearchQuery{Prefix: "products", FullText: "hedphnes", Fuzzy: true})
+	search(SearchQuery{Prefix: "products", FullText: "hedphnes", Fuzzy: true, FuzzyMaxEdits: 2}, "products:1")
+	search(SearchQuery{Prefix: "products", FullText: "snoy wireless", Fuzzy: true}, "products:1")
+	search(SearchQuery{Prefix: "products", FullText: "bsoe | logitec", Fuzzy: true}, "products:5", "products:4")
+	// Excluded terms and phrases match exactly.
+	search(SearchQuery{Prefix: "products", FullText: "headphone -wireles", Fuzzy: true}, "products:2", "products:3", "products:1")
+	search(SearchQuery{Prefix: "products", FullText: `"wireles mouse"`, Fuzzy: true})
+	// Fields without trigrams and prefixes without a schema are scanned.
+	search(SearchQuery{Prefix: "reviews", FullText: "batery", Fuzzy: true}, "reviews:1", "reviews:2")
+	search(SearchQuery{Prefix: "notes", FullText: "headphnes", Fuzzy: true}, "notes:1")
+
+	// Typos in trigram-indexed fields are looked up, not scanned.
+	candidates := func(prefix, text string) ([]uint64, bool) {
+		t.Helper()
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+		q := db.withTextAnalysisLocked(SearchQuery{Prefix: prefix, FullText: text, Fuzzy: true})
+		ids, used, err := db.fullTextCandidatesLocked(prefix, parseFullTextQuery(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids, used
+	}
+	if ids, used := candidates("products", "headphnes"); !used || len(ids) != 3 {
+		t.Fatalf("expected 3 trigram candidates, got %v (indexed %v)", ids, used)
+	}
+	if _, used := candidates("reviews", "batery"); used {
+		t.Fatal("expected fields without trigrams to be scanned")
+	}
+
+	// The trigram postings follow updates, deletes and rebuilds.
+	if err := db.Put([]byte("products:2"), []byte(`{"name":"Wired Earbuds","brand":"Sony"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("products:3")); err != nil {
+		t.Fatal(err)
+	}
+	search(SearchQuery{Prefix: "products", FullText: "headphnes", Fuzzy: true}, "products:1")
+	search(SearchQuery{Prefix: "products", FullText: "earbud", Fuzzy: true}, "products:2")
+	if ids, _ := candidates("products", "headphnes"); len(ids) != 1 {
+		t.Fatalf("expected stale trigram postings to be removed, got %v", ids)
+	}
+	if err := db.RebuildIndex("products", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids, used := candidates("products", "erabuds"); !used || len(ids) != 1 {
+		t.Fatalf("expected trigram candidates after rebuild, got %v (indexed %v)", ids, used)
+	}
+	search(SearchQuery{Prefix: "products", FullText: "erabuds", Fuzzy: true}, "products:2")
+}
@@ -0,0 +1,451 @@
+package velocity
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GeoPoint is a WGS84 coordinate in degrees. Documents may hold one as an
+// object with lat and lon (or lng, latitude, longitude), a GeoJSON Point,
+// a [lon, lat] array, a "lat,lon" string or WKT "POINT(lon lat)".
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// GeoRadius is the value of a "within_radius" filter: the points at most
+// Meters from Center along the earth's surface.
+type GeoRadius struct {
+	Center GeoPoint `json:"center"`
+	Meters float64  `json:"meters"`
+}
+
+// GeoBBox is the value of a "within_bbox" filter. A box with MinLon above
+// MaxLon crosses the antimeridian.
+type GeoBBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+// GeoPolygon is the value of a "within_polygon" filter: a ring of at least
+// three vertices, closed implicitly, that does not cross the antimeridian.
+type GeoPolygon []GeoPoint
+
+// Geo filter operators of SearchFilter.
+const (
+	GeoWithinRadius  = "within_radius"
+	GeoWithinBBox    = "within_bbox"
+	GeoWithinPolygon = "within_polygon"
+)
+
+const (
+	earthRadiusMeters = 6371008.8
+
+	// Points are posted under their geohash cells of every precision in
+	// this range, so that a query region can be covered by a few cells of
+	// whichever size fits it best.
+	geoMinPrecision = 2
+	geoMaxPrecision = 7
+	// geoMaxCoverCells bounds the cells a query region is covered with;
+	// regions needing more even at the coarsest precision are scanned.
+	geoMaxCoverCells = 32
+
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	// geoCellMarker starts the index terms that post geohash cells.
+	geoCellMarker = "\x00geo:"
+)
+
+// UnmarshalJSON accepts every form ParseGeoPoint does.
+func (p *GeoPoint) UnmarshalJSON(data []byte) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	point, ok := ParseGeoPoint(raw)
+	if !ok {
+		return fmt.Errorf("velocity: invalid geo point %s", data)
+	}
+	*p = point
+	return nil
+}
+
+// ParseGeoPoint reads a coordinate in any of the forms documented on
+// GeoPoint. It fails for coordinates out of range.
+func ParseGeoPoint(v any) (GeoPoint, bool) {
+	var p GeoPoint
+	ok := false
+	switch t := v.(type) {
+	case GeoPoint:
+		p, ok = t, true
+	case *GeoPoint:
+		if t != nil {
+			p, ok = *t, true
+		}
+	case map[string]any:
+		if coords, found := t["coordinates"]; found {
+			return ParseGeoPoint(coords)
+		}
+		lat, okLat := geoCoordinate(t, "lat", "latitude")
+		lon, okLon := geoCoordinate(t, "lon", "lng", "longitude")
+		p, ok = GeoPoint{Lat: lat, Lon: lon}, okLat && okLon
+	case []any:
+		if len(t) == 2 {
+			lon, okLon := toFloat(t[0])
+			lat, okLat := toFloat(t[1])
+			p, ok = GeoPoint{Lat: lat, Lon: lon}, okLat && okLon
+		}
+	case []float64:
+		if len(t) == 2 {
+			p, ok = GeoPoint{Lat: t[1], Lon: t[0]}, true
+		}
+	case string:
+		p, ok = parseGeoPointString(t)
+	case []byte:
+		p, ok = parseGeoPointString(string(t))
+	}
+	if !ok || !p.valid() {
+		return GeoPoint{}, false
+	}
+	return p, true
+}
+
+func geoCoordinate(m map[string]any, names ...string) (float64, bool) {
+	for _, name := range names {
+		if v, ok := m[name]; ok {
+			return toFloat(v)
+		}
+	}
+	return 0, false
+}
+
+func parseGeoPointString(s string) (GeoPoint, bool) {
+	s = strings.TrimSpace(s)
+	if upper := strings.ToUpper(s); strings.HasPrefix(upper, "POINT") {
+		inner := strings.TrimSpace(s[len("POINT"):])
+		if !strings.HasPrefix(inner, "(") || !strings.HasSuffix(inner, ")") {
+			return GeoPoint{}, false
+		}
+		parts := strings.Fields(inner[1 : len(inner)-1])
+		if len(parts) != 2 {
+			return GeoPoint{}, false
+		}
+		lon, err1 := strconv.ParseFloat(parts[0], 64)
+		lat, err2 := strconv.ParseFloat(parts[1], 64)
+		return GeoPoint{Lat: lat, Lon: lon}, err1 == nil && err2 == nil
+	}
+	if strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+		var p GeoPoint
+		return p, json.Unmarshal([]byte(s), &p) == nil
+	}
+	lat, lon, found := strings.Cut(s, ",")
+	if !found {
+		return GeoPoint{}, false
+	}
+	la, err1 := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	lo, err2 := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	return GeoPoint{Lat: la, Lon: lo}, err1 == nil && err2 == nil
+}
+
+func (p GeoPoint) valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180
+}
+
+// DistanceMeters returns the great-circle distance between p and q.
+func (p GeoPoint) DistanceMeters(q GeoPoint) float64 {
+	lat1, lat2 := p.Lat*math.Pi/180, q.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (q.Lon - p.Lon) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Contains reports whether p lies in b, edges included.
+func (b GeoBBox) Contains(p GeoPoint) bool {
+	if p.Lat < b.MinLat || p.Lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon <= b.MaxLon {
+		return p.Lon >= b.MinLon && p.Lon <= b.MaxLon
+	}
+	return p.Lon >= b.MinLon || p.Lon <= b.MaxLon
+}
+
+// Contains reports whether p lies inside the ring, by the even-odd rule on
+// plain latitude and longitude.
+func (g GeoPolygon) Contains(p GeoPoint) bool {
+	if len(g) < 3 {
+		return false
+	}
+	inside := false
+	for i, j := 0, len(g)-1; i < len(g); j, i = i, i+1 {
+		a, b := g[i], g[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (g GeoPolygon) bbox() GeoBBox {
+	b := GeoBBox{MinLat: 90, MinLon: 180, MaxLat: -90, MaxLon: -180}
+	for _, p := range g {
+		b.MinLat = math.Min(b.MinLat, p.Lat)
+		b.MaxLat = math.Max(b.MaxLat, p.Lat)
+		b.MinLon = math.Min(b.MinLon, p.Lon)
+		b.MaxLon = math.Max(b.MaxLon, p.Lon)
+	}
+	return b
+}
+
+// bbox returns a box holding every point of r.
+func (r GeoRadius) bbox() GeoBBox {
+	d := r.Meters / earthRadiusMeters
+	latDelta := d * 180 / math.Pi
+	b := GeoBBox{MinLat: r.Center.Lat - latDelta, MaxLat: r.Center.Lat + latDelta, MinLon: -180, MaxLon: 180}
+	if b.MinLat <= -90 || b.MaxLat >= 90 || d >= math.Pi/2 {
+		// The circle holds a pole: every longitude is in.
+		b.MinLat = math.Max(b.MinLat, -90)
+		b.MaxLat = math.Min(b.MaxLat, 90)
+		return b
+	}
+	lonDelta := math.Asin(math.Sin(d)/math.Cos(r.Center.Lat*math.Pi/180)) * 180 / math.Pi
+	if lonDelta >= 180 {
+		return b
+	}
+	b.MinLon = r.Center.Lon - lonDelta
+	b.MaxLon = r.Center.Lon + lonDelta
+	if b.MinLon < -180 {
+		b.MinLon += 360
+	}
+	if b.MaxLon > 180 {
+		b.MaxLon -= 360
+	}
+	return b
+}
+
+func isGeoFilterOp(op string) bool {
+	return op == GeoWithinRadius || op == GeoWithinBBox || op == GeoWithinPolygon
+}
+
+// geoFilterRegion returns the box around the region of a geo filter value.
+func geoFilterRegion(op string, value any) (GeoBBox, bool) {
+	switch op {
+	case GeoWithinRadius:
+		r, ok := geoFilterValue[GeoRadius](value)
+		return r.bbox(), ok && r.Center.valid() && r.Meters >= 0
+	case GeoWithinBBox:
+		b, ok := geoFilterValue[GeoBBox](value)
+		return b, ok
+	case GeoWithinPolygon:
+		g, ok := geoFilterValue[GeoPolygon](value)
+		return g.bbox(), ok && len(g) >= 3
+	}
+	return GeoBBox{}, false
+}
+
+// geoMatches reports whether the point held by value satisfies the geo
+// operator op with filter value want.
+func geoMatches(value any, op string, want any) bool {
+	p, ok := ParseGeoPoint(value)
+	if !ok {
+		return false
+	}
+	switch op {
+	case GeoWithinRadius:
+		r, ok := geoFilterValue[GeoRadius](want)
+		return ok && p.DistanceMeters(r.Center) <= r.Meters
+	case GeoWithinBBox:
+		b, ok := geoFilterValue[GeoBBox](want)
+		return ok && b.Contains(p)
+	case GeoWithinPolygon:
+		g, ok := geoFilterValue[GeoPolygon](want)
+		return ok && g.Contains(p)
+	}
+	return false
+}
+
+// geoFilterValue reads a geo filter value given as T, *T or anything that
+// encodes to T's JSON form, such as decoded JSON.
+func geoFilterValue[T any](v any) (T, bool) {
+	var out T
+	switch t := v.(type) {
+	case T:
+		return t, true
+	case *T:
+		if t == nil {
+			return out, false
+		}
+		return *t, true
+	case nil:
+		return out, false
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return out, false
+	}
+	return out, json.Unmarshal(data, &out) == nil
+}
+
+// geoFieldValue returns the value of field in raw, including the objects
+// and arrays points may be written as.
+func geoFieldValue(raw []byte, field string) (any, bool) {
+	if v, ok := fastJSONScalarField(raw, field); ok {
+		return v, true
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, false
+	}
+	data, ok := doc[field]
+	if !ok {
+		return nil, false
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// geohash encodes p as a geohash of precision characters.
+func geohash(p GeoPoint, precision int) string {
+	minLat, maxLat, minLon, maxLon := -90.0, 90.0, -180.0, 180.0
+	out := make([]byte, 0, precision)
+	even := true
+	bit, ch := 0, 0
+	for len(out) < precision {
+		if even {
+			mid := (minLon + maxLon) / 2
+			if p.Lon >= mid {
+				ch |= 1 << (4 - bit)
+				minLon = mid
+			} else {
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if p.Lat >= mid {
+				ch |= 1 << (4 - bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		even = !even
+		if bit < 4 {
+			bit++
+		} else {
+			out = append(out, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(out)
+}
+
+// geohashCellSize returns the height and width in degrees of the cells of
+// a precision: its 5*precision bits alternate between longitude and
+// latitude, longitude first.
+func geohashCellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lonBits))
+}
+
+// geoCellTerm is the index term documents with a point of field in cell
+// are posted under.
+func geoCellTerm(field, cell string) string {
+	return geoCellMarker + field + ":" + cell
+}
+
+// addGeoCellTerms adds to termSet the hashed cell terms of p in field.
+func addGeoCellTerms(termSet map[string]struct{}, field string, p GeoPoint) {
+	cell := geohash(p, geoMaxPrecision)
+	for precision := geoMinPrecision; precision <= geoMaxPrecision; precision++ {
+		termSet[hashValue(geoCellTerm(field, cell[:precision]))] = struct{}{}
+	}
+}
+
+// geoCover returns the cells of the finest precision that cover b in at
+// most geoMaxCoverCells, or false when even the coarsest needs more.
+func geoCover(b GeoBBox) ([]string, bool) {
+	lonRanges := [][2]float64{{b.MinLon, b.MaxLon}}
+	if b.MinLon > b.MaxLon {
+		lonRanges = [][2]float64{{b.MinLon, 180}, {-180, b.MaxLon}}
+	}
+	for precision := geoMaxPrecision; precision >= geoMinPrecision; precision-- {
+		height, width := geohashCellSize(precision)
+		rows, cols := int(180/height), int(360/width)
+		cellIndex := func(v, origin, size float64, n int) int {
+			return max(0, min(int((v-origin)/size), n-1))
+		}
+		i0, i1 := cellIndex(b.MinLat, -90, height, rows), cellIndex(b.MaxLat, -90, height, rows)
+		count := 0
+		for _, r := range lonRanges {
+			count += (i1 - i0 + 1) * (cellIndex(r[1], -180, width, cols) - cellIndex(r[0], -180, width, cols) + 1)
+		}
+		if count > geoMaxCoverCells {
+			continue
+		}
+		cells := make([]string, 0, count)
+		for _, r := range lonRanges {
+			j0, j1 := cellIndex(r[0], -180, width, cols), cellIndex(r[1], -180, width, cols)
+			for i := i0; i <= i1; i++ {
+				for j := j0; j <= j1; j++ {
+					center := GeoPoint{Lat: -90 + (float64(i)+0.5)*height, Lon: -180 + (float64(j)+0.5)*width}
+					cells = append(cells, geohash(center, precision))
+				}
+			}
+		}
+		return cells, true
+	}
+	return nil, false
+}
+
+// geoCandidatesLocked returns the documents posted under the cells
+// covering the region of a geo filter. It reports false when the field is
+// not a GeoPoint field of the prefix or the region is too large to cover.
+func (db *DB) geoCandidatesLocked(prefix string, f SearchFilter) ([]uint64, bool, error) {
+	if !db.hasGeoFieldLocked(prefix, f.Field) {
+		return nil, false, nil
+	}
+	region, ok := geoFilterRegion(f.Op, f.Value)
+	if !ok {
+		// An invalid region matches nothing.
+		return []uint64{}, true, nil
+	}
+	cells, ok := geoCover(region)
+	if !ok {
+		return nil, false, nil
+	}
+	var out []uint64
+	for _, cell := range cells {
+		ids, err := db.getPostingListLocked(indexTermKey(prefix, hashValue(geoCellTerm(f.Field, cell))))
+		if err != nil {
+			return nil, false, err
+		}
+		out = mergeSortedUnique(out, ids)
+	}
+	if out == nil {
+		out = []uint64{}
+	}
+	return out, true, nil
+}
+
+func (db *DB) hasGeoFieldLocked(prefix, field string) bool {
+	schema := db.schemaForPrefixLocked(prefix)
+	if schema == nil {
+		return false
+	}
+	for _, f := range schema.Fields {
+		if f.GeoPoint && f.Name == field {
+			return true
+		}
+	}
+	return false
+}
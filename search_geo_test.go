@@ -0,0 +1,231 @@
+package velocity
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestGeohash(t *testing.T) {
+	// The first is the example of the geohash.org announcement.
+	for _, tc := range []struct {
+		p    GeoPoint
+		want string
+	}{
+		{GeoPoint{Lat: 57.64911, Lon: 10.40744}, "u4pruydqqvj"},
+		{GeoPoint{Lat: 48.8566, Lon: 2.3522}, "u09tvw0f6"},
+		{GeoPoint{Lat: -33.8688, Lon: 151.2093}, "r3gx2f77b"},
+	} {
+		if got := geohash(tc.p, len(tc.want)); got != tc.want {
+			t.Errorf("geohash(%v) = %q, want %q", tc.p, got, tc.want)
+		}
+	}
+
+	paris, london := GeoPoint{Lat: 48.8566, Lon: 2.3522}, GeoPoint{Lat: 51.5074, Lon: -0.1278}
+	if d := paris.DistanceMeters(london); math.Abs(d-343_500) > 1_000 {
+		t.Errorf("Paris to London = %.0fm, want about 343.5km", d)
+	}
+
+	// A cover holds every point of its box.
+	for _, b := range []GeoBBox{
+		{MinLat: 48.7, MinLon: 2.1, MaxLat: 48.9, MaxLon: 2.5},
+		{MinLat: -20, MinLon: 175, MaxLat: -15, MaxLon: -175},
+	} {
+		cells, ok := geoCover(b)
+		if !ok || len(cells) == 0 || len(cells) > geoMaxCoverCells {
+			t.Fatalf("cover of %+v: %v (%v)", b, cells, ok)
+		}
+		for _, p := range []GeoPoint{{Lat: b.MinLat, Lon: b.MinLon}, {Lat: b.MaxLat, Lon: b.MaxLon}, {Lat: (b.MinLat + b.MaxLat) / 2, Lon: b.MinLon}} {
+			hash, covered := geohash(p, geoMaxPrecision), false
+			for _, cell := range cells {
+				covered = covered || hash[:len(cell)] == cell
+			}
+			if !covered {
+				t.Errorf("cover of %+v misses %v: %v", b, p, cells)
+			}
+		}
+	}
+	if _, ok := geoCover(GeoBBox{MinLat: -80, MinLon: -170, MaxLat: 80, MaxLon: 170}); ok {
+		t.Error("expected a continent-sized box to need a scan")
+	}
+}
+
+func TestParseGeoPoint(t *testing.T) {
+	want := GeoPoint{Lat: 48.8566, Lon: 2.3522}
+	for _, v := range []any{
+		want,
+		&want,
+		map[string]any{"lat": 48.8566, "lon": 2.3522},
+		map[string]any{"latitude": "48.8566", "lng": 2.3522},
+		map[string]any{"type": "Point", "coordinates": []any{2.3522, 48.8566}},
+		[]any{2.3522, 48.8566},
+		[]float64{2.3522, 48.8566},
+		"48.8566, 2.3522",
+		"POINT(2.3522 48.8566)",
+		`{"lat":48.8566,"lon":2.3522}`,
+	} {
+		if got, ok := ParseGeoPoint(v); !ok || got != want {
+			t.Errorf("ParseGeoPoint(%#v) = %v, %v", v, got, ok)
+		}
+	}
+	for _, v := range []any{nil, 42, "paris", "91,0", []any{200.0, 0.0}, map[string]any{"lat": 1}} {
+		if _, ok := ParseGeoPoint(v); ok {
+			t.Errorf("expected ParseGeoPoint(%#v) to fail", v)
+		}
+	}
+}
+
+var geoSearchSchemas = map[string]*SearchSchema{
+	"places": {Fields: []SearchSchemaField{
+		{Name: "loc", GeoPoint: true},
+		{Name: "kind", HashSearch: true},
+	}},
+}
+
+func putGeoPlaces(t *testing.T, db *DB) {
+	t.Helper()
+	for key, value := range map[string]string{
+		"places:paris":      `{"kind":"city","loc":{"lat":48.8566,"lon":2.3522}}`,
+		"places:versailles": `{"kind":"palace","loc":[2.1204,48.8049]}`,
+		"places:london":     `{"kind":"city","loc":"51.5074,-0.1278"}`,
+		"places:berlin":     `{"kind":"city","loc":{"type":"Point","coordinates":[13.405,52.52]}}`,
+		"places:suva":       `{"kind":"city","loc":{"lat":-18.1416,"lon":178.4419}}`,
+		"places:apia":       `{"kind":"city","loc":{"lat":-13.8507,"lon":-171.7514}}`,
+		"places:nowhere":    `{"kind":"city"}`,
+		"sights:eiffel":     `{"loc":{"lat":48.8584,"lon":2.2945}}`,
+	} {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchGeoFilters(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), geoSearchSchemas)
+	defer db.Close()
+	putGeoPlaces(t, db)
+	paris := GeoPoint{Lat: 48.8566, Lon: 2.3522}
+
+	search := func(prefix string, filters []SearchFilter, want ...string) {
+		t.Helper()
+		q := SearchQuery{Prefix: prefix, Filters: filters, Sort: []SearchSort{{Field: sortFieldKey}}, Limit: 10}
+		for _, indexed := range []bool{true, false} {
+			db.EnableSearchIndex(indexed)
+			results, err := db.Search(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultKeys(results); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("%+v (index %v): got %v, want %v", filters, indexed, got, want)
+			}
+			count, err := db.SearchCount(q)
+			if err != nil || count != len(want) {
+				t.Fatalf("%+v (index %v): count %d, want %d (%v)", filters, indexed, count, len(want), err)
+			}
+		}
+		db.EnableSearchIndex(true)
+	}
+	radius := func(meters float64) []SearchFilter {
+		return []SearchFilter{{Field: "loc", Op: GeoWithinRadius, Value: GeoRadius{Center: paris, Meters: meters}}}
+	}
+
+	search("places", radius(25_000), "places:paris", "places:versailles")
+	search("places", radius(400_000), "places:london", "places:paris", "places:versailles")
+	search("places", []SearchFilter{{Field: "loc", Op: GeoWithinRadius, Value: GeoRadius{Center: GeoPoint{Lat: 48.8584, Lon: 2.2945}, Meters: 100}}})
+	search("places", append(radius(400_000), SearchFilter{Field: "kind", Op: "=", Value: "city", HashOnly: true}), "places:london", "places:paris")
+	// Regions decoded from JSON work as well as typed ones.
+	search("places", []SearchFilter{{Field: "loc", Op: GeoWithinRadius, Value: map[string]any{
+		"center": map[string]any{"lat": 48.8566, "lon": 2.3522}, "meters": 25_000.0,
+	}}}, "places:paris", "places:versailles")
+	search("places", []SearchFilter{{Field: "loc", Op: GeoWithinBBox, Value: GeoBBox{MinLat: 45, MinLon: -5, MaxLat: 55, MaxLon: 5}}},
+		"places:london", "places:paris", "places:versailles")
+	// A box across the antimeridian.
+	search("places", []SearchFilter{{Field: "loc", Op: GeoWithinBBox, Value: GeoBBox{MinLat: -25, MinLon: 170, MaxLat: -10, MaxLon: -170}}},
+		"places:apia", "places:suva")
+	search("places", []SearchFilter{{Field: "loc", Op: GeoWithinPolygon, Value: GeoPolygon{
+		{Lat: 51, Lon: -3}, {Lat: 53, Lon: -3}, {Lat: 53, Lon: 16}, {Lat: 51.8, Lon: 16},
+	}}}, "places:berlin", "places:london")
+	// Regions too large to cover and prefixes without cells are scanned.
+	search("places", radius(3_000_000), "places:berlin", "places:london", "places:paris", "places:versailles")
+	search("sights", radius(5_000), "sights:eiffel")
+	search("places", []SearchFilter{{Field: "loc", Op: GeoWithinRadius, Value: "nonsense"}})
+
+	candidates := func(f SearchFilter) ([]uint64, bool) {
+		t.Helper()
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+		ids, used, err := db.geoCandidatesLocked("places", f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids, used
+	}
+	if ids, used := candidates(radius(25_000)[0]); !used || len(ids) != 2 {
+		t.Fatalf("expected 2 cell candidates, got %v (indexed %v)", ids, used)
+	}
+
+	// The cell postings follow updates, deletes and rebuilds.
+	if err := db.Put([]byte("places:versailles"), []byte(`{"kind":"palace","loc":{"lat":47.6162,"lon":1.5170}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("places:london")); err != nil {
+		t.Fatal(err)
+	}
+	search("places", radius(25_000), "places:paris")
+	search("places", radius(400_000), "places:paris", "places:versailles")
+	if ids, _ := candidates(radius(25_000)[0]); len(ids) != 1 {
+		t.Fatalf("expected stale cell postings to be removed, got %v", ids)
+	}
+	if err := db.RebuildIndex("places", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids, used := candidates(radius(25_000)[0]); !used || len(ids) != 1 {
+		t.Fatalf("expected cell candidates after rebuild, got %v (indexed %v)", ids, used)
+	}
+	search("places", radius(25_000), "places:paris")
+}
+
+func TestSearchGeoDistanceSort(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), geoSearchSchemas)
+	defer db.Close()
+	putGeoPlaces(t, db)
+	paris := GeoPoint{Lat: 48.8566, Lon: 2.3522}
+	q := SearchQuery{
+		Prefix:  "places",
+		Filters: []SearchFilter{{Field: "kind", Op: "=", Value: "city", HashOnly: true}},
+		Sort:    []SearchSort{{Field: "loc", Near: &paris}},
+		Limit:   2,
+	}
+	var got []string
+	for {
+		results, err := db.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resultKeys(results)...)
+		if len(results) < q.Limit {
+			break
+		}
+		q.After = results[len(results)-1].Cursor
+	}
+	// Closest first; the document without a point comes last.
+	if fmt.Sprint(got) != "[places:paris places:london places:berlin places:apia places:suva places:nowhere]" {
+		t.Fatalf("unexpected distance order: %v", got)
+	}
+
+	q.Sort[0].Desc, q.After, q.Limit = true, "", 3
+	results, err := db.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resultKeys(results); fmt.Sprint(got) != "[places:suva places:apia places:berlin]" {
+		t.Fatalf("unexpected descending distance order: %v", got)
+	}
+
+	// Cursors belong to the point they measure from.
+	berlin := GeoPoint{Lat: 52.52, Lon: 13.405}
+	q.Sort[0].Near, q.After = &berlin, results[0].Cursor
+	if _, err := db.Search(q); err == nil {
+		t.Fatal("expected a cursor from another sort point to be rejected")
+	}
+}
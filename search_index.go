@@ -24,6 +24,7 @@ const (
 	indexTermPrefix     = "__idx:term:"
 	indexHashPrefix     = "__idx:hash:"
 	indexValuePrefix    = "__idx:value:"
+	indexNormPrefix     = "__idx:norm:"
 )
 
 func isIndexKey(key []byte) bool {
@@ -32,11 +33,21 @@ func isIndexKey(key []byte) bool {
 
 // SearchSchemaField describes how a field should be indexed.
 // Name refers to a top-level JSON field. Use "$value" to index the full value for plain text.
+// Analyzer names the analyzer producing the full-text terms of a searchable
+// field (see RegisterAnalyzer); empty is "standard". Boost weighs the
+// field's share of the relevance score; zero counts as 1. Fuzzy also
+// indexes the trigrams of a searchable field's terms, so that fuzzy queries
+// find its typos without a scan. GeoPoint posts the field's GeoPoint under
+// the geohash cells holding it for the geo filters.
 type SearchSchemaField struct {
 	Name       string
 	Searchable bool // full-text search
 	HashSearch bool // equality-only hash search
 	ValueIndex bool // structured value posting index for range/equality filters
+	GeoPoint   bool // geohash cell postings for within_radius/within_bbox/within_polygon
+	Analyzer   string
+	Boost      float64
+	Fuzzy      bool
 }
 
 // SearchSchema defines indexing rules for a record.
@@ -50,7 +61,9 @@ func isHighCardinalityIdentifierField(name string) bool {
 }
 
 // SearchFilter defines a filter for search queries.
-// Op supports: "=", "==", "!=", ">", ">=", "<", "<=".
+// Op supports: "=", "==", "!=", ">", ">=", "<", "<=", and for fields holding
+// a GeoPoint "within_radius" (Value a GeoRadius), "within_bbox" (a GeoBBox)
+// and "within_polygon" (a GeoPolygon).
 // If HashOnly is true, equality uses the hash index when available.
 type SearchFilter struct {
 	Field    string
@@ -89,6 +102,31 @@ type SearchQuery struct {
 	MatchMode   string // "", "all", "any", "phrase", or "boolean"; empty keeps all-terms behavior.
 	PrefixMatch bool   // allows query terms ending in * to match token prefixes.
 	Highlight   bool   // include lightweight text snippets for matching full-text queries.
+	// Fuzzy lets each full-text term match terms up to FuzzyMaxEdits
+	// insertions, deletions, substitutions or adjacent swaps away (1 when
+	// zero, at most 2), ranked below exact matches. Terms of up to two
+	// characters still match exactly, and up to five allow one edit.
+	// Phrases and excluded terms are not fuzzy. Typos are found through the
+	// trigram postings of Fuzzy schema fields and by scanning otherwise.
+	Fuzzy         bool
+	FuzzyMaxEdits int
+	// Sort orders the results by fields, "_score" or "_key"; ties are broken
+	// by key. Offset skips that many results, and After resumes after the
+	// result whose Cursor it holds. Any of the three makes the order stable
+	// across calls: by score for full-text queries and by key otherwise
+	// when Sort is empty.
+	Sort   []SearchSort
+	Offset int
+	After  string
+	// Fields limits each result Value to a JSON object of these top-level
+	// scalar fields.
+	Fields []string
+	// Aggregations are computed over every match by SearchWithAggregations;
+	// Search and SearchCount reject a query that has them.
+	Aggregations []SearchAggregation
+
+	// analysis is set by the search entry points from the schema of Prefix.
+	analysis *textAnalysis
 }
 
 // SearchResult contains key/value pairs returned by Search().
@@ -97,6 +135,10 @@ type SearchResult struct {
 	Value      []byte
 	Score      float64
 	Highlights map[string][]string
+	// Cursor resumes the search after this result when passed as
+	// SearchQuery.After. It is set when the query has Sort, Offset or
+	// After.
+	Cursor string
 }
 
 // RebuildOptions controls bulk index rebuild.
@@ -108,10 +150,11 @@ type RebuildOptions struct {
 }
 
 type indexMeta struct {
-	Prefix string            `json:"prefix"`
-	Terms  []string          `json:"terms"`
-	Hashes map[string]string `json:"hashes"`
-	Values map[string]string `json:"values,omitempty"`
+	Prefix  string            `json:"prefix"`
+	Terms   []string          `json:"terms"`
+	Hashes  map[string]string `json:"hashes"`
+	Values  map[string]string `json:"values,omitempty"`
+	Lengths map[string]int    `json:"lengths,omitempty"` // analyzed terms per searchable field
 }
 
 // PutIndexed stores a value and updates the hybrid index based on schema.
@@ -150,7 +193,7 @@ func (db *DB) PutWithIndexFieldPairs(key, value []byte, fields []IndexFieldValue
 		db.mutex.Unlock()
 		return err
 	}
-	err := db.indexEntryWithProjectionsLocked(key, value, prefix, schema, func() ([]string, map[string]string, map[string]string) {
+	err := db.indexEntryWithProjectionsLocked(key, value, prefix, schema, func() ([]string, map[string]string, map[string]string, map[string]int) {
 		return buildIndexProjectionsFromFieldPairs(fields, schema)
 	})
 	db.mutex.Unlock()
@@ -234,7 +277,10 @@ func (db *DB) RebuildIndex(prefix string, schema *SearchSchema, opts *RebuildOpt
 	// Scan memtable
 	db.memTable.entries.Range(func(k, v any) bool {
 		e := storedEntryPtr(v)
-		if e.Deleted {
+		if e.Deleted || db.rangeDeletedLocked(e) {
+			return true
+		}
+		if e = db.resolvedEntryLocked(e); e == nil {
 			return true
 		}
 		if isIndexKey(e.Key) {
@@ -256,7 +302,10 @@ func (db *DB) RebuildIndex(prefix string, schema *SearchSchema, opts *RebuildOpt
 	for i := len(db.flushingMemTables) - 1; i >= 0; i-- {
 		db.flushingMemTables[i].entries.Range(func(k, v any) bool {
 			e := storedEntryPtr(v)
-			if e.Deleted || isIndexKey(e.Key) {
+			if e.Deleted || isIndexKey(e.Key) || db.rangeDeletedLocked(e) {
+				return true
+			}
+			if e = db.resolvedEntryLocked(e); e == nil {
 				return true
 			}
 			if prefix != "" && !prefixMatch(string(e.Key), prefix) {
@@ -282,6 +331,10 @@ func (db *DB) RebuildIndex(prefix string, schema *SearchSchema, opts *RebuildOpt
 	for _, level := range db.levels {
 		for sstIdx := len(level) - 1; sstIdx >= 0; sstIdx-- {
 			sst := level[sstIdx]
+			if prefix != "" && !sst.mayHoldSearchPrefix(prefix, db.sstOptions.PrefixExtractor) {
+				db.counters.scanTablesSkipped.Add(1)
+				continue
+			}
 			idxPos := uint32(0)
 			for i := 0; i < sst.entryCount; i++ {
 				indexEntry, err := sst.readIndexEntryAt(idxPos)
@@ -303,7 +356,10 @@ func (db *DB) RebuildIndex(prefix string, schema *SearchSchema, opts *RebuildOpt
 				}
 
 				val, err := sst.readEntryAt(indexEntry.Offset, indexEntry.Size)
-				if err != nil || val == nil || val.Deleted {
+				if err != nil || val == nil || val.Deleted || db.rangeDeletedLocked(val) {
+					continue
+				}
+				if val = db.resolvedEntryLocked(val); val == nil {
 					continue
 				}
 				if val.ExpiresAt != 0 && time.Now().UnixNano() > int64(val.ExpiresAt) {
@@ -328,13 +384,14 @@ func (db *DB) RebuildIndex(prefix string, schema *SearchSchema, opts *RebuildOpt
 		}
 		batch := make([]indexWorkItem, 0, end-start)
 		for _, p := range pairs[start:end] {
-			terms, hashes, values := buildIndexProjections(p.value, schema)
+			terms, hashes, values, lengths := buildIndexProjections(p.value, schema)
 			batch = append(batch, indexWorkItem{
 				key:           p.key,
 				value:         p.value,
 				terms:         terms,
 				hashes:        hashes,
 				values:        values,
+				lengths:       lengths,
 				valuePostings: valuePostingsForSchema(values, schema),
 			})
 		}
@@ -352,12 +409,40 @@ func (db *DB) ClearIndexForPrefix(prefix string) error {
 	return db.clearIndexForPrefix(prefix, &RebuildOptions{NoWAL: true})
 }
 
+// DropIndexForPrefix clears the prefix's index like ClearIndexForPrefix and
+// also forgets the document ids bound to its keys, for when the records
+// themselves are gone, as after DeletePrefix. The per-document records keyed
+// by id stay behind: ids are never reused, and nothing reaches those records
+// once the bindings and postings are gone.
+func (db *DB) DropIndexForPrefix(prefix string) error {
+	if err := db.clearIndexForPrefix(prefix, &RebuildOptions{NoWAL: true}); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for key, docID := range db.docIDByKey {
+		if prefixMatch(key, prefix) {
+			delete(db.docIDByKey, key)
+			delete(db.docKeyByID, docID)
+			delete(db.indexMetaByID, docID)
+		}
+	}
+	for _, sep := range []string{":", "/"} {
+		start := indexDocIDKey([]byte(prefix + sep))
+		if err := db.deleteRangeLocked(start, prefixUpperBound(start), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type indexWorkItem struct {
 	key           []byte
 	value         []byte
 	terms         []string
 	hashes        map[string]string
 	values        map[string]string
+	lengths       map[string]int
 	valuePostings map[string]string
 }
 
@@ -405,7 +490,7 @@ func (db *DB) applyIndexBatch(prefix string, batch []indexWorkItem, opts *Rebuil
 			}
 		}
 
-		meta := indexMeta{Prefix: prefix, Terms: item.terms, Hashes: item.hashes, Values: item.values}
+		meta := indexMeta{Prefix: prefix, Terms: item.terms, Hashes: item.hashes, Values: item.values, Lengths: item.lengths}
 		var metaBytes []byte
 		if !inMemoryOnly {
 			var err error
@@ -416,6 +501,7 @@ func (db *DB) applyIndexBatch(prefix string, batch []indexWorkItem, opts *Rebuil
 		}
 		if inMemoryOnly {
 			db.rememberIndexMetaLocked(docID, meta)
+			db.adjustFieldNormsLocked(meta, 1)
 		} else {
 			if err := db.storeIndexMetaLocked(docID, meta, metaBytes); err != nil {
 				return err
@@ -459,6 +545,11 @@ func (db *DB) applyIndexBatch(prefix string, batch []indexWorkItem, opts *Rebuil
 			return err
 		}
 	}
+	if !inMemoryOnly {
+		if err := db.storeFieldNormsLocked(); err != nil {
+			return err
+		}
+	}
 
 	for k, ids := range additions {
 		if len(ids) == 0 {
@@ -507,29 +598,16 @@ func (db *DB) clearIndexForPrefix(prefix string, opts *RebuildOptions) error {
 			delete(db.valueIndexPostings, k)
 		}
 	}
-	terms, _ := db.keysLocked(indexTermPrefix + tag + ":*")
-	hashes, _ := db.keysLocked(indexHashPrefix + tag + ":*")
-	values, _ := db.keysLocked(indexValuePrefix + tag + ":*")
-	noWAL := opts != nil && opts.NoWAL
-	for _, k := range terms {
-		if noWAL {
-			_ = db.deleteIndexNoWALLocked([]byte(k))
-		} else {
-			_ = db.deleteLocked([]byte(k))
-		}
-	}
-	for _, k := range hashes {
-		if noWAL {
-			_ = db.deleteIndexNoWALLocked([]byte(k))
-		} else {
-			_ = db.deleteLocked([]byte(k))
-		}
+	db.resetFieldNormsLocked(prefix)
+	if err := db.storeFieldNormsLocked(); err != nil {
+		return err
 	}
-	for _, k := range values {
-		if noWAL {
-			_ = db.deleteIndexNoWALLocked([]byte(k))
-		} else {
-			_ = db.deleteLocked([]byte(k))
+	// One range tombstone per index family replaces a delete per key.
+	useWAL := opts == nil || !opts.NoWAL
+	for _, family := range []string{indexTermPrefix, indexHashPrefix, indexValuePrefix} {
+		start := []byte(family + tag + ":")
+		if err := db.deleteRangeLocked(start, prefixUpperBound(start), useWAL); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -608,12 +686,12 @@ func (db *DB) indexEntryLocked(key, value []byte, prefix string, schema *SearchS
 	if isIndexKey(key) {
 		return fmt.Errorf("reserved index key prefix")
 	}
-	return db.indexEntryWithProjectionsLocked(key, value, prefix, schema, func() ([]string, map[string]string, map[string]string) {
+	return db.indexEntryWithProjectionsLocked(key, value, prefix, schema, func() ([]string, map[string]string, map[string]string, map[string]int) {
 		return buildIndexProjections(value, schema)
 	})
 }
 
-func (db *DB) indexEntryWithProjectionsLocked(key, value []byte, prefix string, schema *SearchSchema, projections func() ([]string, map[string]string, map[string]string)) error {
+func (db *DB) indexEntryWithProjectionsLocked(key, value []byte, prefix string, schema *SearchSchema, projections func() ([]string, map[string]string, map[string]string, map[string]int)) error {
 	// Get or allocate docID
 	docID, exists, err := db.getDocIDLocked(key)
 	if err != nil {
@@ -633,12 +711,12 @@ func (db *DB) indexEntryWithProjectionsLocked(key, value []byte, prefix string,
 	}
 
 	// Index the new value
-	terms, hashes, values := projections()
+	terms, hashes, values, lengths := projections()
 	if err := db.addIndexEntriesLocked(docID, prefix, terms, hashes, valuePostingsForSchema(values, schema)); err != nil {
 		return err
 	}
 
-	meta := indexMeta{Prefix: prefix, Terms: terms, Hashes: hashes, Values: values}
+	meta := indexMeta{Prefix: prefix, Terms: terms, Hashes: hashes, Values: values, Lengths: lengths}
 	var metaBytes []byte
 	if !db.disableIndexPersistence {
 		metaBytes, err = json.Marshal(meta)
@@ -650,7 +728,7 @@ func (db *DB) indexEntryWithProjectionsLocked(key, value []byte, prefix string,
 		return err
 	}
 
-	return nil
+	return db.storeFieldNormsLocked()
 }
 
 // DeleteIndexed removes a value and its index entries.
@@ -669,6 +747,15 @@ func (db *DB) DeleteIndexed(key []byte) error {
 }
 
 func (db *DB) deleteIndexedLocked(key []byte) error {
+	if err := db.unindexKeyLocked(key); err != nil {
+		return err
+	}
+	return db.deleteLocked(key)
+}
+
+// unindexKeyLocked drops key's postings and doc bindings without touching the
+// primary record.
+func (db *DB) unindexKeyLocked(key []byte) error {
 	docID, exists, err := db.getDocIDLocked(key)
 	if err != nil {
 		return err
@@ -683,160 +770,226 @@ func (db *DB) deleteIndexedLocked(key []byte) error {
 		_ = db.deleteLocked(indexDocKey(docID))
 		_ = db.deleteLocked(indexDocIDKey(key))
 		_ = db.deleteLocked(indexMetaKey(docID))
+		return db.storeFieldNormsLocked()
 	}
-
-	return db.deleteLocked(key)
+	return nil
 }
 
 // Search executes a hybrid full-text and structured query.
 func (db *DB) Search(q SearchQuery) ([]SearchResult, error) {
+	if err := q.checkNoAggregations("Search"); err != nil {
+		return nil, err
+	}
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
+	q = db.withTextAnalysisLocked(q)
 
 	if q.Limit <= 0 {
 		q.Limit = 100
 	}
+	var results []SearchResult
+	var err error
+	if q.paged() {
+		results, err = db.pagedSearchLocked(q)
+	} else {
+		results, err = db.searchLocked(q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	projectSearchResults(results, q.Fields)
+	return results, nil
+}
 
+// searchLocked returns up to q.Limit matches of q, by relevance for
+// full-text queries and in index or scan order otherwise.
+func (db *DB) searchLocked(q SearchQuery) ([]SearchResult, error) {
 	if id, ok := exactIDFilterValue(q.Filters); ok && q.Prefix != "" {
-		key := []byte(q.Prefix + ":" + id)
-		value, err := db.get(key)
-		if err != nil {
-			return nil, nil
-		}
-		if matchesQuery(value, q) {
-			plan := parseFullTextQuery(q)
-			return []SearchResult{{Key: append([]byte{}, key...), Value: append([]byte{}, value...), Score: searchQueryScore(value, q, plan), Highlights: searchQueryHighlights(value, q, plan)}}, nil
-		}
-		return nil, nil
+		return db.exactIDSearchLocked(q, id), nil
 	}
 
-	indexEnabled := db.searchIndexEnabled
 	fullTextPlan := parseFullTextQuery(q)
 	rankTextResults := fullTextPlan.active() || conditionHasFullText(q.Condition)
 
 	// Build candidate set from indexes (if possible)
+	candidates, usedIndex, err := db.searchCandidatesLocked(q, fullTextPlan)
+	if err != nil {
+		return nil, err
+	}
+	// If no usable index predicate, fall back to scanning
+	if !usedIndex {
+		return db.scanSearchLocked(q)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	limit := q.Limit
+	if rankTextResults {
+		limit = 0
+	}
+	results := db.evaluateCandidatesLocked(candidates, q, fullTextPlan, limit)
+	if rankTextResults {
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].Score == results[j].Score {
+				return string(results[i].Key) < string(results[j].Key)
+			}
+			return results[i].Score > results[j].Score
+		})
+		if len(results) > q.Limit {
+			results = results[:q.Limit]
+		}
+	}
+
+	return results, nil
+}
+
+// exactIDSearchLocked answers a query whose filters pin the id of the key
+// under q.Prefix with a single lookup.
+func (db *DB) exactIDSearchLocked(q SearchQuery, id string) []SearchResult {
+	key := []byte(q.Prefix + ":" + id)
+	value, err := db.get(key)
+	if err != nil {
+		return nil
+	}
+	if matchesQuery(value, q) {
+		plan := parseFullTextQuery(q)
+		return []SearchResult{{Key: append([]byte{}, key...), Value: append([]byte{}, value...), Score: searchQueryScore(value, q, plan), Highlights: searchQueryHighlights(value, q, plan)}}
+	}
+	return nil
+}
+
+// searchCandidatesLocked returns the ids of the documents the indexes admit
+// for q, and false if no index applies and the data must be scanned.
+func (db *DB) searchCandidatesLocked(q SearchQuery, fullTextPlan fullTextPlan) ([]uint64, bool, error) {
+	if !db.searchIndexEnabled {
+		return nil, false, nil
+	}
 	var candidates []uint64
 	usedIndex := false
 
-	if indexEnabled && fullTextPlan.active() {
+	if fullTextPlan.active() {
 		ids, ok, err := db.fullTextCandidatesLocked(q.Prefix, fullTextPlan)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		if ok {
 			candidates = ids
 			usedIndex = true
 			if len(candidates) == 0 {
-				return nil, nil
+				return candidates, true, nil
 			}
 		}
 	}
 
 	for _, f := range q.Filters {
-		if f.Op == "=" || f.Op == "==" {
-			if indexEnabled && f.HashOnly {
-				hash := hashValue(normalizeValue(f.Value))
-				ids := db.hashIndexPostingLocked(q.Prefix, f.Field, hash)
-				var err error
-				if ids == nil {
-					ids, err = db.getPostingListLocked(indexHashKey(q.Prefix, f.Field, hash))
-				}
-				if err != nil {
-					return nil, err
-				}
-				if ids == nil {
-					// Hash index is not available for this field/value.
-					// Fall back to scan-based evaluation instead of returning an empty result set.
-					if db.hasHashIndexFieldLocked(q.Prefix, f.Field) {
-						return nil, nil
-					}
-					continue
-				}
-				if candidates == nil {
-					candidates = ids
-				} else {
-					candidates = intersectSorted(candidates, ids)
-				}
-				usedIndex = true
-				if len(candidates) == 0 {
-					return nil, nil
+		if (f.Op == "=" || f.Op == "==") && f.HashOnly {
+			hash := hashValue(normalizeValue(f.Value))
+			ids := db.hashIndexPostingLocked(q.Prefix, f.Field, hash)
+			var err error
+			if ids == nil {
+				ids, err = db.getPostingListLocked(indexHashKey(q.Prefix, f.Field, hash))
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			if ids == nil {
+				// Hash index is not available for this field/value.
+				// Fall back to scan-based evaluation instead of returning an empty result set.
+				if db.hasHashIndexFieldLocked(q.Prefix, f.Field) {
+					return []uint64{}, true, nil
 				}
+				continue
+			}
+			if candidates == nil {
+				candidates = ids
+			} else {
+				candidates = intersectSorted(candidates, ids)
+			}
+			usedIndex = true
+			if len(candidates) == 0 {
+				return candidates, true, nil
 			}
 		}
-	}
-
-	if !usedIndex && indexEnabled {
-		ids, ok, err := db.valueIndexCandidatesLocked(q)
-		if err != nil {
-			return nil, err
-		}
-		if ok {
-			candidates = ids
+		if isGeoFilterOp(f.Op) {
+			ids, ok, err := db.geoCandidatesLocked(q.Prefix, f)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				continue
+			}
+			if candidates == nil {
+				candidates = ids
+			} else {
+				candidates = intersectSorted(candidates, ids)
+			}
 			usedIndex = true
 			if len(candidates) == 0 {
-				return nil, nil
+				return candidates, true, nil
 			}
 		}
 	}
 
-	// If no usable index predicate, fall back to scanning
-	results := make([]SearchResult, 0, min(q.Limit, 100))
 	if !usedIndex {
-		return db.scanSearchLocked(q)
+		return db.valueIndexCandidatesLocked(q)
 	}
+	return candidates, usedIndex, nil
+}
 
-	// Evaluate candidates
+// evaluateCandidatesLocked loads the candidate documents and returns those
+// matching q, stopping after limit matches unless limit is 0.
+func (db *DB) evaluateCandidatesLocked(candidates []uint64, q SearchQuery, fullTextPlan fullTextPlan, limit int) []SearchResult {
+	results := make([]SearchResult, 0, min(len(candidates), 100))
 	for _, id := range candidates {
-		if !rankTextResults && len(results) >= q.Limit {
+		if limit > 0 && len(results) >= limit {
 			break
 		}
-		meta, metaFound, metaErr := db.getIndexMetaLocked(id)
-		if metaErr == nil && metaFound {
-			if ok, exact := matchesQueryMeta(meta, q); exact && !ok {
-				continue
-			}
-		}
-		key, err := db.getDocKeyLocked(id)
-		if err != nil || len(key) == 0 {
-			continue
-		}
-		if q.Prefix != "" && !prefixMatch(string(key), q.Prefix) {
-			continue
-		}
-		value, err := db.get(key)
-		if err != nil {
-			continue
-		}
-		if matchesQuery(value, q) {
-			results = append(results, SearchResult{
-				Key:        append([]byte{}, key...),
-				Value:      append([]byte{}, value...),
-				Score:      searchQueryScore(value, q, fullTextPlan),
-				Highlights: searchQueryHighlights(value, q, fullTextPlan),
-			})
+		if result, ok := db.evaluateCandidateLocked(id, q, fullTextPlan); ok {
+			results = append(results, result)
 		}
 	}
-	if rankTextResults {
-		sort.SliceStable(results, func(i, j int) bool {
-			if results[i].Score == results[j].Score {
-				return string(results[i].Key) < string(results[j].Key)
-			}
-			return results[i].Score > results[j].Score
-		})
-		if len(results) > q.Limit {
-			results = results[:q.Limit]
+	return results
+}
+
+// evaluateCandidateLocked loads one candidate document and reports whether
+// it matches q.
+func (db *DB) evaluateCandidateLocked(id uint64, q SearchQuery, fullTextPlan fullTextPlan) (SearchResult, bool) {
+	meta, metaFound, metaErr := db.getIndexMetaLocked(id)
+	if metaErr == nil && metaFound {
+		if ok, exact := matchesQueryMeta(meta, q); exact && !ok {
+			return SearchResult{}, false
 		}
 	}
-
-	return results, nil
+	key, err := db.getDocKeyLocked(id)
+	if err != nil || len(key) == 0 {
+		return SearchResult{}, false
+	}
+	if q.Prefix != "" && !prefixMatch(string(key), q.Prefix) {
+		return SearchResult{}, false
+	}
+	value, err := db.get(key)
+	if err != nil || !matchesQuery(value, q) {
+		return SearchResult{}, false
+	}
+	return SearchResult{
+		Key:        append([]byte{}, key...),
+		Value:      append([]byte{}, value...),
+		Score:      searchQueryScore(value, q, fullTextPlan),
+		Highlights: searchQueryHighlights(value, q, fullTextPlan),
+	}, true
 }
 
 // SearchCount executes the same query planning as Search but returns only the
 // number of matching documents. It uses index metadata when possible to avoid
 // decrypting primary values during encrypted/index-backed queries.
 func (db *DB) SearchCount(q SearchQuery) (int, error) {
+	if err := q.checkNoAggregations("SearchCount"); err != nil {
+		return 0, err
+	}
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
+	q = db.withTextAnalysisLocked(q)
 
 	if q.Limit <= 0 {
 		q.Limit = int(^uint(0) >> 1)
@@ -899,6 +1052,24 @@ func (db *DB) SearchCount(q SearchQuery) (int, error) {
 				return 0, nil
 			}
 		}
+		if isGeoFilterOp(f.Op) && indexEnabled {
+			ids, ok, err := db.geoCandidatesLocked(q.Prefix, f)
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				continue
+			}
+			if candidates == nil {
+				candidates = ids
+			} else {
+				candidates = intersectSorted(candidates, ids)
+			}
+			usedIndex = true
+			if len(candidates) == 0 {
+				return 0, nil
+			}
+		}
 	}
 
 	if !usedIndex && indexEnabled {
@@ -969,6 +1140,9 @@ func (db *DB) SearchCount(q SearchQuery) (int, error) {
 }
 
 func (db *DB) fullTextCandidatesLocked(prefix string, plan fullTextPlan) ([]uint64, bool, error) {
+	if plan.analysis.isScoped() {
+		return db.analyzedTextCandidatesLocked(prefix, plan)
+	}
 	terms := plan.indexTerms()
 	if len(terms) == 0 {
 		return nil, false, nil
@@ -1197,7 +1371,10 @@ func (db *DB) scanSearchLocked(q SearchQuery) ([]SearchResult, error) {
 			}
 			seen[keyStr] = struct{}{}
 		}
-		if entry.Deleted {
+		if entry.Deleted || db.rangeDeletedLocked(entry) {
+			return false
+		}
+		if entry = db.resolvedEntryLocked(entry); entry == nil {
 			return false
 		}
 		if entry.ExpiresAt != 0 && now > int64(entry.ExpiresAt) {
@@ -1236,6 +1413,10 @@ func (db *DB) scanSearchLocked(q SearchQuery) ([]SearchResult, error) {
 	for _, level := range db.levels {
 		for sstIdx := len(level) - 1; sstIdx >= 0; sstIdx-- {
 			sst := level[sstIdx]
+			if q.Prefix != "" && !sst.mayHoldSearchPrefix(q.Prefix, db.sstOptions.PrefixExtractor) {
+				db.counters.scanTablesSkipped.Add(1)
+				continue
+			}
 			idxPos := uint32(0)
 			for i := 0; i < sst.entryCount; i++ {
 				indexEntry, err := sst.readIndexEntryAt(idxPos)
@@ -1302,7 +1483,10 @@ func (db *DB) scanSearchCountLocked(q SearchQuery) (int, error) {
 			}
 			seen[keyStr] = struct{}{}
 		}
-		if entry.Deleted {
+		if entry.Deleted || db.rangeDeletedLocked(entry) {
+			return false
+		}
+		if entry = db.resolvedEntryLocked(entry); entry == nil {
 			return false
 		}
 		if entry.ExpiresAt != 0 && now > int64(entry.ExpiresAt) {
@@ -1330,6 +1514,10 @@ func (db *DB) scanSearchCountLocked(q SearchQuery) (int, error) {
 	for _, level := range db.levels {
 		for sstIdx := len(level) - 1; sstIdx >= 0; sstIdx-- {
 			sst := level[sstIdx]
+			if q.Prefix != "" && !sst.mayHoldSearchPrefix(q.Prefix, db.sstOptions.PrefixExtractor) {
+				db.counters.scanTablesSkipped.Add(1)
+				continue
+			}
 			idxPos := uint32(0)
 			for i := 0; i < sst.entryCount; i++ {
 				indexEntry, err := sst.readIndexEntryAt(idxPos)
@@ -1375,11 +1563,12 @@ type fullTextPlan struct {
 	negative  []string
 	anyMode   bool
 	phraseAll bool
+	analysis  *textAnalysis
 }
 
 func parseFullTextQuery(q SearchQuery) fullTextPlan {
 	text := strings.TrimSpace(q.FullText)
-	plan := fullTextPlan{raw: text}
+	plan := fullTextPlan{raw: text, analysis: q.analysis}
 	if text == "" {
 		return plan
 	}
@@ -1508,6 +1697,9 @@ func (p fullTextPlan) matches(value []byte) bool {
 	if !p.active() {
 		return true
 	}
+	if p.analysis.isScoped() {
+		return p.analysis.matches(value, p)
+	}
 	tokens := tokenize(strings.ToLower(string(value)))
 	if len(tokens) == 0 {
 		return false
@@ -1555,6 +1747,9 @@ func fullTextScore(value []byte, plan fullTextPlan) float64 {
 	if !plan.active() {
 		return 0
 	}
+	if plan.analysis != nil {
+		return plan.analysis.score(value, plan)
+	}
 	tokens := tokenize(strings.ToLower(string(value)))
 	if len(tokens) == 0 {
 		return 0
@@ -1996,7 +2191,11 @@ func evaluateFilter(raw []byte, f SearchFilter) bool {
 		val = string(raw)
 	} else {
 		var ok bool
-		val, ok = fastJSONScalarField(raw, f.Field)
+		if isGeoFilterOp(f.Op) {
+			val, ok = geoFieldValue(raw, f.Field)
+		} else {
+			val, ok = fastJSONScalarField(raw, f.Field)
+		}
 		if !ok {
 			return false
 		}
@@ -2196,6 +2395,8 @@ func compareValues(a, b any, op string) bool {
 		case "<=":
 			return fa <= fb
 		}
+	case GeoWithinRadius, GeoWithinBBox, GeoWithinPolygon:
+		return geoMatches(a, op, b)
 	}
 	return false
 }
@@ -2233,7 +2434,10 @@ func toFloat(v any) (float64, bool) {
 	}
 }
 
-func buildIndexProjections(value []byte, schema *SearchSchema) ([]string, map[string]string, map[string]string) {
+// buildIndexProjections returns the hashed full-text terms of value, the
+// hashes and values of its hash and value indexed fields, and the number of
+// analyzed terms of each searchable field.
+func buildIndexProjections(value []byte, schema *SearchSchema) ([]string, map[string]string, map[string]string, map[string]int) {
 	if schema == nil || len(schema.Fields) == 0 {
 		// Default: full-text on entire value
 		termSet := make(map[string]struct{})
@@ -2245,12 +2449,13 @@ func buildIndexProjections(value []byte, schema *SearchSchema) ([]string, map[st
 			terms = append(terms, t)
 		}
 		sort.Strings(terms)
-		return terms, map[string]string{}, map[string]string{"$value": normalizeValue(value)}
+		return terms, map[string]string{}, map[string]string{"$value": normalizeValue(value)}, nil
 	}
 
 	var hashes map[string]string
 	var values map[string]string
 	var termsSet map[string]struct{}
+	var lengths map[string]int
 
 	var doc map[string]any
 	needsJSON := false
@@ -2288,13 +2493,29 @@ func buildIndexProjections(value []byte, schema *SearchSchema) ([]string, map[st
 			}
 			values[field.Name] = normalized
 		}
+		if field.GeoPoint {
+			if p, ok := ParseGeoPoint(v); ok {
+				if termsSet == nil {
+					termsSet = make(map[string]struct{})
+				}
+				addGeoCellTerms(termsSet, field.Name, p)
+			}
+		}
 		if field.Searchable {
 			if termsSet == nil {
 				termsSet = make(map[string]struct{})
 			}
-			for _, t := range tokenize(strings.ToLower(normalized)) {
+			if lengths == nil {
+				lengths = make(map[string]int)
+			}
+			tokens := lookupAnalyzer(field.Analyzer).Analyze(normalized)
+			for _, t := range tokens {
 				termsSet[hashValue(t)] = struct{}{}
 			}
+			if field.Fuzzy {
+				addFuzzyGramTerms(termsSet, tokens)
+			}
+			lengths[searchableFieldName(field)] = len(tokens)
 		}
 		if field.HashSearch && !isDirectPrimaryLookupField(field.Name) {
 			if hashes == nil {
@@ -2312,17 +2533,18 @@ func buildIndexProjections(value []byte, schema *SearchSchema) ([]string, map[st
 		}
 		sort.Strings(terms)
 	}
-	return terms, hashes, values
+	return terms, hashes, values, lengths
 }
 
-func buildIndexProjectionsFromFieldPairs(fields []IndexFieldValue, schema *SearchSchema) ([]string, map[string]string, map[string]string) {
+func buildIndexProjectionsFromFieldPairs(fields []IndexFieldValue, schema *SearchSchema) ([]string, map[string]string, map[string]string, map[string]int) {
 	if schema == nil || len(schema.Fields) == 0 {
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
 
 	var hashes map[string]string
 	var values map[string]string
 	var termsSet map[string]struct{}
+	var lengths map[string]int
 
 	for _, field := range schema.Fields {
 		if field.Name == "" || field.Name == "$value" {
@@ -2339,13 +2561,29 @@ func buildIndexProjectionsFromFieldPairs(fields []IndexFieldValue, schema *Searc
 			}
 			values[field.Name] = normalized
 		}
+		if field.GeoPoint {
+			if p, ok := ParseGeoPoint(v); ok {
+				if termsSet == nil {
+					termsSet = make(map[string]struct{})
+				}
+				addGeoCellTerms(termsSet, field.Name, p)
+			}
+		}
 		if field.Searchable {
 			if termsSet == nil {
 				termsSet = make(map[string]struct{})
 			}
-			for _, t := range tokenize(strings.ToLower(normalized)) {
+			if lengths == nil {
+				lengths = make(map[string]int)
+			}
+			tokens := lookupAnalyzer(field.Analyzer).Analyze(normalized)
+			for _, t := range tokens {
 				termsSet[hashValue(t)] = struct{}{}
 			}
+			if field.Fuzzy {
+				addFuzzyGramTerms(termsSet, tokens)
+			}
+			lengths[searchableFieldName(field)] = len(tokens)
 		}
 		if field.HashSearch && !isDirectPrimaryLookupField(field.Name) {
 			if hashes == nil {
@@ -2363,7 +2601,7 @@ func buildIndexProjectionsFromFieldPairs(fields []IndexFieldValue, schema *Searc
 		}
 		sort.Strings(terms)
 	}
-	return terms, hashes, values
+	return terms, hashes, values, lengths
 }
 
 func indexFieldPairValue(fields []IndexFieldValue, name string) (any, bool) {
@@ -2381,7 +2619,7 @@ func (db *DB) canUseFastVolatileValueIndexLocked(schema *SearchSchema) bool {
 	}
 	hasValue := false
 	for _, field := range schema.Fields {
-		if field.Name == "" || field.Name == "$value" || field.Searchable {
+		if field.Name == "" || field.Name == "$value" || field.Searchable || field.GeoPoint {
 			return false
 		}
 		if field.HashSearch && !isDirectPrimaryLookupField(field.Name) {
@@ -2424,7 +2662,7 @@ func isDirectPrimaryLookupField(name string) bool {
 
 func canUseFastJSONScalars(schema *SearchSchema) bool {
 	for _, field := range schema.Fields {
-		if field.Name == "" || field.Name == "$value" || field.Searchable {
+		if field.Name == "" || field.Name == "$value" || field.Searchable || field.GeoPoint {
 			return false
 		}
 	}
@@ -2527,6 +2765,7 @@ func (db *DB) getIndexMetaLocked(docID uint64) (indexMeta, bool, error) {
 }
 
 func matchesQueryMeta(meta indexMeta, q SearchQuery) (bool, bool) {
+	exact := true
 	if strings.TrimSpace(q.FullText) != "" {
 		plan := parseFullTextQuery(q)
 		if plan.anyMode || len(plan.phrases) > 0 || len(plan.prefixes) > 0 || len(plan.negative) > 0 {
@@ -2539,15 +2778,29 @@ func matchesQueryMeta(meta indexMeta, q SearchQuery) (bool, bool) {
 		for _, term := range meta.Terms {
 			termSet[term] = struct{}{}
 		}
-		for _, term := range plan.terms {
-			if _, ok := termSet[hashValue(term)]; !ok {
-				return false, true
+		if plan.analysis.isScoped() {
+			if plan.analysis.edits > 0 {
+				return false, false
+			}
+			for _, c := range plan.analysis.terms {
+				if !c.inTerms(termSet) {
+					return false, true
+				}
+			}
+			// The terms may come from different fields: only the value
+			// can tell.
+			exact = false
+		} else {
+			for _, term := range plan.terms {
+				if _, ok := termSet[hashValue(term)]; !ok {
+					return false, true
+				}
 			}
 		}
 	}
 
 	for _, f := range q.Filters {
-		if f.Field == "" || f.Field == "$value" {
+		if f.Field == "" || f.Field == "$value" || isGeoFilterOp(f.Op) {
 			return false, false
 		}
 		if (f.Op == "=" || f.Op == "==") && f.HashOnly {
@@ -2568,7 +2821,7 @@ func matchesQueryMeta(meta indexMeta, q SearchQuery) (bool, bool) {
 		}
 	}
 
-	return true, true
+	return exact, exact
 }
 
 func tokenize(s string) []string {
@@ -2844,7 +3097,7 @@ func (db *DB) putIndexNoWALLocked(key, value []byte) error {
 	e := entryPool.Get().(*Entry)
 	e.Key = append(e.Key[:0], key...)
 	e.Value = append(e.Value[:0], value...)
-	e.Timestamp = uint64(time.Now().UnixNano())
+	e.Timestamp = nextEntryTimestamp()
 	e.Deleted = false
 	h := crc32.NewIEEE()
 	h.Write(e.Key)
@@ -2870,6 +3123,7 @@ func isVolatileIndexKey(key []byte) bool {
 		bytes.HasPrefix(key, []byte(indexDocIDKeyPrefix)) ||
 		bytes.HasPrefix(key, []byte(indexDocKeyPrefix)) ||
 		bytes.HasPrefix(key, []byte(indexMetaPrefix)) ||
+		bytes.HasPrefix(key, []byte(indexNormPrefix)) ||
 		bytes.HasPrefix(key, []byte(indexHashPrefix)) ||
 		bytes.HasPrefix(key, []byte(indexValuePrefix))
 }
@@ -2879,6 +3133,7 @@ func (db *DB) storeIndexMetaLocked(docID uint64, meta indexMeta, metaBytes []byt
 		db.indexMetaByID = make(map[uint64]indexMeta)
 	}
 	db.indexMetaByID[docID] = meta
+	db.adjustFieldNormsLocked(meta, 1)
 	if db.disableIndexPersistence {
 		return nil
 	}
@@ -2892,19 +3147,6 @@ func (db *DB) rememberIndexMetaLocked(docID uint64, meta indexMeta) {
 	db.indexMetaByID[docID] = meta
 }
 
-// deleteIndexNoWALLocked tombstones index keys without WAL.
-func (db *DB) deleteIndexNoWALLocked(key []byte) error {
-	e := &Entry{
-		Key:       append([]byte{}, key...),
-		Value:     nil,
-		Timestamp: uint64(time.Now().UnixNano()),
-		Deleted:   true,
-	}
-	e.checksum = crc32.ChecksumIEEE(e.Key)
-	db.memTable.Delete(key)
-	return nil
-}
-
 func (db *DB) allocateDocIDLocked(key []byte) (uint64, error) {
 	return db.allocateDocIDLockedWithWAL(key, true)
 }
@@ -3095,6 +3337,7 @@ func (db *DB) removeIndexEntriesLocked(docID uint64) error {
 	if err != nil || !found {
 		return nil
 	}
+	db.adjustFieldNormsLocked(meta, -1)
 
 	for _, term := range meta.Terms {
 		if err := db.removePostingLocked(indexTermKey(meta.Prefix, term), docID); err != nil {
@@ -3223,27 +3466,24 @@ func intersectSorted(a, b []uint64) []uint64 {
 }
 
 func (db *DB) deleteLocked(key []byte) error {
+	write, err := db.deleteBuffered(key)
+	if err != nil {
+		return err
+	}
+	return db.awaitWriteLocked(write)
+}
+
+// deleteBuffered is deleteLocked without waiting for the WAL record to be
+// synced; see putBuffered.
+func (db *DB) deleteBuffered(key []byte) (*pendingWrite, error) {
 	entry := &Entry{
 		Key:       append([]byte{}, key...),
 		Value:     nil,
-		Timestamp: uint64(time.Now().UnixNano()),
+		Timestamp: nextEntryTimestamp(),
 		Deleted:   true,
 	}
 
 	entry.checksum = crc32.ChecksumIEEE(entry.Key)
 
-	if !db.disableWAL {
-		if db.wal == nil {
-			return fmt.Errorf("WAL is not initialized")
-		}
-		if err := db.wal.Write(entry); err != nil {
-			return err
-		}
-	}
-
-	db.memTable.Delete(key)
-	if db.cache != nil {
-		db.cache.Remove(string(key))
-	}
-	return nil
+	return db.logWriteLocked(entry)
 }
@@ -0,0 +1,537 @@
+package velocity
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+)
+
+// BM25 parameters: k1 bounds how much repeated terms add, b how much a
+// field longer than average is discounted.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// fieldNorms are the collection statistics of the searchable fields under a
+// prefix: the documents with any of them, the documents with each and their
+// summed lengths in terms. Together with the lengths stored in each
+// document's indexMeta they give BM25 its length normalisation.
+type fieldNorms struct {
+	Docs    int            `json:"docs"`
+	Fields  map[string]int `json:"fields,omitempty"`
+	Lengths map[string]int `json:"lengths,omitempty"`
+}
+
+func indexNormKey(prefix string) []byte {
+	return []byte(indexNormPrefix + indexPrefixTag(prefix))
+}
+
+// fieldNormsLocked returns the statistics of prefix. Statistics not yet
+// loaded are read from the index without being cached, so it is safe under
+// the read lock.
+func (db *DB) fieldNormsLocked(prefix string) fieldNorms {
+	if n, ok := db.fieldNorms[indexPrefixTag(prefix)]; ok {
+		return *n
+	}
+	var n fieldNorms
+	if raw, err := db.get(indexNormKey(prefix)); err == nil {
+		_ = json.Unmarshal(raw, &n)
+	}
+	return n
+}
+
+// loadFieldNormsLocked returns the cached statistics of prefix, loading
+// them first. The caller must hold the write lock.
+func (db *DB) loadFieldNormsLocked(prefix string) *fieldNorms {
+	tag := indexPrefixTag(prefix)
+	if n, ok := db.fieldNorms[tag]; ok {
+		return n
+	}
+	n := db.fieldNormsLocked(prefix)
+	if n.Fields == nil {
+		n.Fields = make(map[string]int)
+	}
+	if n.Lengths == nil {
+		n.Lengths = make(map[string]int)
+	}
+	if db.fieldNorms == nil {
+		db.fieldNorms = make(map[string]*fieldNorms)
+	}
+	db.fieldNorms[tag] = &n
+	return &n
+}
+
+// adjustFieldNormsLocked adds (delta 1) or removes (delta -1) the field
+// lengths of a document to the statistics of its prefix.
+func (db *DB) adjustFieldNormsLocked(meta indexMeta, delta int) {
+	if len(meta.Lengths) == 0 {
+		return
+	}
+	n := db.loadFieldNormsLocked(meta.Prefix)
+	n.Docs = max(n.Docs+delta, 0)
+	for field, length := range meta.Lengths {
+		n.Fields[field] = max(n.Fields[field]+delta, 0)
+		n.Lengths[field] = max(n.Lengths[field]+delta*length, 0)
+	}
+	db.markFieldNormsDirtyLocked(meta.Prefix)
+}
+
+func (db *DB) resetFieldNormsLocked(prefix string) {
+	if db.fieldNorms == nil {
+		db.fieldNorms = make(map[string]*fieldNorms)
+	}
+	db.fieldNorms[indexPrefixTag(prefix)] = &fieldNorms{Fields: make(map[string]int), Lengths: make(map[string]int)}
+	db.markFieldNormsDirtyLocked(prefix)
+}
+
+func (db *DB) markFieldNormsDirtyLocked(prefix string) {
+	if db.dirtyFieldNorms == nil {
+		db.dirtyFieldNorms = make(map[string]struct{})
+	}
+	db.dirtyFieldNorms[indexPrefixTag(prefix)] = struct{}{}
+}
+
+// storeFieldNormsLocked persists the statistics changed since the last
+// call, once per prefix however many documents changed them.
+func (db *DB) storeFieldNormsLocked() error {
+	for tag := range db.dirtyFieldNorms {
+		data, err := json.Marshal(db.fieldNorms[tag])
+		if err != nil {
+			return err
+		}
+		if err := db.putIndexLocked([]byte(indexNormPrefix+tag), data); err != nil {
+			return err
+		}
+		delete(db.dirtyFieldNorms, tag)
+	}
+	return nil
+}
+
+// textField is a searchable field of the schema a full-text query runs
+// against.
+type textField struct {
+	name     string
+	analyzer Analyzer
+	boost    float64
+	avgLen   float64
+	fuzzy    bool // trigrams of its terms are indexed
+}
+
+// textClause is a query term or phrase analyzed for every searchable field:
+// terms[i] are its terms in fields[i].
+type textClause struct {
+	text  string
+	terms [][]string
+}
+
+// textAnalysis is the schema side of a full-text query: the searchable
+// fields of its prefix, the query analyzed by each field's analyzer, and
+// the document frequencies and field lengths BM25 ranks with. When a field
+// has a non-standard analyzer, or the query is fuzzy, the query is also
+// matched field by field against the analyzed terms instead of the tokens
+// of the raw value.
+type textAnalysis struct {
+	fields   []textField
+	scoped   bool
+	edits    int // edit cap of fuzzy queries
+	docs     int
+	df       map[string]int
+	terms    []textClause
+	phrases  []textClause
+	negative []textClause
+}
+
+// withTextAnalysisLocked attaches to a full-text query the analysis of the
+// schema of its prefix, if that schema has searchable fields. Fuzzy queries
+// without searchable fields are analyzed against the whole value.
+func (db *DB) withTextAnalysisLocked(q SearchQuery) SearchQuery {
+	q.analysis = nil
+	if strings.TrimSpace(q.FullText) == "" {
+		return q
+	}
+	norms := db.fieldNormsLocked(q.Prefix)
+	a := &textAnalysis{edits: fuzzyQueryEdits(q), docs: norms.Docs, df: make(map[string]int)}
+	if schema := db.schemaForPrefixLocked(q.Prefix); schema != nil {
+		for _, field := range schema.Fields {
+			if !field.Searchable {
+				continue
+			}
+			f := textField{name: searchableFieldName(field), analyzer: lookupAnalyzer(field.Analyzer), boost: field.Boost, fuzzy: field.Fuzzy}
+			if f.boost <= 0 {
+				f.boost = 1
+			}
+			if docs := norms.Fields[f.name]; docs > 0 {
+				f.avgLen = float64(norms.Lengths[f.name]) / float64(docs)
+			}
+			a.fields = append(a.fields, f)
+			if !isStandardAnalyzer(field.Analyzer) {
+				a.scoped = true
+			}
+		}
+	}
+	if len(a.fields) == 0 && a.edits > 0 {
+		a.fields = []textField{{name: "$value", analyzer: lookupAnalyzer(AnalyzerStandard), boost: 1}}
+	}
+	if len(a.fields) == 0 {
+		return q
+	}
+	if a.edits > 0 {
+		a.scoped = true
+	}
+
+	plan := parseFullTextQuery(q)
+	a.terms = a.clauses(plan.terms)
+	a.phrases = a.clauses(plan.phrases)
+	a.negative = a.clauses(plan.negative)
+	if db.searchIndexEnabled {
+		for _, clauses := range [][]textClause{a.terms, a.phrases} {
+			for _, c := range clauses {
+				for _, terms := range c.terms {
+					for _, term := range terms {
+						if _, ok := a.df[term]; ok {
+							continue
+						}
+						ids, _ := db.getPostingListLocked(indexTermKey(q.Prefix, hashValue(term)))
+						a.df[term] = len(ids)
+					}
+				}
+			}
+		}
+	}
+	q.analysis = a
+	return q
+}
+
+func searchableFieldName(field SearchSchemaField) string {
+	if field.Name == "" {
+		return "$value"
+	}
+	return field.Name
+}
+
+// clauses analyzes each text for every field. Texts without a term in any
+// field, such as stop words, are dropped.
+func (a *textAnalysis) clauses(texts []string) []textClause {
+	var out []textClause
+	for _, text := range texts {
+		c := textClause{text: text, terms: make([][]string, len(a.fields))}
+		found := false
+		for i, f := range a.fields {
+			c.terms[i] = dedupeStrings(analyzeQuery(f.analyzer, text))
+			found = found || len(c.terms[i]) > 0
+		}
+		if found {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (a *textAnalysis) isScoped() bool {
+	return a != nil && a.scoped
+}
+
+// fieldText is a document field as a query sees it: its standard tokens,
+// which phrases and prefixes match, the counts of its analyzed terms and
+// the edit cap of a fuzzy query.
+type fieldText struct {
+	words  []string
+	length int
+	counts map[string]int
+	edits  int
+}
+
+// analyzeValue returns the searchable fields of raw, nil where raw lacks
+// the field.
+func (a *textAnalysis) analyzeValue(raw []byte) []*fieldText {
+	out := make([]*fieldText, len(a.fields))
+	var doc map[string]any
+	parsed := false
+	for i, f := range a.fields {
+		var text string
+		if f.name == "$value" {
+			text = string(raw)
+		} else if v, ok := fastJSONScalarField(raw, f.name); ok {
+			if v == nil {
+				continue
+			}
+			text = normalizeValue(v)
+		} else {
+			// Arrays and objects are indexed by their printed value.
+			if !parsed {
+				_ = json.Unmarshal(raw, &doc)
+				parsed = true
+			}
+			v := doc[f.name]
+			if v == nil {
+				continue
+			}
+			text = normalizeValue(v)
+		}
+		terms := f.analyzer.Analyze(text)
+		ft := &fieldText{words: standardAnalyze(text), length: len(terms), counts: make(map[string]int, len(terms)), edits: a.edits}
+		for _, term := range terms {
+			ft.counts[term]++
+		}
+		out[i] = ft
+	}
+	return out
+}
+
+// has reports whether field i of fields holds every term of c there.
+func (c textClause) has(fields []*fieldText, i int) bool {
+	if fields[i] == nil || len(c.terms[i]) == 0 {
+		return false
+	}
+	for _, term := range c.terms[i] {
+		if fields[i].counts[term] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasNear is has allowing each term the edits of a fuzzy query.
+func (c textClause) hasNear(fields []*fieldText, i int) bool {
+	if fields[i] == nil || len(c.terms[i]) == 0 {
+		return false
+	}
+	for _, term := range c.terms[i] {
+		if n, _ := fields[i].match(term); n == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPhrase reports whether field i of fields holds the words of phrase c
+// in order, and its terms.
+func (c textClause) hasPhrase(fields []*fieldText, i int) bool {
+	return c.has(fields, i) && containsNormalizedPhrase(strings.Join(fields[i].words, " "), c.text)
+}
+
+func (c textClause) matches(fields []*fieldText, phrase bool) bool {
+	for i := range fields {
+		if phrase && c.hasPhrase(fields, i) || !phrase && c.has(fields, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c textClause) matchesNear(fields []*fieldText) bool {
+	for i := range fields {
+		if c.hasNear(fields, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches is fullTextPlan.matches for scoped analyses: each term, phrase
+// and excluded term matches when one field holds all of its terms. Only
+// the terms of fuzzy queries tolerate edits; phrases and excluded terms
+// have to match exactly.
+func (a *textAnalysis) matches(raw []byte, p fullTextPlan) bool {
+	fields := a.analyzeValue(raw)
+	for _, c := range a.negative {
+		if c.matches(fields, false) {
+			return false
+		}
+	}
+	positive := 0
+	matched := 0
+	for _, c := range a.terms {
+		positive++
+		if c.matchesNear(fields) {
+			matched++
+		}
+	}
+	for _, c := range a.phrases {
+		positive++
+		if c.matches(fields, true) {
+			matched++
+		}
+	}
+	for _, prefix := range p.prefixes {
+		positive++
+		for _, f := range fields {
+			if f != nil && containsTokenPrefix(f.words, prefix) {
+				matched++
+				break
+			}
+		}
+	}
+	if positive == 0 {
+		return len(a.negative) > 0
+	}
+	if p.anyMode {
+		return matched > 0
+	}
+	return matched == positive
+}
+
+// idf is the BM25 inverse document frequency of term.
+func (a *textAnalysis) idf(term string) float64 {
+	if a.docs == 0 {
+		return 1
+	}
+	df := float64(min(a.df[term], a.docs))
+	return math.Log(1 + (float64(a.docs)-df+0.5)/(df+0.5))
+}
+
+// score ranks raw for the query with BM25: per field, each query term adds
+// its idf weighted by its frequency, saturated by k1 and normalised by the
+// field length against the average, and the sum is scaled by the field's
+// boost. Terms matched within the edits of a fuzzy query are weighted by
+// their similarity, matched phrases add their terms and token prefixes add
+// three quarters of a term each.
+func (a *textAnalysis) score(raw []byte, p fullTextPlan) float64 {
+	fields := a.analyzeValue(raw)
+	score := 0.0
+	for i, f := range a.fields {
+		field := fields[i]
+		if field == nil {
+			continue
+		}
+		avgLen := f.avgLen
+		if avgLen <= 0 {
+			avgLen = float64(max(field.length, 1))
+		}
+		norm := bm25K1 * (1 - bm25B + bm25B*float64(field.length)/avgLen)
+		saturate := func(tf int) float64 {
+			return float64(tf) * (bm25K1 + 1) / (float64(tf) + norm)
+		}
+		fieldScore := 0.0
+		for _, c := range a.terms {
+			for _, term := range c.terms[i] {
+				if tf, weight := field.match(term); tf > 0 {
+					fieldScore += weight * a.idf(term) * saturate(tf)
+				}
+			}
+		}
+		for _, c := range a.phrases {
+			if !c.hasPhrase(fields, i) {
+				continue
+			}
+			for _, term := range c.terms[i] {
+				fieldScore += a.idf(term) * saturate(field.counts[term])
+			}
+		}
+		for _, prefix := range p.prefixes {
+			if n := prefixFrequency(field.words, prefix); n > 0 {
+				fieldScore += 0.75 * saturate(n)
+			}
+		}
+		score += f.boost * fieldScore
+	}
+	return score
+}
+
+// inTerms reports whether the hashed index terms of a document can hold
+// every term of c in one field. The terms of all fields share one set, so
+// a true result still has to be checked against the value.
+func (c textClause) inTerms(termSet map[string]struct{}) bool {
+	for _, terms := range c.terms {
+		if len(terms) == 0 {
+			continue
+		}
+		all := true
+		for _, term := range terms {
+			if _, ok := termSet[hashValue(term)]; !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// analyzedTextCandidatesLocked is fullTextCandidatesLocked for scoped
+// analyses. A term or phrase admits the documents holding all its terms of
+// some field; it reports false when a clause has no indexed terms to look
+// up in any-mode, where that clause alone may match. The terms of fuzzy
+// queries admit the documents near them by trigrams; a term the trigrams
+// cannot look up is left to the other clauses, or the scan in any-mode.
+func (db *DB) analyzedTextCandidatesLocked(prefix string, plan fullTextPlan) ([]uint64, bool, error) {
+	a := plan.analysis
+	clauses := append(append([]textClause(nil), a.terms...), a.phrases...)
+	var candidates []uint64
+	used := false
+	for n, c := range clauses {
+		var ids []uint64
+		var err error
+		if n < len(a.terms) && a.edits > 0 {
+			var indexed bool
+			ids, indexed, err = db.fuzzyClauseCandidatesLocked(prefix, a, c)
+			if err == nil && !indexed {
+				if plan.anyMode {
+					return nil, false, nil
+				}
+				continue
+			}
+		} else {
+			ids, err = db.clauseCandidatesLocked(prefix, c)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		switch {
+		case !used:
+			candidates = ids
+		case plan.anyMode:
+			candidates = mergeSortedUnique(candidates, ids)
+		default:
+			candidates = intersectSorted(candidates, ids)
+		}
+		used = true
+		if !plan.anyMode && len(candidates) == 0 {
+			return []uint64{}, true, nil
+		}
+	}
+	if plan.anyMode && len(plan.prefixes) > 0 {
+		return nil, false, nil
+	}
+	if used && candidates == nil {
+		candidates = []uint64{}
+	}
+	return candidates, used, nil
+}
+
+// clauseCandidatesLocked returns the documents holding all the terms of c
+// in one of its fields' analyses.
+func (db *DB) clauseCandidatesLocked(prefix string, c textClause) ([]uint64, error) {
+	var out []uint64
+	seen := make(map[string]struct{}, len(c.terms))
+	for _, terms := range c.terms {
+		if len(terms) == 0 {
+			continue
+		}
+		sig := strings.Join(terms, "\x00")
+		if _, ok := seen[sig]; ok {
+			continue
+		}
+		seen[sig] = struct{}{}
+		var ids []uint64
+		for j, term := range terms {
+			posting, err := db.getPostingListLocked(indexTermKey(prefix, hashValue(term)))
+			if err != nil {
+				return nil, err
+			}
+			if j == 0 {
+				ids = posting
+			} else {
+				ids = intersectSorted(ids, posting)
+			}
+			if len(ids) == 0 {
+				break
+			}
+		}
+		out = mergeSortedUnique(out, ids)
+	}
+	return out, nil
+}
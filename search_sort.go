@@ -0,0 +1,367 @@
+package velocity
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SearchSort orders search results by Field: a top-level JSON field,
+// "_score" for relevance or "_key" for the key. Results missing the field
+// come last in either direction. With Near set, results are ordered by the
+// distance in meters of the GeoPoint in Field from Near instead.
+type SearchSort struct {
+	Field string
+	Desc  bool
+	Near  *GeoPoint
+}
+
+// ErrInvalidSearchCursor is returned by Search when After is not a cursor
+// issued for the query's sort order.
+var ErrInvalidSearchCursor = errors.New("velocity: invalid search cursor")
+
+const (
+	sortFieldScore = "_score"
+	sortFieldKey   = "_key"
+)
+
+// sortedResult is a search result with the values it is ordered by.
+type sortedResult struct {
+	SearchResult
+	values []any
+}
+
+// searchCursor is the position after a result: its sort values and key,
+// and the order they belong to. It travels as base64 JSON.
+type searchCursor struct {
+	Order  string `json:"o"`
+	Values []any  `json:"v"`
+	Key    string `json:"k"`
+}
+
+// paged reports whether the query asks for a stable order, so its results
+// are sorted and carry cursors.
+func (q SearchQuery) paged() bool {
+	return len(q.Sort) > 0 || q.Offset > 0 || q.After != ""
+}
+
+// searchOrder returns the sort keys of q: Sort, or relevance for full-text
+// queries and key order otherwise.
+func (q SearchQuery) searchOrder() []SearchSort {
+	if len(q.Sort) > 0 {
+		return q.Sort
+	}
+	if parseFullTextQuery(q).active() || conditionHasFullText(q.Condition) {
+		return []SearchSort{{Field: sortFieldScore, Desc: true}}
+	}
+	return []SearchSort{{Field: sortFieldKey}}
+}
+
+func orderSignature(order []SearchSort) string {
+	parts := make([]string, len(order))
+	for i, s := range order {
+		dir := "asc"
+		if s.Desc {
+			dir = "desc"
+		}
+		parts[i] = s.Field + ":" + dir
+		if s.Near != nil {
+			parts[i] += fmt.Sprintf("@%g,%g", s.Near.Lat, s.Near.Lon)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func encodeSearchCursor(r sortedResult, order []SearchSort) string {
+	data, err := json.Marshal(searchCursor{Order: orderSignature(order), Values: r.values, Key: string(r.Key)})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchCursor(token string, order []SearchSort) (*searchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidSearchCursor
+	}
+	var c searchCursor
+	if err := json.Unmarshal(data, &c); err != nil || len(c.Values) != len(order) {
+		return nil, ErrInvalidSearchCursor
+	}
+	if c.Order != orderSignature(order) {
+		return nil, fmt.Errorf("%w: issued for a different sort order", ErrInvalidSearchCursor)
+	}
+	return &c, nil
+}
+
+// admits reports whether r comes after the cursor position.
+func (c *searchCursor) admits(r sortedResult, order []SearchSort) bool {
+	return compareSortedResults(r.values, c.Values, string(r.Key), c.Key, order) > 0
+}
+
+// sortValues returns the values r is ordered by; nil stands for a missing
+// field.
+func sortValues(r SearchResult, order []SearchSort) []any {
+	values := make([]any, len(order))
+	for i, s := range order {
+		switch s.Field {
+		case sortFieldScore:
+			values[i] = r.Score
+		case sortFieldKey:
+			values[i] = string(r.Key)
+		default:
+			if s.Near != nil {
+				if v, ok := geoFieldValue(r.Value, s.Field); ok {
+					if p, ok := ParseGeoPoint(v); ok {
+						values[i] = p.DistanceMeters(*s.Near)
+					}
+				}
+			} else if v, ok := fastJSONScalarField(r.Value, s.Field); ok {
+				values[i] = v
+			}
+		}
+	}
+	return values
+}
+
+// compareSortValue orders two values of a sort key: missing values last,
+// numbers numerically and anything else by its normalized text.
+func compareSortValue(a, b any, desc bool) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	var c int
+	fa, oka := toFloat(a)
+	fb, okb := toFloat(b)
+	if oka && okb {
+		c = cmp.Compare(fa, fb)
+	} else {
+		c = strings.Compare(normalizeValue(a), normalizeValue(b))
+	}
+	if desc {
+		return -c
+	}
+	return c
+}
+
+func compareSortedResults(a, b []any, keyA, keyB string, order []SearchSort) int {
+	for i, s := range order {
+		if c := compareSortValue(a[i], b[i], s.Desc); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(keyA, keyB)
+}
+
+func sortResults(results []sortedResult, order []SearchSort) {
+	sort.Slice(results, func(i, j int) bool {
+		return compareSortedResults(results[i].values, results[j].values, string(results[i].Key), string(results[j].Key), order) < 0
+	})
+}
+
+// pagedSearchLocked returns the page of q's matches selected by After,
+// Offset and Limit in the order of searchOrder. When the first sort key is
+// a value-indexed field, matches are read from its postings in order and
+// only until the page is full.
+func (db *DB) pagedSearchLocked(q SearchQuery) ([]SearchResult, error) {
+	order := q.searchOrder()
+	after, err := q.afterCursor(order)
+	if err != nil {
+		return nil, err
+	}
+	offset := max(q.Offset, 0)
+
+	matches, ok, err := db.valueIndexOrderedLocked(q, order, after, offset+q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		all, err := db.allMatchesLocked(q)
+		if err != nil {
+			return nil, err
+		}
+		matches = orderResults(all, order, after)
+	}
+	return pageResults(matches, offset, q.Limit, order), nil
+}
+
+func (q SearchQuery) afterCursor(order []SearchSort) (*searchCursor, error) {
+	if q.After == "" {
+		return nil, nil
+	}
+	return decodeSearchCursor(q.After, order)
+}
+
+// orderResults sorts results and drops those up to the cursor.
+func orderResults(results []SearchResult, order []SearchSort, after *searchCursor) []sortedResult {
+	sorted := make([]sortedResult, 0, len(results))
+	for _, r := range results {
+		sr := sortedResult{SearchResult: r, values: sortValues(r, order)}
+		if after == nil || after.admits(sr, order) {
+			sorted = append(sorted, sr)
+		}
+	}
+	sortResults(sorted, order)
+	return sorted
+}
+
+// pageResults returns limit of the ordered results after offset, each with
+// its cursor.
+func pageResults(sorted []sortedResult, offset, limit int, order []SearchSort) []SearchResult {
+	if offset >= len(sorted) {
+		return nil
+	}
+	sorted = sorted[offset:min(offset+limit, len(sorted))]
+	results := make([]SearchResult, len(sorted))
+	for i, m := range sorted {
+		results[i] = m.SearchResult
+		results[i].Cursor = encodeSearchCursor(m, order)
+	}
+	return results
+}
+
+// allMatchesLocked returns every match of q, in no particular order.
+func (db *DB) allMatchesLocked(q SearchQuery) ([]SearchResult, error) {
+	if id, ok := exactIDFilterValue(q.Filters); ok && q.Prefix != "" {
+		return db.exactIDSearchLocked(q, id), nil
+	}
+	plan := parseFullTextQuery(q)
+	candidates, used, err := db.searchCandidatesLocked(q, plan)
+	if err != nil {
+		return nil, err
+	}
+	if !used {
+		q.Limit = int(^uint(0) >> 1)
+		return db.scanSearchLocked(q)
+	}
+	return db.evaluateCandidatesLocked(candidates, q, plan, 0), nil
+}
+
+// valueIndexOrderedLocked returns at least want matches of q after the
+// cursor, in order, by walking the in-memory value postings of the first
+// sort key value by value. Only the documents of the values walked are
+// read. It reports false when the first key has no postings or they run
+// out first: documents without the field, which come last, are not in
+// them.
+func (db *DB) valueIndexOrderedLocked(q SearchQuery, order []SearchSort, after *searchCursor, want int) ([]sortedResult, bool, error) {
+	first := order[0]
+	if !db.searchIndexEnabled || first.Field == "" || first.Field == "$value" || first.Field == sortFieldScore || first.Field == sortFieldKey || first.Near != nil {
+		return nil, false, nil
+	}
+	if _, ok := exactIDFilterValue(q.Filters); ok && q.Prefix != "" {
+		return nil, false, nil
+	}
+	postings := db.valueIndexPostings[valueIndexValuesKey(q.Prefix, first.Field)]
+	if len(postings) == 0 {
+		return nil, false, nil
+	}
+
+	plan := parseFullTextQuery(q)
+	candidates, used, err := db.searchCandidatesLocked(q, plan)
+	if err != nil {
+		return nil, false, err
+	}
+	var admitted map[uint64]struct{}
+	if used {
+		if len(candidates) == 0 {
+			return nil, true, nil
+		}
+		admitted = make(map[uint64]struct{}, len(candidates))
+		for _, id := range candidates {
+			admitted[id] = struct{}{}
+		}
+	}
+
+	values := make([]string, 0, len(postings))
+	for value := range postings {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if c := compareSortValue(values[i], values[j], first.Desc); c != 0 {
+			return c < 0
+		}
+		return values[i] < values[j]
+	})
+
+	var out []sortedResult
+	for _, value := range values {
+		if len(out) >= want {
+			return out, true, nil
+		}
+		if after != nil && compareSortValue(value, after.Values[0], first.Desc) < 0 {
+			continue
+		}
+		var group []sortedResult
+		for _, id := range postings[value] {
+			if admitted != nil {
+				if _, ok := admitted[id]; !ok {
+					continue
+				}
+			}
+			result, ok := db.evaluateCandidateLocked(id, q, plan)
+			if !ok {
+				continue
+			}
+			r := sortedResult{SearchResult: result, values: sortValues(result, order)}
+			if compareSortValue(r.values[0], value, first.Desc) != 0 {
+				// The posting is behind the stored value.
+				continue
+			}
+			if after == nil || after.admits(r, order) {
+				group = append(group, r)
+			}
+		}
+		sortResults(group, order)
+		out = append(out, group...)
+	}
+	if len(out) < want {
+		return nil, false, nil
+	}
+	return out, true, nil
+}
+
+// projectSearchResults replaces each result value by a JSON object of the
+// given top-level scalar fields it has, in the order given.
+func projectSearchResults(results []SearchResult, fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+	for i := range results {
+		results[i].Value = projectJSONFields(results[i].Value, fields)
+	}
+}
+
+func projectJSONFields(raw []byte, fields []string) []byte {
+	out := []byte{'{'}
+	for _, field := range fields {
+		v, ok := fastJSONScalarField(raw, field)
+		if !ok {
+			continue
+		}
+		name, err := json.Marshal(field)
+		if err != nil {
+			continue
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		if len(out) > 1 {
+			out = append(out, ',')
+		}
+		out = append(out, name...)
+		out = append(out, ':')
+		out = append(out, value...)
+	}
+	return append(out, '}')
+}
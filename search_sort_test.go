@@ -0,0 +1,198 @@
+package velocity
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+var sortSearchSchemas = map[string]*SearchSchema{
+	"items": {
+		Fields: []SearchSchemaField{
+			{Name: "name", Searchable: true},
+			{Name: "price", ValueIndex: true},
+			{Name: "tier", HashSearch: true},
+		},
+	},
+}
+
+func putSortItems(t *testing.T, db *DB) {
+	t.Helper()
+	for i := 0; i < 60; i++ {
+		record := fmt.Sprintf(`{"name":"item %d","price":%d,"tier":"t%d","rank":%d}`, i, 100-(i%20), i%3, i)
+		if err := db.Put([]byte(fmt.Sprintf("items:%02d", i)), []byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No price: sorts after every priced item.
+	if err := db.Put([]byte("items:free"), []byte(`{"name":"item free","tier":"t0","rank":-1}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchSortsByIndexedAndScannedFields(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), sortSearchSchemas)
+	defer db.Close()
+	putSortItems(t, db)
+
+	q := SearchQuery{
+		Prefix: "items",
+		Sort:   []SearchSort{{Field: "price"}, {Field: "rank", Desc: true}},
+		Limit:  5,
+	}
+	results, err := db.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The page comes from the price postings without loading every item.
+	db.mutex.RLock()
+	_, fromPostings, err := db.valueIndexOrderedLocked(q, q.Sort, nil, q.Limit)
+	db.mutex.RUnlock()
+	if err != nil || !fromPostings {
+		t.Fatalf("expected the price postings to order the page: %v", err)
+	}
+	want := []string{"items:59", "items:39", "items:19", "items:58", "items:38"}
+	if got := resultKeys(results); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// A field without an index is sorted after loading every match, and
+	// filters still apply.
+	results, err = db.Search(SearchQuery{
+		Prefix:  "items",
+		Filters: []SearchFilter{{Field: "tier", Op: "=", Value: "t0", HashOnly: true}},
+		Sort:    []SearchSort{{Field: "rank", Desc: true}},
+		Limit:   3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resultKeys(results); fmt.Sprint(got) != "[items:57 items:54 items:51]" {
+		t.Fatalf("unexpected rank order: %v", got)
+	}
+
+	// Items without the sort field come last, ascending or descending.
+	for _, desc := range []bool{false, true} {
+		results, err = db.Search(SearchQuery{Prefix: "items", Sort: []SearchSort{{Field: "price", Desc: desc}}, Offset: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resultKeys(results); fmt.Sprint(got) != "[items:free]" {
+			t.Fatalf("expected the unpriced item last (desc=%v), got %v", desc, got)
+		}
+	}
+}
+
+func TestSearchCursorPagesThroughEveryMatchOnce(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), sortSearchSchemas)
+	defer db.Close()
+	putSortItems(t, db)
+
+	for _, sortBy := range [][]SearchSort{
+		{{Field: "price", Desc: true}},
+		{{Field: "rank"}},
+		{{Field: "_key", Desc: true}},
+	} {
+		q := SearchQuery{Prefix: "items", Sort: sortBy, Limit: 7}
+		seen := make(map[string]bool)
+		var prev []SearchResult
+		for page := 0; ; page++ {
+			results, err := db.Search(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) == 0 {
+				break
+			}
+			for _, r := range results {
+				if seen[string(r.Key)] {
+					t.Fatalf("sort %v: %s returned twice", sortBy, r.Key)
+				}
+				seen[string(r.Key)] = true
+				if r.Cursor == "" {
+					t.Fatal("expected every paged result to carry a cursor")
+				}
+			}
+			prev = results
+			q.After = results[len(results)-1].Cursor
+			if page > 20 {
+				t.Fatal("pagination did not end")
+			}
+		}
+		if len(seen) != 61 {
+			t.Fatalf("sort %v: expected 61 results across pages, got %d (last page %v)", sortBy, len(seen), resultKeys(prev))
+		}
+
+		// Offset selects the same page as following the cursor.
+		byOffset, err := db.Search(SearchQuery{Prefix: "items", Sort: sortBy, Offset: 14, Limit: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q = SearchQuery{Prefix: "items", Sort: sortBy, Limit: 14}
+		first, err := db.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.After, q.Limit = first[13].Cursor, 7
+		byCursor, err := db.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(resultKeys(byOffset)) != fmt.Sprint(resultKeys(byCursor)) {
+			t.Fatalf("sort %v: offset page %v differs from cursor page %v", sortBy, resultKeys(byOffset), resultKeys(byCursor))
+		}
+	}
+
+	first, err := db.Search(SearchQuery{Prefix: "items", Sort: []SearchSort{{Field: "price"}}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Search(SearchQuery{Prefix: "items", Sort: []SearchSort{{Field: "rank"}}, After: first[0].Cursor}); err == nil {
+		t.Fatal("expected a cursor of another sort order to be rejected")
+	}
+	if _, err := db.Search(SearchQuery{Prefix: "items", After: "not a cursor"}); err == nil {
+		t.Fatal("expected a malformed cursor to be rejected")
+	}
+}
+
+func TestSearchFieldsProjection(t *testing.T) {
+	db := newSearchTestDB(t, t.TempDir(), sortSearchSchemas)
+	defer db.Close()
+	putSortItems(t, db)
+
+	results, err := db.Search(SearchQuery{Prefix: "items", FullText: "item", Fields: []string{"rank", "name", "missing"}, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	for _, r := range results {
+		var doc map[string]any
+		if err := json.Unmarshal(r.Value, &doc); err != nil {
+			t.Fatalf("projected value is not JSON: %s", r.Value)
+		}
+		if len(doc) != 2 || doc["name"] == nil || doc["rank"] == nil {
+			t.Fatalf("unexpected projection %s", r.Value)
+		}
+	}
+}
+
+func resultKeys(results []SearchResult) []string {
+	keys := make([]string, len(results))
+	for i, r := range results {
+		keys[i] = string(r.Key)
+	}
+	return keys
+}
+
+// newSearchTestDB opens a database at path with the given search schemas.
+// Its index is not encrypted, so value postings stay in value order.
+func newSearchTestDB(t *testing.T, path string, schemas map[string]*SearchSchema) *DB {
+	t.Helper()
+	db, err := NewWithConfig(Config{Path: path, DisableEncryption: true, DisableFsync: true, SearchSchemas: schemas})
+	if err != nil {
+		t.Fatalf("NewWithConfig failed: %v", err)
+	}
+	return db
+}
@@ -0,0 +1,233 @@
+package velocity
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is a read-only, point-in-time view of the database. Reads through
+// a snapshot see exactly the writes committed before NewSnapshot returned,
+// regardless of later puts, deletes, flushes or compactions. The versions a
+// snapshot needs are kept alive until it is released, so long-lived snapshots
+// hold back space reclamation and should be released promptly.
+type Snapshot struct {
+	db       *DB
+	ts       uint64
+	released atomic.Bool
+}
+
+// NewSnapshot pins the current state of the database. Callers must call
+// Release when done.
+func (db *DB) NewSnapshot() *Snapshot {
+	return &Snapshot{db: db, ts: db.pinSnapshot()}
+}
+
+// Timestamp returns the entry timestamp the snapshot reads at.
+func (s *Snapshot) Timestamp() uint64 {
+	return s.ts
+}
+
+// Release unpins the snapshot. It is safe to call more than once.
+func (s *Snapshot) Release() {
+	if s.released.Swap(true) {
+		return
+	}
+	s.db.unpinSnapshot(s.ts)
+}
+
+// Get returns the value of key as of the snapshot.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if s.released.Load() {
+		return nil, fmt.Errorf("snapshot released")
+	}
+	s.db.mutex.RLock()
+	entry, err := s.db.getAtLocked(key, s.ts)
+	s.db.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if !entryVisible(entry) {
+		return nil, fmt.Errorf("key not found")
+	}
+	return append([]byte(nil), entry.Value...), nil
+}
+
+// Scan calls fn for every live key with the given prefix as of the snapshot,
+// in key order. Iteration stops when fn returns false.
+func (s *Snapshot) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	if s.released.Load() {
+		return fmt.Errorf("snapshot released")
+	}
+	it := s.NewIterator(IterOptions{Prefix: prefix})
+	defer it.Close()
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// entryVisible reports whether a stored version represents a live value.
+func entryVisible(entry *Entry) bool {
+	if entry == nil || entry.Deleted {
+		return false
+	}
+	return entry.ExpiresAt == 0 || time.Now().UnixNano() <= int64(entry.ExpiresAt)
+}
+
+// pinSnapshot registers a read timestamp whose versions flush and compaction
+// must preserve. Writers that bypass db.mutex hold commitMu, so taking both
+// guarantees every write is either fully before the timestamp or after it,
+// and that the memtable starts retaining versions before anyone overwrites.
+func (db *DB) pinSnapshot() uint64 {
+	db.mutex.Lock()
+	db.commitMu.Lock()
+	db.memTable.keepVersions.Store(true)
+	for _, mt := range db.flushingMemTables {
+		mt.keepVersions.Store(true)
+	}
+	ts := nextEntryTimestamp()
+	if oldest := db.oldestPendingLocked(); oldest != 0 {
+		// Writes waiting for their sync are not readable yet, so the
+		// snapshot must not cover them.
+		ts = oldest - 1
+	}
+	db.snapshotMu.Lock()
+	if db.snapshots == nil {
+		db.snapshots = make(map[uint64]int)
+	}
+	db.snapshots[ts]++
+	db.snapshotMu.Unlock()
+	db.commitMu.Unlock()
+	db.mutex.Unlock()
+	return ts
+}
+
+func (db *DB) unpinSnapshot(ts uint64) {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+	if db.snapshots[ts] <= 1 {
+		delete(db.snapshots, ts)
+		return
+	}
+	db.snapshots[ts]--
+}
+
+// liveSnapshots returns the read timestamps of all pinned snapshots in
+// ascending order.
+func (db *DB) liveSnapshots() []uint64 {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+	if len(db.snapshots) == 0 {
+		return nil
+	}
+	out := make([]uint64, 0, len(db.snapshots))
+	for ts := range db.snapshots {
+		out = append(out, ts)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// newMemTableLocked returns an empty memtable that retains versions if any
+// snapshot is live. Callers hold db.mutex.
+func (db *DB) newMemTableLocked() *MemTable {
+	mt := NewMemTable()
+	db.snapshotMu.Lock()
+	if len(db.snapshots) > 0 {
+		mt.keepVersions.Store(true)
+	}
+	db.snapshotMu.Unlock()
+	return mt
+}
+
+// getAtLocked returns the newest version of key at or before ts, including
+// tombstones and range tombstones, bypassing the value cache. Merge operands
+// are folded into the value they apply to. Callers hold db.mutex.
+func (db *DB) getAtLocked(key []byte, ts uint64) (*Entry, error) {
+	entry, err := db.storedEntryAtLocked(key, ts)
+	if err != nil {
+		return nil, err
+	}
+	entry = db.applyRangeDeletesLocked(key, entry, ts)
+	if entry != nil && entry.kind == entryKindMerge {
+		return db.resolveMergeLocked(key, ts)
+	}
+	return entry, nil
+}
+
+// storedEntryAtLocked is getAtLocked without range tombstones.
+func (db *DB) storedEntryAtLocked(key []byte, ts uint64) (*Entry, error) {
+	if entry := db.memTable.GetAt(key, ts); entry != nil {
+		return entry, nil
+	}
+	for i := len(db.flushingMemTables) - 1; i >= 0; i-- {
+		if entry := db.flushingMemTables[i].GetAt(key, ts); entry != nil {
+			return entry, nil
+		}
+	}
+	for level := 0; level < len(db.levels); level++ {
+		sstables := db.levels[level]
+		for i := len(sstables) - 1; i >= 0; i-- {
+			entry, err := sstables[i].GetAt(key, ts)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				return entry, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// memTableVersions returns the versions of a memtable entry that must be
+// written out: the newest, plus whatever older versions the given snapshots
+// or merge operands still read.
+func memTableVersions(newest *Entry, snapshots []uint64) []*Entry {
+	if newest.prev == nil {
+		return []*Entry{newest}
+	}
+	var versions []*Entry
+	for e := newest; e != nil; e = e.prev {
+		versions = append(versions, e)
+	}
+	return retainVersions(versions, snapshots)
+}
+
+// retainVersions filters the versions of one key, sorted newest first, down
+// to the newest one plus the newest version visible to each snapshot. A
+// kept merge operand also keeps the versions below it, down to the value it
+// applies to. snapshots must be sorted ascending.
+func retainVersions(versions []*Entry, snapshots []uint64) []*Entry {
+	if len(versions) <= 1 || (len(snapshots) == 0 && versions[0].kind != entryKindMerge) {
+		return versions[:min(len(versions), 1)]
+	}
+	keep := make([]bool, len(versions))
+	keep[0] = true
+	last := 0
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		for j := last; j < len(versions); j++ {
+			if versions[j].Timestamp <= snapshots[i] {
+				keep[j] = true
+				last = j
+				break
+			}
+		}
+	}
+	var kept []*Entry
+	for j := 0; j < len(versions); j++ {
+		if !keep[j] {
+			continue
+		}
+		kept = append(kept, versions[j])
+		for versions[j].kind == entryKindMerge && j+1 < len(versions) {
+			j++
+			kept = append(kept, versions[j])
+		}
+	}
+	return kept
+}
@@ -0,0 +1,144 @@
+package velocity
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotIsolatedFromLaterWrites(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("report:a"), []byte("1"))
+	db.Put([]byte("report:b"), []byte("1"))
+
+	snap := db.NewSnapshot()
+	defer snap.Release()
+
+	db.Put([]byte("report:a"), []byte("2"))
+	db.Delete([]byte("report:b"))
+	db.Put([]byte("report:c"), []byte("new"))
+
+	if v, err := snap.Get([]byte("report:a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected snapshot value 1, got %q (%v)", v, err)
+	}
+	if v, err := snap.Get([]byte("report:b")); err != nil || string(v) != "1" {
+		t.Fatalf("expected deleted key to stay visible in snapshot, got %q (%v)", v, err)
+	}
+	if _, err := snap.Get([]byte("report:c")); err == nil {
+		t.Fatal("expected key written after the snapshot to be invisible")
+	}
+
+	var got []string
+	snap.Scan([]byte("report:"), func(key, value []byte) bool {
+		got = append(got, string(key)+"="+string(value))
+		return true
+	})
+	if fmt.Sprint(got) != "[report:a=1 report:b=1]" {
+		t.Fatalf("unexpected snapshot scan: %v", got)
+	}
+
+	if v, _ := db.Get([]byte("report:a")); string(v) != "2" {
+		t.Fatalf("expected live value 2, got %q", v)
+	}
+}
+
+func TestSnapshotSurvivesFlushAndCompaction(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := []byte("balance")
+	db.Put(key, []byte("v1"))
+	snap1 := db.NewSnapshot()
+	db.Put(key, []byte("v2"))
+	snap2 := db.NewSnapshot()
+	db.Put(key, []byte("v3"))
+
+	check := func(stage string) {
+		t.Helper()
+		for snap, want := range map[*Snapshot]string{snap1: "v1", snap2: "v2"} {
+			if v, err := snap.Get(key); err != nil || string(v) != want {
+				t.Fatalf("%s: expected %s, got %q (%v)", stage, want, v, err)
+			}
+		}
+		if v, _ := db.Get(key); string(v) != "v3" {
+			t.Fatalf("%s: expected latest v3, got %q", stage, v)
+		}
+	}
+
+	check("memtable")
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	check("flush")
+	db.Put(key, []byte("v4"))
+	db.Put(key, []byte("v3"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.compactLevel(0)
+	check("compaction")
+
+	snap1.Release()
+	snap2.Release()
+	db.compactLevel(1)
+	total := 0
+	for _, sst := range db.levels[2] {
+		sst.forEachVersion(key, func(IndexEntry) bool {
+			total++
+			return true
+		})
+	}
+	if total != 1 {
+		t.Fatalf("expected released versions to be compacted away, %d remain", total)
+	}
+}
+
+func TestSSTableVersionsWithSparseIndex(t *testing.T) {
+	crypto, _ := newCryptoProvider(make([]byte, 32))
+	var entries []*Entry
+	for i := 0; i < 1500; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		for ts := uint64(1); ts <= 3; ts++ {
+			value := []byte(fmt.Sprintf("v%d", ts))
+			entries = append(entries, &Entry{Key: key, Value: value, Timestamp: ts, checksum: crc32Of(string(key), string(value))})
+		}
+	}
+	path := filepath.Join(t.TempDir(), "versions.db")
+	sst, err := NewSSTable(path, entries, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	loaded, err := LoadSSTable(path, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if loaded.indexData != nil {
+		t.Fatal("expected a sparse index for this table size")
+	}
+
+	for i := 0; i < 1500; i += 7 {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		e, err := loaded.Get(key)
+		if err != nil || e == nil || string(e.Value) != "v3" {
+			t.Fatalf("%s: expected newest v3, got %+v (%v)", key, e, err)
+		}
+		e, err = loaded.GetAt(key, 2)
+		if err != nil || e == nil || string(e.Value) != "v2" {
+			t.Fatalf("%s: expected v2 at ts 2, got %+v (%v)", key, e, err)
+		}
+		if e, _ := loaded.GetAt(key, 0); e != nil {
+			t.Fatalf("%s: expected no version at ts 0", key)
+		}
+	}
+}
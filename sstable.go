@@ -1,22 +1,39 @@
 package velocity
 
 import (
+	"bufio"
 	"bytes"
+	"container/heap"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
 // SSTable for persistent storage
 type SSTable struct {
-	file *os.File
-	mmap []byte
+	// The table cache may close file and mmap of an idle table and map it
+	// again on the next read; readers go through acquire, which holds mapMu.
+	file   *os.File
+	mmap   []byte
+	mapMu  sync.RWMutex
+	used   atomic.Bool
+	closed bool
+	path   string
+	size   int64
+
+	// id keys the table's blocks in the block cache of caches.
+	id     uint64
+	caches *sstableCaches
+
 	// indexData is kept only for small SSTables; large tables use a sparse on-disk index
 	indexData          []IndexEntry
 	indexOffset        uint64   // offset of index region in the mmap
@@ -26,6 +43,59 @@ type SSTable struct {
 	minKey             []byte
 	maxKey             []byte
 	crypto             *CryptoProvider
+
+	// version is the on-disk format; compare is the key order it was written
+	// in. Length-ordered tables are iterated through lexOrder, the offsets of
+	// their index entries in bytewise key order, built on first use.
+	version   uint32
+	compare   func(a, b []byte) int
+	lexOrder  []uint32
+	orderOnce sync.Once
+	orderErr  error
+
+	// Iterators pin the tables they read. A table replaced by compaction is
+	// closed and removed once the last iterator lets go of it.
+	refs        atomic.Int32
+	retired     atomic.Bool
+	destroyOnce sync.Once
+
+	// blocks is the block index of a block-based table. lastBlock keeps the
+	// most recently decoded block, which serves runs of sequential reads.
+	blocks    []blockHandle
+	lastBlock atomic.Pointer[sstBlock]
+
+	// rangeDels holds the range tombstones stored in the table.
+	rangeDels []rangeTombstone
+
+	// valueLogs lists the value log files the table points into, and values
+	// resolves those pointers on reads; see valueLog.attach.
+	valueLogs []uint64
+	values    *valueLog
+
+	// globalTimestamp, when set, replaces the timestamps of the entries of
+	// an ingested table, which were stamped when the table was built; see
+	// IngestExternalFiles.
+	globalTimestamp uint64
+
+	// tombstones is the number of point tombstones in the table, and
+	// counters the statistics of the database that reads it; see Stats.
+	tombstones int
+	counters   *engineCounters
+
+	// prefixBloom is the bloom filter over the key prefixes the extractor
+	// named prefixExtractor returned; see PrefixExtractor.
+	prefixBloom     *BloomFilter
+	prefixExtractor string
+}
+
+// sstableHeader is the fixed header at the start of every SSTable file.
+type sstableHeader struct {
+	Magic       uint32
+	Version     uint32
+	EntryCount  uint32
+	IndexOffset uint64
+	BloomOffset uint64
+	BloomSize   uint32
 }
 
 type IndexEntry struct {
@@ -34,187 +104,269 @@ type IndexEntry struct {
 	Size   uint32
 }
 
+// SSTableOptions controls the layout of tables written by
+// NewSSTableWithOptions.
+type SSTableOptions struct {
+	// BlockSize is the target size of a data block before compression.
+	// Zero means DefaultBlockSize.
+	BlockSize int
+	// Compression is the codec applied to every data block.
+	Compression CompressionType
+	// BloomBitsPerKey sizes the bloom filters of the table. Zero means
+	// DefaultBloomFilterBits.
+	BloomBitsPerKey int
+	// PrefixExtractor, if set, adds a bloom filter over key prefixes that
+	// lets prefix scans skip the table.
+	PrefixExtractor PrefixExtractor
+}
+
+// blockHandle locates a data block of a block-based SSTable.
+type blockHandle struct {
+	Offset uint64
+	Size   uint32
+}
+
+// sstBlock is a decoded data block.
+type sstBlock struct {
+	offset uint64
+	data   []byte
+}
+
 func NewSSTable(path string, entries []*Entry, crypto *CryptoProvider) (*SSTable, error) {
-	if crypto == nil {
-		return nil, fmt.Errorf("encryption provider is required for SSTable")
-	}
+	return NewSSTableWithOptions(path, entries, crypto, SSTableOptions{})
+}
 
-	// Sort entries by key
-	sort.Slice(entries, func(i, j int) bool {
-		return compareKeys(entries[i].Key, entries[j].Key) < 0
-	})
+// NewSSTableWithOptions writes entries to a new SSTable at path. Records are
+// packed into blocks of about opts.BlockSize bytes, and each block is
+// compressed, encrypted once and checksummed. The index keeps one entry per
+// record; its Offset is the offset of the record's block and its Size the
+// position of the record inside the decoded block.
+func NewSSTableWithOptions(path string, entries []*Entry, crypto *CryptoProvider, opts SSTableOptions) (*SSTable, error) {
+	return newSSTable(path, entries, nil, crypto, opts)
+}
 
-	// Create bloom filter
-	bf := NewBloomFilter(len(entries), DefaultBloomFilterBits)
+// newSSTable writes entries and range tombstones to a new SSTable at path.
+// The tombstones are stored after the block index, and the table's key range
+// covers them, so a table may hold tombstones only.
+func newSSTable(path string, entries []*Entry, rangeDels []rangeTombstone, crypto *CryptoProvider, opts SSTableOptions) (*SSTable, error) {
+	b, err := newSSTableBuilder(path, crypto, opts)
+	if err != nil {
+		return nil, err
+	}
+	sortEntries(entries)
 	for _, entry := range entries {
-		bf.Add(entry.Key)
+		if err := b.add(entry); err != nil {
+			b.abort()
+			return nil, err
+		}
+	}
+	return b.finish(rangeDels)
+}
+
+// sstableBuilder writes an SSTable one entry at a time. Entries must be added
+// in the order sortEntries gives; records go into the current data block,
+// which is written out once it is full, so only the index keys are held
+// until finish writes the filters and the indexes.
+type sstableBuilder struct {
+	path      string
+	crypto    *CryptoProvider
+	opts      SSTableOptions
+	blockSize int
+
+	file   *os.File
+	w      *bufio.Writer
+	header sstableHeader
+	offset uint64
+
+	index      []IndexEntry
+	blocks     []blockHandle
+	raw        []byte
+	encoded    []byte
+	valueLogs  map[uint64]bool
+	tombstones int
+}
+
+func newSSTableBuilder(path string, crypto *CryptoProvider, opts SSTableOptions) (*sstableBuilder, error) {
+	if crypto == nil {
+		return nil, fmt.Errorf("encryption provider is required for SSTable")
+	}
+	b := &sstableBuilder{
+		path:      path,
+		crypto:    crypto,
+		opts:      opts,
+		blockSize: opts.BlockSize,
+		header:    sstableHeader{Magic: MagicNumber, Version: Version},
+		valueLogs: make(map[uint64]bool),
+	}
+	if b.blockSize <= 0 {
+		b.blockSize = DefaultBlockSize
 	}
 
 	// Create temp file in the same directory to ensure atomic rename
-	dir := filepath.Dir(path)
-	tmpFile, err := os.CreateTemp(dir, filepath.Base(path)+".tmp.*")
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp.*")
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		// If the temp file still exists (on failure), try to remove it
-		_ = os.Remove(tmpFile.Name())
-	}()
+	b.file = file
 
 	// Reserve space for the sstable header
-	header := struct {
-		Magic       uint32
-		Version     uint32
-		EntryCount  uint32
-		IndexOffset uint64
-		BloomOffset uint64
-		BloomSize   uint32
-	}{
-		Magic:      MagicNumber,
-		Version:    Version,
-		EntryCount: uint32(len(entries)),
+	if err := binary.Write(file, binary.LittleEndian, b.header); err != nil {
+		b.abort()
+		return nil, err
 	}
+	b.offset = uint64(binary.Size(b.header))
+	b.w = bufio.NewWriterSize(file, 64*1024)
+	return b, nil
+}
 
-	if err := binary.Write(tmpFile, binary.LittleEndian, header); err != nil {
-		tmpFile.Close()
-		return nil, err
+// add appends entry to the current data block and writes the block out once
+// it reaches the block size.
+func (b *sstableBuilder) add(entry *Entry) error {
+	// Ensure a checksum exists for the entry (use default CRC32 if not provided)
+	if entry.checksum == 0 {
+		if entry.Deleted {
+			entry.checksum = crc32.ChecksumIEEE(entry.Key)
+		} else {
+			entry.checksum = crc32.Update(crc32.ChecksumIEEE(entry.Key), crc32.IEEETable, entry.Value)
+		}
 	}
+	if entry.Deleted {
+		b.tombstones++
+	}
+	if entry.kind == entryKindValuePointer {
+		if ptr, err := decodeValuePointer(entry.Value); err == nil {
+			b.valueLogs[ptr.file] = true
+		}
+	}
+	b.index = append(b.index, IndexEntry{
+		Key:    append([]byte{}, entry.Key...),
+		Offset: b.offset,
+		Size:   uint32(len(b.raw)),
+	})
+	b.raw = appendBlockRecord(b.raw, entry)
+	if len(b.raw) >= b.blockSize {
+		return b.flushBlock()
+	}
+	return nil
+}
 
-	// Get the current offset after header
-	curOff, err := tmpFile.Seek(0, io.SeekCurrent)
+func (b *sstableBuilder) flushBlock() error {
+	if len(b.raw) == 0 {
+		return nil
+	}
+	var err error
+	b.encoded, err = encodeBlock(b.encoded[:0], b.raw, b.offset, b.opts.Compression, b.crypto)
 	if err != nil {
-		tmpFile.Close()
-		return nil, err
+		return err
 	}
-	currentOffset := uint64(curOff)
-
-	// Write data blocks and build index
-	var indexEntries []IndexEntry
-	for _, entry := range entries {
-		// Ensure a checksum exists for the entry (use default CRC32 if not provided)
-		if entry.checksum == 0 {
-			if entry.Deleted {
-				entry.checksum = crc32.ChecksumIEEE(entry.Key)
-			} else {
-				entry.checksum = crc32.ChecksumIEEE(append(entry.Key, entry.Value...))
-			}
-		}
+	if _, err := b.w.Write(b.encoded); err != nil {
+		return err
+	}
+	b.blocks = append(b.blocks, blockHandle{Offset: b.offset, Size: uint32(len(b.encoded))})
+	b.offset += uint64(len(b.encoded))
+	b.raw = b.raw[:0]
+	return nil
+}
 
-		keyLen := uint32(len(entry.Key))
-		nonce, ciphertext, err := crypto.Encrypt(entry.Value, buildEntryAAD(entry.Key, entry.Timestamp, entry.ExpiresAt, entry.Deleted))
-		if err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		valueLen := uint32(len(ciphertext))
-		nonceLen := uint16(len(nonce))
+// finish writes the last block, the bloom filters, the block index, the
+// range tombstones and the index, then moves the synced file to its path
+// and opens it. The builder is aborted if that fails.
+func (b *sstableBuilder) finish(rangeDels []rangeTombstone) (*SSTable, error) {
+	sst, err := b.write(rangeDels)
+	if err != nil {
+		b.abort()
+		return nil, err
+	}
+	return sst, nil
+}
 
-		startOffset := currentOffset
+func (b *sstableBuilder) write(rangeDels []rangeTombstone) (*SSTable, error) {
+	if err := b.flushBlock(); err != nil {
+		return nil, err
+	}
 
-		// Write entry
-		if err := binary.Write(tmpFile, binary.LittleEndian, keyLen); err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		if _, err := tmpFile.Write(entry.Key); err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		if err := binary.Write(tmpFile, binary.LittleEndian, nonceLen); err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		if _, err := tmpFile.Write(nonce); err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		if err := binary.Write(tmpFile, binary.LittleEndian, valueLen); err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		if _, err := tmpFile.Write(ciphertext); err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		if err := binary.Write(tmpFile, binary.LittleEndian, entry.Timestamp); err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		if err := binary.Write(tmpFile, binary.LittleEndian, entry.ExpiresAt); err != nil {
-			tmpFile.Close()
-			return nil, err
+	// Write bloom filter
+	bloomBits := b.opts.BloomBitsPerKey
+	if bloomBits <= 0 {
+		bloomBits = DefaultBloomFilterBits
+	}
+	bf := NewBloomFilter(len(b.index), bloomBits)
+	for _, idxEntry := range b.index {
+		bf.Add(idxEntry.Key)
+	}
+	bloomOffset := b.offset
+	bloomData := bf.Marshal()
+	var prefixBloom *BloomFilter
+	if b.opts.PrefixExtractor != nil {
+		if prefixBloom = newPrefixBloom(b.index, b.opts.PrefixExtractor, bloomBits); prefixBloom != nil {
+			bloomData = appendPrefixBloom(bloomData, b.opts.PrefixExtractor.Name(), prefixBloom)
 		}
+	}
+	w := b.w
+	if _, err := w.Write(bloomData); err != nil {
+		return nil, err
+	}
+	b.offset += uint64(len(bloomData))
 
-		var deleted uint8
-		if entry.Deleted {
-			deleted = 1
-		}
-		if err := binary.Write(tmpFile, binary.LittleEndian, deleted); err != nil {
-			tmpFile.Close()
+	// Write the block index right after the bloom filter
+	var tmp [12]byte
+	binary.LittleEndian.PutUint32(tmp[:4], uint32(len(b.blocks)))
+	if _, err := w.Write(tmp[:4]); err != nil {
+		return nil, err
+	}
+	b.offset += 4
+	for _, handle := range b.blocks {
+		binary.LittleEndian.PutUint64(tmp[:8], handle.Offset)
+		binary.LittleEndian.PutUint32(tmp[8:], handle.Size)
+		if _, err := w.Write(tmp[:]); err != nil {
 			return nil, err
 		}
-		if err := binary.Write(tmpFile, binary.LittleEndian, entry.checksum); err != nil {
-			tmpFile.Close()
+		b.offset += uint64(len(tmp))
+	}
+	if len(rangeDels) > 0 {
+		section := appendRangeTombstones(nil, rangeDels)
+		if _, err := w.Write(section); err != nil {
 			return nil, err
 		}
-
-		entrySize := 4 + len(entry.Key) + 2 + len(nonce) + 4 + len(ciphertext) + 8 + 8 + 1 + 4
-		currentOffset += uint64(entrySize)
-
-		indexEntries = append(indexEntries, IndexEntry{
-			Key:    append([]byte{}, entry.Key...),
-			Offset: startOffset,
-			Size:   uint32(entrySize),
-		})
-	}
-
-	// Write bloom filter
-	bloomOffset := currentOffset
-	bloomData := bf.Marshal()
-	if _, err := tmpFile.Write(bloomData); err != nil {
-		tmpFile.Close()
-		return nil, err
+		b.offset += uint64(len(section))
 	}
-	currentOffset += uint64(len(bloomData))
 
 	// Write index
-	indexOffset := currentOffset
-	for _, idxEntry := range indexEntries {
-		keyLen := uint32(len(idxEntry.Key))
-		if err := binary.Write(tmpFile, binary.LittleEndian, keyLen); err != nil {
-			tmpFile.Close()
+	indexOffset := b.offset
+	for _, idxEntry := range b.index {
+		binary.LittleEndian.PutUint32(tmp[:4], uint32(len(idxEntry.Key)))
+		if _, err := w.Write(tmp[:4]); err != nil {
 			return nil, err
 		}
-		if _, err := tmpFile.Write(idxEntry.Key); err != nil {
-			tmpFile.Close()
+		if _, err := w.Write(idxEntry.Key); err != nil {
 			return nil, err
 		}
-		if err := binary.Write(tmpFile, binary.LittleEndian, idxEntry.Offset); err != nil {
-			tmpFile.Close()
-			return nil, err
-		}
-		if err := binary.Write(tmpFile, binary.LittleEndian, idxEntry.Size); err != nil {
-			tmpFile.Close()
+		binary.LittleEndian.PutUint64(tmp[:8], idxEntry.Offset)
+		binary.LittleEndian.PutUint32(tmp[8:], idxEntry.Size)
+		if _, err := w.Write(tmp[:]); err != nil {
 			return nil, err
 		}
 	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
 
 	// Update header with offsets
+	tmpFile := b.file
 	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
-		tmpFile.Close()
 		return nil, err
 	}
+	header := b.header
+	header.EntryCount = uint32(len(b.index))
 	header.IndexOffset = indexOffset
 	header.BloomOffset = bloomOffset
 	header.BloomSize = uint32(len(bloomData))
 	if err := binary.Write(tmpFile, binary.LittleEndian, header); err != nil {
-		tmpFile.Close()
 		return nil, err
 	}
 
 	// Ensure everything is flushed to disk
 	if err := tmpFile.Sync(); err != nil {
-		tmpFile.Close()
 		return nil, err
 	}
 	if err := tmpFile.Close(); err != nil {
@@ -222,11 +374,13 @@ func NewSSTable(path string, entries []*Entry, crypto *CryptoProvider) (*SSTable
 	}
 
 	// Atomically rename into place
+	path := b.path
 	if err := os.Rename(tmpFile.Name(), path); err != nil {
 		return nil, err
 	}
 
 	// Fsync the directory to ensure the rename is durable on crash
+	dir := filepath.Dir(path)
 	if err := syncDir(dir); err != nil {
 		log.Printf("velocity: warning: directory fsync failed for %s: %v", dir, err)
 	}
@@ -246,28 +400,53 @@ func NewSSTable(path string, entries []*Entry, crypto *CryptoProvider) (*SSTable
 	sst := &SSTable{
 		file:        file,
 		mmap:        mmap,
-		indexData:   indexEntries,
-		entryCount:  len(entries),
+		path:        path,
+		size:        int64(len(mmap)),
+		id:          sstableIDs.Add(1),
+		indexData:   b.index,
+		entryCount:  len(b.index),
 		indexOffset: indexOffset,
 		bloomFilter: bf,
-		crypto:      crypto,
+		crypto:      b.crypto,
+		version:     Version,
+		compare:     compareKeys,
+		blocks:      b.blocks,
+		rangeDels:   rangeDels,
+		valueLogs:   sortedValueLogIDs(b.valueLogs),
+		tombstones:  b.tombstones,
+		prefixBloom: prefixBloom,
+	}
+	if prefixBloom != nil {
+		sst.prefixExtractor = b.opts.PrefixExtractor.Name()
 	}
 
-	if len(entries) > 0 {
-		sst.minKey = append([]byte{}, entries[0].Key...)
-		sst.maxKey = append([]byte{}, entries[len(entries)-1].Key...)
+	if n := len(b.index); n > 0 {
+		sst.minKey = append([]byte{}, b.index[0].Key...)
+		sst.maxKey = append([]byte{}, b.index[n-1].Key...)
 	}
+	sst.widenKeyRange()
 
 	return sst, nil
 }
 
+// abort closes and removes the temporary file of an unfinished table.
+func (b *sstableBuilder) abort() {
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
+
 // readIndexEntryAt reads an index entry starting at idxOffset bytes (relative to sst.indexOffset)
 func (sst *SSTable) readIndexEntryAt(idxOffset uint32) (IndexEntry, error) {
 	start := sst.indexOffset + uint64(idxOffset)
-	if int(start) >= len(sst.mmap) {
+	if int64(start) >= sst.size {
 		return IndexEntry{}, fmt.Errorf("index offset out of range")
 	}
-	reader := bytes.NewReader(sst.mmap[start:])
+	mmap, err := sst.acquire()
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	defer sst.release()
+	reader := bytes.NewReader(mmap[start:])
 	var keyLen uint32
 	if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
 		return IndexEntry{}, err
@@ -287,21 +466,51 @@ func (sst *SSTable) readIndexEntryAt(idxOffset uint32) (IndexEntry, error) {
 	return IndexEntry{Key: append([]byte{}, key...), Offset: off, Size: size}, nil
 }
 
-// findIndexForKey uses a sparse sample index to locate the index entry for key without materializing the full index
+// sortEntries orders entries the way SSTables store them: by key, and for
+// the versions of one key newest first, so a plain lookup finds the latest.
+func sortEntries(entries []*Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if cmp := compareKeys(entries[i].Key, entries[j].Key); cmp != 0 {
+			return cmp < 0
+		}
+		return entries[i].Timestamp > entries[j].Timestamp
+	})
+}
+
+// findIndexForKey locates the index entry of the newest version of key.
 func (sst *SSTable) findIndexForKey(key []byte) (*IndexEntry, bool, error) {
+	var found *IndexEntry
+	err := sst.forEachVersion(key, func(entry IndexEntry) bool {
+		found = &entry
+		return false
+	})
+	if err != nil || found == nil {
+		return nil, false, err
+	}
+	return found, true, nil
+}
+
+// forEachVersion calls fn with the index entry of every stored version of
+// key, newest first, until fn returns false. It uses the sparse sample index
+// to narrow the scan instead of materializing the full index.
+func (sst *SSTable) forEachVersion(key []byte, fn func(IndexEntry) bool) error {
 	// Fast path: fully materialized index
 	if sst.indexData != nil {
 		idx := sort.Search(len(sst.indexData), func(i int) bool {
-			return compareKeys(sst.indexData[i].Key, key) >= 0
+			return sst.compare(sst.indexData[i].Key, key) >= 0
 		})
-		if idx >= len(sst.indexData) || compareKeys(sst.indexData[idx].Key, key) != 0 {
-			return nil, false, nil
+		for ; idx < len(sst.indexData) && sst.compare(sst.indexData[idx].Key, key) == 0; idx++ {
+			if !fn(sst.indexData[idx]) {
+				return nil
+			}
 		}
-		entry := sst.indexData[idx]
-		return &entry, true, nil
+		return nil
 	}
 
-	// If we have sample offsets, do a binary search on samples to narrow the scan range
+	// Binary search the samples for the last one strictly before key. A
+	// sample equal to key may not hold its newest version, so the scan always
+	// starts before the first occurrence.
+	startOff := uint32(0)
 	if len(sst.indexSampleOffsets) > 0 {
 		low := 0
 		high := len(sst.indexSampleOffsets) - 1
@@ -311,157 +520,123 @@ func (sst *SSTable) findIndexForKey(key []byte) (*IndexEntry, bool, error) {
 			off := sst.indexSampleOffsets[mid]
 			sampleEntry, err := sst.readIndexEntryAt(off)
 			if err != nil {
-				return nil, false, err
-			}
-			cmp := compareKeys(sampleEntry.Key, key)
-			if cmp == 0 {
-				return &sampleEntry, true, nil
+				return err
 			}
-			if cmp < 0 {
+			if sst.compare(sampleEntry.Key, key) < 0 {
 				samplePos = mid
 				low = mid + 1
 			} else {
 				high = mid - 1
 			}
 		}
-
-		// Start scanning from the chosen sample offset (or beginning if samplePos == 0)
-		startOff := uint32(0)
-		if samplePos < len(sst.indexSampleOffsets) {
-			startOff = sst.indexSampleOffsets[samplePos]
-		}
-		// Scan forward until we find the key or pass it
-		idxPos := startOff
-		scanned := 0
-		for scanned < sst.entryCount { // conservative bound
-			entry, err := sst.readIndexEntryAt(idxPos)
-			if err != nil {
-				return nil, false, err
-			}
-			cmp := compareKeys(entry.Key, key)
-			if cmp == 0 {
-				return &entry, true, nil
-			}
-			if cmp > 0 {
-				return nil, false, nil
-			}
-			idxEntrySize := 4 + len(entry.Key) + 8 + 4
-			idxPos += uint32(idxEntrySize)
-			scanned++
-		}
-
-		return nil, false, nil
+		startOff = sst.indexSampleOffsets[samplePos]
 	}
 
-	// Linear scan across index region — correct and safe fallback when sparse index logic is not available.
-	idxPos := uint32(0)
-	for i := 0; i < sst.entryCount; i++ {
+	// Scan forward until we pass the key
+	idxPos := startOff
+	for scanned := 0; scanned < sst.entryCount; scanned++ { // conservative bound
 		entry, err := sst.readIndexEntryAt(idxPos)
 		if err != nil {
-			return nil, false, err
-		}
-		cmp := compareKeys(entry.Key, key)
-		if cmp == 0 {
-			return &entry, true, nil
+			return err
 		}
+		cmp := sst.compare(entry.Key, key)
 		if cmp > 0 {
-			return nil, false, nil
+			return nil
 		}
-		idxEntrySize := 4 + len(entry.Key) + 8 + 4
-		if idxEntrySize == 0 {
-			break
+		if cmp == 0 && !fn(entry) {
+			return nil
 		}
+		idxEntrySize := 4 + len(entry.Key) + 8 + 4
 		idxPos += uint32(idxEntrySize)
 	}
-
-	return nil, false, nil
+	return nil
 }
 
-func (sst *SSTable) Get(key []byte) (*Entry, error) {
-	// Check bloom filter first
-	if !sst.bloomFilter.Contains(key) {
+// GetAt returns the newest version of key with a timestamp at or before ts,
+// including tombstones. It returns nil if the table holds no such version.
+func (sst *SSTable) GetAt(key []byte, ts uint64) (*Entry, error) {
+	if !sst.mayContain(key) {
 		return nil, nil
 	}
-
-	entryIdx, found, err := sst.findIndexForKey(key)
+	var found *Entry
+	var readErr error
+	seen := false
+	err := sst.forEachVersion(key, func(idx IndexEntry) bool {
+		seen = true
+		entry, err := sst.readEntryAt(idx.Offset, idx.Size)
+		if err != nil {
+			readErr = err
+			return false
+		}
+		if entry.Timestamp <= ts {
+			found = entry
+			return false
+		}
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
-	if !found {
-		return nil, nil
+	if readErr != nil {
+		return nil, readErr
 	}
-
-	// Read entry from mmap with bounds checking
-	offset := entryIdx.Offset
-	if offset >= uint64(len(sst.mmap)) || offset+uint64(entryIdx.Size) > uint64(len(sst.mmap)) {
-		return nil, fmt.Errorf("sstable: entry offset %d size %d out of bounds (mmap size: %d)", offset, entryIdx.Size, len(sst.mmap))
+	if !seen {
+		sst.bloomFalsePositive()
 	}
-	data := sst.mmap[offset:]
-
-	var keyLen, valueLen uint32
-	var timestamp uint64
-	var deleted uint8
-	var checksum uint32
-	var nonceLen uint16
-
-	reader := bytes.NewReader(data)
-	binary.Read(reader, binary.LittleEndian, &keyLen)
-
-	entryKey := make([]byte, keyLen)
-	reader.Read(entryKey)
-
-	binary.Read(reader, binary.LittleEndian, &nonceLen)
-	nonce := make([]byte, nonceLen)
-	reader.Read(nonce)
-
-	binary.Read(reader, binary.LittleEndian, &valueLen)
-	ciphertext := make([]byte, valueLen)
-	reader.Read(ciphertext)
-
-	binary.Read(reader, binary.LittleEndian, &timestamp)
-	var expiresAt uint64
-	binary.Read(reader, binary.LittleEndian, &expiresAt)
-	binary.Read(reader, binary.LittleEndian, &deleted)
-	binary.Read(reader, binary.LittleEndian, &checksum)
+	return found, nil
+}
 
-	plaintext, err := sst.crypto.Decrypt(nonce, ciphertext, buildEntryAAD(entryKey, timestamp, expiresAt, deleted == 1))
+// versionsAt calls fn with the versions of key at or before ts, newest
+// first, until fn returns false.
+func (sst *SSTable) versionsAt(key []byte, ts uint64, fn func(*Entry) bool) error {
+	if !sst.bloomFilter.Contains(key) {
+		return nil
+	}
+	var readErr error
+	err := sst.forEachVersion(key, func(idx IndexEntry) bool {
+		entry, err := sst.readEntryAt(idx.Offset, idx.Size)
+		if err != nil {
+			readErr = err
+			return false
+		}
+		return entry.Timestamp > ts || fn(entry)
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return readErr
+}
 
-	entry := &Entry{
-		Key:       entryKey,
-		Value:     plaintext,
-		Timestamp: timestamp,
-		ExpiresAt: expiresAt,
-		Deleted:   deleted == 1,
-		checksum:  checksum,
+func (sst *SSTable) Get(key []byte) (*Entry, error) {
+	// Check bloom filter first
+	if !sst.mayContain(key) {
+		return nil, nil
 	}
 
-	// Verify checksum
-	var calc uint32
-	if entry.Deleted {
-		calc = crc32.ChecksumIEEE(entry.Key)
-	} else {
-		calc = crc32.ChecksumIEEE(append(entry.Key, entry.Value...))
+	entryIdx, found, err := sst.findIndexForKey(key)
+	if err != nil {
+		return nil, err
 	}
-	if calc != entry.checksum {
-		return nil, fmt.Errorf("sstable: checksum mismatch for key %x: expected %08x got %08x", key, entry.checksum, calc)
+	if !found {
+		sst.bloomFalsePositive()
+		return nil, nil
 	}
 
-	return entry, nil
+	return sst.readEntryAt(entryIdx.Offset, entryIdx.Size)
 }
 
 // VerifyIntegrity performs a lightweight integrity check on the SSTable structure.
 // It validates that the index and bloom filter regions are within mmap bounds and
 // that a sample of index entries point to valid data offsets.
+// For block-based tables it also verifies the checksums of a sample of blocks.
 func (sst *SSTable) VerifyIntegrity() error {
-	mmapLen := uint64(len(sst.mmap))
+	mmapLen := uint64(sst.size)
 	if mmapLen == 0 {
 		return fmt.Errorf("sstable: empty mmap")
 	}
-	// Verify index offset is within bounds
-	if sst.indexOffset >= mmapLen {
+	// Verify index offset is within bounds. A table holding only range
+	// tombstones has an empty index at the very end of the file.
+	if sst.indexOffset > mmapLen || (sst.entryCount > 0 && sst.indexOffset == mmapLen) {
 		return fmt.Errorf("sstable: index offset %d exceeds file size %d", sst.indexOffset, mmapLen)
 	}
 	// Verify bloom filter exists
@@ -479,29 +654,47 @@ func (sst *SSTable) VerifyIntegrity() error {
 		if err != nil {
 			return fmt.Errorf("sstable: integrity check failed reading index entry %d: %w", i, err)
 		}
-		if entry.Offset+uint64(entry.Size) > mmapLen {
+		if sst.version == sstableVersionBlocks {
+			// Size is a position inside the decoded block.
+			if entry.Offset >= mmapLen {
+				return fmt.Errorf("sstable: entry %d block offset %d exceeds file size %d", i, entry.Offset, mmapLen)
+			}
+		} else if entry.Offset+uint64(entry.Size) > mmapLen {
 			return fmt.Errorf("sstable: entry %d offset %d+size %d exceeds file size %d", i, entry.Offset, entry.Size, mmapLen)
 		}
 		idxEntrySize := 4 + len(entry.Key) + 8 + 4
 		idxPos += uint32(idxEntrySize)
 	}
+	// Spot-check the checksums of a few data blocks
+	for i, handle := range sst.blocks {
+		if i >= 16 {
+			break
+		}
+		if handle.Offset+uint64(handle.Size) > mmapLen {
+			return fmt.Errorf("sstable: block %d offset %d+size %d exceeds file size %d", i, handle.Offset, handle.Size, mmapLen)
+		}
+		mmap, err := sst.acquire()
+		if err != nil {
+			return err
+		}
+		_, _, err = decodeBlock(mmap[handle.Offset:handle.Offset+uint64(handle.Size)], handle.Offset, sst.crypto)
+		sst.release()
+		if err != nil {
+			return fmt.Errorf("sstable: integrity check failed for block %d: %w", i, err)
+		}
+	}
 	return nil
 }
 
 func (sst *SSTable) Close() error {
-	if sst.mmap != nil {
-		if err := syscall.Munmap(sst.mmap); err != nil {
-			// Log but continue to close file
-			log.Printf("velocity: SSTable munmap error: %v", err)
-		}
-		sst.mmap = nil
-	}
-	if sst.file != nil {
-		err := sst.file.Close()
-		sst.file = nil
-		return err
-	}
-	return nil
+	sst.mapMu.Lock()
+	sst.closed = true
+	err := sst.unmapLocked()
+	sst.mapMu.Unlock()
+	if sst.caches != nil {
+		sst.caches.tables.remove(sst)
+	}
+	return err
 }
 
 // LoadSSTable opens an existing SSTable file, memory maps it and reconstructs
@@ -522,15 +715,7 @@ func LoadSSTable(path string, crypto *CryptoProvider) (*SSTable, error) {
 		return nil, err
 	}
 
-	var header struct {
-		Magic       uint32
-		Version     uint32
-		EntryCount  uint32
-		IndexOffset uint64
-		BloomOffset uint64
-		BloomSize   uint32
-	}
-
+	var header sstableHeader
 	reader := bytes.NewReader(mmap)
 	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
 		syscall.Munmap(mmap)
@@ -538,7 +723,7 @@ func LoadSSTable(path string, crypto *CryptoProvider) (*SSTable, error) {
 		return nil, err
 	}
 
-	if header.Magic != MagicNumber || header.Version != Version {
+	if header.Magic != MagicNumber || header.Version < sstableVersionLengthOrdered || header.Version > Version {
 		syscall.Munmap(mmap)
 		file.Close()
 		return nil, fmt.Errorf("invalid sstable header")
@@ -551,15 +736,30 @@ func LoadSSTable(path string, crypto *CryptoProvider) (*SSTable, error) {
 		return nil, fmt.Errorf("sstable: bloom region out of range")
 	}
 	bloomData := mmap[header.BloomOffset : header.BloomOffset+uint64(header.BloomSize)]
-	bf := &BloomFilter{}
-	if len(bloomData) >= 16 {
-		bf.size = binary.LittleEndian.Uint64(bloomData[0:8])
-		bf.hash = binary.LittleEndian.Uint64(bloomData[8:16])
-		bits := make([]uint64, (bf.size+63)/64)
-		for i := range bits {
-			bits[i] = binary.LittleEndian.Uint64(bloomData[16+i*8 : 16+(i+1)*8])
+	bf, rest, err := decodeBloomFilter(bloomData)
+	if err != nil {
+		syscall.Munmap(mmap)
+		file.Close()
+		return nil, fmt.Errorf("sstable: %w", err)
+	}
+	prefixExtractor, prefixBloom, err := readPrefixBloom(rest)
+	if err != nil {
+		syscall.Munmap(mmap)
+		file.Close()
+		return nil, err
+	}
+
+	// Block-based tables keep their block index between the bloom filter
+	// and the key index.
+	var blocks []blockHandle
+	var rangeDels []rangeTombstone
+	if header.Version == sstableVersionBlocks {
+		blocks, rangeDels, err = readBlockIndex(mmap, header)
+		if err != nil {
+			syscall.Munmap(mmap)
+			file.Close()
+			return nil, err
 		}
-		bf.bits = bits
 	}
 
 	// Read index (build a sparse on-disk index to avoid holding all keys in memory)
@@ -570,7 +770,6 @@ func LoadSSTable(path string, crypto *CryptoProvider) (*SSTable, error) {
 	}
 
 	// We'll scan the index to gather sample offsets every N entries.
-	const sparseStep = 32 // sample every 32 entries (configurable if needed)
 	idxDataStart := header.IndexOffset
 	idxReader := bytes.NewReader(mmap[idxDataStart:])
 	var firstKey []byte
@@ -604,12 +803,16 @@ func LoadSSTable(path string, crypto *CryptoProvider) (*SSTable, error) {
 			return nil, err
 		}
 
-		if entryIdx == 0 {
+		// Track bounds in bytewise order, which length-ordered tables do
+		// not store their keys in.
+		if entryIdx == 0 || compareKeys(key, firstKey) < 0 {
 			firstKey = append([]byte{}, key...)
 		}
-		lastKey = append([]byte{}, key...)
+		if entryIdx == 0 || compareKeys(key, lastKey) > 0 {
+			lastKey = append([]byte{}, key...)
+		}
 
-		if entryIdx%sparseStep == 0 {
+		if entryIdx%indexSampleStep == 0 {
 			sampleOffsets = append(sampleOffsets, pos)
 		}
 		entryIdx++
@@ -618,17 +821,30 @@ func LoadSSTable(path string, crypto *CryptoProvider) (*SSTable, error) {
 	sst := &SSTable{
 		file:               file,
 		mmap:               mmap,
+		path:               path,
+		size:               int64(len(mmap)),
+		id:                 sstableIDs.Add(1),
 		indexOffset:        uint64(idxDataStart),
 		entryCount:         int(header.EntryCount),
 		indexSampleOffsets: sampleOffsets,
 		bloomFilter:        bf,
 		crypto:             crypto,
+		version:            header.Version,
+		compare:            compareKeys,
+		blocks:             blocks,
+		rangeDels:          rangeDels,
+		prefixBloom:        prefixBloom,
+		prefixExtractor:    prefixExtractor,
+	}
+	if header.Version == sstableVersionLengthOrdered {
+		sst.compare = compareKeysFast
 	}
 
 	if entryIdx > 0 {
 		sst.minKey = append([]byte{}, firstKey...)
 		sst.maxKey = append([]byte{}, lastKey...)
 	}
+	sst.widenKeyRange()
 
 	// For small tables, materialize the full index for faster lookups
 	if entryIdx <= 1024 {
@@ -652,122 +868,523 @@ func LoadSSTable(path string, crypto *CryptoProvider) (*SSTable, error) {
 	return sst, nil
 }
 
-// SSTableIterator iterates over entries in an SSTable
-type SSTableIterator struct {
-	sst     *SSTable
-	index   int
-	entries []*Entry
+// indexSampleStep is how many index entries apart the sparse index samples
+// of a loaded SSTable are.
+const indexSampleStep = 32
+
+// indexEntrySize is the on-disk size of an index entry.
+func indexEntrySize(entry IndexEntry) uint32 {
+	return uint32(4 + len(entry.Key) + 8 + 4)
 }
 
-// NewSSTableIterator creates a new iterator for the SSTable
-func NewSSTableIterator(sst *SSTable) (*SSTableIterator, error) {
-	iter := &SSTableIterator{
-		sst:   sst,
-		index: -1,
+// bytewiseOrder returns the index offsets of a length-ordered table sorted by
+// key in bytewise order, or nil for tables already stored that way.
+func (sst *SSTable) bytewiseOrder() ([]uint32, error) {
+	if sst.version != sstableVersionLengthOrdered {
+		return nil, nil
 	}
+	sst.orderOnce.Do(func() {
+		type keyed struct {
+			key []byte
+			off uint32
+		}
+		all := make([]keyed, 0, sst.entryCount)
+		idxPos := uint32(0)
+		for i := 0; i < sst.entryCount; i++ {
+			entry, err := sst.readIndexEntryAt(idxPos)
+			if err != nil {
+				sst.orderErr = err
+				return
+			}
+			all = append(all, keyed{key: entry.Key, off: idxPos})
+			idxPos += indexEntrySize(entry)
+		}
+		// Stable, so the versions of a key stay newest first.
+		sort.SliceStable(all, func(i, j int) bool { return compareKeys(all[i].key, all[j].key) < 0 })
+		order := make([]uint32, len(all))
+		for i := range all {
+			order[i] = all[i].off
+		}
+		sst.lexOrder = order
+	})
+	return sst.lexOrder, sst.orderErr
+}
 
-	// Load all entries into memory for simplicity (for large SSTables, this could be optimized)
-	iter.entries = make([]*Entry, 0, sst.entryCount)
-	idxPos := uint32(0)
-	for i := 0; i < sst.entryCount; i++ {
+// indexAt returns the index entry with bytewise ordinal i, and its offset in
+// the index region when it is known.
+func (sst *SSTable) indexAt(i int) (IndexEntry, uint32, error) {
+	if i < 0 || i >= sst.entryCount {
+		return IndexEntry{}, 0, fmt.Errorf("sstable: index ordinal %d out of range", i)
+	}
+	order, err := sst.bytewiseOrder()
+	if err != nil {
+		return IndexEntry{}, 0, err
+	}
+	if order != nil {
+		entry, err := sst.readIndexEntryAt(order[i])
+		return entry, order[i], err
+	}
+	if sst.indexData != nil {
+		return sst.indexData[i], 0, nil
+	}
+	if len(sst.indexSampleOffsets) == 0 {
+		return IndexEntry{}, 0, fmt.Errorf("sstable: index is not loaded")
+	}
+	idxPos := sst.indexSampleOffsets[i/indexSampleStep]
+	for skip := i % indexSampleStep; ; skip-- {
 		entry, err := sst.readIndexEntryAt(idxPos)
-		if err != nil {
-			log.Printf("velocity: failed to read index entry at pos %d: %v", idxPos, err)
-			return nil, err
+		if err != nil || skip == 0 {
+			return entry, idxPos, err
+		}
+		idxPos += indexEntrySize(entry)
+	}
+}
+
+// seekOrdinal returns the ordinal of the first entry whose key is >= key in
+// bytewise order, or entryCount if there is none.
+func (sst *SSTable) seekOrdinal(key []byte) (int, error) {
+	if len(key) == 0 || sst.entryCount == 0 {
+		return 0, nil
+	}
+	lo := 0
+	if sst.indexData == nil && len(sst.indexSampleOffsets) > 0 && sst.version != sstableVersionLengthOrdered {
+		// Narrow to the run between the last sample below key and the next.
+		low, high := 0, len(sst.indexSampleOffsets)-1
+		for low <= high {
+			mid := (low + high) / 2
+			sample, err := sst.readIndexEntryAt(sst.indexSampleOffsets[mid])
+			if err != nil {
+				return 0, err
+			}
+			if compareKeys(sample.Key, key) < 0 {
+				lo = mid * indexSampleStep
+				low = mid + 1
+			} else {
+				high = mid - 1
+			}
 		}
-		// Read the full entry
-		fullEntry, err := sst.readEntryAt(entry.Offset, entry.Size)
+	}
+	var searchErr error
+	n := sort.Search(sst.entryCount-lo, func(i int) bool {
+		entry, _, err := sst.indexAt(lo + i)
 		if err != nil {
-			log.Printf("velocity: failed to read full entry at offset %d: %v", entry.Offset, err)
-			return nil, err
+			searchErr = err
+			return true
 		}
-		iter.entries = append(iter.entries, fullEntry)
-		idxEntrySize := 4 + len(entry.Key) + 8 + 4
-		idxPos += uint32(idxEntrySize)
+		return compareKeys(entry.Key, key) >= 0
+	})
+	return lo + n, searchErr
+}
+
+// ref pins the table for a reader that runs without holding db.mutex.
+func (sst *SSTable) ref() {
+	sst.refs.Add(1)
+}
+
+// unref releases a pin taken with ref.
+func (sst *SSTable) unref() {
+	if sst.refs.Add(-1) == 0 && sst.retired.Load() {
+		sst.destroy()
 	}
+}
+
+// retire marks a table that is no longer part of any level. Its file is
+// closed and removed as soon as no reader pins it.
+func (sst *SSTable) retire() {
+	sst.retired.Store(true)
+	if sst.refs.Load() == 0 {
+		sst.destroy()
+	}
+}
+
+func (sst *SSTable) destroy() {
+	sst.destroyOnce.Do(func() {
+		sst.Close()
+		if sst.path != "" {
+			os.Remove(sst.path)
+		}
+		if sst.values != nil {
+			sst.values.release(sst.valueLogs)
+		}
+	})
+}
 
-	return iter, nil
+// SSTableIterator iterates over the entries of an SSTable in key order,
+// reading one entry at a time. Versions of the same key come newest first.
+// Values moved to the value log are returned as pointer records.
+//
+// It is also the table's keyCursor: Iterator and MergedIterator step it one
+// distinct key at a time in either direction, through the same index reads.
+type SSTableIterator struct {
+	sst   *SSTable
+	index int // ordinal of the entry Next returned
+	entry *Entry
+	err   error
+
+	pos int // ordinal of the newest version of the current key
+	cur []byte
+	end int // first ordinal past the current key's versions, -1 if not read yet
+
+	// The last index entry read and its ordinal and offset, so stepping
+	// through a sparse index does not go back to the nearest sample.
+	hint    IndexEntry
+	hintOrd int
+	hintOff uint32
+	hintOK  bool
+}
+
+// NewSSTableIterator creates a new iterator for the SSTable
+func NewSSTableIterator(sst *SSTable) (*SSTableIterator, error) {
+	if _, err := sst.bytewiseOrder(); err != nil {
+		return nil, err
+	}
+	return &SSTableIterator{
+		sst:   sst,
+		index: -1,
+		pos:   -1,
+		end:   -1,
+	}, nil
 }
 
 // Next advances the iterator
 func (iter *SSTableIterator) Next() bool {
+	if iter.err != nil {
+		return false
+	}
 	iter.index++
-	return iter.index < len(iter.entries)
+	iter.entry = nil
+	if iter.index >= iter.sst.entryCount {
+		return false
+	}
+	idx, err := iter.indexAt(iter.index)
+	if err == nil {
+		iter.entry, err = iter.sst.readRecordAt(idx.Offset, idx.Size)
+	}
+	if err != nil {
+		log.Printf("velocity: failed to read sstable entry %d: %v", iter.index, err)
+		iter.err = err
+		return false
+	}
+	return true
 }
 
 // Entry returns the current entry
 func (iter *SSTableIterator) Entry() *Entry {
-	if iter.index < 0 || iter.index >= len(iter.entries) {
+	if iter.index < 0 || iter.index >= iter.sst.entryCount {
 		return nil
 	}
-	return iter.entries[iter.index]
+	return iter.entry
 }
 
-// MergedIterator merges multiple SSTableIterators
+// Err returns the error that stopped the iterator early, if any.
+func (iter *SSTableIterator) Err() error {
+	return iter.err
+}
+
+func (iter *SSTableIterator) indexAt(i int) (IndexEntry, error) {
+	sparse := iter.sst.indexData == nil && iter.sst.lexOrder == nil
+	if sparse && iter.hintOK {
+		switch i {
+		case iter.hintOrd:
+			return iter.hint, nil
+		case iter.hintOrd + 1:
+			off := iter.hintOff + indexEntrySize(iter.hint)
+			entry, err := iter.sst.readIndexEntryAt(off)
+			if err == nil {
+				iter.hint, iter.hintOrd, iter.hintOff = entry, i, off
+			}
+			return entry, err
+		}
+	}
+	entry, off, err := iter.sst.indexAt(i)
+	if err == nil && sparse {
+		iter.hint, iter.hintOrd, iter.hintOff, iter.hintOK = entry, i, off, true
+	}
+	return entry, err
+}
+
+// load positions the cursor at ordinal i, which must be the newest version
+// of its key.
+func (iter *SSTableIterator) load(i int) {
+	iter.pos = i
+	iter.cur = nil
+	iter.end = -1
+	if i < 0 || i >= iter.sst.entryCount {
+		return
+	}
+	entry, err := iter.indexAt(i)
+	if err != nil {
+		iter.err = err
+		return
+	}
+	iter.cur = entry.Key
+}
+
+// backTo positions the cursor at the key holding ordinal i, rewinding to the
+// newest version of that key.
+func (iter *SSTableIterator) backTo(i int) {
+	iter.load(i)
+	for iter.valid() && iter.pos > 0 {
+		entry, _, err := iter.sst.indexAt(iter.pos - 1)
+		if err != nil {
+			iter.err = err
+			return
+		}
+		if !bytes.Equal(entry.Key, iter.cur) {
+			return
+		}
+		iter.pos--
+	}
+}
+
+func (iter *SSTableIterator) seekGE(key []byte) {
+	i, err := iter.sst.seekOrdinal(key)
+	if err != nil {
+		iter.err = err
+		return
+	}
+	iter.load(i)
+}
+
+func (iter *SSTableIterator) seekLT(key []byte) {
+	i, err := iter.sst.seekOrdinal(key)
+	if err != nil {
+		iter.err = err
+		return
+	}
+	iter.backTo(i - 1)
+}
+
+func (iter *SSTableIterator) first() { iter.load(0) }
+func (iter *SSTableIterator) last()  { iter.backTo(iter.sst.entryCount - 1) }
+func (iter *SSTableIterator) prev()  { iter.backTo(iter.pos - 1) }
+
+func (iter *SSTableIterator) next() {
+	if iter.end > iter.pos {
+		// The versions of the current key were read up to the next one.
+		iter.load(iter.end)
+		return
+	}
+	for i := iter.pos + 1; i < iter.sst.entryCount; i++ {
+		entry, err := iter.indexAt(i)
+		if err != nil {
+			iter.err = err
+			return
+		}
+		if !bytes.Equal(entry.Key, iter.cur) {
+			iter.pos, iter.cur, iter.end = i, entry.Key, -1
+			return
+		}
+	}
+	iter.load(iter.sst.entryCount)
+}
+
+func (iter *SSTableIterator) valid() bool {
+	return iter.err == nil && iter.pos >= 0 && iter.pos < iter.sst.entryCount
+}
+
+func (iter *SSTableIterator) key() []byte  { return iter.cur }
+func (iter *SSTableIterator) error() error { return iter.err }
+
+func (iter *SSTableIterator) entryAt(ts uint64) (*Entry, error) {
+	var found *Entry
+	err := iter.versionsAt(ts, func(e *Entry) bool {
+		found = e
+		return false
+	})
+	return found, err
+}
+
+func (iter *SSTableIterator) versionsAt(ts uint64, fn func(*Entry) bool) error {
+	for i := iter.pos; i < iter.sst.entryCount; i++ {
+		idx, err := iter.indexAt(i)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(idx.Key, iter.cur) {
+			iter.end = i
+			return nil
+		}
+		entry, err := iter.sst.readRecordAt(idx.Offset, idx.Size)
+		if err != nil {
+			return err
+		}
+		if entry.Timestamp <= ts && !fn(entry) {
+			return nil
+		}
+	}
+	iter.end = iter.sst.entryCount
+	return nil
+}
+
+func (iter *SSTableIterator) resolve(e *Entry) (*Entry, error) {
+	if e.kind != entryKindValuePointer {
+		return e, nil
+	}
+	return iter.sst.values.resolve(e)
+}
+
+// MergedIterator merges sources into one stream in key order. Iterator
+// steps it a key at a time in either direction; compaction reads every
+// stored version through Next. A heap keeps each step at O(log k) for k
+// sources, and sources holding the same key are visited in the order they
+// were passed.
 type MergedIterator struct {
-	iterators []*SSTableIterator
-	current   *Entry
-	// Track which iterator provided the last entry
-	lastIteratorIndex int
-	// Track if each iterator has been initialized
-	initialized []bool
+	sources []keyCursor
+	heap    mergeHeap
+	at      []int // sources positioned on the current key, in order
+	err     error
+
+	started bool
+	pending []*Entry
+	next    int
+	current *Entry
 }
 
 // NewMergedIterator creates a merged iterator
 func NewMergedIterator(iterators ...*SSTableIterator) *MergedIterator {
+	sources := make([]keyCursor, len(iterators))
+	for i, iter := range iterators {
+		sources[i] = iter
+	}
+	return newMergedIterator(sources)
+}
+
+func newMergedIterator(sources []keyCursor) *MergedIterator {
 	return &MergedIterator{
-		iterators:         iterators,
-		lastIteratorIndex: -1,
-		initialized:       make([]bool, len(iterators)),
+		sources: sources,
+		heap:    mergeHeap{sources: sources, forward: true},
 	}
 }
 
-// Next advances to the next entry in sorted order
+// Next advances to the next entry in sorted order: every version of a key,
+// source by source in the order they were passed, before the next key.
 func (mi *MergedIterator) Next() bool {
-	// On first call, initialize all iterators
-	// On subsequent calls, only advance the iterator that provided the last entry
-	if mi.lastIteratorIndex == -1 {
-		// First call: advance all iterators
-		for i := range mi.iterators {
-			if mi.iterators[i].Next() {
-				mi.initialized[i] = true
+	for mi.next >= len(mi.pending) {
+		if !mi.started {
+			mi.started = true
+			for _, src := range mi.sources {
+				src.first()
 			}
+			mi.reset(true)
+		} else {
+			mi.advance()
 		}
-	} else {
-		// Advance only the iterator that provided the last entry
-		if mi.lastIteratorIndex >= 0 && mi.lastIteratorIndex < len(mi.iterators) {
-			if mi.iterators[mi.lastIteratorIndex].Next() {
-				mi.initialized[mi.lastIteratorIndex] = true
-			} else {
-				mi.initialized[mi.lastIteratorIndex] = false
+		mi.pending, mi.next = mi.pending[:0], 0
+		if _, ok := mi.gather(); !ok {
+			mi.current = nil
+			return false
+		}
+		for _, i := range mi.at {
+			err := mi.sources[i].versionsAt(math.MaxUint64, func(e *Entry) bool {
+				mi.pending = append(mi.pending, e)
+				return true
+			})
+			if err != nil {
+				mi.err = err
+				mi.current = nil
+				return false
 			}
 		}
 	}
+	mi.current = mi.pending[mi.next]
+	mi.next++
+	return true
+}
 
-	// Find the smallest key among all valid current entries
-	var minEntry *Entry
-	minIndex := -1
-	for i, iter := range mi.iterators {
-		if !mi.initialized[i] {
-			continue
+// reset rebuilds the merge from the current positions of its sources, for
+// steps in the given direction.
+func (mi *MergedIterator) reset(forward bool) {
+	mi.heap.forward = forward
+	mi.heap.order = mi.heap.order[:0]
+	mi.at = mi.at[:0]
+	for i, src := range mi.sources {
+		if mi.check(src) && src.valid() {
+			mi.heap.order = append(mi.heap.order, i)
 		}
-		entry := iter.Entry()
-		if entry == nil {
-			continue
+	}
+	heap.Init(&mi.heap)
+}
+
+// gather returns the nearest key in the merge direction and moves the
+// sources positioned on it to at.
+func (mi *MergedIterator) gather() ([]byte, bool) {
+	if len(mi.at) > 0 {
+		return mi.sources[mi.at[0]].key(), true
+	}
+	if mi.err != nil || len(mi.heap.order) == 0 {
+		return nil, false
+	}
+	key := mi.sources[mi.heap.order[0]].key()
+	for len(mi.heap.order) > 0 && bytes.Equal(mi.sources[mi.heap.order[0]].key(), key) {
+		mi.at = append(mi.at, heap.Pop(&mi.heap).(int))
+	}
+	return key, true
+}
+
+// advance steps the sources on the current key past it.
+func (mi *MergedIterator) advance() {
+	for _, i := range mi.at {
+		src := mi.sources[i]
+		if mi.heap.forward {
+			src.next()
+		} else {
+			src.prev()
 		}
-		if minEntry == nil || compareKeys(entry.Key, minEntry.Key) < 0 {
-			minEntry = entry
-			minIndex = i
+		if mi.check(src) && src.valid() {
+			heap.Push(&mi.heap, i)
 		}
 	}
+	mi.at = mi.at[:0]
+}
 
-	if minEntry == nil {
-		return false
+func (mi *MergedIterator) check(src keyCursor) bool {
+	if err := src.error(); err != nil && mi.err == nil {
+		mi.err = err
 	}
+	return mi.err == nil
+}
 
-	mi.current = minEntry
-	mi.lastIteratorIndex = minIndex
-	return true
+// mergeHeap orders positioned sources by their current key in the merge
+// direction, then by their position in the merge.
+type mergeHeap struct {
+	sources []keyCursor
+	order   []int
+	forward bool
+}
+
+func (h mergeHeap) Len() int { return len(h.order) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h.order[i], h.order[j]
+	if cmp := compareKeys(h.sources[a].key(), h.sources[b].key()); cmp != 0 {
+		return (cmp < 0) == h.forward
+	}
+	return a < b
+}
+
+func (h mergeHeap) Swap(i, j int) { h.order[i], h.order[j] = h.order[j], h.order[i] }
+
+func (h *mergeHeap) Push(x any) { h.order = append(h.order, x.(int)) }
+
+func (h *mergeHeap) Pop() any {
+	last := h.order[len(h.order)-1]
+	h.order = h.order[:len(h.order)-1]
+	return last
+}
+
+// Err returns the first error hit by any of the merged sources. A merge
+// that stopped on an error is incomplete and must not replace its inputs.
+func (mi *MergedIterator) Err() error {
+	if mi.err != nil {
+		return mi.err
+	}
+	for _, src := range mi.sources {
+		if err := src.error(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Entry returns the current entry
@@ -775,12 +1392,36 @@ func (mi *MergedIterator) Entry() *Entry {
 	return mi.current
 }
 
-// readEntryAt reads a full entry at the given offset and size
+// readEntryAt reads a full entry at the given offset and size, with its
+// value read back from the value log if it was moved there. For block-based
+// tables offset is the block offset and size the position of the record
+// inside the decoded block.
 func (sst *SSTable) readEntryAt(offset uint64, size uint32) (*Entry, error) {
-	if offset >= uint64(len(sst.mmap)) || offset+uint64(size) > uint64(len(sst.mmap)) {
-		return nil, fmt.Errorf("sstable: readEntryAt offset %d size %d out of bounds (mmap size: %d)", offset, size, len(sst.mmap))
+	entry, err := sst.readRecordAt(offset, size)
+	if err != nil || entry.kind != entryKindValuePointer {
+		return entry, err
+	}
+	return sst.values.resolve(entry)
+}
+
+// readRecordAt reads the entry stored at the given offset and size as is.
+func (sst *SSTable) readRecordAt(offset uint64, size uint32) (*Entry, error) {
+	if sst.version == sstableVersionBlocks {
+		entry, err := sst.readBlockEntry(offset, size)
+		if err == nil && sst.globalTimestamp != 0 {
+			entry.Timestamp = sst.globalTimestamp
+		}
+		return entry, err
+	}
+	if int64(offset) >= sst.size || int64(offset+uint64(size)) > sst.size {
+		return nil, fmt.Errorf("sstable: readEntryAt offset %d size %d out of bounds (mmap size: %d)", offset, size, sst.size)
+	}
+	mmap, err := sst.acquire()
+	if err != nil {
+		return nil, err
 	}
-	data := sst.mmap[offset : offset+uint64(size)]
+	defer sst.release()
+	data := mmap[offset : offset+uint64(size)]
 
 	reader := bytes.NewReader(data)
 	var keyLen, valueLen uint32
@@ -808,7 +1449,7 @@ func (sst *SSTable) readEntryAt(offset uint64, size uint32) (*Entry, error) {
 	binary.Read(reader, binary.LittleEndian, &deleted)
 	binary.Read(reader, binary.LittleEndian, &checksum)
 
-	plaintext, err := sst.crypto.Decrypt(nonce, ciphertext, buildEntryAAD(entryKey, timestamp, expiresAt, deleted == 1))
+	plaintext, err := sst.crypto.Decrypt(nonce, ciphertext, buildEntryAAD(entryKey, timestamp, expiresAt, deleted))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,290 @@
+package velocity
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Data block layout of block-based SSTables:
+//
+//	codec u8 | rawLen u32 | nonceLen u16 | nonce | bodyLen u32 | body | crc32 u32
+//
+// body is the block's records, compressed with codec and then encrypted as a
+// whole. The trailing CRC covers every preceding byte of the block, so
+// corruption is caught before decryption is attempted. Each record is
+//
+//	keyLen u32 | key | valueLen u32 | value | ts u64 | expiresAt u64 | flag u8 | crc32 u32
+//
+// where flag marks tombstones and merge operands; see recordFlag.
+const (
+	blockHeaderSize     = 1 + 4 + 2
+	blockRecordOverhead = 4 + 4 + 8 + 8 + 1 + 4
+)
+
+// appendBlockRecord appends the raw encoding of entry to a block.
+func appendBlockRecord(dst []byte, entry *Entry) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint32(tmp[:4], uint32(len(entry.Key)))
+	dst = append(dst, tmp[:4]...)
+	dst = append(dst, entry.Key...)
+	binary.LittleEndian.PutUint32(tmp[:4], uint32(len(entry.Value)))
+	dst = append(dst, tmp[:4]...)
+	dst = append(dst, entry.Value...)
+	binary.LittleEndian.PutUint64(tmp[:], entry.Timestamp)
+	dst = append(dst, tmp[:]...)
+	binary.LittleEndian.PutUint64(tmp[:], entry.ExpiresAt)
+	dst = append(dst, tmp[:]...)
+	dst = append(dst, recordFlag(entry))
+	binary.LittleEndian.PutUint32(tmp[:4], entry.checksum)
+	return append(dst, tmp[:4]...)
+}
+
+// encodeBlock compresses, encrypts and frames raw as the block stored at
+// offset, appending the result to dst.
+func encodeBlock(dst, raw []byte, offset uint64, compression CompressionType, crypto *CryptoProvider) ([]byte, error) {
+	compressed, codec := compressBlock(nil, raw, compression)
+	nonce, body, err := crypto.Encrypt(compressed, buildBlockAAD(offset, codec, uint32(len(raw))))
+	if err != nil {
+		return nil, err
+	}
+	start := len(dst)
+	var tmp [4]byte
+	dst = append(dst, byte(codec))
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(raw)))
+	dst = append(dst, tmp[:]...)
+	binary.LittleEndian.PutUint16(tmp[:2], uint16(len(nonce)))
+	dst = append(dst, tmp[:2]...)
+	dst = append(dst, nonce...)
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(body)))
+	dst = append(dst, tmp[:]...)
+	dst = append(dst, body...)
+	binary.LittleEndian.PutUint32(tmp[:], crc32.ChecksumIEEE(dst[start:]))
+	return append(dst, tmp[:]...), nil
+}
+
+// decodeBlock verifies and decodes the framed block in data, which was
+// stored at offset. It returns the block's raw records and its framed size.
+func decodeBlock(data []byte, offset uint64, crypto *CryptoProvider) ([]byte, int, error) {
+	if len(data) < blockHeaderSize {
+		return nil, 0, fmt.Errorf("sstable: truncated block at %d", offset)
+	}
+	codec := CompressionType(data[0])
+	rawLen := binary.LittleEndian.Uint32(data[1:5])
+	nonceLen := int(binary.LittleEndian.Uint16(data[5:7]))
+	pos := blockHeaderSize + nonceLen
+	if pos+4 > len(data) {
+		return nil, 0, fmt.Errorf("sstable: truncated block at %d", offset)
+	}
+	nonce := data[blockHeaderSize:pos]
+	bodyLen := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	if bodyLen > len(data)-pos-4 {
+		return nil, 0, fmt.Errorf("sstable: truncated block at %d", offset)
+	}
+	body := data[pos : pos+bodyLen]
+	pos += bodyLen
+	if crc32.ChecksumIEEE(data[:pos]) != binary.LittleEndian.Uint32(data[pos:]) {
+		return nil, 0, fmt.Errorf("sstable: block checksum mismatch at %d", offset)
+	}
+	compressed, err := crypto.Decrypt(nonce, body, buildBlockAAD(offset, codec, rawLen))
+	if err != nil {
+		return nil, 0, err
+	}
+	raw, err := decompressBlock(compressed, codec, int(rawLen))
+	if err != nil {
+		return nil, 0, fmt.Errorf("sstable: block at %d: %w", offset, err)
+	}
+	return raw, pos + 4, nil
+}
+
+// readBlockIndex reads the block handles stored after the bloom filter.
+func readBlockIndex(mmap []byte, header sstableHeader) ([]blockHandle, []rangeTombstone, error) {
+	pos := header.BloomOffset + uint64(header.BloomSize)
+	if pos+4 > header.IndexOffset || header.IndexOffset > uint64(len(mmap)) {
+		return nil, nil, fmt.Errorf("sstable: block index out of range")
+	}
+	count := uint64(binary.LittleEndian.Uint32(mmap[pos:]))
+	pos += 4
+	if pos+count*12 > header.IndexOffset {
+		return nil, nil, fmt.Errorf("sstable: block index out of range")
+	}
+	blocks := make([]blockHandle, count)
+	for i := range blocks {
+		blocks[i].Offset = binary.LittleEndian.Uint64(mmap[pos:])
+		blocks[i].Size = binary.LittleEndian.Uint32(mmap[pos+8:])
+		if blocks[i].Offset+uint64(blocks[i].Size) > header.BloomOffset {
+			return nil, nil, fmt.Errorf("sstable: block %d out of range", i)
+		}
+		pos += 12
+	}
+	// Range tombstones, if any, fill the gap up to the key index.
+	if pos == header.IndexOffset {
+		return blocks, nil, nil
+	}
+	rangeDels, err := readRangeTombstones(mmap[pos:header.IndexOffset])
+	if err != nil {
+		return nil, nil, err
+	}
+	return blocks, rangeDels, nil
+}
+
+// appendRangeTombstones appends the range tombstone section of a block-based
+// table: a count, then start, end and timestamp of each tombstone, then a
+// CRC32 of all of it.
+func appendRangeTombstones(dst []byte, tombstones []rangeTombstone) []byte {
+	start := len(dst)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(tombstones)))
+	for _, t := range tombstones {
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(t.Start)))
+		dst = append(dst, t.Start...)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(t.End)))
+		dst = append(dst, t.End...)
+		dst = binary.LittleEndian.AppendUint64(dst, t.Timestamp)
+	}
+	return binary.LittleEndian.AppendUint32(dst, crc32.ChecksumIEEE(dst[start:]))
+}
+
+// readRangeTombstones decodes a section written by appendRangeTombstones.
+func readRangeTombstones(data []byte) ([]rangeTombstone, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("sstable: range tombstones truncated")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, fmt.Errorf("sstable: range tombstone checksum mismatch")
+	}
+	readBytes := func() ([]byte, bool) {
+		if len(body) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(body)
+		if uint64(n) > uint64(len(body)-4) {
+			return nil, false
+		}
+		b := append([]byte(nil), body[4:4+n]...)
+		body = body[4+n:]
+		return b, true
+	}
+	count := binary.LittleEndian.Uint32(body)
+	body = body[4:]
+	tombstones := make([]rangeTombstone, 0, min(int(count), 1024))
+	for i := uint32(0); i < count; i++ {
+		start, ok1 := readBytes()
+		end, ok2 := readBytes()
+		if !ok1 || !ok2 || len(body) < 8 {
+			return nil, fmt.Errorf("sstable: range tombstone %d truncated", i)
+		}
+		tombstones = append(tombstones, rangeTombstone{Start: start, End: end, Timestamp: binary.LittleEndian.Uint64(body)})
+		body = body[8:]
+	}
+	return tombstones, nil
+}
+
+// widenKeyRange extends the table's key range to cover its range
+// tombstones, so compaction picks the table up wherever they apply. The end
+// of a tombstone is exclusive; an end that is the successor of a key, as
+// compaction leaves them, stands for that key.
+func (sst *SSTable) widenKeyRange() {
+	for _, t := range sst.rangeDels {
+		if sst.minKey == nil || compareKeys(t.Start, sst.minKey) < 0 {
+			sst.minKey = append([]byte{}, t.Start...)
+		}
+		end := t.End
+		if n := len(end); n > 1 && end[n-1] == 0 {
+			end = end[:n-1]
+		}
+		if sst.maxKey == nil || compareKeys(end, sst.maxKey) > 0 {
+			sst.maxKey = append([]byte{}, end...)
+		}
+	}
+}
+
+// loadBlock returns the decoded block stored at offset, reusing the last
+// decoded block or the one in the block cache when possible.
+func (sst *SSTable) loadBlock(offset uint64) ([]byte, error) {
+	if b := sst.lastBlock.Load(); b != nil && b.offset == offset {
+		return b.data, nil
+	}
+	var blocks *blockCache
+	if sst.caches != nil {
+		blocks = sst.caches.blocks
+	}
+	if raw, ok := blocks.get(sst.id, offset); ok {
+		sst.lastBlock.Store(&sstBlock{offset: offset, data: raw})
+		return raw, nil
+	}
+	if int64(offset) >= sst.size {
+		return nil, fmt.Errorf("sstable: block offset %d out of bounds (mmap size: %d)", offset, sst.size)
+	}
+	mmap, err := sst.acquire()
+	if err != nil {
+		return nil, err
+	}
+	raw, _, err := decodeBlock(mmap[offset:], offset, sst.crypto)
+	if err == nil && sst.caches != nil && sst.crypto.noop && CompressionType(mmap[offset]) == CompressionNone {
+		// The block is still the mapped bytes, which the table cache may
+		// unmap.
+		raw = append([]byte(nil), raw...)
+	}
+	sst.release()
+	if err != nil {
+		return nil, err
+	}
+	blocks.put(sst.id, offset, raw)
+	sst.lastBlock.Store(&sstBlock{offset: offset, data: raw})
+	return raw, nil
+}
+
+// readBlockEntry decodes the record at pos of the block stored at offset.
+func (sst *SSTable) readBlockEntry(offset uint64, pos uint32) (*Entry, error) {
+	block, err := sst.loadBlock(offset)
+	if err != nil {
+		return nil, err
+	}
+	entry, _, err := decodeBlockRecord(block, int(pos))
+	if err != nil {
+		return nil, fmt.Errorf("sstable: block at %d: %w", offset, err)
+	}
+	return entry, nil
+}
+
+// decodeBlockRecord decodes the record at pos of a raw block, copying key and
+// value out of it, and returns the position of the next record.
+func decodeBlockRecord(block []byte, pos int) (*Entry, int, error) {
+	if pos < 0 || pos+4 > len(block) {
+		return nil, 0, fmt.Errorf("record offset %d out of range", pos)
+	}
+	keyLen := int(binary.LittleEndian.Uint32(block[pos:]))
+	pos += 4
+	if keyLen > len(block)-pos-4 {
+		return nil, 0, fmt.Errorf("truncated record")
+	}
+	key := append([]byte(nil), block[pos:pos+keyLen]...)
+	pos += keyLen
+	valueLen := int(binary.LittleEndian.Uint32(block[pos:]))
+	pos += 4
+	if valueLen > len(block)-pos-(blockRecordOverhead-8) {
+		return nil, 0, fmt.Errorf("truncated record")
+	}
+	entry := &Entry{
+		Key:       key,
+		Value:     append([]byte(nil), block[pos:pos+valueLen]...),
+		Timestamp: binary.LittleEndian.Uint64(block[pos+valueLen:]),
+		ExpiresAt: binary.LittleEndian.Uint64(block[pos+valueLen+8:]),
+		checksum:  binary.LittleEndian.Uint32(block[pos+valueLen+17:]),
+	}
+	applyRecordFlag(entry, block[pos+valueLen+16])
+	pos += valueLen + blockRecordOverhead - 8
+
+	var calc uint32
+	if entry.Deleted {
+		calc = crc32.ChecksumIEEE(entry.Key)
+	} else {
+		calc = crc32.Update(crc32.ChecksumIEEE(entry.Key), crc32.IEEETable, entry.Value)
+	}
+	if calc != entry.checksum {
+		return nil, 0, fmt.Errorf("checksum mismatch for key %x: expected %08x got %08x", entry.Key, entry.checksum, calc)
+	}
+	return entry, pos, nil
+}
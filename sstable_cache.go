@@ -0,0 +1,378 @@
+package velocity
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// DefaultBlockCacheSize is the memory the block cache of a database may
+	// hold decoded SSTable blocks in.
+	DefaultBlockCacheSize = 32 * 1024 * 1024 // 32MB
+
+	// DefaultMaxOpenTables is how many SSTables a database keeps open and
+	// mapped at once.
+	DefaultMaxOpenTables = 1000
+
+	blockCacheShards = 16
+)
+
+// sstableIDs numbers SSTables for the block cache, which must never mix up
+// the blocks of a table with those of one opened later.
+var sstableIDs atomic.Uint64
+
+// sstableCaches are the read caches shared by the SSTables of a database and
+// its column families.
+type sstableCaches struct {
+	blocks *blockCache
+	tables *tableCache
+}
+
+// newSSTableCaches returns caches of the sizes set by Config.BlockCacheSize
+// and Config.MaxOpenTables.
+func newSSTableCaches(blockCacheSize int64, maxOpenTables int) *sstableCaches {
+	if blockCacheSize == 0 {
+		blockCacheSize = DefaultBlockCacheSize
+	}
+	if maxOpenTables == 0 {
+		maxOpenTables = DefaultMaxOpenTables
+	}
+	c := &sstableCaches{}
+	if blockCacheSize > 0 {
+		c.blocks = newBlockCache(blockCacheSize)
+	}
+	if maxOpenTables > 0 {
+		c.tables = &tableCache{capacity: maxOpenTables}
+	}
+	return c
+}
+
+// attachTable hands a table that joins the levels of db to the value log and
+// the read caches.
+func (db *DB) attachTable(sst *SSTable) {
+	db.values.attach(sst)
+	sst.counters = &db.counters
+	if db.caches == nil {
+		return
+	}
+	sst.caches = db.caches
+	db.caches.tables.add(sst)
+}
+
+// blockCache keeps decoded SSTable blocks, so hot blocks are decrypted,
+// checksummed and decompressed once. It is split into shards with their own
+// lock and LRU list to keep concurrent readers apart.
+type blockCache struct {
+	seed   maphash.Seed
+	shards [blockCacheShards]blockCacheShard
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type blockCacheKey struct {
+	table  uint64
+	offset uint64
+}
+
+type blockCacheEntry struct {
+	key  blockCacheKey
+	data []byte
+}
+
+type blockCacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	items    map[blockCacheKey]*list.Element
+	lru      list.List // front is most recently used
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	c := &blockCache{seed: maphash.MakeSeed()}
+	for i := range c.shards {
+		c.shards[i].capacity = max(capacity/blockCacheShards, 1)
+		c.shards[i].items = make(map[blockCacheKey]*list.Element)
+	}
+	return c
+}
+
+func (c *blockCache) shard(key blockCacheKey) *blockCacheShard {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	var buf [16]byte
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(key.table >> (8 * i))
+		buf[8+i] = byte(key.offset >> (8 * i))
+	}
+	h.Write(buf[:])
+	return &c.shards[h.Sum64()%blockCacheShards]
+}
+
+// get returns the cached block of table at offset. The block must not be
+// modified.
+func (c *blockCache) get(table, offset uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := blockCacheKey{table, offset}
+	s := c.shard(key)
+	s.mu.Lock()
+	el, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return el.Value.(*blockCacheEntry).data, true
+}
+
+// put caches a decoded block, evicting the least recently used blocks of its
+// shard to make room. Blocks larger than a shard are not cached.
+func (c *blockCache) put(table, offset uint64, data []byte) {
+	if c == nil {
+		return
+	}
+	key := blockCacheKey{table, offset}
+	s := c.shard(key)
+	size := int64(len(data))
+	if size > s.capacity {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[key]; ok {
+		return
+	}
+	s.items[key] = s.lru.PushFront(&blockCacheEntry{key: key, data: data})
+	s.size += size
+	for s.size > s.capacity {
+		el := s.lru.Back()
+		e := el.Value.(*blockCacheEntry)
+		s.lru.Remove(el)
+		delete(s.items, e.key)
+		s.size -= int64(len(e.data))
+		c.evictions.Add(1)
+	}
+}
+
+// BlockCacheStats describes the block cache of a database.
+type BlockCacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Blocks    int    `json:"blocks"`
+	Bytes     int64  `json:"bytes"`
+	Capacity  int64  `json:"capacity"`
+}
+
+// HitRate returns the share of lookups the cache served.
+func (s BlockCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (c *blockCache) stats() BlockCacheStats {
+	if c == nil {
+		return BlockCacheStats{}
+	}
+	stats := BlockCacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Blocks += len(s.items)
+		stats.Bytes += s.size
+		stats.Capacity += s.capacity
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// tableCache bounds how many SSTables are open and mapped. Tables are opened
+// on demand when read and the least recently read ones are closed again; a
+// clock sweep approximates LRU without taking a lock on every read.
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int
+	open     []*SSTable
+	hand     int
+
+	reopens   atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// add counts sst as open and closes other tables if that leaves too many
+// open. Tables that are being read are skipped, so the cache may briefly
+// hold more than its capacity.
+func (c *tableCache) add(sst *SSTable) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open = append(c.open, sst)
+	for swept := 0; len(c.open) > c.capacity && swept < 2*len(c.open); swept++ {
+		if c.hand >= len(c.open) {
+			c.hand = 0
+		}
+		victim := c.open[c.hand]
+		if victim == sst || victim.used.Swap(false) || !victim.mapMu.TryLock() {
+			c.hand++
+			continue
+		}
+		victim.unmapLocked()
+		victim.mapMu.Unlock()
+		c.removeAt(c.hand)
+		c.evictions.Add(1)
+	}
+}
+
+// remove stops tracking a table that was closed.
+func (c *tableCache) remove(sst *SSTable) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t := range c.open {
+		if t == sst {
+			c.removeAt(i)
+			return
+		}
+	}
+}
+
+func (c *tableCache) removeAt(i int) {
+	last := len(c.open) - 1
+	c.open[i] = c.open[last]
+	c.open[last] = nil
+	c.open = c.open[:last]
+}
+
+// TableCacheStats describes the table cache of a database.
+type TableCacheStats struct {
+	Open      int    `json:"open"`
+	Capacity  int    `json:"capacity"`
+	Reopens   uint64 `json:"reopens"`
+	Evictions uint64 `json:"evictions"`
+}
+
+func (c *tableCache) stats() TableCacheStats {
+	if c == nil {
+		return TableCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return TableCacheStats{
+		Open:      len(c.open),
+		Capacity:  c.capacity,
+		Reopens:   c.reopens.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// BlockCacheStats returns the hit counters and size of the block cache,
+// which column families share with their database.
+func (db *DB) BlockCacheStats() BlockCacheStats {
+	if db.caches == nil {
+		return BlockCacheStats{}
+	}
+	return db.caches.blocks.stats()
+}
+
+// TableCacheStats returns how many SSTables are open and how often tables
+// were reopened and closed by the table cache.
+func (db *DB) TableCacheStats() TableCacheStats {
+	if db.caches == nil {
+		return TableCacheStats{}
+	}
+	return db.caches.tables.stats()
+}
+
+// acquire returns the table's mapping, reopening the file if the table cache
+// closed it. The mapping stays valid until release is called; callers must
+// not acquire the same table again before then.
+func (sst *SSTable) acquire() ([]byte, error) {
+	sst.used.Store(true)
+	for {
+		sst.mapMu.RLock()
+		if sst.mmap != nil {
+			return sst.mmap, nil
+		}
+		sst.mapMu.RUnlock()
+		if err := sst.reopen(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// release ends a read started by acquire.
+func (sst *SSTable) release() {
+	sst.mapMu.RUnlock()
+}
+
+// reopen maps the table's file again after the table cache closed it.
+func (sst *SSTable) reopen() error {
+	sst.mapMu.Lock()
+	if sst.mmap != nil {
+		sst.mapMu.Unlock()
+		return nil
+	}
+	if sst.closed {
+		sst.mapMu.Unlock()
+		return fmt.Errorf("sstable %s is closed", sst.path)
+	}
+	file, err := os.Open(sst.path)
+	if err != nil {
+		sst.mapMu.Unlock()
+		return err
+	}
+	mmap, err := syscall.Mmap(int(file.Fd()), 0, int(sst.size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		sst.mapMu.Unlock()
+		return err
+	}
+	sst.file, sst.mmap = file, mmap
+	sst.mapMu.Unlock()
+	if sst.caches != nil && sst.caches.tables != nil {
+		sst.caches.tables.reopens.Add(1)
+		sst.caches.tables.add(sst)
+	}
+	return nil
+}
+
+// unmapLocked closes the file and mapping of the table. Callers hold
+// mapMu exclusively.
+func (sst *SSTable) unmapLocked() error {
+	var err error
+	if sst.mmap != nil {
+		err = syscall.Munmap(sst.mmap)
+		sst.mmap = nil
+	}
+	if sst.file != nil {
+		if cerr := sst.file.Close(); err == nil {
+			err = cerr
+		}
+		sst.file = nil
+	}
+	// The last block may point into the mapping.
+	sst.lastBlock.Store(nil)
+	return err
+}
@@ -0,0 +1,81 @@
+package velocity
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlockCacheServesRepeatedReads(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir(), SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		db.Put([]byte(fmt.Sprintf("bc:%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read keys far apart so the last decoded block of the table never
+	// serves the next lookup.
+	read := func() {
+		for _, i := range []int{0, 499, 250, 10, 400} {
+			got, err := db.Get([]byte(fmt.Sprintf("bc:%04d", i)))
+			if err != nil || string(got) != fmt.Sprintf("value-%d", i) {
+				t.Fatalf("bc:%04d: got %q (%v)", i, got, err)
+			}
+		}
+	}
+	read()
+	first := db.BlockCacheStats()
+	if first.Misses == 0 || first.Blocks == 0 {
+		t.Fatalf("expected the first reads to fill the cache, got %+v", first)
+	}
+	read()
+	second := db.BlockCacheStats()
+	if second.Hits <= first.Hits || second.Misses != first.Misses {
+		t.Fatalf("expected the second reads to hit the cache: %+v then %+v", first, second)
+	}
+}
+
+func TestTableCacheBoundsOpenTables(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir(), MaxOpenTables: 2, BlockCacheSize: -1, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for table := 0; table < 6; table++ {
+		for i := 0; i < 20; i++ {
+			db.Put([]byte(fmt.Sprintf("tc:%d:%02d", table, i)), []byte(fmt.Sprintf("%d-%d", table, i)))
+		}
+		if err := db.flushMemTable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := db.TableCacheStats(); stats.Open > 2 {
+		t.Fatalf("expected at most 2 open tables, got %+v", stats)
+	}
+
+	for round := 0; round < 2; round++ {
+		for table := 0; table < 6; table++ {
+			key := fmt.Sprintf("tc:%d:%02d", table, round)
+			got, err := db.Get([]byte(key))
+			if err != nil || string(got) != fmt.Sprintf("%d-%d", table, round) {
+				t.Fatalf("%s: got %q (%v)", key, got, err)
+			}
+		}
+	}
+	n := 0
+	if err := db.Scan([]byte("tc:"), func(key, value []byte) bool {
+		n++
+		return true
+	}); err != nil || n != 120 {
+		t.Fatalf("expected 120 keys from scan, got %d (%v)", n, err)
+	}
+	stats := db.TableCacheStats()
+	if stats.Open > 2 || stats.Reopens == 0 || stats.Evictions == 0 {
+		t.Fatalf("expected tables to be closed and reopened on demand, got %+v", stats)
+	}
+}
@@ -0,0 +1,224 @@
+package velocity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLZ4BlockRoundTrip(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("abc"),
+		"repetitive": bytes.Repeat([]byte(`{"status":"active","region":"eu-west"}`), 200),
+		"run":        bytes.Repeat([]byte{'x'}, 70000),
+	}
+	noise := make([]byte, 8192)
+	for i := range noise {
+		noise[i] = byte(i*7919 + i>>3*31)
+	}
+	inputs["noise"] = noise
+
+	for name, src := range inputs {
+		enc, codec := compressBlock(nil, src, CompressionLZ4)
+		dec, err := decompressBlock(enc, codec, len(src))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(dec, src) {
+			t.Fatalf("%s: round trip mismatch", name)
+		}
+		if name == "repetitive" && (codec != CompressionLZ4 || len(enc) > len(src)/10) {
+			t.Fatalf("%s: expected strong compression, got %d bytes with %s", name, len(enc), codec)
+		}
+	}
+
+	enc := lz4CompressBlock(nil, inputs["repetitive"])
+	if _, err := lz4DecompressBlock(nil, enc[:len(enc)-3], len(inputs["repetitive"])); err == nil {
+		t.Fatal("expected truncated input to fail")
+	}
+}
+
+func TestBlockSSTableWithSparseIndex(t *testing.T) {
+	crypto, _ := newCryptoProvider(make([]byte, 32))
+	var entries []*Entry
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("order:%06d", i)
+		value := fmt.Sprintf(`{"id":%d,"status":"shipped","customer":"c-%d"}`, i, i%50)
+		entries = append(entries, &Entry{Key: []byte(key), Value: []byte(value), Timestamp: 1, checksum: crc32Of(key, value)})
+	}
+	path := filepath.Join(t.TempDir(), "blocks.db")
+	sst, err := NewSSTableWithOptions(path, entries, crypto, SSTableOptions{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sst.blocks) < 10 {
+		t.Fatalf("expected many blocks, got %d", len(sst.blocks))
+	}
+	sst.Close()
+
+	loaded, err := LoadSSTable(path, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if loaded.version != sstableVersionBlocks || loaded.indexData != nil {
+		t.Fatalf("expected a sparse block-based table, got version %d", loaded.version)
+	}
+	if err := loaded.VerifyIntegrity(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i += 37 {
+		key := fmt.Sprintf("order:%06d", i)
+		e, err := loaded.Get([]byte(key))
+		if err != nil || e == nil || !strings.Contains(string(e.Value), fmt.Sprintf(`"id":%d,`, i)) {
+			t.Fatalf("get %s: %+v (%v)", key, e, err)
+		}
+	}
+	iter, err := NewSSTableIterator(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for iter.Next() {
+		count++
+	}
+	if iter.Err() != nil || count != 3000 {
+		t.Fatalf("expected 3000 entries, got %d (%v)", count, iter.Err())
+	}
+}
+
+func TestBlockSSTableDetectsCorruption(t *testing.T) {
+	crypto, _ := newCryptoProvider(make([]byte, 32))
+	var entries []*Entry
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		entries = append(entries, &Entry{Key: []byte(key), Value: []byte("value"), Timestamp: 1, checksum: crc32Of(key, "value")})
+	}
+	path := filepath.Join(t.TempDir(), "corrupt.db")
+	sst, err := NewSSTableWithOptions(path, entries, crypto, SSTableOptions{BlockSize: 512, Compression: CompressionNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := sst.blocks[1]
+	sst.Close()
+
+	data, _ := os.ReadFile(path)
+	data[second.Offset+uint64(second.Size/2)] ^= 0xFF
+	os.WriteFile(path, data, 0o644)
+
+	loaded, err := LoadSSTable(path, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if err := loaded.VerifyIntegrity(); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("expected a block checksum error, got %v", err)
+	}
+	if e, err := loaded.Get([]byte("k0000")); err != nil || e == nil {
+		t.Fatalf("expected the first block to stay readable: %v", err)
+	}
+
+	out := filepath.Join(t.TempDir(), "repaired.db")
+	n, err := RepairSSTable(path, out, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n >= len(entries) {
+		t.Fatalf("expected a partial recovery, got %d entries", n)
+	}
+}
+
+func TestLoadRecordFormatSSTable(t *testing.T) {
+	crypto, _ := newCryptoProvider(make([]byte, 32))
+	var entries []*Entry
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user:%03d", i)
+		entries = append(entries, &Entry{Key: []byte(key), Value: []byte("v" + key), Timestamp: 1, checksum: crc32Of(key, "v"+key)})
+	}
+	path := filepath.Join(t.TempDir(), "v2.db")
+	writeRecordSSTable(t, path, entries, crypto, sstableVersionRecords)
+
+	sst, err := LoadSSTable(path, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	if err := sst.VerifyIntegrity(); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		got, err := sst.Get(e.Key)
+		if err != nil || got == nil || !bytes.Equal(got.Value, e.Value) {
+			t.Fatalf("get %s: %+v (%v)", e.Key, got, err)
+		}
+	}
+}
+
+// writeRecordSSTable writes entries in the per-record layout used before
+// block-based tables: version 1 sorts keys by length first and version 2
+// bytewise.
+func writeRecordSSTable(t *testing.T, path string, entries []*Entry, crypto *CryptoProvider, version uint32) {
+	t.Helper()
+	sorted := append([]*Entry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if version == sstableVersionLengthOrdered {
+			return compareKeysFast(sorted[i].Key, sorted[j].Key) < 0
+		}
+		return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+	le := binary.LittleEndian
+	bf := NewBloomFilter(len(sorted), DefaultBloomFilterBits)
+	out := make([]byte, binary.Size(sstableHeader{}))
+	var index []byte
+	for _, e := range sorted {
+		bf.Add(e.Key)
+		nonce, ct, err := crypto.Encrypt(e.Value, buildEntryAAD(e.Key, e.Timestamp, e.ExpiresAt, recordFlag(e)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := len(out)
+		out = le.AppendUint32(out, uint32(len(e.Key)))
+		out = append(out, e.Key...)
+		out = le.AppendUint16(out, uint16(len(nonce)))
+		out = append(out, nonce...)
+		out = le.AppendUint32(out, uint32(len(ct)))
+		out = append(out, ct...)
+		out = le.AppendUint64(out, e.Timestamp)
+		out = le.AppendUint64(out, e.ExpiresAt)
+		if e.Deleted {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		out = le.AppendUint32(out, e.checksum)
+
+		index = le.AppendUint32(index, uint32(len(e.Key)))
+		index = append(index, e.Key...)
+		index = le.AppendUint64(index, uint64(start))
+		index = le.AppendUint32(index, uint32(len(out)-start))
+	}
+	bloom := bf.Marshal()
+	header := sstableHeader{
+		Magic:       MagicNumber,
+		Version:     version,
+		EntryCount:  uint32(len(sorted)),
+		BloomOffset: uint64(len(out)),
+		BloomSize:   uint32(len(bloom)),
+	}
+	out = append(out, bloom...)
+	header.IndexOffset = uint64(len(out))
+	out = append(out, index...)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, le, header)
+	copy(out, buf.Bytes())
+	if err := os.WriteFile(path, out, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
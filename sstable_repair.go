@@ -20,21 +20,17 @@ func RepairSSTable(inPath, outPath string, crypto *CryptoProvider) (int, error)
 	}
 	defer f.Close()
 
-	var header struct {
-		Magic       uint32
-		Version     uint32
-		EntryCount  uint32
-		IndexOffset uint64
-		BloomOffset uint64
-		BloomSize   uint32
-	}
+	var header sstableHeader
 
 	if err := binary.Read(f, binary.LittleEndian, &header); err != nil {
 		return 0, fmt.Errorf("failed to read header: %w", err)
 	}
-	if header.Magic != MagicNumber || header.Version != Version {
+	if header.Magic != MagicNumber || header.Version < sstableVersionLengthOrdered || header.Version > Version {
 		return 0, fmt.Errorf("invalid sstable header")
 	}
+	// Entries are copied in their stored order, so the output keeps the
+	// input's key order and format version.
+	version := header.Version
 
 	// We'll iterate from after header (current offset) until bloom offset.
 	startOffset, err := f.Seek(0, io.SeekCurrent)
@@ -53,6 +49,9 @@ func RepairSSTable(inPath, outPath string, crypto *CryptoProvider) (int, error)
 	if limit <= startOffset || limit > fileSize {
 		limit = fileSize
 	}
+	if version == sstableVersionBlocks {
+		return repairBlockSSTable(f, header, startOffset, limit, outPath, crypto)
+	}
 
 	// Instead of collecting all recovered entries into memory, stream them out to a temp SSTable file
 	// and build the index as we go. This avoids holding the entire dataset in memory.
@@ -65,16 +64,9 @@ func RepairSSTable(inPath, outPath string, crypto *CryptoProvider) (int, error)
 	defer func() { _ = os.Remove(tmpFile.Name()) }()
 
 	// Reserve space for the sstable header
-	header = struct {
-		Magic       uint32
-		Version     uint32
-		EntryCount  uint32
-		IndexOffset uint64
-		BloomOffset uint64
-		BloomSize   uint32
-	}{
+	header = sstableHeader{
 		Magic:   MagicNumber,
-		Version: Version,
+		Version: version,
 	}
 	if err := binary.Write(tmpFile, binary.LittleEndian, header); err != nil {
 		tmpFile.Close()
@@ -148,7 +140,7 @@ func RepairSSTable(inPath, outPath string, crypto *CryptoProvider) (int, error)
 			break
 		}
 
-		plaintext, err := crypto.Decrypt(nonce, ciphertext, buildEntryAAD(key, timestamp, expiresAt, deleted == 1))
+		plaintext, err := crypto.Decrypt(nonce, ciphertext, buildEntryAAD(key, timestamp, expiresAt, deleted))
 		if err != nil {
 			break
 		}
@@ -165,7 +157,7 @@ func RepairSSTable(inPath, outPath string, crypto *CryptoProvider) (int, error)
 		}
 
 		// Re-encrypt with current crypto provider (in case of rotation) and write entry to tmp file
-		nonce2, ciphertext2, err := crypto.Encrypt(plaintext, buildEntryAAD(key, timestamp, expiresAt, deleted == 1))
+		nonce2, ciphertext2, err := crypto.Encrypt(plaintext, buildEntryAAD(key, timestamp, expiresAt, deleted))
 		if err != nil {
 			tmpFile.Close()
 			return count, err
@@ -297,3 +289,76 @@ func RepairSSTable(inPath, outPath string, crypto *CryptoProvider) (int, error)
 
 	return count, nil
 }
+
+// repairBlockSSTable recovers the entries of a block-based SSTable by walking
+// its blocks from start up to limit, stopping at the first block that fails
+// its checksum or cannot be decoded. Recovered entries are held in memory and
+// written out with NewSSTable, which is bounded by the size of the input.
+func repairBlockSSTable(f *os.File, header sstableHeader, start, limit int64, outPath string, crypto *CryptoProvider) (int, error) {
+	data := make([]byte, limit-start)
+	if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+		return 0, err
+	}
+	var entries []*Entry
+	for pos := 0; pos < len(data); {
+		raw, size, err := decodeBlock(data[pos:], uint64(start)+uint64(pos), crypto)
+		if err != nil {
+			break
+		}
+		for rec := 0; rec < len(raw); {
+			entry, next, err := decodeBlockRecord(raw, rec)
+			if err != nil {
+				break
+			}
+			entries = append(entries, entry)
+			rec = next
+		}
+		pos += size
+	}
+	// Range tombstones survive only if the block index is still intact.
+	var rangeDels []rangeTombstone
+	if stat, err := f.Stat(); err == nil && header.IndexOffset <= uint64(stat.Size()) {
+		meta := make([]byte, header.IndexOffset)
+		if _, err := f.ReadAt(meta, 0); err == nil {
+			_, rangeDels, _ = readBlockIndex(meta, header)
+		}
+	}
+	if len(entries) == 0 && len(rangeDels) == 0 {
+		return 0, fmt.Errorf("no recoverable entries found")
+	}
+	sst, err := newSSTable(outPath, entries, rangeDels, crypto, SSTableOptions{})
+	if err != nil {
+		return 0, err
+	}
+	sst.Close()
+	return len(entries), nil
+}
+
+// RebuildManifest replaces the MANIFEST in dir with one that lists the
+// SSTable files there which pass their integrity checks, at the level their
+// names carry. Use it when the MANIFEST is lost or damaged, or to drop
+// tables that no longer load; the database must be closed. The value log
+// files each table points into are found by reading it. It returns the
+// number of tables listed.
+func RebuildManifest(dir string, crypto *CryptoProvider) (int, error) {
+	var live []manifestTable
+	scanValueLogs := hasValueLogFiles(dir)
+	for _, t := range scanSSTableFiles(dir) {
+		sst, err := loadVerifiedSSTable(filepath.Join(dir, t.Name), crypto)
+		if err != nil {
+			continue
+		}
+		if scanValueLogs {
+			if err := sst.scanValueLogRefs(); err != nil {
+				sst.Close()
+				continue
+			}
+		}
+		live = append(live, manifestTableFor(sst, t.Level))
+		sst.Close()
+	}
+	if err := writeManifestSnapshot(dir, live, crypto); err != nil {
+		return 0, err
+	}
+	return len(live), nil
+}
@@ -0,0 +1,280 @@
+package velocity
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// engineCounters are the running totals behind Stats. Tables count their
+// bloom filter probes in the counters of the database that attached them.
+type engineCounters struct {
+	flushes                atomic.Uint64
+	flushBytes             atomic.Uint64
+	compactions            atomic.Uint64
+	compactionBytesRead    atomic.Uint64
+	compactionBytesWritten atomic.Uint64
+	ingestedBytes          atomic.Uint64
+
+	bloomChecks         atomic.Uint64
+	bloomUseful         atomic.Uint64
+	bloomFalsePositives atomic.Uint64
+	scanTablesSkipped   atomic.Uint64
+}
+
+// mayContain checks the bloom filter for key and counts the probe.
+func (sst *SSTable) mayContain(key []byte) bool {
+	ok := sst.bloomFilter.Contains(key)
+	if c := sst.counters; c != nil {
+		c.bloomChecks.Add(1)
+		if !ok {
+			c.bloomUseful.Add(1)
+		}
+	}
+	return ok
+}
+
+// bloomFalsePositive counts a key the bloom filter let through that the
+// table does not hold.
+func (sst *SSTable) bloomFalsePositive() {
+	if c := sst.counters; c != nil {
+		c.bloomFalsePositives.Add(1)
+	}
+}
+
+// LevelStats describes one level of the LSM tree.
+type LevelStats struct {
+	Level           int     `json:"level"`
+	Files           int     `json:"files"`
+	Bytes           int64   `json:"bytes"`
+	Entries         int     `json:"entries"`
+	Tombstones      int     `json:"tombstones"`       // point tombstones
+	RangeTombstones int     `json:"range_tombstones"` // DeleteRange tombstones
+	Overlaps        int     `json:"overlaps"`         // files whose key range starts inside another file of the level
+	Score           float64 `json:"score"`            // compaction score; at 1 or more the level is due
+}
+
+// Stats is a point in time view of the storage engine, for tuning and
+// monitoring. Counters run from when the database was opened.
+type Stats struct {
+	Levels []LevelStats `json:"levels"`
+
+	MemTableBytes          int64 `json:"memtable_bytes"`
+	ImmutableMemTables     int   `json:"immutable_memtables"` // full memtables waiting for their flush
+	ImmutableMemTableBytes int64 `json:"immutable_memtable_bytes"`
+
+	Flushes                uint64 `json:"flushes"`
+	FlushBytes             uint64 `json:"flush_bytes"`
+	Compactions            uint64 `json:"compactions"`
+	CompactionBytesRead    uint64 `json:"compaction_bytes_read"`
+	CompactionBytesWritten uint64 `json:"compaction_bytes_written"`
+	IngestedBytes          uint64 `json:"ingested_bytes"`
+	// WriteAmplification is the bytes written to SSTables by flushes,
+	// compactions and ingestion per byte flushed or ingested.
+	WriteAmplification float64 `json:"write_amplification"`
+
+	// CompactionBacklog is the number of levels due for compaction, and
+	// PendingCompactionBytes how far they are over their targets.
+	CompactionBacklog      int   `json:"compaction_backlog"`
+	PendingCompactionBytes int64 `json:"pending_compaction_bytes"`
+
+	// Bloom filter probes of point reads. Useful probes ruled a table out;
+	// false positives let a read into a table that did not hold the key.
+	BloomChecks            uint64  `json:"bloom_checks"`
+	BloomUseful            uint64  `json:"bloom_useful"`
+	BloomFalsePositives    uint64  `json:"bloom_false_positives"`
+	BloomFalsePositiveRate float64 `json:"bloom_false_positive_rate"`
+	// ScanTablesSkipped counts the SSTables scans left out because their
+	// key range or prefix bloom filter excluded the scanned range.
+	ScanTablesSkipped uint64 `json:"scan_tables_skipped"`
+
+	Tombstones      int `json:"tombstones"`       // point tombstones in SSTables
+	RangeTombstones int `json:"range_tombstones"` // range tombstones in SSTables
+
+	BlockCache        BlockCacheStats `json:"block_cache"`
+	BlockCacheHitRate float64         `json:"block_cache_hit_rate"`
+	TableCache        TableCacheStats `json:"table_cache"`
+	WriteStalls       WriteStallStats `json:"write_stalls"`
+	ValueLog          ValueLogStats   `json:"value_log"`
+	WAL               WALStats        `json:"wal"`
+}
+
+// Stats returns the state of the storage engine: the shape of the LSM tree,
+// the memtables, flush and compaction totals, bloom filter and cache
+// effectiveness, and write stalls. Column families report their own Stats.
+func (db *DB) Stats() Stats {
+	c := &db.counters
+	stats := Stats{
+		Flushes:                c.flushes.Load(),
+		FlushBytes:             c.flushBytes.Load(),
+		Compactions:            c.compactions.Load(),
+		CompactionBytesRead:    c.compactionBytesRead.Load(),
+		CompactionBytesWritten: c.compactionBytesWritten.Load(),
+		IngestedBytes:          c.ingestedBytes.Load(),
+		BloomChecks:            c.bloomChecks.Load(),
+		BloomUseful:            c.bloomUseful.Load(),
+		BloomFalsePositives:    c.bloomFalsePositives.Load(),
+		ScanTablesSkipped:      c.scanTablesSkipped.Load(),
+		BlockCache:             db.BlockCacheStats(),
+		TableCache:             db.TableCacheStats(),
+		WriteStalls:            db.WriteStallStats(),
+		ValueLog:               db.ValueLogStats(),
+		WAL:                    db.WALStats(),
+	}
+	if in := stats.FlushBytes + stats.IngestedBytes; in > 0 {
+		stats.WriteAmplification = float64(in+stats.CompactionBytesWritten) / float64(in)
+	}
+	if absent := stats.BloomUseful + stats.BloomFalsePositives; absent > 0 {
+		stats.BloomFalsePositiveRate = float64(stats.BloomFalsePositives) / float64(absent)
+	}
+	stats.BlockCacheHitRate = stats.BlockCache.HitRate()
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.memTable != nil {
+		stats.MemTableBytes = db.memTable.Size()
+	}
+	stats.ImmutableMemTables = len(db.flushingMemTables)
+	for _, mt := range db.flushingMemTables {
+		stats.ImmutableMemTableBytes += mt.Size()
+	}
+	for level, tables := range db.levels {
+		ls := LevelStats{
+			Level:    level,
+			Files:    len(tables),
+			Bytes:    levelSize(tables),
+			Overlaps: overlappingTables(tables),
+		}
+		for _, sst := range tables {
+			ls.Entries += sst.entryCount
+			ls.Tombstones += sst.tombstones
+			ls.RangeTombstones += len(sst.rangeDels)
+		}
+		if level < MaxLevels-1 {
+			ls.Score = db.levelScoreLocked(level)
+		}
+		if ls.Score >= 1 {
+			stats.CompactionBacklog++
+			if level == 0 {
+				stats.PendingCompactionBytes += ls.Bytes
+			} else {
+				stats.PendingCompactionBytes += ls.Bytes - levelMaxBytes(level)
+			}
+		}
+		stats.Tombstones += ls.Tombstones
+		stats.RangeTombstones += ls.RangeTombstones
+		stats.Levels = append(stats.Levels, ls)
+	}
+	return stats
+}
+
+// overlappingTables counts the tables whose key range starts inside the
+// range of another table of the same level.
+func overlappingTables(tables []*SSTable) int {
+	sorted := append([]*SSTable(nil), tables...)
+	sort.Slice(sorted, func(i, j int) bool { return compareKeys(sorted[i].minKey, sorted[j].minKey) < 0 })
+	n := 0
+	var maxKey []byte
+	for i, sst := range sorted {
+		if i > 0 && compareKeys(sst.minKey, maxKey) <= 0 {
+			n++
+		}
+		if i == 0 || compareKeys(sst.maxKey, maxKey) > 0 {
+			maxKey = sst.maxKey
+		}
+	}
+	return n
+}
+
+// Property returns one engine statistic by name, and false if the name is
+// unknown. Level properties take the level number as a suffix, as in
+// "velocity.num-files-at-level0". "velocity.stats" returns a readable
+// summary of all of them.
+//
+//	velocity.num-files-at-level<N>        velocity.bytes-at-level<N>
+//	velocity.overlaps-at-level<N>         velocity.tombstones-at-level<N>
+//	velocity.compaction-score-at-level<N> velocity.num-tombstones
+//	velocity.num-range-tombstones         velocity.cur-size-active-mem-table
+//	velocity.num-immutable-mem-table      velocity.size-immutable-mem-tables
+//	velocity.write-amplification          velocity.compaction-backlog
+//	velocity.estimate-pending-compaction-bytes
+//	velocity.bloom-false-positive-rate    velocity.block-cache-hit-ratio
+//	velocity.num-open-tables              velocity.stats
+func (db *DB) Property(name string) (string, bool) {
+	stats := db.Stats()
+	if name == "velocity.stats" {
+		return stats.String(), true
+	}
+	for _, p := range []struct {
+		prefix string
+		value  func(LevelStats) string
+	}{
+		{"velocity.num-files-at-level", func(ls LevelStats) string { return strconv.Itoa(ls.Files) }},
+		{"velocity.bytes-at-level", func(ls LevelStats) string { return strconv.FormatInt(ls.Bytes, 10) }},
+		{"velocity.overlaps-at-level", func(ls LevelStats) string { return strconv.Itoa(ls.Overlaps) }},
+		{"velocity.tombstones-at-level", func(ls LevelStats) string { return strconv.Itoa(ls.Tombstones) }},
+		{"velocity.compaction-score-at-level", func(ls LevelStats) string { return formatRatio(ls.Score) }},
+	} {
+		if rest, ok := strings.CutPrefix(name, p.prefix); ok {
+			level, err := strconv.Atoi(rest)
+			if err != nil || level < 0 || level >= len(stats.Levels) {
+				return "", false
+			}
+			return p.value(stats.Levels[level]), true
+		}
+	}
+	switch name {
+	case "velocity.num-tombstones":
+		return strconv.Itoa(stats.Tombstones), true
+	case "velocity.num-range-tombstones":
+		return strconv.Itoa(stats.RangeTombstones), true
+	case "velocity.cur-size-active-mem-table":
+		return strconv.FormatInt(stats.MemTableBytes, 10), true
+	case "velocity.num-immutable-mem-table":
+		return strconv.Itoa(stats.ImmutableMemTables), true
+	case "velocity.size-immutable-mem-tables":
+		return strconv.FormatInt(stats.ImmutableMemTableBytes, 10), true
+	case "velocity.write-amplification":
+		return formatRatio(stats.WriteAmplification), true
+	case "velocity.compaction-backlog":
+		return strconv.Itoa(stats.CompactionBacklog), true
+	case "velocity.estimate-pending-compaction-bytes":
+		return strconv.FormatInt(stats.PendingCompactionBytes, 10), true
+	case "velocity.bloom-false-positive-rate":
+		return formatRatio(stats.BloomFalsePositiveRate), true
+	case "velocity.block-cache-hit-ratio":
+		return formatRatio(stats.BlockCacheHitRate), true
+	case "velocity.num-open-tables":
+		return strconv.Itoa(stats.TableCache.Open), true
+	}
+	return "", false
+}
+
+func formatRatio(f float64) string {
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+// String formats the stats as a readable report, one level per row.
+func (s Stats) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-5s %7s %12s %10s %10s %8s %8s %7s\n", "Level", "Files", "Bytes", "Entries", "Tombstones", "RangeDel", "Overlaps", "Score")
+	for _, ls := range s.Levels {
+		fmt.Fprintf(&sb, "L%-4d %7d %12d %10d %10d %8d %8d %7.2f\n",
+			ls.Level, ls.Files, ls.Bytes, ls.Entries, ls.Tombstones, ls.RangeTombstones, ls.Overlaps, ls.Score)
+	}
+	fmt.Fprintf(&sb, "Memtable: %d bytes; %d immutable (%d bytes)\n", s.MemTableBytes, s.ImmutableMemTables, s.ImmutableMemTableBytes)
+	fmt.Fprintf(&sb, "Flushes: %d (%d bytes); compactions: %d (read %d, wrote %d bytes); ingested: %d bytes\n",
+		s.Flushes, s.FlushBytes, s.Compactions, s.CompactionBytesRead, s.CompactionBytesWritten, s.IngestedBytes)
+	fmt.Fprintf(&sb, "Write amplification: %.2f; compaction backlog: %d levels, %d bytes pending\n",
+		s.WriteAmplification, s.CompactionBacklog, s.PendingCompactionBytes)
+	fmt.Fprintf(&sb, "Bloom filters: %d checks, %d useful, %d false positives (rate %.4f); %d tables skipped by scans\n",
+		s.BloomChecks, s.BloomUseful, s.BloomFalsePositives, s.BloomFalsePositiveRate, s.ScanTablesSkipped)
+	fmt.Fprintf(&sb, "Block cache: %d hits, %d misses (hit rate %.4f), %d of %d bytes; open tables: %d of %d\n",
+		s.BlockCache.Hits, s.BlockCache.Misses, s.BlockCacheHitRate, s.BlockCache.Bytes, s.BlockCache.Capacity, s.TableCache.Open, s.TableCache.Capacity)
+	fmt.Fprintf(&sb, "Write stalls: %d delayed, %d stopped, %s stalled\n", s.WriteStalls.Delayed, s.WriteStalls.Stopped, s.WriteStalls.StallTime)
+	fmt.Fprintf(&sb, "Value log: %d files, %d bytes, %d garbage\n", s.ValueLog.Files, s.ValueLog.Bytes, s.ValueLog.Garbage)
+	fmt.Fprintf(&sb, "WAL: %d syncs, %d bytes; %d group commits for %d writes\n", s.WAL.Syncs, s.WAL.BytesWritten, s.WAL.GroupCommits, s.WAL.GroupedWrites)
+	return sb.String()
+}
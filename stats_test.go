@@ -0,0 +1,79 @@
+package velocity
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStatsReportLevelsAndCounters(t *testing.T) {
+	db := newCompactionTestDB(t)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			db.Put([]byte(fmt.Sprintf("st:%03d", i)), []byte(fmt.Sprintf("value-%d-%d", round, i)))
+		}
+		db.Delete([]byte(fmt.Sprintf("st:%03d", 10+round)))
+		if err := db.flushMemTable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := db.Stats()
+	if stats.Flushes != 2 || stats.Levels[0].Files != 2 || stats.Levels[0].Overlaps != 1 || stats.Levels[0].Tombstones != 2 {
+		t.Fatalf("unexpected level 0 after two flushes: %+v", stats)
+	}
+
+	db.compactLevel(0)
+	for i := 0; i < 20; i++ {
+		db.Get([]byte(fmt.Sprintf("missing:%d", i)))
+	}
+	stats = db.Stats()
+	if stats.Compactions != 1 || stats.Levels[0].Files != 0 || stats.Levels[1].Files == 0 || stats.Levels[1].Overlaps != 0 {
+		t.Fatalf("unexpected levels after compaction: %+v", stats.Levels)
+	}
+	if stats.WriteAmplification <= 1 || stats.CompactionBytesRead == 0 {
+		t.Fatalf("expected compaction to add to write amplification, got %+v", stats)
+	}
+	if stats.BloomChecks < 20 || stats.BloomUseful+stats.BloomFalsePositives < 20 {
+		t.Fatalf("expected the missing keys to be checked against the bloom filters, got %+v", stats)
+	}
+
+	for name, want := range map[string]string{
+		"velocity.num-files-at-level0":     "0",
+		"velocity.num-files-at-level1":     fmt.Sprint(stats.Levels[1].Files),
+		"velocity.num-immutable-mem-table": "0",
+	} {
+		if got, ok := db.Property(name); !ok || got != want {
+			t.Fatalf("%s: got %q (%v), want %q", name, got, ok, want)
+		}
+	}
+	if _, ok := db.Property("velocity.num-files-at-level99"); ok {
+		t.Fatal("expected an unknown level to be rejected")
+	}
+	if report, ok := db.Property("velocity.stats"); !ok || !strings.Contains(report, "Write amplification") {
+		t.Fatalf("unexpected stats report: %q", report)
+	}
+}
+
+func TestMetricsExportEngineStats(t *testing.T) {
+	db := newCompactionTestDB(t)
+	db.Put([]byte("m:1"), []byte("v"))
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	mc := NewMetricsCollector()
+	mc.UpdateGauges(db, nil, nil, nil)
+	out := mc.RenderMetrics()
+	for _, want := range []string{
+		"# TYPE velocity_lsm_level_files gauge",
+		`velocity_lsm_level_files{level="0"} 1`,
+		"velocity_flushes_total 1",
+		"velocity_write_amplification 1\n",
+		"velocity_bloom_false_positive_rate 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in the metrics:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package velocity
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+var (
+	// ErrTxnConflict is returned when a transaction read or wrote a key that
+	// another writer committed after the transaction began. The caller should
+	// retry the whole transaction.
+	ErrTxnConflict = errors.New("transaction conflict")
+	// ErrTxnDone is returned when a committed or rolled back transaction is
+	// used again.
+	ErrTxnDone = errors.New("transaction already committed or rolled back")
+	// ErrTxnReadOnly is returned when a View transaction attempts a write.
+	ErrTxnReadOnly = errors.New("transaction is read-only")
+)
+
+// Txn is a multi-key transaction with snapshot isolation. Reads observe the
+// database as of Begin, through a pinned Snapshot, and see the transaction's
+// own pending writes. Writes are buffered and, on Commit, validated against
+// every key the transaction touched; if any of them was committed by someone
+// else in the meantime the commit fails with ErrTxnConflict. A successful
+// commit is written to the WAL as one atomic record, so recovery replays all
+// of it or none of it.
+//
+// A Txn is not safe for concurrent use by multiple goroutines.
+type Txn struct {
+	db     *DB
+	readTs uint64
+	update bool
+	done   bool
+
+	writes map[string]*Entry
+	order  []string // keys in first-write order, for deterministic commits
+	reads  map[string]struct{}
+}
+
+// Begin starts a read-write transaction. Callers must finish it with Commit
+// or Rollback.
+func (db *DB) Begin() *Txn {
+	return db.newTxn(true)
+}
+
+// BeginReadOnly starts a transaction that can only read.
+func (db *DB) BeginReadOnly() *Txn {
+	return db.newTxn(false)
+}
+
+func (db *DB) newTxn(update bool) *Txn {
+	return &Txn{
+		db:     db,
+		readTs: db.pinSnapshot(),
+		update: update,
+		writes: make(map[string]*Entry),
+		reads:  make(map[string]struct{}),
+	}
+}
+
+// Update runs fn inside a read-write transaction and commits it if fn returns
+// nil. Any error from fn rolls the transaction back and is returned as is.
+func (db *DB) Update(fn func(tx *Txn) error) error {
+	txn := db.Begin()
+	defer txn.Rollback()
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// View runs fn inside a read-only transaction.
+func (db *DB) View(fn func(tx *Txn) error) error {
+	txn := db.BeginReadOnly()
+	defer txn.Rollback()
+	return fn(txn)
+}
+
+// Get returns the value of key as seen by the transaction.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	if pending, ok := txn.writes[string(key)]; ok {
+		if pending.Deleted {
+			return nil, fmt.Errorf("key not found")
+		}
+		return append([]byte(nil), pending.Value...), nil
+	}
+
+	txn.db.mutex.RLock()
+	entry, err := txn.db.getAtLocked(key, txn.readTs)
+	txn.db.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if txn.update {
+		txn.reads[string(key)] = struct{}{}
+	}
+	if !entryVisible(entry) {
+		return nil, fmt.Errorf("key not found")
+	}
+	return append([]byte(nil), entry.Value...), nil
+}
+
+// Put buffers a write of key. It becomes visible to other readers on Commit.
+func (txn *Txn) Put(key, value []byte) error {
+	return txn.set(key, value, 0, false)
+}
+
+// PutWithTTL buffers a write of key that expires ttl after commit time. If
+// ttl <= 0 the key will not expire.
+func (txn *Txn) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	var expiresAt uint64
+	if ttl > 0 {
+		expiresAt = uint64(time.Now().Add(ttl).UnixNano())
+	}
+	return txn.set(key, value, expiresAt, false)
+}
+
+// Delete buffers a delete of key.
+func (txn *Txn) Delete(key []byte) error {
+	return txn.set(key, nil, 0, true)
+}
+
+func (txn *Txn) set(key, value []byte, expiresAt uint64, deleted bool) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if !txn.update {
+		return ErrTxnReadOnly
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("empty key")
+	}
+	if isIndexKey(key) {
+		return fmt.Errorf("reserved index key prefix")
+	}
+	keyStr := string(key)
+	if _, ok := txn.writes[keyStr]; !ok {
+		txn.order = append(txn.order, keyStr)
+	}
+	txn.writes[keyStr] = &Entry{
+		Key:       append([]byte(nil), key...),
+		Value:     append([]byte(nil), value...),
+		ExpiresAt: expiresAt,
+		Deleted:   deleted,
+	}
+	return nil
+}
+
+// Len reports the number of distinct keys written by the transaction.
+func (txn *Txn) Len() int {
+	return len(txn.order)
+}
+
+// Rollback discards the transaction. It is safe to call after Commit, which
+// makes `defer txn.Rollback()` the idiomatic cleanup.
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.writes = nil
+	txn.order = nil
+	txn.reads = nil
+	txn.db.unpinSnapshot(txn.readTs)
+}
+
+// Commit validates and applies the transaction's writes atomically.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	defer txn.db.unpinSnapshot(txn.readTs)
+	if len(txn.order) == 0 {
+		return nil
+	}
+
+	db := txn.db
+	db.mutex.Lock()
+	if err := db.makeRoomForWriteLocked(); err != nil {
+		db.mutex.Unlock()
+		return err
+	}
+	if err := txn.checkConflictsLocked(); err != nil {
+		db.mutex.Unlock()
+		return err
+	}
+
+	commitTs := nextEntryTimestamp()
+	entries := make([]*Entry, 0, len(txn.order))
+	for _, keyStr := range txn.order {
+		e := txn.writes[keyStr]
+		e.Timestamp = commitTs
+		if e.Deleted {
+			e.Value = nil
+			e.checksum = crc32.ChecksumIEEE(e.Key)
+		} else {
+			e.checksum = crc32.Update(crc32.ChecksumIEEE(e.Key), crc32.IEEETable, e.Value)
+		}
+		entries = append(entries, e)
+	}
+
+	var commit *walGroup
+	if !db.disableWAL {
+		if db.wal == nil {
+			db.mutex.Unlock()
+			return fmt.Errorf("WAL is not initialized")
+		}
+		var err error
+		if commit, err = db.wal.appendAtomic([]walBatchGroup{{wal: db.wal, entries: entries}}); err != nil {
+			db.mutex.Unlock()
+			return err
+		}
+	}
+
+	// The commit is synced without db.mutex, so concurrent commits share
+	// the sync, and applied once it is.
+	write := db.queueWriteLocked(commit, entries, true)
+	db.mutex.Unlock()
+	err := db.awaitWrite(write)
+	if err == nil || write.applied {
+		db.publishCommitted(entries)
+	}
+	return err
+}
+
+// applyCommittedLocked applies entries already written to the WAL to the
+// memtable and cache, and to the search indexes if index is set. It returns
+// the first indexing error. Callers hold db.mutex.
+func (db *DB) applyCommittedLocked(entries []*Entry, index bool) error {
+	var indexErr error
+	for _, e := range entries {
+		db.memTable.PutEntry(e)
+		if db.cache != nil {
+			if e.Deleted {
+				db.cache.Remove(string(e.Key))
+			} else {
+				db.cache.Put(string(e.Key), append([]byte{}, e.Value...))
+			}
+		}
+		if !index || !db.searchIndexEnabled {
+			continue
+		}
+		var err error
+		if e.Deleted {
+			err = db.unindexKeyLocked(e.Key)
+		} else if prefix, schema := db.schemaForKeyLocked(e.Key); schema != nil {
+			err = db.indexEntryLocked(e.Key, e.Value, prefix, schema)
+		}
+		if err != nil && indexErr == nil {
+			indexErr = err
+		}
+	}
+
+	if db.memTable.Size() > db.memTableSize {
+		db.scheduleFlush()
+	}
+	return indexErr
+}
+
+// publishCommitted notifies watchers and the knowledge graph of committed
+// entries.
+func (db *DB) publishCommitted(entries []*Entry) {
+	for _, e := range entries {
+		if e.Deleted {
+			db.publishDelete(e.Key, e.Timestamp)
+			db.kgAutoDeleteKV(e.Key)
+			continue
+		}
+		db.publishPut(e.Key, e.Value, e.Timestamp)
+		db.kgAutoIndexKV(e.Key, e.Value)
+	}
+}
+
+// checkConflictsLocked fails if any key the transaction read or wrote has a
+// version committed after readTs.
+func (txn *Txn) checkConflictsLocked() error {
+	check := func(keyStr string) error {
+		entry, err := txn.db.latestEntryLocked([]byte(keyStr))
+		if err != nil {
+			return err
+		}
+		if entry != nil && entry.Timestamp > txn.readTs {
+			return ErrTxnConflict
+		}
+		if txn.db.pendingKeys[keyStr] > txn.readTs {
+			return ErrTxnConflict
+		}
+		return nil
+	}
+	for keyStr := range txn.reads {
+		if err := check(keyStr); err != nil {
+			return err
+		}
+	}
+	for _, keyStr := range txn.order {
+		if _, ok := txn.reads[keyStr]; ok {
+			continue
+		}
+		if err := check(keyStr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestEntryLocked returns the newest stored version of key, including
+// tombstones and expired entries, bypassing the value cache. It returns nil if
+// the key has never been written. A range tombstone newer than the stored
+// version is reported as a tombstone, and merge operands are folded into the
+// value they apply to.
+func (db *DB) latestEntryLocked(key []byte) (*Entry, error) {
+	entry, err := db.latestStoredEntryLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	entry = db.applyRangeDeletesLocked(key, entry, ^uint64(0))
+	if entry != nil && entry.kind == entryKindMerge {
+		return db.resolveMergeLocked(key, ^uint64(0))
+	}
+	return entry, nil
+}
+
+// latestStoredEntryLocked is latestEntryLocked without range tombstones.
+func (db *DB) latestStoredEntryLocked(key []byte) (*Entry, error) {
+	if entry := db.memTable.Get(key); entry != nil {
+		return entry, nil
+	}
+	for i := len(db.flushingMemTables) - 1; i >= 0; i-- {
+		if entry := db.flushingMemTables[i].Get(key); entry != nil {
+			return entry, nil
+		}
+	}
+	for level := 0; level < len(db.levels); level++ {
+		sstables := db.levels[level]
+		for i := len(sstables) - 1; i >= 0; i-- {
+			entry, err := sstables[i].Get(key)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				return entry, nil
+			}
+		}
+	}
+	return nil, nil
+}
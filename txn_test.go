@@ -0,0 +1,266 @@
+package velocity
+
+import (
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTxnCommitIsAtomicAndVisible(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("acct:a"), []byte("100")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("acct:b"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *Txn) error {
+		a, err := tx.Get([]byte("acct:a"))
+		if err != nil {
+			return err
+		}
+		if string(a) != "100" {
+			t.Fatalf("expected 100, got %s", a)
+		}
+		if err := tx.Put([]byte("acct:a"), []byte("60")); err != nil {
+			return err
+		}
+		if err := tx.Put([]byte("acct:b"), []byte("40")); err != nil {
+			return err
+		}
+		// Own writes are visible inside the transaction only.
+		if v, err := tx.Get([]byte("acct:b")); err != nil || string(v) != "40" {
+			t.Fatalf("expected pending write 40, got %q (%v)", v, err)
+		}
+		if v, _ := db.Get([]byte("acct:b")); string(v) != "0" {
+			t.Fatalf("uncommitted write leaked: %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	for key, want := range map[string]string{"acct:a": "60", "acct:b": "40"} {
+		v, err := db.Get([]byte(key))
+		if err != nil || string(v) != want {
+			t.Fatalf("%s: expected %s, got %q (%v)", key, want, v, err)
+		}
+	}
+}
+
+func TestTxnConflictOnConcurrentWrite(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("counter"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	defer tx.Rollback()
+	if _, err := tx.Get([]byte("counter")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put([]byte("counter"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer commits first.
+	if err := db.Put([]byte("counter"), []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); !errors.Is(err, ErrTxnConflict) {
+		t.Fatalf("expected ErrTxnConflict, got %v", err)
+	}
+	v, _ := db.Get([]byte("counter"))
+	if string(v) != "5" {
+		t.Fatalf("conflicting commit must not apply, got %s", v)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("expected ErrTxnDone on reuse, got %v", err)
+	}
+}
+
+func TestTxnReadOnlyRejectsWrites(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *Txn) error {
+		return tx.Put([]byte("k"), []byte("v"))
+	})
+	if !errors.Is(err, ErrTxnReadOnly) {
+		t.Fatalf("expected ErrTxnReadOnly, got %v", err)
+	}
+}
+
+func TestTxnReplayedFromWAL(t *testing.T) {
+	path := t.TempDir()
+	db, err := NewWithConfig(Config{Path: path, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("gone"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *Txn) error {
+		if err := tx.Put([]byte("k1"), []byte("v1")); err != nil {
+			return err
+		}
+		if err := tx.Put([]byte("k2"), []byte("v2")); err != nil {
+			return err
+		}
+		return tx.Delete([]byte("gone"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	for key, want := range map[string]string{"k1": "v1", "k2": "v2"} {
+		v, err := db2.Get([]byte(key))
+		if err != nil || string(v) != want {
+			t.Fatalf("%s: expected %s after replay, got %q (%v)", key, want, v, err)
+		}
+	}
+	if _, err := db2.Get([]byte("gone")); err == nil {
+		t.Fatal("expected transactional delete to survive replay")
+	}
+}
+
+func TestWALReplayDropsTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	crypto, _ := newCryptoProvider(make([]byte, 32))
+	wal, err := NewWAL(walPath, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Write(&Entry{Key: []byte("before"), Value: []byte("ok"), Timestamp: 1, checksum: crc32Of("before", "ok")}); err != nil {
+		t.Fatal(err)
+	}
+	batch := []*Entry{
+		{Key: []byte("a"), Value: []byte("1"), Timestamp: 2, checksum: crc32Of("a", "1")},
+		{Key: []byte("b"), Value: []byte("2"), Timestamp: 2, checksum: crc32Of("b", "2")},
+	}
+	if err := wal.WriteAtomic(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing the batch.
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(walPath, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	wal2, err := NewWAL(walPath, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal2.Close()
+	entries, err := wal2.Replay()
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(entries) != 1 || string(entries[0].Key) != "before" {
+		t.Fatalf("expected only the record before the torn batch, got %d entries", len(entries))
+	}
+}
+
+func crc32Of(key, value string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key + value))
+}
+
+func TestTxnCommitSyncsWithoutHoldingTheDB(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("other"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the log as if a sync were in flight, so the commit waits for it.
+	w := db.wal
+	w.mutex.Lock()
+	w.syncing = true
+	w.mutex.Unlock()
+	release := func() {
+		w.mutex.Lock()
+		w.syncing = false
+		w.synced.Broadcast()
+		w.mutex.Unlock()
+	}
+
+	committed := make(chan error, 1)
+	go func() {
+		committed <- db.Update(func(tx *Txn) error {
+			return tx.Put([]byte("k"), []byte("v"))
+		})
+	}()
+	for {
+		w.mutex.Lock()
+		waiting := w.pending != nil
+		w.mutex.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := db.Get([]byte("other"))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		release()
+		t.Fatal("expected reads to go on while a commit waits for its sync")
+	}
+	if _, err := db.Get([]byte("k")); err == nil {
+		t.Fatal("expected the commit to be unreadable before its sync")
+	}
+
+	release()
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get([]byte("k")); err != nil || string(v) != "v" {
+		t.Fatalf("expected the commit to be readable, got %q (%v)", v, err)
+	}
+}
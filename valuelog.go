@@ -0,0 +1,550 @@
+package velocity
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultValueLogGCRatio is the share of a value log file that must be
+// garbage before compaction moves its live values elsewhere.
+const DefaultValueLogGCRatio = 0.5
+
+// valueLogStatsName holds the garbage counts of the value log files of a
+// directory. They only steer garbage collection; losing them delays it.
+const valueLogStatsName = "VALUELOG"
+
+var valueLogMagic = [8]byte{'V', 'L', 'O', 'G', 0, 0, 0, 1}
+
+// valuePointerSize is the size of the location an SSTable stores in place
+// of a separated value: file id, record offset and record size.
+const valuePointerSize = 20
+
+// valuePointer locates a value log record.
+type valuePointer struct {
+	file   uint64
+	offset uint64
+	size   uint32
+}
+
+func (p valuePointer) encode() []byte {
+	buf := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint64(buf[0:], p.file)
+	binary.LittleEndian.PutUint64(buf[8:], p.offset)
+	binary.LittleEndian.PutUint32(buf[16:], p.size)
+	return buf
+}
+
+func decodeValuePointer(data []byte) (valuePointer, error) {
+	if len(data) != valuePointerSize {
+		return valuePointer{}, fmt.Errorf("velocity: malformed value pointer")
+	}
+	return valuePointer{
+		file:   binary.LittleEndian.Uint64(data[0:]),
+		offset: binary.LittleEndian.Uint64(data[8:]),
+		size:   binary.LittleEndian.Uint32(data[16:]),
+	}, nil
+}
+
+// valueLog stores large values outside the LSM tree. Flushes and
+// compactions append them to new files, vlog_<id>.vlog, which never change
+// once written; the SSTables hold pointers to them. A file is removed when
+// the last table that points into it is, and compaction counts the bytes it
+// drops as garbage, moving the live values of mostly-garbage files into new
+// ones so the old files can go.
+type valueLog struct {
+	dir       string
+	crypto    *CryptoProvider
+	threshold int
+	gcRatio   float64
+
+	mu    sync.Mutex
+	files map[uint64]*valueLogFile
+}
+
+// valueLogFile is a value log file that tables point into.
+type valueLogFile struct {
+	file    *os.File // opened on first read
+	size    int64
+	garbage int64
+	refs    int
+}
+
+func newValueLog(dir string, crypto *CryptoProvider, threshold int, gcRatio float64) *valueLog {
+	if gcRatio <= 0 {
+		gcRatio = DefaultValueLogGCRatio
+	}
+	return &valueLog{
+		dir:       dir,
+		crypto:    crypto,
+		threshold: threshold,
+		gcRatio:   gcRatio,
+		files:     make(map[uint64]*valueLogFile),
+	}
+}
+
+func valueLogFileName(id uint64) string {
+	return fmt.Sprintf("vlog_%d.vlog", id)
+}
+
+func isValueLogName(name string) bool {
+	_, ok := valueLogFileID(name)
+	return ok
+}
+
+// valueLogFileID parses the id from a value log file name.
+func valueLogFileID(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "vlog_") || filepath.Ext(name) != ".vlog" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name[5:], ".vlog"), 10, 64)
+	return id, err == nil
+}
+
+// separates reports whether e is written to the value log.
+func (v *valueLog) separates(e *Entry) bool {
+	return v != nil && v.threshold > 0 && e.kind == entryKindValue && !e.Deleted && len(e.Value) >= v.threshold
+}
+
+// valueLogWriter appends the values of one flush or compaction to a new
+// value log file.
+type valueLogWriter struct {
+	log  *valueLog
+	id   uint64
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// newWriter creates a value log file.
+func (v *valueLog) newWriter() (*valueLogWriter, error) {
+	for {
+		id := uint64(time.Now().UnixNano())
+		f, err := os.OpenFile(filepath.Join(v.dir, valueLogFileName(id)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		w := &valueLogWriter{log: v, id: id, file: f, w: bufio.NewWriterSize(f, 64*1024)}
+		if _, err := w.w.Write(valueLogMagic[:]); err != nil {
+			w.abort()
+			return nil, err
+		}
+		w.size = int64(len(valueLogMagic))
+		return w, nil
+	}
+}
+
+// add appends the value of e and returns the pointer record that replaces
+// it in an SSTable.
+func (w *valueLogWriter) add(e *Entry) (*Entry, error) {
+	nonce, sealed, err := w.log.crypto.Encrypt(e.Value, buildValueLogAAD(e.Key, e.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+	body := binary.LittleEndian.AppendUint16(make([]byte, 0, 2+len(nonce)+len(sealed)), uint16(len(nonce)))
+	body = append(append(body, nonce...), sealed...)
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(body)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(body))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.w.Write(body); err != nil {
+		return nil, err
+	}
+	ptr := valuePointer{file: w.id, offset: uint64(w.size), size: uint32(len(header) + len(body))}
+	w.size += int64(ptr.size)
+
+	p := &Entry{
+		Key:       e.Key,
+		Value:     ptr.encode(),
+		Timestamp: e.Timestamp,
+		ExpiresAt: e.ExpiresAt,
+		kind:      entryKindValuePointer,
+	}
+	p.checksum = crc32.Update(crc32.ChecksumIEEE(p.Key), crc32.IEEETable, p.Value)
+	return p, nil
+}
+
+// finish makes the file durable and registers it, so tables written with
+// its pointers can be attached.
+func (w *valueLogWriter) finish() error {
+	err := w.w.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = syncDir(w.log.dir)
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	w.log.mu.Lock()
+	w.log.files[w.id] = &valueLogFile{size: w.size}
+	w.log.mu.Unlock()
+	return nil
+}
+
+// abort removes the file, whether or not it was finished.
+func (w *valueLogWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+	w.log.mu.Lock()
+	if f := w.log.files[w.id]; f != nil && f.refs == 0 {
+		delete(w.log.files, w.id)
+	}
+	w.log.mu.Unlock()
+}
+
+// attach makes sst read its values from v and keeps the files it points
+// into until it is destroyed.
+func (v *valueLog) attach(sst *SSTable) {
+	sst.values = v
+	if len(sst.valueLogs) == 0 {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, id := range sst.valueLogs {
+		f := v.files[id]
+		if f == nil {
+			f = &valueLogFile{}
+			if info, err := os.Stat(filepath.Join(v.dir, valueLogFileName(id))); err == nil {
+				f.size = info.Size()
+			} else {
+				log.Printf("velocity: WARN: value log file %s: %v", valueLogFileName(id), err)
+			}
+			v.files[id] = f
+		}
+		f.refs++
+	}
+}
+
+// release drops the references of a destroyed table and removes the files
+// no table points into any more.
+func (v *valueLog) release(ids []uint64) {
+	if len(ids) == 0 {
+		return
+	}
+	v.mu.Lock()
+	var removed bool
+	for _, id := range ids {
+		f := v.files[id]
+		if f == nil {
+			continue
+		}
+		if f.refs--; f.refs > 0 {
+			continue
+		}
+		if f.file != nil {
+			f.file.Close()
+		}
+		delete(v.files, id)
+		if err := os.Remove(filepath.Join(v.dir, valueLogFileName(id))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("velocity: WARN: cannot remove value log file %s: %v", valueLogFileName(id), err)
+		}
+		removed = true
+	}
+	v.mu.Unlock()
+	if removed {
+		v.saveStats()
+	}
+}
+
+// resolve returns e, a pointer record, with the value it points to.
+func (v *valueLog) resolve(e *Entry) (*Entry, error) {
+	if v == nil {
+		return nil, fmt.Errorf("velocity: value of key %q is in a value log that is not open", e.Key)
+	}
+	ptr, err := decodeValuePointer(e.Value)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	f := v.files[ptr.file]
+	var file *os.File
+	if f != nil {
+		if f.file == nil {
+			f.file, err = os.Open(filepath.Join(v.dir, valueLogFileName(ptr.file)))
+		}
+		file = f.file
+	}
+	v.mu.Unlock()
+	if f == nil {
+		return nil, fmt.Errorf("velocity: value log file %s of key %q is not live", valueLogFileName(ptr.file), e.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, ptr.size)
+	if _, err := file.ReadAt(record, int64(ptr.offset)); err != nil {
+		return nil, fmt.Errorf("velocity: value log %s at %d: %w", valueLogFileName(ptr.file), ptr.offset, err)
+	}
+	body := record[8:]
+	if ptr.size < 10 || int(binary.LittleEndian.Uint32(record[:4])) != len(body) ||
+		crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(record[4:8]) {
+		return nil, fmt.Errorf("velocity: corrupt value log record in %s at %d", valueLogFileName(ptr.file), ptr.offset)
+	}
+	n := 2 + int(binary.LittleEndian.Uint16(body))
+	if n > len(body) {
+		return nil, fmt.Errorf("velocity: corrupt value log record in %s at %d", valueLogFileName(ptr.file), ptr.offset)
+	}
+	value, err := v.crypto.Decrypt(body[2:n], body[n:], buildValueLogAAD(e.Key, e.Timestamp))
+	if err != nil {
+		return nil, fmt.Errorf("velocity: value log record of key %q: %w", e.Key, err)
+	}
+	resolved := &Entry{Key: e.Key, Value: value, Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt}
+	resolved.checksum = crc32.Update(crc32.ChecksumIEEE(resolved.Key), crc32.IEEETable, value)
+	return resolved, nil
+}
+
+// addGarbage records the bytes of each file that a compaction stopped
+// pointing to.
+func (v *valueLog) addGarbage(garbage map[uint64]int64) {
+	if len(garbage) == 0 {
+		return
+	}
+	v.mu.Lock()
+	for id, n := range garbage {
+		if f := v.files[id]; f != nil {
+			f.garbage = min64(f.garbage+n, f.size)
+		}
+	}
+	v.mu.Unlock()
+	v.saveStats()
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// collectable reports whether enough of file id is garbage that compaction
+// should move its live values.
+func (v *valueLog) collectable(id uint64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	f := v.files[id]
+	return f != nil && f.size > 0 && float64(f.garbage) >= v.gcRatio*float64(f.size)
+}
+
+// mostGarbage returns the collectable files, most garbage first.
+func (v *valueLog) mostGarbage() []uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var ids []uint64
+	for id, f := range v.files {
+		if f.size > 0 && float64(f.garbage) >= v.gcRatio*float64(f.size) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := v.files[ids[i]], v.files[ids[j]]
+		return float64(a.garbage)/float64(a.size) > float64(b.garbage)/float64(b.size)
+	})
+	return ids
+}
+
+// loadStats restores the garbage counts of the attached files.
+func (v *valueLog) loadStats() {
+	data, err := os.ReadFile(filepath.Join(v.dir, valueLogStatsName))
+	if err != nil {
+		return
+	}
+	var garbage map[uint64]int64
+	if err := json.Unmarshal(data, &garbage); err != nil {
+		log.Printf("velocity: WARN: ignoring damaged %s: %v", valueLogStatsName, err)
+		return
+	}
+	v.mu.Lock()
+	for id, n := range garbage {
+		if f := v.files[id]; f != nil {
+			f.garbage = min64(n, f.size)
+		}
+	}
+	v.mu.Unlock()
+}
+
+// saveStats writes the garbage counts out.
+func (v *valueLog) saveStats() {
+	v.mu.Lock()
+	garbage := make(map[uint64]int64, len(v.files))
+	for id, f := range v.files {
+		if f.garbage > 0 {
+			garbage[id] = f.garbage
+		}
+	}
+	v.mu.Unlock()
+	data, err := json.Marshal(garbage)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(v.dir, valueLogStatsName)
+	if err := os.WriteFile(path+".tmp", data, 0600); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Printf("velocity: WARN: cannot save value log stats: %v", err)
+	}
+}
+
+// close closes the open value log files.
+func (v *valueLog) close() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, f := range v.files {
+		if f.file != nil {
+			f.file.Close()
+			f.file = nil
+		}
+	}
+}
+
+// removeOrphanValueLogs deletes the value log files in dir that no listed
+// table points into: leftovers of interrupted flushes and compactions, and
+// of tables whose removal was not finished.
+func removeOrphanValueLogs(dir string, referenced map[uint64]bool) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		id, ok := valueLogFileID(f.Name())
+		if !ok || referenced[id] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, f.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("velocity: WARN: cannot remove orphaned %s: %v", f.Name(), err)
+		}
+	}
+}
+
+// hasValueLogFiles reports whether dir holds any value log file.
+func hasValueLogFiles(dir string) bool {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		if isValueLogName(f.Name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanValueLogRefs lists the value log files the records of sst point
+// into, for tables whose manifest entry does not say.
+func (sst *SSTable) scanValueLogRefs() error {
+	iter, err := NewSSTableIterator(sst)
+	if err != nil {
+		return err
+	}
+	seen := make(map[uint64]bool)
+	for iter.Next() {
+		if e := iter.Entry(); e.kind == entryKindValuePointer {
+			if ptr, err := decodeValuePointer(e.Value); err == nil {
+				seen[ptr.file] = true
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	sst.valueLogs = sortedValueLogIDs(seen)
+	return nil
+}
+
+func sortedValueLogIDs(set map[uint64]bool) []uint64 {
+	if len(set) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// separateValues moves the values of entries that are large enough to a new
+// value log file, returning the entries to write to the table in their
+// place. The writer is nil if nothing was moved; otherwise it is finished
+// and must be aborted if the table is not kept.
+func (db *DB) separateValues(entries []*Entry) ([]*Entry, *valueLogWriter, error) {
+	var w *valueLogWriter
+	var out []*Entry
+	for i, e := range entries {
+		if !db.values.separates(e) {
+			if out != nil {
+				out = append(out, e)
+			}
+			continue
+		}
+		if w == nil {
+			var err error
+			if w, err = db.values.newWriter(); err != nil {
+				return nil, nil, err
+			}
+			out = append(make([]*Entry, 0, len(entries)), entries[:i]...)
+		}
+		p, err := w.add(e)
+		if err != nil {
+			w.abort()
+			return nil, nil, err
+		}
+		out = append(out, p)
+	}
+	if w == nil {
+		return entries, nil, nil
+	}
+	if err := w.finish(); err != nil {
+		return nil, nil, err
+	}
+	return out, w, nil
+}
+
+// ValueLogStats describes the value log of a database.
+type ValueLogStats struct {
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+	Garbage int64 `json:"garbage"`
+}
+
+// ValueLogStats returns the size of the value log and how much of it no
+// table points to any more.
+func (db *DB) ValueLogStats() ValueLogStats {
+	var stats ValueLogStats
+	if db.values == nil {
+		return stats
+	}
+	db.values.mu.Lock()
+	defer db.values.mu.Unlock()
+	for _, f := range db.values.files {
+		stats.Files++
+		stats.Bytes += f.size
+		stats.Garbage += f.garbage
+	}
+	return stats
+}
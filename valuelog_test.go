@@ -0,0 +1,107 @@
+package velocity
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValueLogSeparatesLargeValuesAndCollectsGarbage(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *DB {
+		db, err := NewWithConfig(Config{Path: dir, ValueThreshold: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	value := func(i, round int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%02d-%d|", i, round)), 1000)
+	}
+	check := func(stage string, db *DB, want map[string][]byte) {
+		t.Helper()
+		for key, v := range want {
+			got, err := db.Get([]byte(key))
+			if err != nil || !bytes.Equal(got, v) {
+				t.Fatalf("%s: %s: got %d bytes (%v)", stage, key, len(got), err)
+			}
+		}
+		n := 0
+		err := db.Scan([]byte("vl:"), func(key, got []byte) bool {
+			n++
+			if !bytes.Equal(got, want[string(key)]) {
+				t.Fatalf("%s: scan returned the wrong value for %s", stage, key)
+			}
+			return true
+		})
+		if err != nil || n != len(want) {
+			t.Fatalf("%s: expected %d keys from scan, got %d (%v)", stage, len(want), n, err)
+		}
+	}
+
+	db := open()
+	want := make(map[string][]byte)
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("vl:%02d", i)
+		want[key] = value(i, 0)
+		db.Put([]byte(key), want[key])
+	}
+	want["vl:small"] = []byte("inline")
+	db.Put([]byte("vl:small"), want["vl:small"])
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.ValueLogStats()
+	if stats.Files != 1 || stats.Bytes < 40*5000 {
+		t.Fatalf("expected the large values in one value log file, got %+v", stats)
+	}
+	db.mutex.RLock()
+	first := db.levels[0][len(db.levels[0])-1]
+	db.mutex.RUnlock()
+	if size := first.size; size > 8*1024 {
+		t.Fatalf("expected the table to hold pointers only, it is %d bytes", size)
+	}
+	firstLog := filepath.Join(dir, valueLogFileName(first.valueLogs[0]))
+	check("flushed", db, want)
+
+	// Rewriting most keys leaves the first file mostly garbage once
+	// compaction drops the old versions.
+	for i := 0; i < 35; i++ {
+		key := fmt.Sprintf("vl:%02d", i)
+		if i < 5 {
+			db.Delete([]byte(key))
+			delete(want, key)
+			continue
+		}
+		want[key] = value(i, 1)
+		db.Put([]byte(key), want[key])
+	}
+	if err := db.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	db.compactLevel(0)
+	if stats := db.ValueLogStats(); stats.Garbage < 35*5000 {
+		t.Fatalf("expected compaction to count the dropped values as garbage, got %+v", stats)
+	}
+	check("compacted", db, want)
+
+	// With nothing else to do, compaction moves the live values out of the
+	// first file, which is then removed.
+	db.performCompaction()
+	if _, err := os.Stat(firstLog); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be collected, stat err=%v", filepath.Base(firstLog), err)
+	}
+	if stats := db.ValueLogStats(); stats.Garbage != 0 {
+		t.Fatalf("expected no garbage left, got %+v", stats)
+	}
+	check("collected", db, want)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = open()
+	defer db.Close()
+	check("reopened", db, want)
+}
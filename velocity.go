@@ -41,9 +41,20 @@ const (
 
 	// File format constants
 	MagicNumber = 0xDEADBEEF
-	Version     = 1
+	Version     = sstableVersionBlocks
+
+	// Older SSTable versions stay readable and are rewritten in the current
+	// format by compaction. sstableVersionLengthOrdered tables sort keys by
+	// length first; sstableVersionRecords tables store one encrypted record
+	// per entry in bytewise order; sstableVersionBlocks tables pack entries
+	// into compressed, encrypted blocks.
+	sstableVersionLengthOrdered = 1
+	sstableVersionRecords       = 2
+	sstableVersionBlocks        = 3
 )
 
+// flushCheckpointName is the marker older versions wrote while a flush was
+// in progress. The MANIFEST took its place; a leftover one is removed on open.
 const flushCheckpointName = "flush.checkpoint"
 
 type flushCheckpoint struct {
@@ -58,13 +69,41 @@ type DB struct {
 	flushingMemTables []*MemTable
 	wal               *WAL
 	levels            [][]*SSTable // levels[0] = L0, levels[1] = L1, etc.
+	manifest          *manifest    // logs every change to levels
 	mutex             sync.RWMutex
 	envelopeMu        sync.RWMutex
 	flushMu           sync.Mutex
+	compactMu         sync.Mutex // Serializes compactions
 	compacting        atomic.Bool
 	flushing          atomic.Bool // Prevent concurrent flushes
-	cache             *storage.LRUCache
-	crypto            *CryptoProvider
+
+	// Write stalls; see makeRoomForWriteLocked. flushCh and compactCh wake
+	// the background flush and compaction loops.
+	stallCond             *sync.Cond
+	flushCh               chan struct{}
+	compactCh             chan struct{}
+	l0SlowdownTrigger     int
+	l0StopTrigger         int
+	maxImmutableMemTables int
+	stallDelayed          atomic.Uint64
+	stallStopped          atomic.Uint64
+	stallNanos            atomic.Int64
+
+	cache  *storage.LRUCache
+	crypto *CryptoProvider
+
+	// MVCC snapshots. commitMu is held shared by writers that do not take
+	// mutex, and exclusively while pinning a snapshot or swapping memtables.
+	commitMu   sync.RWMutex
+	snapshotMu sync.Mutex
+	snapshots  map[uint64]int // pinned read timestamp -> reference count
+
+	// Writes logged to a group commit that has not synced yet, oldest
+	// first; see pendingWrite. pendingKeys maps their keys to the newest
+	// pending timestamp, for transaction conflict checks. Guarded by mutex.
+	pending         []*pendingWrite
+	pendingKeys     map[string]uint64
+	applyingPending bool
 
 	complianceTagManager *ComplianceTagManager
 	classificationEngine *DataClassificationEngine
@@ -91,6 +130,8 @@ type DB struct {
 	docIDByKey              map[string]uint64
 	docKeyByID              map[uint64][]byte
 	indexMetaByID           map[uint64]indexMeta
+	fieldNorms              map[string]*fieldNorms
+	dirtyFieldNorms         map[string]struct{}
 	nextDocID               uint64
 	disableIndexPersistence bool
 
@@ -107,6 +148,45 @@ type DB struct {
 	disableWAL     bool // Skip WAL writes for maximum throughput (data loss risk)
 	skipCloseFlush bool // Skip clean-close memtable flush and rely on WAL replay
 
+	// sstOptions controls the layout of SSTables written by flush and compaction
+	sstOptions SSTableOptions
+
+	// Compaction tuning. compactPointers records, per level, the largest key
+	// of the last compaction so the next one resumes after it.
+	targetFileSize      int64
+	compactionRateLimit int64
+	compactPointers     [MaxLevels][]byte
+
+	// values holds the values flush and compaction move out of the
+	// SSTables; see Config.ValueThreshold.
+	values *valueLog
+
+	// caches holds the block and table caches, shared with the column
+	// families.
+	caches *sstableCaches
+
+	// hasRangeDels is set while any range tombstone exists, so reads can
+	// skip looking for them otherwise.
+	hasRangeDels atomic.Bool
+
+	// Merge operators by key prefix; see SetMergeOperator.
+	mergeMu        sync.RWMutex
+	mergeOperators map[string]MergeOperator
+
+	// Running totals of flushes, compactions and bloom filter probes; see
+	// Stats.
+	counters engineCounters
+
+	// Compaction filters by key prefix; see SetCompactionFilter.
+	compactionFilterMu sync.RWMutex
+	compactionFilters  map[string]CompactionFilter
+
+	// Column families by name, and the database whose WAL a column family
+	// logs to; see CreateColumnFamily.
+	familyMu sync.RWMutex
+	families *columnFamilySet
+	walOwner *DB
+
 	// Knowledge Graph engine
 	kg          *kg.KnowledgeGraphEngine
 	kgAutoIndex *KGAutoIndexer
@@ -207,6 +287,42 @@ type Config struct {
 	DisableIndexPersistence bool // Keep derived search indexes in memory only (benchmarks only)
 	SkipCloseFlush          bool // Skip clean-close memtable flush and rely on WAL replay (benchmarks only)
 
+	// RetainWAL archives the WAL at each flush instead of discarding it, so
+	// ChangesSince can read back past flushes. Archives follow the WAL
+	// rotation retention policy.
+	RetainWAL bool
+
+	// SSTable layout options
+	Compression CompressionType // Codec for SSTable data blocks; zero value uses LZ4
+	BlockSize   int             // Target uncompressed SSTable block size; 0 means DefaultBlockSize
+
+	// Bloom filter options
+	BloomBitsPerKey int             // Bloom filter bits per key of new SSTables; 0 means DefaultBloomFilterBits
+	PrefixExtractor PrefixExtractor // If set, SSTables get a prefix bloom filter that prefix scans use to skip them
+
+	// Compaction options
+	TargetFileSize      int64 // Approximate size of compacted SSTables; 0 means DefaultTargetFileSize
+	CompactionRateLimit int64 // Compaction write rate in bytes/sec; 0 means DefaultCompactionRateLimit, negative disables throttling
+
+	// MergeOperators registers merge operators by key prefix; see SetMergeOperator.
+	MergeOperators map[string]MergeOperator
+
+	// CompactionFilters registers compaction filters by key prefix; see SetCompactionFilter.
+	CompactionFilters map[string]CompactionFilter
+
+	// Key-value separation options
+	ValueThreshold  int     // Values of at least this many bytes are moved to the value log at flush; 0 keeps every value in the SSTables
+	ValueLogGCRatio float64 // Garbage share at which compaction rewrites the live values of a value log file; 0 means DefaultValueLogGCRatio
+
+	// Write stall options
+	L0SlowdownWritesTrigger int // Level 0 table count at which each write is delayed; 0 means DefaultL0SlowdownWritesTrigger, negative disables
+	L0StopWritesTrigger     int // Level 0 table count at which writes block until compaction catches up; 0 means DefaultL0StopWritesTrigger, negative disables
+	MaxImmutableMemTables   int // Full memtables that may wait for their flush before writes block; 0 means DefaultMaxImmutableMemTables, negative disables
+
+	// Read cache options
+	BlockCacheSize int64 // Memory for decoded SSTable blocks; 0 means DefaultBlockCacheSize, negative disables the block cache
+	MaxOpenTables  int   // SSTables kept open and mapped at once; 0 means DefaultMaxOpenTables, negative keeps every table open
+
 	SQLQueryCacheDisabled       bool
 	SQLQueryCacheMaxBytes       int64
 	SQLQueryCacheTTL            time.Duration
@@ -315,6 +431,14 @@ func NewWithConfig(cfg Config) (*DB, error) {
 		if cfg.DisableFsync {
 			wal.SetSyncOnWrite(false)
 		}
+		wal.retain = cfg.RetainWAL
+	}
+
+	// Column families register their keys with the WAL before it is replayed.
+	caches := newSSTableCaches(cfg.BlockCacheSize, cfg.MaxOpenTables)
+	families, err := openColumnFamilies(currentPath, cryptoProvider, wal, cfg, caches)
+	if err != nil {
+		return nil, err
 	}
 
 	// Replay WAL to restore memtable state
@@ -353,11 +477,29 @@ func NewWithConfig(cfg Config) (*DB, error) {
 		jwtSecret:               cfg.JWTSecret,
 		disableWAL:              cfg.DisableWAL,
 		skipCloseFlush:          cfg.SkipCloseFlush,
+		sstOptions:              SSTableOptions{BlockSize: cfg.BlockSize, Compression: cfg.Compression, BloomBitsPerKey: cfg.BloomBitsPerKey, PrefixExtractor: cfg.PrefixExtractor},
+		targetFileSize:          cfg.TargetFileSize,
+		compactionRateLimit:     cfg.CompactionRateLimit,
+		values:                  newValueLog(currentPath, cryptoProvider, cfg.ValueThreshold, cfg.ValueLogGCRatio),
+		caches:                  caches,
 		disableIndexPersistence: cfg.DisableIndexPersistence && cfg.DisableWAL,
 		watchKeys:               make(map[string]map[uint64]*watcher),
 		watchPrefixes:           make(map[string]map[uint64]*watcher),
 		watchAll:                make(map[uint64]*watcher),
 	}
+	db.initWriteStalls(cfg.L0SlowdownWritesTrigger, cfg.L0StopWritesTrigger, cfg.MaxImmutableMemTables)
+	for prefix, op := range cfg.MergeOperators {
+		db.SetMergeOperator(prefix, op)
+	}
+	for prefix, f := range cfg.CompactionFilters {
+		db.SetCompactionFilter(prefix, f)
+	}
+	if db.targetFileSize <= 0 {
+		db.targetFileSize = DefaultTargetFileSize
+	}
+	if db.compactionRateLimit == 0 {
+		db.compactionRateLimit = DefaultCompactionRateLimit
+	}
 	if db.nodeID == "" {
 		host, _ := os.Hostname()
 		if host != "" {
@@ -385,52 +527,20 @@ func NewWithConfig(cfg Config) (*DB, error) {
 	os.MkdirAll(db.envelopeDir, 0700)
 
 	// Load entries from WAL into memtable
+	entries = db.attachColumnFamilies(families, entries)
 	if len(entries) > 0 {
+		for _, e := range entries {
+			observeEntryTimestamp(e.Timestamp)
+		}
 		db.memTable.LoadEntries(entries)
+		if len(db.memTable.rangeTombstones()) > 0 {
+			db.hasRangeDels.Store(true)
+		}
 	}
 
 	// Load existing SSTables from disk
-	files, err := os.ReadDir(currentPath)
-	if err == nil {
-		for _, f := range files {
-			name := f.Name()
-			if !(len(name) > 4 && name[:4] == "sst_") {
-				continue
-			}
-			if filepath.Ext(name) != ".db" {
-				continue
-			}
-			path := filepath.Join(currentPath, name)
-			sst, err := LoadSSTable(path, cryptoProvider)
-			if err != nil {
-				log.Printf("velocity: WARN: corrupted sstable %s will be skipped: %v", name, err)
-				log.Printf("velocity: consider running repair or restoring from backup")
-				continue
-			}
-			// Verify SSTable integrity: check header, bloom filter bounds, and index bounds
-			if err := sst.VerifyIntegrity(); err != nil {
-				log.Printf("velocity: WARN: integrity check failed for %s: %v", name, err)
-				sst.Close()
-				continue
-			}
-			// Parse level from filename, e.g., sst_L0_001.db -> level 0
-			level := 0
-			if len(name) > 6 && name[:5] == "sst_L" {
-				end := 5
-				for end < len(name) && name[end] >= '0' && name[end] <= '9' {
-					end++
-				}
-				if end > 5 {
-					if l, err := strconv.Atoi(name[5:end]); err == nil && l < MaxLevels {
-						level = l
-					}
-				}
-			}
-			if level >= len(db.levels) {
-				db.levels = append(db.levels, make([][]*SSTable, level-len(db.levels)+1)...)
-			}
-			db.levels[level] = append(db.levels[level], sst)
-		}
+	if err := db.loadSSTables(); err != nil {
+		return nil, fmt.Errorf("failed to load sstables: %w", err)
 	}
 	if db.complianceTagManager != nil {
 		db.complianceTagManager.mu.Lock()
@@ -457,12 +567,8 @@ func NewWithConfig(cfg Config) (*DB, error) {
 		})
 	}
 
-	// Start background compaction
-	db.compactionWG.Add(1)
-	go func() {
-		defer db.compactionWG.Done()
-		db.compactionLoop()
-	}()
+	// Start background flushes and compaction
+	db.startBackgroundLoops()
 
 	return db, nil
 }
@@ -488,22 +594,6 @@ func (db *DB) JWTSecret() string {
 	return db.jwtSecret
 }
 
-func writeFlushCheckpoint(dir, sstable string) error {
-	cp := flushCheckpoint{
-		SSTable: sstable,
-		Started: time.Now().UnixNano(),
-	}
-	data, err := json.Marshal(cp)
-	if err != nil {
-		return err
-	}
-	path := filepath.Join(dir, flushCheckpointName)
-	if err := os.WriteFile(path, data, 0o600); err != nil {
-		return err
-	}
-	return syncDir(dir)
-}
-
 func removeFlushCheckpoint(dir string) error {
 	path := filepath.Join(dir, flushCheckpointName)
 	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
@@ -600,13 +690,16 @@ func (db *DB) SetPerformanceMode(mode string) {
 }
 
 func (db *DB) Put(key, value []byte) error {
-	// Ultra-fast path: when WAL and search index are disabled, skip mutex entirely
-	// sync.Map provides its own thread safety
+	// Ultra-fast path: when WAL and search index are disabled, write straight
+	// to the memtable. db.mutex is still taken so the write cannot land
+	// between a transaction's conflict check and its apply.
 	if db.disableWAL && !db.searchIndexEnabled && db.cache == nil {
+		db.mutex.Lock()
 		db.memTable.Put(key, value)
+		db.mutex.Unlock()
 		if db.memTable.Size() > db.memTableSize {
-			if !db.flushing.Load() {
-				go db.flushMemTable()
+			if err := db.makeRoomForWrite(); err != nil {
+				return err
 			}
 		}
 		db.publishPut(key, value, uint64(time.Now().UnixNano()))
@@ -614,6 +707,10 @@ func (db *DB) Put(key, value []byte) error {
 		return nil
 	}
 	db.mutex.Lock()
+	if err := db.makeRoomForWriteLocked(); err != nil {
+		db.mutex.Unlock()
+		return err
+	}
 	var err error
 	if db.searchIndexEnabled && !isIndexKey(key) {
 		_, schema := db.schemaForKeyLocked(key)
@@ -627,8 +724,11 @@ func (db *DB) Put(key, value []byte) error {
 			return err
 		}
 	}
-	err = db.put(key, value)
+	write, err := db.putBuffered(key, value)
 	db.mutex.Unlock()
+	if err == nil {
+		err = db.awaitWrite(write)
+	}
 	if err == nil {
 		db.publishPut(key, value, uint64(time.Now().UnixNano()))
 		db.kgAutoIndexKV(key, value)
@@ -639,111 +739,101 @@ func (db *DB) Put(key, value []byte) error {
 // PutWithTTL stores a key with a TTL. If ttl <= 0 the key will not expire.
 func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
 	db.mutex.Lock()
+	if err := db.makeRoomForWriteLocked(); err != nil {
+		db.mutex.Unlock()
+		return err
+	}
+	timestamp, write, err := db.putWithTTLLocked(key, value, ttl)
+	db.mutex.Unlock()
+	if err == nil {
+		err = db.awaitWrite(write)
+	}
+	if err != nil {
+		return err
+	}
+	db.publishPut(key, value, timestamp)
+	db.kgAutoIndexKV(key, value)
+	return nil
+}
 
+// putWithTTLLocked is PutWithTTL without locking or notifications. It
+// returns the timestamp of the write and the write to await once db.mutex
+// is released.
+func (db *DB) putWithTTLLocked(key, value []byte, ttl time.Duration) (uint64, *pendingWrite, error) {
 	// Build entry
-	e := entryPool.Get().(*Entry)
-	e.Key = append(e.Key[:0], key...)
-	e.Value = append(e.Value[:0], value...)
-	e.Timestamp = uint64(time.Now().UnixNano())
+	e := &Entry{
+		Key:       append([]byte(nil), key...),
+		Value:     append([]byte(nil), value...),
+		Timestamp: nextEntryTimestamp(),
+	}
 	if ttl > 0 {
 		e.ExpiresAt = uint64(time.Now().Add(ttl).UnixNano())
-	} else {
-		e.ExpiresAt = 0
 	}
-	e.Deleted = false
 	// checksum
 	h := crc32.NewIEEE()
 	h.Write(e.Key)
 	h.Write(e.Value)
 	e.checksum = h.Sum32()
 
-	// Write to WAL
-	if !db.disableWAL {
-		if db.wal == nil {
-			entryPool.Put(e)
-			db.mutex.Unlock()
-			return fmt.Errorf("WAL is not initialized")
-		}
-		if err := db.wal.Write(e); err != nil {
-			entryPool.Put(e)
-			db.mutex.Unlock()
-			return err
-		}
-	}
-
-	// Put into memtable
-	db.memTable.PutEntry(e)
-
-	// Update cache
-	if db.cache != nil {
-		db.cache.Put(string(key), append([]byte{}, value...))
-	}
-
-	// Return entry buffer to pool
-	timestamp := e.Timestamp
-	entryPool.Put(e)
-	if db.memTable.Size() > db.memTableSize {
-		// Only trigger flush if not already flushing
-		if !db.flushing.Load() {
-			go db.flushMemTable()
-		}
+	write, err := db.logWriteLocked(e)
+	if err != nil {
+		return 0, nil, err
 	}
-
-	db.mutex.Unlock()
-	db.publishPut(key, value, timestamp)
-	db.kgAutoIndexKV(key, value)
-	return nil
+	return e.Timestamp, write, nil
 }
 
 // Internal put method without locking - used when already holding a lock
 func (db *DB) put(key, value []byte) error {
+	write, err := db.putBuffered(key, value)
+	if err != nil {
+		return err
+	}
+	return db.awaitWriteLocked(write)
+}
+
+// putBuffered is put without waiting for the WAL record to be synced. It
+// returns the write to await once db.mutex is released, so concurrent
+// writers share syncs; the value is readable only after that.
+func (db *DB) putBuffered(key, value []byte) (*pendingWrite, error) {
 	if db.disableWAL {
 		// Fast path: skip entry creation and WAL, write directly to memtable
 		db.memTable.Put(key, value)
-	} else {
-		// Get an entry from pool to reduce allocations
-		e := entryPool.Get().(*Entry)
-		e.Key = append(e.Key[:0], key...)
-		e.Value = append(e.Value[:0], value...)
-		e.Timestamp = uint64(time.Now().UnixNano())
-		e.Deleted = false
-		// Compute checksum using streaming to avoid temporary concatenation
-		h := crc32.NewIEEE()
-		h.Write(e.Key)
-		h.Write(e.Value)
-		e.checksum = h.Sum32()
-
-		// Write to WAL first for durability
-		if db.wal == nil {
-			entryPool.Put(e)
-			return fmt.Errorf("WAL is not initialized")
+		if db.cache != nil {
+			db.cache.Put(string(key), append([]byte{}, value...))
 		}
-		err := db.wal.Write(e)
-		if err != nil {
-			entryPool.Put(e)
-			return err
+		if db.memTable.Size() > db.memTableSize {
+			db.scheduleFlush()
 		}
-
-		// Write to memtable (reuse the entry we already built)
-		db.memTable.PutEntry(e)
-
-		// Return entry buffer to pool
-		entryPool.Put(e)
+		return nil, nil
 	}
 
-	// Update cache
-	if db.cache != nil {
-		db.cache.Put(string(key), append([]byte{}, value...))
+	e := &Entry{
+		Key:       append([]byte(nil), key...),
+		Value:     append([]byte(nil), value...),
+		Timestamp: nextEntryTimestamp(),
 	}
+	// Compute checksum using streaming to avoid temporary concatenation
+	h := crc32.NewIEEE()
+	h.Write(e.Key)
+	h.Write(e.Value)
+	e.checksum = h.Sum32()
+	return db.logWriteLocked(e)
+}
 
-	if db.memTable.Size() > db.memTableSize {
-		// Only trigger flush if not already flushing
-		if !db.flushing.Load() {
-			go db.flushMemTable()
+// logWriteLocked appends e to the WAL and queues it for the memtable, which
+// it reaches once its group commit syncs. Callers hold db.mutex.
+func (db *DB) logWriteLocked(e *Entry) (*pendingWrite, error) {
+	var commit *walGroup
+	if !db.disableWAL {
+		if db.wal == nil {
+			return nil, fmt.Errorf("WAL is not initialized")
+		}
+		var err error
+		if commit, err = db.wal.append(e); err != nil {
+			return nil, err
 		}
 	}
-
-	return nil
+	return db.queueWriteLocked(commit, []*Entry{e}, false), nil
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
@@ -761,68 +851,26 @@ func (db *DB) get(key []byte) ([]byte, error) {
 		}
 	}
 
-	// Check memtable first
-	if entry := db.memTable.Get(key); entry != nil {
-		// Check expiry
-		if entry.ExpiresAt != 0 && time.Now().UnixNano() > int64(entry.ExpiresAt) {
-			return nil, fmt.Errorf("key not found")
-		}
-		if entry.Deleted {
-			return nil, fmt.Errorf("key not found")
-		}
-		value := entry.Value
-		if db.cache != nil {
-			db.cache.Put(keyStr, append([]byte{}, value...))
-		}
-		return value, nil
+	entry, err := db.latestEntryLocked(key)
+	if err != nil {
+		return nil, err
 	}
-	for i := len(db.flushingMemTables) - 1; i >= 0; i-- {
-		if entry := db.flushingMemTables[i].Get(key); entry != nil {
-			if entry.ExpiresAt != 0 && time.Now().UnixNano() > int64(entry.ExpiresAt) {
-				return nil, fmt.Errorf("key not found")
-			}
-			if entry.Deleted {
-				return nil, fmt.Errorf("key not found")
-			}
-			value := entry.Value
-			if db.cache != nil {
-				db.cache.Put(keyStr, append([]byte{}, value...))
-			}
-			return value, nil
-		}
+	if !entryVisible(entry) {
+		return nil, fmt.Errorf("key not found")
 	}
-
-	// Check SSTables by level
-	for level := 0; level < len(db.levels); level++ {
-		sstables := db.levels[level]
-		// Search SSTables in reverse order (newest first) within level
-		for i := len(sstables) - 1; i >= 0; i-- {
-			entry, err := sstables[i].Get(key)
-			if err != nil {
-				return nil, err
-			}
-			if entry != nil {
-				// Check expiry
-				if entry.ExpiresAt != 0 && time.Now().UnixNano() > int64(entry.ExpiresAt) {
-					return nil, fmt.Errorf("key not found")
-				}
-				if entry.Deleted {
-					return nil, fmt.Errorf("key not found")
-				}
-				value := entry.Value
-				if db.cache != nil {
-					db.cache.Put(keyStr, append([]byte{}, value...))
-				}
-				return value, nil
-			}
-		}
+	value := entry.Value
+	if db.cache != nil {
+		db.cache.Put(keyStr, append([]byte{}, value...))
 	}
-
-	return nil, fmt.Errorf("key not found")
+	return value, nil
 }
 
 func (db *DB) Delete(key []byte) error {
 	db.mutex.Lock()
+	if err := db.makeRoomForWriteLocked(); err != nil {
+		db.mutex.Unlock()
+		return err
+	}
 	var err error
 	if db.searchIndexEnabled && !isIndexKey(key) {
 		err = db.deleteIndexedLocked(key)
@@ -833,8 +881,11 @@ func (db *DB) Delete(key []byte) error {
 		}
 		return err
 	}
-	err = db.deleteLocked(key)
+	write, err := db.deleteBuffered(key)
 	db.mutex.Unlock()
+	if err == nil {
+		err = db.awaitWrite(write)
+	}
 	if err == nil {
 		db.publishDelete(key, uint64(time.Now().UnixNano()))
 		db.kgAutoDeleteKV(key)
@@ -863,67 +914,126 @@ func (db *DB) flushMemTable() error {
 }
 
 func (db *DB) flushMemTableOnce() (bool, error) {
+	flushed, err := db.writeMemTableToL0()
+	if err != nil || !flushed {
+		return flushed, err
+	}
+
+	// Truncate WAL after successfully flushing memtable to SSTable
+	if err := db.releaseWAL(); err != nil {
+		log.Printf("velocity: WAL truncation failed: %v", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// writeMemTableToL0 swaps in an empty memtable and writes the old one, and
+// any memtables queued before it, to level 0. It reports false if there was
+// nothing to write.
+func (db *DB) writeMemTableToL0() (bool, error) {
 	db.mutex.Lock()
 	if db.memTable == nil {
 		db.mutex.Unlock()
 		return false, fmt.Errorf("memTable is not initialized")
 	}
+	db.rotateMemTableLocked()
+	db.mutex.Unlock()
+	return db.writeImmutableMemTables()
+}
 
-	oldMemTable := db.memTable
-	db.memTable = NewMemTable()
-	db.flushingMemTables = append(db.flushingMemTables, oldMemTable)
+// rotateMemTableLocked swaps in an empty memtable and queues the old one
+// for flushing. Callers hold db.mutex.
+func (db *DB) rotateMemTableLocked() {
+	db.commitMu.Lock()
+	db.flushingMemTables = append(db.flushingMemTables, db.memTable)
+	db.memTable = db.newMemTableLocked()
+	db.commitMu.Unlock()
+}
+
+// writeImmutableMemTables writes the queued memtables to level 0, oldest
+// first, so newer versions always land in newer tables. It reports whether
+// any table was written. Once the log has failed it writes none, since
+// their entries may not have reached the log.
+func (db *DB) writeImmutableMemTables() (bool, error) {
+	if db.wal != nil {
+		if err := db.wal.failure(); err != nil {
+			return false, err
+		}
+	}
+	flushed := false
+	for {
+		db.mutex.RLock()
+		if len(db.flushingMemTables) == 0 {
+			db.mutex.RUnlock()
+			return flushed, nil
+		}
+		oldMemTable := db.flushingMemTables[0]
+		db.mutex.RUnlock()
+		wrote, err := db.writeImmutableMemTable(oldMemTable)
+		if err != nil {
+			return flushed, err
+		}
+		flushed = flushed || wrote
+	}
+}
 
+// writeImmutableMemTable writes a queued memtable to a new level 0 table and
+// takes it off the queue. It reports false if the memtable was empty.
+func (db *DB) writeImmutableMemTable(oldMemTable *MemTable) (bool, error) {
+	db.mutex.Lock()
+	// Snapshots pinned after this point read newer memtables for anything
+	// newer, so only the ones live now can need the older versions.
+	snapshots := db.liveSnapshots()
 	var entries []*Entry
 	oldMemTable.entries.Range(func(key, value any) bool {
-		entries = append(entries, storedEntryPtr(value))
+		entries = append(entries, memTableVersions(storedEntryPtr(value), snapshots)...)
 		return true
 	})
-	db.mutex.Unlock()
-
-	if len(entries) == 0 {
+	rangeDels := oldMemTable.rangeTombstones()
+	if len(entries) == 0 && len(rangeDels) == 0 {
+		db.removeFlushingMemTableLocked(oldMemTable)
+		db.wakeWritersLocked()
+		db.mutex.Unlock()
 		return false, nil
 	}
+	db.mutex.Unlock()
 
-	// Sort entries by key
-	sort.Slice(entries, func(i, j int) bool {
-		return compareKeys(entries[i].Key, entries[j].Key) < 0
-	})
+	sortEntries(entries)
 
 	// Create new SSTable in L0
 	level := 0
 	sstPath := filepath.Join(db.path, fmt.Sprintf("sst_L%d_%d.db", level, time.Now().UnixNano()))
-	if err := writeFlushCheckpoint(db.path, filepath.Base(sstPath)); err != nil {
-		return false, err
+	tableEntries, values, err := db.separateValues(entries)
+	var sst *SSTable
+	if err == nil {
+		sst, err = newSSTable(sstPath, tableEntries, rangeDels, db.crypto, db.sstOptions)
+	}
+	if err == nil {
+		// The table only counts once the manifest lists it; until then the
+		// WAL still holds its entries.
+		if err = db.logEdit(manifestEdit{Added: []manifestTable{manifestTableFor(sst, level)}}); err != nil {
+			sst.Close()
+			os.Remove(sstPath)
+		}
+	}
+	if err != nil && values != nil {
+		values.abort()
 	}
-	sst, err := NewSSTable(sstPath, entries, db.crypto)
 	if err != nil {
-		db.mutex.Lock()
-		oldMemTable.entries.Range(func(key, value any) bool {
-			db.memTable.entries.Store(key, value)
-			return true
-		})
-		db.removeFlushingMemTableLocked(oldMemTable)
-		db.mutex.Unlock()
+		// The memtable stays queued, and readable, for the next flush.
 		return false, err
 	}
 
+	db.attachTable(sst)
+	db.counters.flushes.Add(1)
+	db.counters.flushBytes.Add(uint64(sst.size))
 	db.mutex.Lock()
 	db.levels[level] = append(db.levels[level], sst)
 	db.removeFlushingMemTableLocked(oldMemTable)
+	db.wakeWritersLocked()
 	db.mutex.Unlock()
-
-	// Truncate WAL after successfully flushing memtable to SSTable
-	if db.wal != nil {
-		if err := db.wal.Truncate(); err != nil {
-			log.Printf("velocity: WAL truncation failed: %v", err)
-			return false, err
-		}
-	}
-	if err := removeFlushCheckpoint(db.path); err != nil {
-		log.Printf("velocity: flush checkpoint cleanup failed: %v", err)
-		return false, err
-	}
-
+	db.scheduleCompaction()
 	return true, nil
 }
 
@@ -935,6 +1045,7 @@ func (db *DB) removeFlushingMemTableLocked(mt *MemTable) {
 		copy(db.flushingMemTables[i:], db.flushingMemTables[i+1:])
 		db.flushingMemTables[len(db.flushingMemTables)-1] = nil
 		db.flushingMemTables = db.flushingMemTables[:len(db.flushingMemTables)-1]
+		db.updateRangeDelsLocked()
 		return
 	}
 }
@@ -948,12 +1059,19 @@ func (db *DB) Close() error {
 	// Unregister from graceful shutdown handler
 	unregisterDB(db)
 
-	// Signal shutdown to any background goroutines
+	// Signal shutdown to any background goroutines, and let writers blocked
+	// by a write stall finish.
 	if db.shutdownCh != nil {
 		close(db.shutdownCh)
 	}
+	db.mutex.Lock()
+	db.wakeWritersLocked()
+	db.mutex.Unlock()
 	db.compactionWG.Wait()
 
+	// Column families log to the same WAL, so they go first.
+	db.closeColumnFamilies()
+
 	// Flush memtable to ensure all data is persisted
 	if db.disableWAL || (db.wal != nil && !db.skipCloseFlush) {
 		if err := db.flushMemTable(); err != nil {
@@ -972,6 +1090,12 @@ func (db *DB) Close() error {
 			}
 		}
 	}
+	if db.manifest != nil {
+		db.manifest.close()
+	}
+	if db.values != nil {
+		db.values.close()
+	}
 
 	// Close WAL (this also flushes any remaining buffer)
 	if db.wal != nil {
@@ -993,6 +1117,10 @@ func (db *DB) HasString(key string) bool {
 			return true
 		}
 	}
+	if db.hasRangeDels.Load() {
+		entry, err := db.latestEntryLocked([]byte(key))
+		return err == nil && entry != nil && !entry.Deleted
+	}
 
 	// Check memtable first
 	if entry := db.memTable.GetString(key); entry != nil {
@@ -1099,47 +1227,21 @@ func (db *DB) TTL(key []byte) (time.Duration, error) {
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
 
-	// Check memtable first
-	if entry := db.memTable.Get(key); entry != nil {
-		// deleted or expired
-		if entry.Deleted {
-			return 0, fmt.Errorf("key not found")
-		}
-		if entry.ExpiresAt == 0 {
-			return time.Duration(-1), nil
-		}
-		remaining := time.Until(time.Unix(0, int64(entry.ExpiresAt)))
-		if remaining <= 0 {
-			return 0, fmt.Errorf("key not found")
-		}
-		return remaining, nil
+	entry, err := db.latestEntryLocked(key)
+	if err != nil {
+		return 0, err
 	}
-
-	// Check SSTables by level
-	for level := 0; level < len(db.levels); level++ {
-		sstables := db.levels[level]
-		for i := len(sstables) - 1; i >= 0; i-- {
-			entry, err := sstables[i].Get(key)
-			if err != nil {
-				return 0, err
-			}
-			if entry != nil {
-				if entry.Deleted {
-					return 0, fmt.Errorf("key not found")
-				}
-				if entry.ExpiresAt == 0 {
-					return time.Duration(-1), nil
-				}
-				remaining := time.Until(time.Unix(0, int64(entry.ExpiresAt)))
-				if remaining <= 0 {
-					return 0, fmt.Errorf("key not found")
-				}
-				return remaining, nil
-			}
-		}
+	if entry == nil || entry.Deleted {
+		return 0, fmt.Errorf("key not found")
 	}
-
-	return 0, fmt.Errorf("key not found")
+	if entry.ExpiresAt == 0 {
+		return time.Duration(-1), nil
+	}
+	remaining := time.Until(time.Unix(0, int64(entry.ExpiresAt)))
+	if remaining <= 0 {
+		return 0, fmt.Errorf("key not found")
+	}
+	return remaining, nil
 }
 
 // Keys returns all keys that match the provided shell-style pattern. If pattern
@@ -1168,7 +1270,7 @@ func (db *DB) keysLocked(pattern string) ([]string, error) {
 	db.memTable.entries.Range(func(k, v any) bool {
 		e := storedEntryPtr(v)
 		s := string(e.Key)
-		if e.Deleted {
+		if e.Deleted || db.rangeDeletedLocked(e) {
 			return true
 		}
 		if e.ExpiresAt != 0 && time.Now().UnixNano() > int64(e.ExpiresAt) {
@@ -1201,7 +1303,7 @@ func (db *DB) keysLocked(pattern string) ([]string, error) {
 					if err != nil {
 						break
 					}
-					if !entryIsDeletedInMemTable(db.memTable, entry.Key) {
+					if !entryIsDeletedInMemTable(db.memTable, entry.Key) && !db.keyRangeDeletedLocked(entry.Key) {
 						allKeys = append(allKeys, string(entry.Key))
 					}
 					idxEntrySize := 4 + len(entry.Key) + 8 + 4
@@ -1230,7 +1332,7 @@ func (db *DB) keysLocked(pattern string) ([]string, error) {
 				if err != nil {
 					break
 				}
-				if !entryIsDeletedInMemTable(db.memTable, entry.Key) {
+				if !entryIsDeletedInMemTable(db.memTable, entry.Key) && !db.keyRangeDeletedLocked(entry.Key) {
 					s := string(entry.Key)
 					if match(s) && !seen[s] {
 						seen[s] = true
@@ -1335,7 +1437,7 @@ func (db *DB) keysPageLocked(offset, limit int) ([][]byte, int) {
 	// sequential SSTable scan below to avoid scanning the entire dataset.
 	db.memTable.entries.Range(func(key, value any) bool {
 		entry := storedEntryPtr(value)
-		if !entry.Deleted {
+		if !entry.Deleted && !db.rangeDeletedLocked(entry) {
 			appendKey(entry.Key)
 		}
 		return true
@@ -1366,7 +1468,7 @@ func (db *DB) keysPageLocked(offset, limit int) ([][]byte, int) {
 					if err != nil {
 						break
 					}
-					if !entryIsDeletedInMemTable(db.memTable, entry.Key) {
+					if !entryIsDeletedInMemTable(db.memTable, entry.Key) && !db.keyRangeDeletedLocked(entry.Key) {
 						allKeys = append(allKeys, string(entry.Key))
 					}
 					idxEntrySize := 4 + len(entry.Key) + 8 + 4
@@ -1414,7 +1516,7 @@ func (db *DB) keysPageLocked(offset, limit int) ([][]byte, int) {
 				if err != nil {
 					break
 				}
-				if !entryIsDeletedInMemTable(db.memTable, entry.Key) { // ensure not deleted by memtable
+				if !entryIsDeletedInMemTable(db.memTable, entry.Key) && !db.keyRangeDeletedLocked(entry.Key) { // ensure not deleted by memtable
 					appendKey(entry.Key)
 				}
 				idxEntrySize := 4 + len(entry.Key) + 8 + 4
@@ -1456,90 +1558,19 @@ func (db *DB) keysPageLocked(offset, limit int) ([][]byte, int) {
 	return keys[start:end], total
 }
 
-// Scan iterates over all keys with the given prefix, calling fn for each
-// key-value pair. Iteration stops when fn returns false. This is a
-// high-performance prefix scan that avoids materialising the full key set.
+// Scan iterates over all keys with the given prefix in key order, calling fn
+// for each key-value pair. Iteration stops when fn returns false. It streams
+// from an Iterator, so it never materialises the matching key set, and fn may
+// safely call back into the database.
 func (db *DB) Scan(prefix []byte, fn func(key, value []byte) bool) error {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-
-	prefixStr := string(prefix)
-
-	// Collect from memtable first — these override SSTable values.
-	memKeys := make(map[string][]byte)
-	db.memTable.entries.Range(func(k, v any) bool {
-		e := storedEntryPtr(v)
-		s := string(e.Key)
-		if len(s) >= len(prefixStr) && s[:len(prefixStr)] == prefixStr {
-			if e.Deleted {
-				memKeys[s] = nil // tombstone
-			} else if e.ExpiresAt != 0 && time.Now().UnixNano() > int64(e.ExpiresAt) {
-				memKeys[s] = nil // expired
-			} else {
-				memKeys[s] = e.Value
-			}
-		}
-		return true
-	})
-
-	// Collect from SSTables (newest first so first-seen wins).
-	sstKeys := make(map[string][]byte)
-	for level := 0; level < len(db.levels); level++ {
-		sstables := db.levels[level]
-		for i := len(sstables) - 1; i >= 0; i-- {
-			sst := sstables[i]
-			idxPos := uint32(0)
-			for j := 0; j < sst.entryCount; j++ {
-				entry, err := sst.readIndexEntryAt(idxPos)
-				if err != nil {
-					break
-				}
-				s := string(entry.Key)
-				idxEntrySize := 4 + len(entry.Key) + 8 + 4
-				idxPos += uint32(idxEntrySize)
-
-				if len(s) < len(prefixStr) || s[:len(prefixStr)] != prefixStr {
-					continue
-				}
-				// Skip if already seen in a newer SSTable or memtable
-				if _, ok := memKeys[s]; ok {
-					continue
-				}
-				if _, ok := sstKeys[s]; ok {
-					continue
-				}
-				// Fetch actual value
-				val, err := db.get(entry.Key)
-				if err != nil {
-					continue
-				}
-				sstKeys[s] = val
-			}
-		}
-	}
-
-	// Merge and sort for deterministic order.
-	type kv struct {
-		key   string
-		value []byte
-	}
-	all := make([]kv, 0, len(memKeys)+len(sstKeys))
-	for k, v := range memKeys {
-		if v != nil {
-			all = append(all, kv{k, v})
-		}
-	}
-	for k, v := range sstKeys {
-		all = append(all, kv{k, v})
-	}
-	sort.Slice(all, func(i, j int) bool { return all[i].key < all[j].key })
-
-	for _, item := range all {
-		if !fn([]byte(item.key), item.value) {
+	it := db.NewIterator(IterOptions{Prefix: prefix})
+	defer it.Close()
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
 			break
 		}
 	}
-	return nil
+	return it.Err()
 }
 
 func min(a, b int) int {
@@ -1557,196 +1588,6 @@ func entryIsDeletedInMemTable(mt *MemTable, key []byte) bool {
 	return false
 }
 
-// compactionLoop runs in the background and performs compaction when levels exceed size thresholds
-func (db *DB) compactionLoop() {
-	ticker := time.NewTicker(10 * time.Second) // Check every 10 seconds
-	defer ticker.Stop()
-	shutdownCh := db.shutdownCh
-
-	for {
-		select {
-		case <-ticker.C:
-			db.performCompaction()
-		case <-shutdownCh:
-			return
-		}
-	}
-}
-
-// performCompaction checks levels and compacts if necessary
-func (db *DB) performCompaction() {
-	if db.compacting.Load() {
-		log.Printf("velocity: compaction already in progress, skipping")
-		return // Already compacting
-	}
-	db.compacting.Store(true)
-	defer db.compacting.Store(false)
-
-	// Acquire lock only to read level info
-	db.mutex.Lock()
-
-	// Calculate level sizes
-	levelSizes := make([]int64, MaxLevels)
-	levelCounts := make([]int, MaxLevels)
-	for level, sstables := range db.levels {
-		levelCounts[level] = len(sstables)
-		for _, sst := range sstables {
-			// Get actual file size
-			if fi, err := sst.file.Stat(); err == nil {
-				levelSizes[level] += fi.Size()
-			}
-		}
-	}
-
-	// Check each level for compaction
-	for level := 0; level < MaxLevels-1; level++ {
-		nextLevelSize := levelSizes[level+1]
-		if nextLevelSize == 0 {
-			nextLevelSize = 1 // Avoid division by zero
-		}
-		ratio := float64(levelSizes[level]) / float64(nextLevelSize)
-		if ratio > float64(CompactionRatio) {
-			// Release lock before expensive compaction work
-			db.mutex.Unlock()
-			db.compactLevel(level)
-			return // Compact one level at a time, lock already released
-		}
-	}
-
-	// Release lock before returning
-	db.mutex.Unlock()
-}
-
-// compactLevel merges level with level+1
-func (db *DB) compactLevel(level int) {
-	if level >= MaxLevels-1 {
-		return
-	}
-
-	// Acquire lock to snapshot current SSTables
-	db.mutex.Lock()
-	currentLevelSSTables := make([]*SSTable, len(db.levels[level]))
-	copy(currentLevelSSTables, db.levels[level])
-	nextLevelSSTables := make([]*SSTable, len(db.levels[level+1]))
-	copy(nextLevelSSTables, db.levels[level+1])
-	db.mutex.Unlock()
-
-	// Collect all entries from current level and next level
-	// This work is done WITHOUT holding the lock so reads can proceed
-	var allEntries []*Entry
-	iterators := make([]*SSTableIterator, 0)
-
-	// Add iterators for current level
-	for _, sst := range currentLevelSSTables {
-		iter, err := NewSSTableIterator(sst)
-		if err != nil {
-			log.Printf("velocity: failed to create iterator for sstable: %v", err)
-			continue
-		}
-		iterators = append(iterators, iter)
-	}
-
-	// Add iterators for next level
-	for _, sst := range nextLevelSSTables {
-		iter, err := NewSSTableIterator(sst)
-		if err != nil {
-			log.Printf("velocity: failed to create iterator for sstable: %v", err)
-			continue
-		}
-		iterators = append(iterators, iter)
-	}
-
-	// Merge iterators
-	merged := NewMergedIterator(iterators...)
-
-	// Collect all entries, resolving duplicates (newer timestamps win)
-	seen := make(map[string]*Entry)
-	entryCount := 0
-	for merged.Next() {
-		entry := merged.Entry()
-		entryCount++
-		keyStr := string(entry.Key)
-		if existing, ok := seen[keyStr]; !ok || entry.Timestamp > existing.Timestamp {
-			seen[keyStr] = entry
-		}
-	}
-	// Filter out expired entries during compaction. Preserve tombstones so
-	// deletes cannot resurrect older values that live in lower levels.
-	// Entries with ExpiresAt=0 never expire
-	now := uint64(time.Now().UnixNano())
-	expiredCount := 0
-	for _, entry := range seen {
-		if entry.ExpiresAt > 0 && entry.ExpiresAt < now {
-			expiredCount++
-			continue // Skip expired entries
-		}
-		allEntries = append(allEntries, entry)
-	}
-
-	// Sort entries
-	sort.Slice(allEntries, func(i, j int) bool {
-		return compareKeys(allEntries[i].Key, allEntries[j].Key) < 0
-	})
-
-	// Create new SSTables for next level
-	newSSTables := make([]*SSTable, 0)
-	batchSize := 10000 // Entries per SSTable
-	for i := 0; i < len(allEntries); i += batchSize {
-		end := i + batchSize
-		if end > len(allEntries) {
-			end = len(allEntries)
-		}
-		batch := allEntries[i:end]
-
-		sstPath := filepath.Join(db.path, fmt.Sprintf("sst_L%d_%d.db", level+1, time.Now().UnixNano()))
-		sst, err := NewSSTable(sstPath, batch, db.crypto)
-		if err != nil {
-			log.Printf("velocity: failed to create compacted sstable: %v", err)
-			continue
-		}
-		newSSTables = append(newSSTables, sst)
-	}
-
-	// CRITICAL: Acquire lock briefly to swap SSTables atomically
-	// This ensures concurrent reads see consistent state
-	db.mutex.Lock()
-
-	// Save references to old SSTables before swapping
-	oldLevel := db.levels[level]
-	oldNextLevel := db.levels[level+1]
-
-	// Atomically update levels - concurrent reads will now use new SSTables
-	db.levels[level] = nil
-	db.levels[level+1] = newSSTables
-
-	db.mutex.Unlock()
-	// Lock released - reads can proceed with new SSTables
-
-	// Now safe to close and remove old SSTables
-	// Any reads that were in progress have either:
-	// 1. Acquired read lock before we swapped levels (using old SSTables, still valid)
-	// 2. Acquire read lock after we swapped (using new SSTables)
-	// The mutex ensures this is safe without needing delays
-	for _, sst := range oldLevel {
-		if sst.file != nil {
-			fileName := sst.file.Name()
-			sst.Close()
-			os.Remove(fileName)
-		} else {
-			sst.Close()
-		}
-	}
-	for _, sst := range oldNextLevel {
-		if sst.file != nil {
-			fileName := sst.file.Name()
-			sst.Close()
-			os.Remove(fileName)
-		} else {
-			sst.Close()
-		}
-	}
-}
-
 // KnowledgeGraph returns the Knowledge Graph engine, creating it on first call.
 func (db *DB) KnowledgeGraph(config ...kg.KGConfig) *kg.KnowledgeGraphEngine {
 	if db.kg != nil {
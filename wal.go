@@ -1,6 +1,7 @@
 package velocity
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
@@ -12,22 +13,46 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// WAL (Write-Ahead Log) for durability
+// WAL (Write-Ahead Log) for durability. Column families share the log of
+// their database through views that tag records with the family's id and
+// encrypt them with the family's key.
 type WAL struct {
+	*walLog
+	family uint32
+	crypto *CryptoProvider
+}
+
+// walLog is the file and buffer state shared by every view of a WAL.
+type walLog struct {
 	file     *os.File
 	buffer   *bytes.Buffer
 	mutex    sync.Mutex
 	ticker   *time.Ticker
 	stopChan chan struct{}
 	closed   bool
-	crypto   *CryptoProvider
-	// syncOnWrite enforces fsync on every Write/WriteBatch call.
-	// When false, writes are group-committed by the periodic sync loop.
+	// syncOnWrite makes Write/WriteBatch return only once their records
+	// are synced. When false, records are synced by the periodic sync loop.
 	syncOnWrite bool
 
+	// Group commit. Writers that wait for a sync join the pending group;
+	// the first of them to find no sync in flight leads it, writing and
+	// syncing the buffer outside the lock while the rest wait on synced.
+	// syncing is set while that write is in flight, and every other write
+	// to the file waits for it to finish.
+	synced  *sync.Cond
+	syncing bool
+	pending *walGroup
+	stats   walCounters
+	// failed is the error of the first write or sync of the log to fail.
+	// Records appended before it may be lost, so from then on the log
+	// takes no more records and the DB flushes no memtable: reopening
+	// keeps only what the file holds.
+	failed error
+
 	// Async flush channel
 	flushChan chan *bytes.Buffer
 	flushWg   sync.WaitGroup
@@ -41,6 +66,19 @@ type WAL struct {
 	// Time-based rotation
 	rotationInterval time.Duration // rotate at least this often (0 disables)
 	lastRotationTime time.Time     // last time rotation occurred
+
+	// families maps the ids of the column families logging here to the
+	// providers their records are encrypted with.
+	families map[uint32]*CryptoProvider
+
+	// seq is the sequence number of the last record written; floorPending
+	// is set when the log was emptied and its next record must be preceded
+	// by the floor. retain makes Truncate archive the log instead of
+	// discarding it, and tails are the change feeds following the log.
+	seq          uint64
+	floorPending bool
+	retain       bool
+	tails        map[*walTail]struct{}
 }
 
 func NewWAL(path string, crypto *CryptoProvider) (*WAL, error) {
@@ -52,12 +90,12 @@ func NewWAL(path string, crypto *CryptoProvider) (*WAL, error) {
 		return nil, fmt.Errorf("encryption provider is required for WAL")
 	}
 
-	wal := &WAL{
+	wal := &WAL{crypto: crypto}
+	wal.walLog = &walLog{
 		file:        file,
 		buffer:      bytes.NewBuffer(make([]byte, 0, WALBufferSize)),
 		ticker:      time.NewTicker(WALSyncInterval),
 		stopChan:    make(chan struct{}),
-		crypto:      crypto,
 		flushChan:   make(chan *bytes.Buffer, 2),
 		syncOnWrite: true,
 		// defaults: rotation disabled
@@ -67,7 +105,9 @@ func NewWAL(path string, crypto *CryptoProvider) (*WAL, error) {
 		maxAgeDays:        0,
 		rotationInterval:  0,
 		lastRotationTime:  time.Now().UTC(),
+		families:          make(map[uint32]*CryptoProvider),
 	}
+	wal.synced = sync.NewCond(&wal.mutex)
 
 	// Background sync + rotation goroutine
 	go wal.syncLoop()
@@ -87,6 +127,22 @@ func NewWAL(path string, crypto *CryptoProvider) (*WAL, error) {
 	return wal, nil
 }
 
+// forFamily returns a view of the log that writes records of the column
+// family id, encrypted with crypto, and registers the family for replay.
+func (w *WAL) forFamily(id uint32, crypto *CryptoProvider) *WAL {
+	w.mutex.Lock()
+	w.families[id] = crypto
+	w.mutex.Unlock()
+	return &WAL{walLog: w.walLog, family: id, crypto: crypto}
+}
+
+// dropFamily forgets a column family; replay skips its records from then on.
+func (w *WAL) dropFamily(id uint32) {
+	w.mutex.Lock()
+	delete(w.families, id)
+	w.mutex.Unlock()
+}
+
 func (w *WAL) File() *os.File {
 	return w.file
 }
@@ -113,117 +169,430 @@ var walBufferPool = sync.Pool{
 	},
 }
 
+// Write logs entry. In sync-on-write mode it returns once the record is
+// synced, sharing the sync with concurrent writers.
 func (w *WAL) Write(entry *Entry) error {
-	w.mutex.Lock()
+	g, err := w.append(entry)
+	if err != nil {
+		return err
+	}
+	return g.wait()
+}
 
-	// Encrypt value using AEAD with entry metadata as AAD (including expiry)
-	nonce, ciphertext, err := w.crypto.Encrypt(entry.Value, buildEntryAAD(entry.Key, entry.Timestamp, entry.ExpiresAt, entry.Deleted))
+// WriteBatch writes multiple entries to WAL with a single sync at the end.
+func (w *WAL) WriteBatch(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	g, err := w.append(entries...)
 	if err != nil {
-		w.mutex.Unlock()
 		return err
 	}
+	return g.wait()
+}
+
+// append adds records for entries to the buffer; their values are encrypted
+// before the lock is taken. In sync-on-write mode it returns the group
+// commit that syncs them, to wait on once the caller has released its own
+// locks. Otherwise the sync loop syncs them and it returns nil.
+func (w *WAL) append(entries ...*Entry) (*walGroup, error) {
+	sealed := make([][2][]byte, len(entries))
+	for i, entry := range entries {
+		nonce, ciphertext, err := w.crypto.Encrypt(entry.Value, buildEntryAAD(entry.Key, entry.Timestamp, entry.ExpiresAt, recordFlag(entry)))
+		if err != nil {
+			return nil, err
+		}
+		sealed[i] = [2][]byte{nonce, ciphertext}
+	}
 
 	scratch := walScratchPool.Get().([]byte)
+	defer walScratchPool.Put(scratch)
 
-	// keyLen (uint32)
-	binary.LittleEndian.PutUint32(scratch, uint32(len(entry.Key)))
-	w.buffer.Write(scratch[:4])
-	w.buffer.Write(entry.Key)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.failedUnlocked(); err != nil {
+		return nil, err
+	}
 
-	// nonceLen (uint16)
-	binary.LittleEndian.PutUint16(scratch, uint16(len(nonce)))
-	w.buffer.Write(scratch[:2])
-	w.buffer.Write(nonce)
+	w.writeFloorUnlocked(scratch)
+	first := w.seq
+	for i, entry := range entries {
+		w.seq++
+		encodeWALRecord(w.buffer, scratch, w.seq, w.family, entry, sealed[i][0], sealed[i][1])
+	}
 
-	// valueLen (uint32)
-	binary.LittleEndian.PutUint32(scratch, uint32(len(ciphertext)))
-	w.buffer.Write(scratch[:4])
-	w.buffer.Write(ciphertext)
+	var g *walGroup
+	switch {
+	case w.syncOnWrite:
+		g = w.joinUnlocked()
+	case w.pending != nil || w.syncing:
+		// Change feeds must see records in order, so these wait for the
+		// group commit ahead of them.
+		g = w.pendingUnlocked()
+	}
+	for i, entry := range entries {
+		if g != nil {
+			g.queue(first+uint64(i)+1, w.family, entry)
+		} else {
+			w.publishUnlocked(first+uint64(i)+1, w.family, entry)
+		}
+	}
+	if w.syncOnWrite {
+		return g, nil
+	}
+	if w.buffer.Len() >= w.buffer.Cap() {
+		return nil, w.syncUnsafe()
+	}
+	return nil, nil
+}
 
-	// timestamp (uint64)
-	binary.LittleEndian.PutUint64(scratch, entry.Timestamp)
-	w.buffer.Write(scratch[:8])
+// walBatchMarker occupies the key length slot of a record to introduce an
+// atomic batch. The layout is marker(u32) count(u32) payloadLen(u32)
+// crc32(u32) followed by payloadLen bytes of ordinary entry records. Replay
+// applies either every record of a batch or, if the batch was torn by a
+// crash, none of them.
+const walBatchMarker = 0xFFFFFFFF
+
+// WriteAtomic writes entries as one batch record that replay applies
+// all-or-nothing, and syncs it regardless of the syncOnWrite setting.
+func (w *WAL) WriteAtomic(entries []*Entry) error {
+	commit, err := w.appendAtomic([]walBatchGroup{{wal: w, entries: entries}})
+	if err != nil {
+		return err
+	}
+	return commit.wait()
+}
 
-	// expiresAt (uint64)
-	binary.LittleEndian.PutUint64(scratch, entry.ExpiresAt)
-	w.buffer.Write(scratch[:8])
+// walBatchGroup holds the entries an atomic batch writes through one view of
+// the log.
+type walBatchGroup struct {
+	wal     *WAL
+	entries []*Entry
+}
 
-	// deleted (uint8)
-	if entry.Deleted {
-		scratch[0] = 1
-	} else {
-		scratch[0] = 0
+// appendAtomic appends the entries of every group, which must all be views
+// of this log, as one atomic batch. It returns the group commit that syncs
+// the batch, to wait on once the caller has released its own locks.
+func (w *WAL) appendAtomic(groups []walBatchGroup) (*walGroup, error) {
+	count := 0
+	for _, g := range groups {
+		count += len(g.entries)
+	}
+	if count == 0 {
+		return nil, nil
 	}
-	w.buffer.Write(scratch[:1])
 
-	// checksum (uint32)
-	binary.LittleEndian.PutUint32(scratch, entry.checksum)
-	w.buffer.Write(scratch[:4])
+	scratch := walScratchPool.Get().([]byte)
+	defer walScratchPool.Put(scratch)
 
-	walScratchPool.Put(scratch)
+	// Encrypt up front; records are numbered under the lock, so sequence
+	// numbers follow the order of the log.
+	sealed := make([][2][]byte, 0, count)
+	for _, g := range groups {
+		for _, entry := range g.entries {
+			nonce, ciphertext, err := g.wal.crypto.Encrypt(entry.Value, buildEntryAAD(entry.Key, entry.Timestamp, entry.ExpiresAt, recordFlag(entry)))
+			if err != nil {
+				return nil, err
+			}
+			sealed = append(sealed, [2][]byte{nonce, ciphertext})
+		}
+	}
 
-	if w.syncOnWrite || w.buffer.Len() >= w.buffer.Cap() {
-		if err := w.syncUnsafe(); err != nil {
-			w.mutex.Unlock()
-			return err
+	payload := walBufferPool.Get().(*bytes.Buffer)
+	payload.Reset()
+	defer walBufferPool.Put(payload)
+
+	w.mutex.Lock()
+	if err := w.failedUnlocked(); err != nil {
+		w.mutex.Unlock()
+		return nil, err
+	}
+	first := w.seq
+	i := 0
+	for _, g := range groups {
+		for _, entry := range g.entries {
+			encodeWALRecord(payload, scratch, first+uint64(i)+1, g.wal.family, entry, sealed[i][0], sealed[i][1])
+			i++
+		}
+	}
+
+	w.writeFloorUnlocked(scratch)
+	binary.LittleEndian.PutUint32(scratch, walBatchMarker)
+	w.buffer.Write(scratch[:4])
+	binary.LittleEndian.PutUint32(scratch, uint32(count))
+	w.buffer.Write(scratch[:4])
+	binary.LittleEndian.PutUint32(scratch, uint32(payload.Len()))
+	w.buffer.Write(scratch[:4])
+	binary.LittleEndian.PutUint32(scratch, crc32.ChecksumIEEE(payload.Bytes()))
+	w.buffer.Write(scratch[:4])
+	w.buffer.Write(payload.Bytes())
+	w.seq += uint64(count)
+
+	commit := w.joinUnlocked()
+	i = 0
+	for _, g := range groups {
+		for _, entry := range g.entries {
+			i++
+			commit.queue(first+uint64(i), g.wal.family, entry)
 		}
 	}
 	w.mutex.Unlock()
+	return commit, nil
+}
 
-	return nil
+// walGroup is a group commit: the records of the writes that one sync
+// makes durable.
+type walGroup struct {
+	log     *walLog
+	writes  int         // Write, WriteBatch and atomic batch calls that joined
+	changes []walChange // records to hand to change feeds once synced
+	done    bool
+	err     error
 }
 
-// WriteBatch writes multiple entries to WAL with a single sync at the end.
-func (w *WAL) WriteBatch(entries []*Entry) error {
-	if len(entries) == 0 {
-		return nil
+// walChange is a record waiting for its group commit before change feeds
+// see it.
+type walChange struct {
+	family uint32
+	change Change
+}
+
+// pendingUnlocked returns the group commit records appended now belong to.
+// Caller holds the lock.
+func (w *walLog) pendingUnlocked() *walGroup {
+	if w.pending == nil {
+		w.pending = &walGroup{log: w}
 	}
+	return w.pending
+}
+
+// joinUnlocked adds a write that waits for its sync to the pending group
+// commit and returns the group. Caller holds the lock.
+func (w *walLog) joinUnlocked() *walGroup {
+	g := w.pendingUnlocked()
+	g.writes++
+	return g
+}
+
+// queue holds a record of g back from change feeds until g is synced. A
+// feed that starts in the meantime syncs the log first, so nothing needs
+// to be held while no feed is open. Caller holds the lock.
+func (g *walGroup) queue(seq uint64, family uint32, entry *Entry) {
+	if len(g.log.tails) > 0 {
+		g.changes = append(g.changes, walChange{family: family, change: changeFromEntry(seq, entry)})
+	}
+}
 
+// wait returns once the records of g are synced, or the sync failed. The
+// first waiter to find no sync in flight leads: it takes the buffer, which
+// holds g and any records appended since, and writes and syncs it without
+// the lock, so writers keep appending to the next group meanwhile. A nil
+// group has nothing to wait for.
+func (g *walGroup) wait() error {
+	if g == nil {
+		return nil
+	}
+	w := g.log
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
+	for !g.done {
+		if w.syncing {
+			w.synced.Wait()
+			continue
+		}
+		if w.failed != nil {
+			// Writing g after records lost ahead of it would leave a gap
+			// in the log.
+			w.buffer.Reset()
+			w.pending = nil
+			w.finishUnlocked(g, w.failed)
+			break
+		}
+		// g is still pending, since a group leaves w.pending only for a
+		// sync that marks it done.
+		buf, file := w.buffer, w.file
+		w.buffer = newWALBuffer()
+		w.pending = nil
+		w.syncing = true
+		w.mutex.Unlock()
+		err := w.writeBuffer(file, buf)
+		w.mutex.Lock()
+		w.syncing = false
+		w.finishUnlocked(g, err)
+	}
+	return g.err
+}
 
-	scratch := walScratchPool.Get().([]byte)
-	defer walScratchPool.Put(scratch)
+// result reports whether g has completed and the error of its sync. A nil
+// group has nothing to wait for.
+func (g *walGroup) result() (bool, error) {
+	if g == nil {
+		return true, nil
+	}
+	g.log.mutex.Lock()
+	defer g.log.mutex.Unlock()
+	return g.done, g.err
+}
 
-	for _, entry := range entries {
-		nonce, ciphertext, err := w.crypto.Encrypt(entry.Value, buildEntryAAD(entry.Key, entry.Timestamp, entry.ExpiresAt, entry.Deleted))
-		if err != nil {
-			return err
+// finishUnlocked completes a group commit, if g is not nil, with the result
+// of its sync, and wakes the writers waiting for a sync. A failed sync
+// fails the log. Caller holds the lock.
+func (w *walLog) finishUnlocked(g *walGroup, err error) {
+	if err != nil && w.failed == nil {
+		w.failed = err
+	}
+	if g != nil {
+		g.done, g.err = true, err
+		if g.writes > 0 {
+			w.stats.groupCommits.Add(1)
+			w.stats.groupedWrites.Add(uint64(g.writes))
+		}
+		if err == nil {
+			for _, c := range g.changes {
+				w.pushUnlocked(c.family, c.change)
+			}
 		}
+	}
+	w.synced.Broadcast()
+}
 
-		binary.LittleEndian.PutUint32(scratch, uint32(len(entry.Key)))
-		w.buffer.Write(scratch[:4])
-		w.buffer.Write(entry.Key)
+// failedUnlocked returns the error that failed the log, if one did. Caller
+// holds the lock.
+func (w *walLog) failedUnlocked() error {
+	if w.failed != nil {
+		return fmt.Errorf("velocity: WAL write failed: %w", w.failed)
+	}
+	return nil
+}
 
-		binary.LittleEndian.PutUint16(scratch, uint16(len(nonce)))
-		w.buffer.Write(scratch[:2])
-		w.buffer.Write(nonce)
+// failure returns the error that failed the log, if a write or sync of it did.
+func (w *WAL) failure() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.failedUnlocked()
+}
 
-		binary.LittleEndian.PutUint32(scratch, uint32(len(ciphertext)))
-		w.buffer.Write(scratch[:4])
-		w.buffer.Write(ciphertext)
+// writeBuffer appends buf to file, syncs it and recycles buf.
+func (w *walLog) writeBuffer(file *os.File, buf *bytes.Buffer) error {
+	defer walBufferPool.Put(buf)
+	if buf.Len() == 0 {
+		return nil
+	}
+	n, err := file.Write(buf.Bytes())
+	w.stats.bytes.Add(uint64(n))
+	if err != nil {
+		return err
+	}
+	w.stats.syncs.Add(1)
+	return file.Sync()
+}
 
-		binary.LittleEndian.PutUint64(scratch, entry.Timestamp)
-		w.buffer.Write(scratch[:8])
+// newWALBuffer returns an empty buffer from the pool.
+func newWALBuffer() *bytes.Buffer {
+	buf := walBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
 
-		binary.LittleEndian.PutUint64(scratch, entry.ExpiresAt)
-		w.buffer.Write(scratch[:8])
+// walCounters count the writes and syncs of a log.
+type walCounters struct {
+	syncs         atomic.Uint64
+	bytes         atomic.Uint64
+	groupCommits  atomic.Uint64
+	groupedWrites atomic.Uint64
+}
 
-		if entry.Deleted {
-			scratch[0] = 1
-		} else {
-			scratch[0] = 0
-		}
-		w.buffer.Write(scratch[:1])
+// WALStats describes the syncs of the write-ahead log.
+type WALStats struct {
+	Syncs        uint64 `json:"syncs"`         // fsyncs of the log file
+	BytesWritten uint64 `json:"bytes_written"` // bytes appended to the log file
+	// GroupCommits counts the syncs writers waited for, and GroupedWrites
+	// the writes they acknowledged; their ratio is the average group size.
+	GroupCommits  uint64 `json:"group_commits"`
+	GroupedWrites uint64 `json:"grouped_writes"`
+}
 
-		binary.LittleEndian.PutUint32(scratch, entry.checksum)
-		w.buffer.Write(scratch[:4])
+// Stats returns the sync counters of the log.
+func (w *WAL) Stats() WALStats {
+	return WALStats{
+		Syncs:         w.stats.syncs.Load(),
+		BytesWritten:  w.stats.bytes.Load(),
+		GroupCommits:  w.stats.groupCommits.Load(),
+		GroupedWrites: w.stats.groupedWrites.Load(),
 	}
+}
 
-	if w.syncOnWrite || w.buffer.Len() >= w.buffer.Cap() {
-		return w.syncUnsafe()
+// WALStats returns the sync counters of the write-ahead log; they are zero
+// without a WAL.
+func (db *DB) WALStats() WALStats {
+	if db.wal == nil {
+		return WALStats{}
 	}
-	return nil
+	return db.wal.Stats()
+}
+
+// walFamilyMarker occupies the key length slot of a record to tag it with a
+// column family: marker(u32) family(u32) precede the ordinary record.
+// Records of the default family carry no tag.
+const walFamilyMarker = 0xFFFFFFFE
+
+// walSequenceMarker occupies the key length slot of a record to number it:
+// marker(u32) seq(u64) precede the family tag, if any, and the record.
+// Records written by older versions carry no number.
+const walSequenceMarker = 0xFFFFFFFD
+
+// walSequenceFloor precedes the first record of a log that follows a
+// truncated or archived one: marker(u32) seq(u64) state that the records
+// before it were numbered up to seq.
+const walSequenceFloor = 0xFFFFFFFC
+
+// walSequenceSuffix names the file, next to the log, that keeps the last
+// sequence number while the log is empty.
+const walSequenceSuffix = ".seq"
+
+// encodeWALRecord appends one encrypted entry record, numbered seq, to buf.
+func encodeWALRecord(buf *bytes.Buffer, scratch []byte, seq uint64, family uint32, entry *Entry, nonce, ciphertext []byte) {
+	binary.LittleEndian.PutUint32(scratch, walSequenceMarker)
+	buf.Write(scratch[:4])
+	binary.LittleEndian.PutUint64(scratch, seq)
+	buf.Write(scratch[:8])
+	if family != 0 {
+		binary.LittleEndian.PutUint32(scratch, walFamilyMarker)
+		buf.Write(scratch[:4])
+		binary.LittleEndian.PutUint32(scratch, family)
+		buf.Write(scratch[:4])
+	}
+
+	// keyLen (uint32)
+	binary.LittleEndian.PutUint32(scratch, uint32(len(entry.Key)))
+	buf.Write(scratch[:4])
+	buf.Write(entry.Key)
+
+	// nonceLen (uint16)
+	binary.LittleEndian.PutUint16(scratch, uint16(len(nonce)))
+	buf.Write(scratch[:2])
+	buf.Write(nonce)
+
+	// valueLen (uint32)
+	binary.LittleEndian.PutUint32(scratch, uint32(len(ciphertext)))
+	buf.Write(scratch[:4])
+	buf.Write(ciphertext)
+
+	// timestamp (uint64)
+	binary.LittleEndian.PutUint64(scratch, entry.Timestamp)
+	buf.Write(scratch[:8])
+
+	// expiresAt (uint64)
+	binary.LittleEndian.PutUint64(scratch, entry.ExpiresAt)
+	buf.Write(scratch[:8])
+
+	// flag (uint8): value, tombstone or range tombstone
+	scratch[0] = recordFlag(entry)
+	buf.Write(scratch[:1])
+
+	// checksum (uint32)
+	binary.LittleEndian.PutUint32(scratch, entry.checksum)
+	buf.Write(scratch[:4])
 }
 
 func (w *WAL) syncLoop() {
@@ -308,22 +677,29 @@ func (w *WAL) writeBufferToFile(b *bytes.Buffer) error {
 }
 
 // syncUnsafe writes the current buffer to disk while holding caller lock.
+// It waits for a group commit in flight first, and completes the pending
+// one, whose records the buffer holds.
 func (w *WAL) syncUnsafe() error {
-	if w.buffer.Len() == 0 {
-		return nil
+	for w.syncing {
+		w.synced.Wait()
 	}
-	// Take buffer contents by swapping to a fresh buffer to minimize time holding the lock
-	old := w.buffer
-	w.buffer = bytes.NewBuffer(make([]byte, 0, WALBufferSize))
-	// Write old buffer directly (caller holds lock)
-	if _, err := w.file.Write(old.Bytes()); err != nil {
-		return err
+	if w.failed != nil {
+		w.buffer.Reset()
+		g := w.pending
+		w.pending = nil
+		w.finishUnlocked(g, w.failed)
+		return w.failedUnlocked()
 	}
-	if err := w.file.Sync(); err != nil {
-		return err
+	if w.buffer.Len() == 0 {
+		return nil
 	}
-	old.Reset()
-	return nil
+	// Take buffer contents by swapping to a fresh buffer
+	old, g := w.buffer, w.pending
+	w.buffer = newWALBuffer()
+	w.pending = nil
+	err := w.writeBuffer(w.file, old)
+	w.finishUnlocked(g, err)
+	return err
 }
 
 func (w *WAL) Close() error {
@@ -350,15 +726,11 @@ func (w *WAL) Close() error {
 		}
 	}()
 
-	// Swap and flush any pending buffer synchronously to ensure durability
+	// Flush any pending buffer synchronously to ensure durability
 	w.mutex.Lock()
-	old := w.buffer
-	w.buffer = bytes.NewBuffer(make([]byte, 0, WALBufferSize))
+	_ = w.syncUnsafe()
 	w.mutex.Unlock()
 
-	// write remaining buffer before closing
-	_ = w.writeBufferToFile(old)
-
 	// Close flush channel and wait for background flusher to finish
 	if w.flushChan != nil {
 		close(w.flushChan)
@@ -405,14 +777,21 @@ func (w *WAL) SetSyncOnWrite(enabled bool) {
 	w.syncOnWrite = enabled
 }
 
-// Truncate truncates the WAL file to zero length after ensuring data has been flushed.
+// Truncate truncates the WAL file to zero length after ensuring data has been
+// flushed. A WAL that retains its history is archived instead.
 func (w *WAL) Truncate() error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
+	if w.retain {
+		return w.rotateUnlocked()
+	}
 	if err := w.syncUnsafe(); err != nil {
 		return err
 	}
+	if err := w.saveSequenceUnlocked(); err != nil {
+		return err
+	}
 
 	// Truncate file
 	if err := w.file.Truncate(0); err != nil {
@@ -426,6 +805,67 @@ func (w *WAL) Truncate() error {
 	return nil
 }
 
+// saveSequenceUnlocked records the sequence number reached so far before
+// the log is emptied, so numbering carries on after a restart. Caller holds
+// the lock.
+func (w *WAL) saveSequenceUnlocked() error {
+	w.floorPending = true
+	if w.seq == 0 {
+		return nil
+	}
+	path := w.file.Name() + walSequenceSuffix
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, binary.LittleEndian.AppendUint64(nil, w.seq), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeFloorUnlocked starts an emptied log with the sequence number reached
+// so far. Caller holds the lock.
+func (w *WAL) writeFloorUnlocked(scratch []byte) {
+	if !w.floorPending {
+		return
+	}
+	w.floorPending = false
+	binary.LittleEndian.PutUint32(scratch, walSequenceFloor)
+	w.buffer.Write(scratch[:4])
+	binary.LittleEndian.PutUint64(scratch, w.seq)
+	w.buffer.Write(scratch[:8])
+}
+
+// copyTo syncs the WAL and copies the file to path, returning the number of
+// bytes copied and the sequence number of the last record. Writes wait
+// until the copy completes.
+func (w *WAL) copyTo(path string) (int64, uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.syncUnsafe(); err != nil {
+		return 0, 0, err
+	}
+	in, err := os.Open(w.file.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, w.seq, err
+}
+
 // RotateNow performs an immediate rotation of the WAL into the archive dir and
 // applies retention (maxBackups / maxAgeDays). The WAL file will be moved and a
 // new WAL file opened at the same path.
@@ -454,6 +894,10 @@ func (w *WAL) rotateUnlocked() error {
 		return err
 	}
 
+	if err := w.saveSequenceUnlocked(); err != nil {
+		return err
+	}
+
 	orig := w.file.Name()
 	// Determine archive dir
 	archive := w.archiveDir
@@ -601,85 +1045,227 @@ func (w *WAL) Replay() ([]*Entry, error) {
 	}
 	defer f.Close()
 
+	if data, err := os.ReadFile(w.file.Name() + walSequenceSuffix); err == nil && len(data) == 8 {
+		w.seq = max(w.seq, binary.LittleEndian.Uint64(data))
+	}
 	var entries []*Entry
+	r := walReader{crypto: w.crypto, families: w.families}
+	floor, err := r.readSegment(f, func(seq uint64, entry *Entry) error {
+		w.seq = max(w.seq, seq)
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.seq = max(w.seq, floor)
+	return entries, nil
+}
+
+// walReader decodes log segments with the keys of the default family and
+// of the column families in families.
+type walReader struct {
+	crypto   *CryptoProvider
+	families map[uint32]*CryptoProvider
+}
+
+// readSegment calls fn with every entry of one log segment and its
+// sequence number, in order, until fn returns an error. Entries of column
+// families that no longer exist are passed as nil. It returns the sequence
+// number the segment follows, if it records one.
+func (r walReader) readSegment(f io.Reader, fn func(seq uint64, entry *Entry) error) (uint64, error) {
+	br := bufio.NewReader(f)
+	var floor uint64
 	for {
 		var keyLen uint32
-		if err := binary.Read(f, binary.LittleEndian, &keyLen); err != nil {
+		if err := binary.Read(br, binary.LittleEndian, &keyLen); err != nil {
 			if err == io.EOF {
-				break
+				return floor, nil
 			}
-			return nil, err
+			return floor, err
 		}
 
-		key := make([]byte, keyLen)
-		if _, err := io.ReadFull(f, key); err != nil {
-			return nil, err
+		switch keyLen {
+		case walSequenceFloor:
+			if err := binary.Read(br, binary.LittleEndian, &floor); err != nil {
+				return floor, err
+			}
+			continue
+		case walBatchMarker:
+			complete, err := r.readWALBatch(br, fn)
+			if err != nil {
+				return floor, err
+			}
+			if !complete {
+				// A crash tore the final batch; none of it was acknowledged.
+				log.Printf("velocity: WAL replay: discarding incomplete batch at end of log")
+				return floor, nil
+			}
+			continue
 		}
 
-		var nonceLen uint16
-		if err := binary.Read(f, binary.LittleEndian, &nonceLen); err != nil {
-			return nil, err
+		entry, seq, err := r.readWALRecord(br, keyLen)
+		if err != nil {
+			return floor, err
 		}
-		nonce := make([]byte, nonceLen)
-		if _, err := io.ReadFull(f, nonce); err != nil {
-			return nil, err
+		if err := fn(seq, entry); err != nil {
+			return floor, err
 		}
+	}
+}
 
-		var valueLen uint32
-		if err := binary.Read(f, binary.LittleEndian, &valueLen); err != nil {
-			return nil, err
+// readWALBatch reads the body of an atomic batch whose marker has already
+// been consumed and passes its entries to fn once the whole batch is read.
+// complete is false when the log ends before the batch does.
+func (r walReader) readWALBatch(f io.Reader, fn func(seq uint64, entry *Entry) error) (bool, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
 		}
-		ciphertext := make([]byte, valueLen)
-		if _, err := io.ReadFull(f, ciphertext); err != nil {
-			return nil, err
+		return false, err
+	}
+	count := binary.LittleEndian.Uint32(hdr[0:4])
+	payloadLen := binary.LittleEndian.Uint32(hdr[4:8])
+	sum := binary.LittleEndian.Uint32(hdr[8:12])
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(f, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
 		}
+		return false, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return false, fmt.Errorf("WAL replay: batch checksum mismatch")
+	}
 
-		var timestamp uint64
-		if err := binary.Read(f, binary.LittleEndian, &timestamp); err != nil {
-			return nil, err
+	reader := bytes.NewReader(payload)
+	seqs := make([]uint64, 0, count)
+	entries := make([]*Entry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var keyLen uint32
+		if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
+			return false, fmt.Errorf("WAL replay: short batch: %w", err)
+		}
+		entry, seq, err := r.readWALRecord(reader, keyLen)
+		if err != nil {
+			return false, err
 		}
+		seqs = append(seqs, seq)
+		entries = append(entries, entry)
+	}
+	for i, entry := range entries {
+		if err := fn(seqs[i], entry); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
 
-		var expiresAt uint64
-		if err := binary.Read(f, binary.LittleEndian, &expiresAt); err != nil {
-			return nil, err
+// readWALRecord decodes, decrypts and verifies one entry record whose key
+// length, or sequence or family tag, has already been read. It returns a
+// nil entry for records of column families that no longer exist, and 0 for
+// the sequence number of records written by older versions.
+func (r walReader) readWALRecord(f io.Reader, keyLen uint32) (*Entry, uint64, error) {
+	var seq uint64
+	if keyLen == walSequenceMarker {
+		if err := binary.Read(f, binary.LittleEndian, &seq); err != nil {
+			return nil, 0, err
 		}
+		if err := binary.Read(f, binary.LittleEndian, &keyLen); err != nil {
+			return nil, 0, err
+		}
+	}
+	entry, err := r.readEntry(f, keyLen)
+	return entry, seq, err
+}
 
-		var deleted uint8
-		if err := binary.Read(f, binary.LittleEndian, &deleted); err != nil {
+func (r walReader) readEntry(f io.Reader, keyLen uint32) (*Entry, error) {
+	var family uint32
+	crypto := r.crypto
+	if keyLen == walFamilyMarker {
+		if err := binary.Read(f, binary.LittleEndian, &family); err != nil {
 			return nil, err
 		}
-
-		var checksum uint32
-		if err := binary.Read(f, binary.LittleEndian, &checksum); err != nil {
+		if err := binary.Read(f, binary.LittleEndian, &keyLen); err != nil {
 			return nil, err
 		}
+		crypto = r.families[family]
+	}
 
-		// Decrypt
-		plaintext, err := w.crypto.Decrypt(nonce, ciphertext, buildEntryAAD(key, timestamp, expiresAt, deleted == 1))
-		if err != nil {
-			// Decryption error likely means corruption; stop and return what we have
-			return nil, fmt.Errorf("WAL replay: decrypt failed for key %x: %w", key, err)
-		}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(f, key); err != nil {
+		return nil, err
+	}
 
-		entry := &Entry{
-			Key:       append([]byte{}, key...),
-			Value:     append([]byte{}, plaintext...),
-			Timestamp: timestamp,
-			ExpiresAt: expiresAt,
-			Deleted:   deleted == 1,
-			checksum:  checksum,
-		}
-		// basic checksum verification
-		calc := crc32.ChecksumIEEE(append(entry.Key, entry.Value...))
-		if entry.Deleted {
-			calc = crc32.ChecksumIEEE(entry.Key)
-		}
-		if calc != entry.checksum {
-			return nil, fmt.Errorf("WAL replay: checksum mismatch for key %x: expected %08x got %08x", key, entry.checksum, calc)
-		}
+	var nonceLen uint16
+	if err := binary.Read(f, binary.LittleEndian, &nonceLen); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceLen)
+	if _, err := io.ReadFull(f, nonce); err != nil {
+		return nil, err
+	}
 
-		entries = append(entries, entry)
+	var valueLen uint32
+	if err := binary.Read(f, binary.LittleEndian, &valueLen); err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, valueLen)
+	if _, err := io.ReadFull(f, ciphertext); err != nil {
+		return nil, err
 	}
 
-	return entries, nil
+	var timestamp uint64
+	if err := binary.Read(f, binary.LittleEndian, &timestamp); err != nil {
+		return nil, err
+	}
+
+	var expiresAt uint64
+	if err := binary.Read(f, binary.LittleEndian, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	var deleted uint8
+	if err := binary.Read(f, binary.LittleEndian, &deleted); err != nil {
+		return nil, err
+	}
+
+	var checksum uint32
+	if err := binary.Read(f, binary.LittleEndian, &checksum); err != nil {
+		return nil, err
+	}
+
+	if crypto == nil {
+		return nil, nil
+	}
+
+	// Decrypt
+	plaintext, err := crypto.Decrypt(nonce, ciphertext, buildEntryAAD(key, timestamp, expiresAt, deleted))
+	if err != nil {
+		// Decryption error likely means corruption; stop and return what we have
+		return nil, fmt.Errorf("WAL replay: decrypt failed for key %x: %w", key, err)
+	}
+
+	entry := &Entry{
+		Key:       append([]byte{}, key...),
+		Value:     append([]byte{}, plaintext...),
+		Timestamp: timestamp,
+		ExpiresAt: expiresAt,
+		checksum:  checksum,
+		family:    family,
+	}
+	applyRecordFlag(entry, deleted)
+	// basic checksum verification
+	calc := crc32.ChecksumIEEE(append(entry.Key, entry.Value...))
+	if entry.Deleted {
+		calc = crc32.ChecksumIEEE(entry.Key)
+	}
+	if calc != entry.checksum {
+		return nil, fmt.Errorf("WAL replay: checksum mismatch for key %x: expected %08x got %08x", key, entry.checksum, calc)
+	}
+	return entry, nil
 }
@@ -0,0 +1,211 @@
+package velocity
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWALGroupCommitSyncsWaitingWritesOnce(t *testing.T) {
+	crypto, _ := newCryptoProvider(make([]byte, 32))
+	w, err := NewWAL(filepath.Join(t.TempDir(), "wal.log"), crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Records appended before anyone waits end up in one group, which the
+	// first waiter syncs for all of them.
+	var groups []*walGroup
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("k%d", i)
+		g, err := w.append(&Entry{Key: []byte(key), Value: []byte("v"), Timestamp: uint64(i + 1), checksum: crc32Of(key, "v")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups = append(groups, g)
+	}
+	for _, g := range groups {
+		if g != groups[0] {
+			t.Fatal("expected the writes to share a group commit")
+		}
+		if err := g.wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := w.Stats(); stats.Syncs != 1 || stats.GroupCommits != 1 || stats.GroupedWrites != 8 {
+		t.Fatalf("expected one sync for 8 writes, got %+v", stats)
+	}
+
+	entries, err := w.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 8 {
+		t.Fatalf("expected 8 records in the log, got %d", len(entries))
+	}
+}
+
+func TestConcurrentDurablePutsShareSyncs(t *testing.T) {
+	path := t.TempDir()
+	db, err := NewWithConfig(Config{Path: path, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err := db.ChangesSince(context.Background(), db.LastSequence(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := db.WALStats()
+
+	const writers, perWriter = 16, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				if err := db.Put([]byte(fmt.Sprintf("cdc:%02d:%03d", i, j)), []byte("v")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	stats := db.WALStats()
+	writes := stats.GroupedWrites - before.GroupedWrites
+	if writes != writers*perWriter {
+		t.Fatalf("expected %d acknowledged writes, got %d", writers*perWriter, writes)
+	}
+	if commits := stats.GroupCommits - before.GroupCommits; commits == 0 || commits > writes {
+		t.Fatalf("expected at most one group commit per write, got %d for %d", commits, writes)
+	}
+
+	// The change feed sees every write once, in sequence order.
+	changes := receiveChanges(t, feed, writers*perWriter)
+	for i := 1; i < len(changes); i++ {
+		if changes[i].Sequence <= changes[i-1].Sequence {
+			t.Fatalf("change %d has sequence %d after %d", i, changes[i].Sequence, changes[i-1].Sequence)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing was flushed, so the writes come back from the log.
+	db, err = NewWithConfig(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < writers; i++ {
+		for j := 0; j < perWriter; j++ {
+			key := fmt.Sprintf("cdc:%02d:%03d", i, j)
+			if _, err := db.Get([]byte(key)); err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+		}
+	}
+}
+
+func TestFailedWALSyncKeepsWritesOutOfTables(t *testing.T) {
+	path := t.TempDir()
+	db, err := NewWithConfig(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("wal:a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap in a read-only handle, so the next group commit fails to write.
+	db.wal.mutex.Lock()
+	file := db.wal.file
+	ro, err := os.Open(file.Name())
+	if err != nil {
+		db.wal.mutex.Unlock()
+		t.Fatal(err)
+	}
+	db.wal.file = ro
+	db.wal.mutex.Unlock()
+	file.Close()
+
+	if err := db.Put([]byte("wal:b"), []byte("2")); err == nil {
+		t.Fatal("expected the put to fail with its sync")
+	}
+	if _, err := db.Get([]byte("wal:b")); err == nil {
+		t.Fatal("expected the write whose sync failed to stay unreadable")
+	}
+	if err := db.Put([]byte("wal:c"), []byte("3")); err == nil {
+		t.Fatal("expected puts after a failed sync to fail")
+	}
+	if err := db.Delete([]byte("wal:a")); err == nil {
+		t.Fatal("expected deletes after a failed sync to fail")
+	}
+	if err := db.flushMemTable(); err == nil {
+		t.Fatal("expected the flush of unlogged entries to fail")
+	}
+	db.Close()
+
+	db, err = NewWithConfig(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get([]byte("wal:a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected the synced write to survive, got %q (%v)", v, err)
+	}
+	if _, err := db.Get([]byte("wal:b")); err == nil {
+		t.Fatal("expected the write whose sync failed to be gone")
+	}
+}
+
+func TestWritesWaitingForSyncAreNotReadable(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewWithConfig failed: %v", err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("sync:k"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Log a write without waiting for its group commit.
+	db.mutex.Lock()
+	write, err := db.putBuffered([]byte("sync:k"), []byte("new"))
+	db.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get([]byte("sync:k")); err != nil || string(v) != "old" {
+		t.Fatalf("expected the unsynced write to be unreadable, got %q (%v)", v, err)
+	}
+	txn := db.Begin()
+	defer txn.Rollback()
+	if v, err := txn.Get([]byte("sync:k")); err != nil || string(v) != "old" {
+		t.Fatalf("expected the transaction to read the synced value, got %q (%v)", v, err)
+	}
+	if err := txn.Put([]byte("sync:k"), []byte("txn")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.awaitWrite(write); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get([]byte("sync:k")); err != nil || string(v) != "new" {
+		t.Fatalf("expected the synced write to be readable, got %q (%v)", v, err)
+	}
+	if err := txn.Commit(); err != ErrTxnConflict {
+		t.Fatalf("expected the transaction to conflict with the synced write, got %v", err)
+	}
+}
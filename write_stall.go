@@ -0,0 +1,240 @@
+package velocity
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultL0SlowdownWritesTrigger is the number of level 0 tables at which
+	// every write is delayed, giving compaction time to catch up.
+	DefaultL0SlowdownWritesTrigger = 20
+
+	// DefaultL0StopWritesTrigger is the number of level 0 tables at which
+	// writes block until compaction brings the count back down.
+	DefaultL0StopWritesTrigger = 36
+
+	// DefaultMaxImmutableMemTables is how many full memtables may wait for
+	// their flush before writes block.
+	DefaultMaxImmutableMemTables = 2
+
+	// writeSlowdownDelay is how long a write is delayed once level 0 reaches
+	// the slowdown trigger.
+	writeSlowdownDelay = time.Millisecond
+)
+
+// WriteStallStats counts the writes that were delayed or blocked to let
+// flushes and compaction catch up.
+type WriteStallStats struct {
+	Delayed   uint64        `json:"delayed"`    // writes slowed down by the level 0 slowdown trigger
+	Stopped   uint64        `json:"stopped"`    // writes blocked by the stop trigger or a full flush queue
+	StallTime time.Duration `json:"stall_time"` // total time writes spent delayed or blocked
+
+	L0Tables           int `json:"l0_tables"`
+	ImmutableMemTables int `json:"immutable_memtables"`
+}
+
+// WriteStallStats returns the write stall counters, and the level 0 and
+// flush queue lengths they depend on.
+func (db *DB) WriteStallStats() WriteStallStats {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	stats := WriteStallStats{
+		Delayed:            db.stallDelayed.Load(),
+		Stopped:            db.stallStopped.Load(),
+		StallTime:          time.Duration(db.stallNanos.Load()),
+		ImmutableMemTables: len(db.flushingMemTables),
+	}
+	if len(db.levels) > 0 {
+		stats.L0Tables = len(db.levels[0])
+	}
+	return stats
+}
+
+// initWriteStalls sets up write stalls with the triggers of Config, applying
+// defaults; negative values disable a trigger.
+func (db *DB) initWriteStalls(slowdown, stop, maxImmutable int) {
+	if slowdown == 0 {
+		slowdown = DefaultL0SlowdownWritesTrigger
+	}
+	if stop == 0 {
+		stop = DefaultL0StopWritesTrigger
+	}
+	if maxImmutable == 0 {
+		maxImmutable = DefaultMaxImmutableMemTables
+	}
+	db.l0SlowdownTrigger, db.l0StopTrigger, db.maxImmutableMemTables = slowdown, stop, maxImmutable
+	db.stallCond = sync.NewCond(&db.mutex)
+	db.flushCh = make(chan struct{}, 1)
+	db.compactCh = make(chan struct{}, 1)
+}
+
+// startBackgroundLoops starts the flush and compaction loops, which run
+// until the DB closes.
+func (db *DB) startBackgroundLoops() {
+	db.compactionWG.Add(2)
+	go func() {
+		defer db.compactionWG.Done()
+		db.flushLoop()
+	}()
+	go func() {
+		defer db.compactionWG.Done()
+		db.compactionLoop()
+	}()
+}
+
+// l0CompactionTrigger returns the level 0 table count that makes level 0 due
+// for compaction: L0CompactionTrigger, or a lower stall trigger, since
+// stalled writers wait for compaction to bring the count down.
+func (db *DB) l0CompactionTrigger() int {
+	trigger := L0CompactionTrigger
+	for _, t := range []int{db.l0SlowdownTrigger, db.l0StopTrigger} {
+		if t > 0 && t < trigger {
+			trigger = t
+		}
+	}
+	return trigger
+}
+
+// makeRoomForWriteLocked is called by writers holding db.mutex before they
+// write. It queues a full memtable for flushing, and delays or blocks the
+// writer while level 0 or the flush queue are over their limits. Waiting
+// releases db.mutex, so callers must not have read any state yet. Once the
+// WAL has failed no flush can make room, so it returns the failure instead.
+func (db *DB) makeRoomForWriteLocked() error {
+	if db.stallCond == nil {
+		return nil
+	}
+	var start time.Time
+	delayed, stopped := false, false
+	defer func() {
+		if !start.IsZero() {
+			db.stallNanos.Add(int64(time.Since(start)))
+		}
+	}()
+	for !db.closed.Load() {
+		if db.wal != nil {
+			if err := db.wal.failure(); err != nil {
+				return err
+			}
+		}
+		l0 := len(db.levels[0])
+		full := db.memTable.Size() > db.memTableSize
+		switch {
+		case db.l0StopTrigger > 0 && l0 >= db.l0StopTrigger,
+			full && db.maxImmutableMemTables > 0 && len(db.flushingMemTables) >= db.maxImmutableMemTables:
+			if !stopped {
+				stopped = true
+				db.stallStopped.Add(1)
+				if start.IsZero() {
+					start = time.Now()
+				}
+			}
+			db.scheduleFlush()
+			db.scheduleCompaction()
+			db.stallCond.Wait()
+		case full:
+			db.rotateMemTableLocked()
+			db.scheduleFlush()
+		case !delayed && db.l0SlowdownTrigger > 0 && l0 >= db.l0SlowdownTrigger:
+			delayed = true
+			db.stallDelayed.Add(1)
+			if start.IsZero() {
+				start = time.Now()
+			}
+			db.scheduleCompaction()
+			db.mutex.Unlock()
+			time.Sleep(writeSlowdownDelay)
+			db.mutex.Lock()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// makeRoomForWrite is makeRoomForWriteLocked for writers that do not hold
+// db.mutex.
+func (db *DB) makeRoomForWrite() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.makeRoomForWriteLocked()
+}
+
+// wakeWritersLocked wakes the writers blocked in makeRoomForWriteLocked
+// after level 0 or the flush queue shrank. Callers hold db.mutex.
+func (db *DB) wakeWritersLocked() {
+	if db.stallCond != nil {
+		db.stallCond.Broadcast()
+	}
+}
+
+// scheduleFlush asks the flush loop to write the queued memtables, and the
+// active one if it is full.
+func (db *DB) scheduleFlush() {
+	if db.flushCh == nil {
+		if !db.flushing.Load() {
+			go db.flushMemTable()
+		}
+		return
+	}
+	select {
+	case db.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleCompaction asks the compaction loop to check the levels now rather
+// than at its next tick.
+func (db *DB) scheduleCompaction() {
+	select {
+	case db.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop writes queued memtables in the background as writers fill them.
+func (db *DB) flushLoop() {
+	for {
+		select {
+		case <-db.flushCh:
+			if err := db.flushImmutableMemTables(); err != nil {
+				log.Printf("velocity: background flush failed: %v", err)
+			}
+		case <-db.shutdownCh:
+			return
+		}
+	}
+}
+
+// flushImmutableMemTables queues the active memtable if it is full and
+// writes the queued memtables to level 0. Unlike flushMemTable it leaves a
+// memtable that still has room alone.
+func (db *DB) flushImmutableMemTables() error {
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	if !db.flushing.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer db.flushing.Store(false)
+
+	db.mutex.Lock()
+	if db.memTable.Size() > db.memTableSize {
+		db.rotateMemTableLocked()
+	}
+	db.mutex.Unlock()
+
+	flushed, err := db.writeImmutableMemTables()
+	if err == nil && flushed {
+		err = db.releaseWAL()
+	}
+	if err != nil {
+		// Let blocked writers retry the flush rather than wait for good.
+		db.mutex.Lock()
+		db.wakeWritersLocked()
+		db.mutex.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package velocity
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// putAsync runs db.Put in the background and reports its result.
+func putAsync(db *DB, key string) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- db.Put([]byte(key), []byte("v")) }()
+	return done
+}
+
+func expectBlocked(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the write to block, it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func expectDone(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write still blocked")
+	}
+}
+
+func TestWritesStopUntilCompactionDrainsL0(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir(), L0SlowdownWritesTrigger: 2, L0StopWritesTrigger: 3, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Hold off compaction while level 0 fills up.
+	db.compactMu.Lock()
+	for i := 0; i < 3; i++ {
+		db.Put([]byte(fmt.Sprintf("stall:%d", i)), []byte("v"))
+		if err := db.flushMemTable(); err != nil {
+			db.compactMu.Unlock()
+			t.Fatal(err)
+		}
+	}
+	done := putAsync(db, "stall:blocked")
+	expectBlocked(t, done)
+	if stats := db.WriteStallStats(); stats.Stopped != 1 || stats.L0Tables != 3 {
+		db.compactMu.Unlock()
+		t.Fatalf("expected one stopped write with 3 level 0 tables, got %+v", stats)
+	}
+	db.compactMu.Unlock()
+
+	expectDone(t, done)
+	stats := db.WriteStallStats()
+	if stats.L0Tables >= 2 || stats.StallTime <= 0 {
+		t.Fatalf("expected compaction to drain level 0, got %+v", stats)
+	}
+	if got, err := db.Get([]byte("stall:blocked")); err != nil || string(got) != "v" {
+		t.Fatalf("blocked write was lost: %q (%v)", got, err)
+	}
+}
+
+func TestFullImmutableMemTableQueueBlocksWrites(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir(), MaxImmutableMemTables: 1, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.mutex.Lock()
+	db.memTableSize = 4 * 1024
+	db.mutex.Unlock()
+
+	// With flushes held off, the first full memtable is queued and the
+	// second one has nowhere to go.
+	db.flushMu.Lock()
+	value := make([]byte, 1024)
+	for i := 0; db.WriteStallStats().ImmutableMemTables == 0; i++ {
+		db.Put([]byte(fmt.Sprintf("queue:a%d", i)), value)
+	}
+	full := func() bool {
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+		return db.memTable.Size() > db.memTableSize
+	}
+	for i := 0; !full(); i++ {
+		db.Put([]byte(fmt.Sprintf("queue:b%d", i)), value)
+	}
+	done := putAsync(db, "queue:blocked")
+	expectBlocked(t, done)
+	if got, err := db.Get([]byte("queue:a0")); err != nil || len(got) != len(value) {
+		db.flushMu.Unlock()
+		t.Fatalf("queued memtable is not readable: %d bytes (%v)", len(got), err)
+	}
+	db.flushMu.Unlock()
+
+	expectDone(t, done)
+	if stats := db.WriteStallStats(); stats.Stopped == 0 {
+		t.Fatalf("expected a stopped write, got %+v", stats)
+	}
+	for _, key := range []string{"queue:a1", "queue:b1", "queue:blocked"} {
+		if _, err := db.Get([]byte(key)); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+}
+
+func TestStoppedWritesFailWithTheWAL(t *testing.T) {
+	db, err := NewWithConfig(Config{Path: t.TempDir(), MaxImmutableMemTables: 1, SkipCloseFlush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.mutex.Lock()
+	db.memTableSize = 4 * 1024
+	db.mutex.Unlock()
+
+	db.flushMu.Lock()
+	value := make([]byte, 1024)
+	for i := 0; db.WriteStallStats().ImmutableMemTables == 0; i++ {
+		db.Put([]byte(fmt.Sprintf("queue:a%d", i)), value)
+	}
+	full := func() bool {
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+		return db.memTable.Size() > db.memTableSize
+	}
+	for i := 0; !full(); i++ {
+		db.Put([]byte(fmt.Sprintf("queue:b%d", i)), value)
+	}
+	defer db.flushMu.Unlock()
+
+	// No flush can make room once the log has failed, so a write that
+	// would stop for one fails instead.
+	failure := errors.New("injected sync failure")
+	db.wal.mutex.Lock()
+	db.wal.failed = failure
+	db.wal.mutex.Unlock()
+	select {
+	case err := <-putAsync(db, "queue:blocked"):
+		if !errors.Is(err, failure) {
+			t.Fatalf("expected the write to fail with the WAL, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write still blocked")
+	}
+}
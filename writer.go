@@ -6,7 +6,6 @@ import (
 	"hash/crc32"
 	"sort"
 	"sync"
-	"time"
 )
 
 // BatchWriter for high-throughput writes with minimal memory allocation
@@ -148,7 +147,7 @@ func (bw *BatchWriter) putWithIndexFieldPairsUnsafe(key []byte, keyString string
 		Key:       keyCopy,
 		KeyString: keyString,
 		Value:     valueCopy,
-		Timestamp: uint64(time.Now().UnixNano()),
+		Timestamp: nextEntryTimestamp(),
 		Deleted:   false,
 	})
 	return bw.finishPutWithIndexFieldPairsUnsafe(fields, assumeNew)
@@ -159,7 +158,7 @@ func (bw *BatchWriter) putOwnedWithIndexFieldPairsUnsafe(key []byte, keyString s
 		Key:       key,
 		KeyString: keyString,
 		Value:     value,
-		Timestamp: uint64(time.Now().UnixNano()),
+		Timestamp: nextEntryTimestamp(),
 		Deleted:   false,
 	})
 	return bw.finishPutWithIndexFieldPairsUnsafe(fields, assumeNew)
@@ -254,7 +253,7 @@ func (bw *BatchWriter) deleteUnsafe(key []byte) error {
 	bw.entries = append(bw.entries, Entry{
 		Key:       append([]byte(nil), key...),
 		Value:     nil,
-		Timestamp: uint64(time.Now().UnixNano()),
+		Timestamp: nextEntryTimestamp(),
 		Deleted:   true,
 	})
 	bw.indexFieldSpans = append(bw.indexFieldSpans, indexFieldSpan{start: len(bw.indexFieldPairs), end: len(bw.indexFieldPairs)})
@@ -275,6 +274,17 @@ func (bw *BatchWriter) flushUnsafe() error {
 		return nil
 	}
 
+	// Stamp entries at flush time rather than queue time so the batch orders
+	// after any transaction that began while it was being assembled. commitMu
+	// keeps a snapshot from being pinned in the middle of the batch.
+	if err := bw.db.makeRoomForWrite(); err != nil {
+		return err
+	}
+	bw.db.commitMu.RLock()
+	for i := range bw.entries {
+		bw.entries[i].Timestamp = nextEntryTimestamp()
+	}
+
 	// Batch write to WAL with single sync (skip if WAL disabled)
 	if bw.db.wal != nil {
 		// Convert to pointer slice for WAL (required by interface)
@@ -283,12 +293,14 @@ func (bw *BatchWriter) flushUnsafe() error {
 			ptrs[i] = &bw.entries[i]
 		}
 		if err := bw.db.wal.WriteBatch(ptrs); err != nil {
+			bw.db.commitMu.RUnlock()
 			return err
 		}
 	}
 
 	// Batch write to memtable
 	bw.db.memTable.PutEntriesOwned(bw.entries)
+	bw.db.commitMu.RUnlock()
 
 	// Update search index if enabled
 	if bw.db.searchIndexEnabled && !bw.skipIndex {
@@ -359,17 +371,18 @@ func (bw *BatchWriter) flushUnsafe() error {
 			}
 			var terms []string
 			var hashes, values map[string]string
+			var lengths map[string]int
 			if i < len(bw.indexFieldSpans) {
 				span := bw.indexFieldSpans[i]
 				if span.end > span.start {
-					terms, hashes, values = buildIndexProjectionsFromFieldPairs(bw.indexFieldPairs[span.start:span.end], schema)
+					terms, hashes, values, lengths = buildIndexProjectionsFromFieldPairs(bw.indexFieldPairs[span.start:span.end], schema)
 				} else {
-					terms, hashes, values = buildIndexProjections(entry.Value, schema)
+					terms, hashes, values, lengths = buildIndexProjections(entry.Value, schema)
 				}
 			} else {
-				terms, hashes, values = buildIndexProjections(entry.Value, schema)
+				terms, hashes, values, lengths = buildIndexProjections(entry.Value, schema)
 			}
-			meta := indexMeta{Prefix: prefix, Terms: terms, Hashes: hashes, Values: values}
+			meta := indexMeta{Prefix: prefix, Terms: terms, Hashes: hashes, Values: values, Lengths: lengths}
 			var metaBytes []byte
 			if !bw.db.disableIndexPersistence {
 				var err error
@@ -411,6 +424,10 @@ func (bw *BatchWriter) flushUnsafe() error {
 				return err
 			}
 		}
+		if err := bw.db.storeFieldNormsLocked(); err != nil {
+			bw.db.mutex.Unlock()
+			return err
+		}
 
 		for k, ids := range additions {
 			if len(ids) == 0 {
@@ -430,9 +447,7 @@ func (bw *BatchWriter) flushUnsafe() error {
 	}
 
 	if !bw.db.skipCloseFlush && bw.db.memTable.Size() > bw.db.memTableSize {
-		if !bw.db.flushing.Load() {
-			go bw.db.flushMemTable()
-		}
+		bw.db.scheduleFlush()
 	}
 
 	bw.db.publishEntries(bw.entries)